@@ -0,0 +1,213 @@
+// Command replay plays back an MQTT recording made with MQTT_RECORD_FILE. It either publishes
+// the messages to a broker, so a regular server picks them up, or feeds them straight into a
+// development server (no Cloudflare Access) serving the usual public and admin endpoints. Its
+// shares and privacy zones live in memory unless -shares and -zones name files, its history
+// unless -history names a database; it has no ingest endpoint, metrics or keyring, so share
+// tokens don't survive a restart.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/go-chi/chi/v5"
+	httpx "github.com/mcuelenaere/where-is-maurus/backend/internal/http"
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/ingest"
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/keys"
+	mqttc "github.com/mcuelenaere/where-is-maurus/backend/internal/mqtt"
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/privacy"
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/recording"
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/shares"
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/state"
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/storage"
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/stream"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+func main() {
+	zerolog.TimeFieldFormat = time.RFC3339Nano
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stdout})
+
+	file := flag.String("file", "", "recording to play (required)")
+	speed := flag.Float64("speed", 1, "playback speed, 0 for as fast as possible")
+	loop := flag.Bool("loop", false, "start over at the end of the recording")
+	broker := flag.String("broker", "", "publish to this MQTT broker instead of serving the stream")
+	username := flag.String("username", "", "MQTT username")
+	password := flag.String("password", "", "MQTT password")
+	prefix := flag.String("prefix", mqttc.DefaultTopicPrefix, "topic prefix the recording was made with")
+	addr := flag.String("http", "127.0.0.1:8080", "listen address of the development server")
+	insecureAdmin := flag.Bool("insecure-admin", false, "allow the development server, admin endpoints without authentication included, to listen beyond loopback")
+	origins := flag.String("cors", "http://localhost:5173", "comma separated CORS allowed origins of the development server")
+	sharesFile := flag.String("shares", "", "issued shares file of the development server, in memory if empty")
+	zonesFile := flag.String("zones", "", "privacy zones file of the development server, in memory if empty")
+	historyDB := flag.String("history", "", "history database of the development server, not persisted if empty")
+	flag.Parse()
+	if *file == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *broker == "" && !*insecureAdmin && !loopback(*addr) {
+		log.Fatal().Str("addr", *addr).Msg("the development server serves the admin endpoints without authentication, listen on loopback or pass -insecure-admin")
+	}
+
+	msgs, err := recording.ReadFile(*file)
+	if err != nil {
+		log.Fatal().Err(err).Msg("read recording")
+	}
+	if len(msgs) == 0 {
+		log.Fatal().Str("file", *file).Msg("recording is empty")
+	}
+	log.Info().Int("messages", len(msgs)).Dur("duration", time.Duration(msgs[len(msgs)-1].TS-msgs[0].TS)*time.Millisecond).Msg("recording loaded")
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	var deliver func(recording.Message)
+	if *broker != "" {
+		deliver = publisher(*broker, *username, *password)
+	} else {
+		var closeDev func()
+		deliver, closeDev = devServer(ctx, devOptions{
+			Addr:       *addr,
+			Origins:    strings.Split(*origins, ","),
+			Topics:     mqttc.Topics{Prefix: *prefix},
+			SharesFile: *sharesFile,
+			ZonesFile:  *zonesFile,
+			HistoryDB:  *historyDB,
+		})
+		defer closeDev()
+	}
+
+	for {
+		if err := recording.Play(ctx, msgs, *speed, deliver); err != nil {
+			if !errors.Is(err, context.Canceled) {
+				log.Error().Err(err).Msg("replay")
+			}
+			return
+		}
+		log.Info().Msg("end of recording")
+		if !*loop {
+			break
+		}
+	}
+	if *broker == "" {
+		// keep serving the final state until interrupted
+		<-ctx.Done()
+	}
+}
+
+// loopback reports whether the listen address only accepts local connections.
+func loopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// publisher connects to the broker and returns a func publishing messages to it.
+func publisher(brokerURL, username, password string) func(recording.Message) {
+	hostname, _ := os.Hostname()
+	opts := mqtt.NewClientOptions().AddBroker(brokerURL).SetClientID(fmt.Sprintf("where-is-maurus-replay-%s-%d", hostname, os.Getpid()))
+	if username != "" {
+		opts.SetUsername(username)
+		opts.SetPassword(password)
+	}
+	cli := mqtt.NewClient(opts)
+	if token := cli.Connect(); !token.WaitTimeout(10*time.Second) || token.Error() != nil {
+		log.Fatal().Err(token.Error()).Str("broker", brokerURL).Msg("mqtt connect")
+	}
+	log.Info().Str("broker", brokerURL).Msg("publishing recording")
+	return func(m recording.Message) {
+		if token := cli.Publish(m.Topic, 0, false, m.Payload); token.Wait() && token.Error() != nil {
+			log.Warn().Err(token.Error()).Str("topic", m.Topic).Msg("mqtt publish")
+		}
+	}
+}
+
+// devOptions configures the development server.
+type devOptions struct {
+	Addr       string
+	Origins    []string
+	Topics     mqttc.Topics
+	SharesFile string
+	ZonesFile  string
+	HistoryDB  string
+}
+
+// devServer starts a server without Cloudflare Access and returns a func feeding messages into
+// its store, stamped with the current time as if they had just been received, and a func
+// closing its history database.
+func devServer(ctx context.Context, opts devOptions) (func(recording.Message), func()) {
+	st := state.NewStore()
+	hub := stream.NewHub()
+	st.SetNotifier(hub.Broadcast)
+	keyMgr, err := keys.NewManager(ctx, 0)
+	if err != nil {
+		log.Fatal().Err(err).Msg("keys")
+	}
+	shareReg, err := shares.NewRegistry(opts.SharesFile)
+	if err != nil {
+		log.Fatal().Err(err).Msg("shares")
+	}
+	go shareReg.Watch(ctx, 5*time.Second)
+	zones, err := privacy.NewZones(opts.ZonesFile)
+	if err != nil {
+		log.Fatal().Err(err).Msg("privacy zones")
+	}
+	closeDB := func() {}
+	if opts.HistoryDB != "" {
+		db, err := storage.OpenBolt(opts.HistoryDB, st.Window())
+		if err != nil {
+			log.Fatal().Err(err).Msg("history db")
+		}
+		closeDB = func() { _ = db.Close() }
+		if err := st.Restore(db); err != nil {
+			log.Fatal().Err(err).Msg("restore history")
+		}
+	}
+	state.StartResampler(st, hub)
+	dispatcher := ingest.NewDispatcher(st, hub)
+
+	addr, origins := opts.Addr, opts.Origins
+	r := httpx.NewRouter(origins)
+	pub := &httpx.PublicHandlers{Keys: keyMgr, Store: st, Hub: hub, Shares: shareReg, Zones: zones, CookieDomain: "localhost", Heartbeat: 15 * time.Second, AllowedOrigins: origins}
+	r.Group(func(r chi.Router) { pub.Routes(r) })
+	adm := &httpx.AdminHandlers{Keys: keyMgr, Store: st, Hub: hub, Shares: shareReg, Zones: zones, Dispatcher: dispatcher, TokenTTL: 8 * time.Hour, Heartbeat: 15 * time.Second, ArrivalRadiusM: 200, AllowedOrigins: origins}
+	r.Group(func(r chi.Router) { adm.Routes(r) })
+
+	srv := &http.Server{Addr: addr, Handler: r, ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		log.Info().Str("addr", addr).Msg("development server starting")
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal().Err(err).Msg("listen")
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+	}()
+
+	return func(m recording.Message) {
+		if ev := opts.Topics.ParseMessage(m.Topic, []byte(m.Payload), time.Now().UnixMilli()); ev != nil {
+			dispatcher.Dispatch(ev)
+		}
+	}, closeDB
+}
@@ -3,9 +3,11 @@ package main
 import (
 	"context"
 	"fmt"
+	"maps"
 	"net/http"
 	"os"
 	"os/signal"
+	"slices"
 	"syscall"
 	"time"
 
@@ -13,10 +15,17 @@ import (
 	"github.com/mcuelenaere/where-is-maurus/backend/internal/auth"
 	"github.com/mcuelenaere/where-is-maurus/backend/internal/config"
 	httpx "github.com/mcuelenaere/where-is-maurus/backend/internal/http"
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/ingest"
 	"github.com/mcuelenaere/where-is-maurus/backend/internal/keys"
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/metrics"
 	mqttc "github.com/mcuelenaere/where-is-maurus/backend/internal/mqtt"
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/privacy"
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/recording"
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/shares"
 	"github.com/mcuelenaere/where-is-maurus/backend/internal/state"
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/storage"
 	"github.com/mcuelenaere/where-is-maurus/backend/internal/stream"
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/tracing"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
@@ -36,18 +45,52 @@ func main() {
 		log.Warn().Str("value", cfg.LogLevel).Err(err).Msg("invalid LOG_LEVEL, using default")
 	}
 	log.Debug().
-		Interface("cfg", cfg).
+		Interface("cfg", cfg.Redacted()).
 		Msg("config loaded")
 
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
 
+	// Tracing, only when there's a collector to export to
+	shutdownTracing := func(context.Context) error { return nil }
+	if cfg.TracingEnabled() {
+		shutdownTracing, err = tracing.Setup(ctx)
+		if err != nil {
+			log.Fatal().Err(err).Msg("tracing")
+		}
+		log.Info().Msg("tracing enabled")
+	}
+
 	// Keys
-	keyMgr, err := keys.NewManager(ctx, cfg.KeyRotateInterval)
+	keyOpts := []keys.Option{keys.WithRetain(cfg.KeyRetain)}
+	if cfg.KeyringDir != "" {
+		keyStore, err := keys.NewFileStore(cfg.KeyringDir, cfg.KeyringPassphrase)
+		if err != nil {
+			log.Fatal().Err(err).Msg("keyring")
+		}
+		keyOpts = append(keyOpts, keys.WithStore(keyStore))
+	} else {
+		log.Warn().Msg("keyring disabled: share tokens won't survive restarts")
+	}
+	keyMgr, err := keys.NewManager(ctx, cfg.KeyRotateInterval, keyOpts...)
 	if err != nil {
 		log.Fatal().Err(err).Msg("keys")
 	}
 
+	// Issued shares, used for listing and revocation
+	shareReg, err := shares.NewRegistry(cfg.SharesFile)
+	if err != nil {
+		log.Fatal().Err(err).Msg("shares")
+	}
+	// Pick up the revocations of other instances sharing SHARES_FILE, ending their streams here
+	go shareReg.Watch(ctx, 5*time.Second)
+
+	// Geofences within which share viewers don't get the exact location
+	zones, err := privacy.NewZones(cfg.PrivacyZonesFile)
+	if err != nil {
+		log.Fatal().Err(err).Msg("privacy zones")
+	}
+
 	// CF validator (only if configured)
 	var cfv *auth.CFValidator
 	if cfg.CFJWKSURL != "" {
@@ -59,42 +102,171 @@ func main() {
 
 	// State and hub
 	st := state.NewStore()
-	hub := stream.NewHub()
+	st.SetStaleAfter(cfg.StaleAfter)
+	st.SetWindow(cfg.HistoryWindow)
+	st.SetResampleInterval(cfg.ResampleInterval)
+	if err := st.SetRetention(cfg.HistoryRetention); err != nil {
+		log.Fatal().Err(err).Msg("history retention")
+	}
+	slowPolicy, err := stream.ParseSlowPolicy(cfg.SSESlowPolicy)
+	if err != nil {
+		log.Fatal().Err(err).Msg("sse slow policy")
+	}
+	hub := stream.NewHub(stream.WithSlowPolicy(slowPolicy))
+	metrics.Registry.MustRegister(metrics.NewHubCollector(hub), metrics.NewStoreCollector(st))
+	// Derived events (charging sessions, ...) go straight to the viewers of the car
+	st.SetNotifier(hub.Broadcast)
+
+	// Durable history so a restart doesn't wipe the window
+	if cfg.HistoryDBPath != "" {
+		db, err := storage.OpenBolt(cfg.HistoryDBPath, st.Window())
+		if err != nil {
+			log.Fatal().Err(err).Msg("history db")
+		}
+		defer func() { _ = db.Close() }()
+		if err := st.Restore(db); err != nil {
+			log.Fatal().Err(err).Msg("restore history")
+		}
+	}
 
 	// Resampler to keep flatlines visible
 	state.StartResampler(st, hub)
 
-	// MQTT
+	// All sources feed the store through the same dispatcher
+	dispatcher := ingest.NewDispatcher(st, hub)
+
+	// MQTT, one connection per TeslaMate instance
+	var conns []mqttc.Options
 	if cfg.MQTTBrokerURL != "" {
-		hostname, _ := os.Hostname()
-		clientID := fmt.Sprintf("where-is-maurus-backend-%s-%d-%d", hostname, os.Getpid(), time.Now().UnixNano())
-		client := mqttc.NewClient(cfg.MQTTBrokerURL, cfg.MQTTUsername, cfg.MQTTPassword, clientID, st, hub)
-		if err := client.Connect(ctx); err != nil {
-			log.Fatal().Err(err).Msg("mqtt connect")
+		conns = append(conns, mqttc.Options{
+			BrokerURL:          cfg.MQTTBrokerURL,
+			Username:           cfg.MQTTUsername,
+			Password:           cfg.MQTTPassword,
+			ClientID:           cfg.MQTTClientID,
+			CAFile:             cfg.MQTTCAFile,
+			CertFile:           cfg.MQTTCertFile,
+			KeyFile:            cfg.MQTTKeyFile,
+			ServerName:         cfg.MQTTTLSServerName,
+			InsecureSkipVerify: cfg.MQTTTLSInsecure,
+			QoS:                cfg.MQTTQoS,
+			CleanSession:       cfg.MQTTCleanSession,
+			Topics:             mqttc.Topics{Prefix: cfg.MQTTTopicPrefix},
+		})
+	}
+	if cfg.MQTTConnectionsFile != "" {
+		more, err := mqttc.LoadConnections(cfg.MQTTConnectionsFile)
+		if err != nil {
+			log.Fatal().Err(err).Msg("mqtt connections")
+		}
+		conns = append(conns, more...)
+	}
+	if err := mqttc.ValidateConnections(conns); err != nil {
+		log.Fatal().Err(err).Msg("mqtt connections")
+	}
+	mqttc.BoundCarIDRanges(conns)
+	if err := mqttc.ValidateIngestCars(conns, slices.Collect(maps.Keys(cfg.IngestKeys))); err != nil {
+		log.Fatal().Err(err).Msg("ingest keys")
+	}
+	var rec *recording.Recorder
+	if cfg.MQTTRecordFile != "" && len(conns) > 0 {
+		rec, err = recording.NewRecorder(cfg.MQTTRecordFile)
+		if err != nil {
+			log.Fatal().Err(err).Msg("mqtt recorder")
 		}
-		if err := client.SubscribeAllCars(ctx); err != nil {
-			log.Fatal().Err(err).Msg("mqtt subscribe all cars")
+		defer func() { _ = rec.Close() }()
+		log.Info().Str("file", cfg.MQTTRecordFile).Msg("recording mqtt messages")
+	}
+	hostname, _ := os.Hostname()
+	for i, opts := range conns {
+		if opts.ClientID == "" {
+			// clean sessions only, persistent ones were refused without an explicit client id
+			opts.ClientID = fmt.Sprintf("where-is-maurus-backend-%s-%d-%d-%d", hostname, os.Getpid(), time.Now().UnixNano(), i)
 		}
-	} else {
+		client, err := mqttc.NewClient(opts)
+		if err != nil {
+			log.Fatal().Err(err).Str("broker", opts.BrokerURL).Msg("mqtt client")
+		}
+		if rec != nil {
+			client.SetRecorder(rec)
+		}
+		go func() {
+			if err := dispatcher.Run(ctx, client); err != nil {
+				log.Fatal().Err(err).Str("broker", opts.BrokerURL).Msg("mqtt")
+			}
+		}()
+	}
+	if len(conns) == 0 {
 		log.Warn().Msg("mqtt disabled: missing broker url")
 	}
 
+	// Synthetic car for development environments without TeslaMate
+	if cfg.SyntheticRouteFile != "" {
+		// the synthetic car would otherwise be mixed with a real one
+		if i := mqttc.Feeding(conns, cfg.SyntheticCarID); i >= 0 {
+			log.Fatal().Int64("car_id", cfg.SyntheticCarID).Int("connection", i).Msg("synthetic car id is fed by an mqtt connection, set SYNTHETIC_CAR_ID")
+		}
+		if _, ok := cfg.IngestKeys[cfg.SyntheticCarID]; ok {
+			log.Fatal().Int64("car_id", cfg.SyntheticCarID).Msg("synthetic car id is also in INGEST_KEYS, set SYNTHETIC_CAR_ID")
+		}
+		route, err := ingest.LoadRoute(cfg.SyntheticRouteFile)
+		if err != nil {
+			log.Fatal().Err(err).Msg("synthetic route")
+		}
+		profile, err := ingest.ParseSpeedProfile(cfg.SyntheticSpeed)
+		if err != nil {
+			log.Fatal().Err(err).Msg("synthetic speed profile")
+		}
+		src := &ingest.Synthetic{CarID: cfg.SyntheticCarID, DisplayName: "Synthetic", Route: route, Profile: profile, Loop: true}
+		log.Info().Int64("car_id", cfg.SyntheticCarID).Int("points", len(route)).Msg("synthetic car starting")
+		go func() {
+			if err := dispatcher.Run(ctx, src); err != nil {
+				log.Error().Err(err).Msg("synthetic car")
+			}
+		}()
+	}
+
 	r := httpx.NewRouter(cfg.CORSAllowedOrigins)
 
 	// Public routes
-	pub := &httpx.PublicHandlers{Keys: keyMgr, Store: st, Hub: hub, CookieDomain: cfg.CookieDomain, Heartbeat: cfg.SSEHeartbeatInterval}
+	pub := &httpx.PublicHandlers{Keys: keyMgr, Shares: shareReg, Zones: zones, Store: st, Hub: hub, CookieDomain: cfg.CookieDomain, Heartbeat: cfg.SSEHeartbeatInterval, AllowedOrigins: cfg.CORSAllowedOrigins}
 	r.Group(func(r chi.Router) { pub.Routes(r) })
 
+	// Trackers pushing over HTTP
+	if len(cfg.IngestKeys) > 0 {
+		ing := &httpx.IngestHandlers{Keys: cfg.IngestKeys, Dispatcher: dispatcher}
+		r.Group(func(r chi.Router) { ing.Routes(r) })
+	}
+
+	// Metrics are served with the admin routes unless they get a listener of their own
+	var adminMetrics http.Handler
+	if cfg.MetricsAddr == "" {
+		adminMetrics = metrics.Handler()
+	}
+
 	// Admin routes
 	if cfv != nil {
-		adm := &httpx.AdminHandlers{CF: cfv, Keys: keyMgr, Store: st, Hub: hub, TokenTTL: cfg.TokenDefaultTTL, Heartbeat: cfg.SSEHeartbeatInterval}
+		adm := &httpx.AdminHandlers{CF: cfv, Keys: keyMgr, Shares: shareReg, Zones: zones, Store: st, Hub: hub, Dispatcher: dispatcher, TokenTTL: cfg.TokenDefaultTTL, Heartbeat: cfg.SSEHeartbeatInterval, ArrivalRadiusM: cfg.ArrivalRadiusM, AllowedOrigins: cfg.CORSAllowedOrigins, Metrics: adminMetrics}
 		r.Group(func(r chi.Router) { adm.Routes(r) })
 	} else {
 		log.Warn().Msg("CF Access disabled: CF_JWKS_URL/CF_ISSUER/C F_AUDIENCE not set")
-		adm := &httpx.AdminHandlers{CF: nil, Keys: keyMgr, Store: st, Hub: hub, TokenTTL: cfg.TokenDefaultTTL, Heartbeat: cfg.SSEHeartbeatInterval}
+		adm := &httpx.AdminHandlers{CF: nil, Keys: keyMgr, Shares: shareReg, Zones: zones, Store: st, Hub: hub, Dispatcher: dispatcher, TokenTTL: cfg.TokenDefaultTTL, Heartbeat: cfg.SSEHeartbeatInterval, ArrivalRadiusM: cfg.ArrivalRadiusM, AllowedOrigins: cfg.CORSAllowedOrigins, Metrics: adminMetrics}
 		r.Group(func(r chi.Router) { adm.Routes(r) })
 	}
 
+	// Metrics on their own listener, e.g. only reachable from the internal network
+	var metricsSrv *http.Server
+	if cfg.MetricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics.Handler())
+		metricsSrv = &http.Server{Addr: cfg.MetricsAddr, Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+		go func() {
+			log.Info().Str("addr", cfg.MetricsAddr).Msg("metrics server starting")
+			if err := metricsSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Fatal().Err(err).Msg("metrics listen")
+			}
+		}()
+	}
+
 	srv := &http.Server{Addr: cfg.HTTPAddr, Handler: r, ReadHeaderTimeout: 5 * time.Second}
 	go func() {
 		log.Info().Str("addr", cfg.HTTPAddr).Msg("server starting")
@@ -107,4 +279,10 @@ func main() {
 	shutdownCtx, cancel2 := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel2()
 	_ = srv.Shutdown(shutdownCtx)
+	if metricsSrv != nil {
+		_ = metricsSrv.Shutdown(shutdownCtx)
+	}
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		log.Warn().Err(err).Msg("flush traces")
+	}
 }
@@ -0,0 +1,39 @@
+package auth
+
+import "fmt"
+
+// Scopes limit which parts of the car state a share exposes. A share without scopes exposes everything.
+const (
+	ScopeLocation = "location"
+	ScopeRoute    = "route"
+	ScopeBattery  = "battery"
+	ScopeCharging = "charging"
+	ScopeClimate  = "climate"
+	ScopeTPMS     = "tpms"
+	ScopeVehicle  = "vehicle"
+	ScopeTrip     = "trip"
+	// ScopeHistory exposes the history window of the other granted scopes.
+	ScopeHistory = "history"
+)
+
+var knownScopes = map[string]bool{
+	ScopeLocation: true,
+	ScopeRoute:    true,
+	ScopeBattery:  true,
+	ScopeCharging: true,
+	ScopeClimate:  true,
+	ScopeTPMS:     true,
+	ScopeVehicle:  true,
+	ScopeTrip:     true,
+	ScopeHistory:  true,
+}
+
+// ValidateScopes rejects unknown scope names.
+func ValidateScopes(scopes []string) error {
+	for _, s := range scopes {
+		if !knownScopes[s] {
+			return fmt.Errorf("unknown scope %q", s)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,15 @@
+package auth
+
+import "testing"
+
+func TestValidateScopes(t *testing.T) {
+	if err := ValidateScopes(nil); err != nil {
+		t.Fatalf("expected no scopes to be valid: %v", err)
+	}
+	if err := ValidateScopes([]string{ScopeLocation, ScopeRoute, ScopeHistory}); err != nil {
+		t.Fatalf("expected known scopes to be valid: %v", err)
+	}
+	if err := ValidateScopes([]string{ScopeRoute, "cabin_camera"}); err == nil {
+		t.Fatalf("expected unknown scope to be rejected")
+	}
+}
@@ -1,6 +1,7 @@
 package auth
 
 import (
+	"encoding/json"
 	"errors"
 	"net/http"
 	"time"
@@ -16,19 +17,65 @@ const (
 )
 
 type ShareClaims struct {
-	CarID int64 `json:"car_id"`
+	// ID is the jti of the token, generated when left empty.
+	ID    string `json:"jti,omitempty"`
+	CarID int64  `json:"car_id"`
+	// CarIDs lists the cars of a share covering several cars, in which case CarID is unused.
+	CarIDs []int64 `json:"car_ids,omitempty"`
+	// AllCars makes the share cover every car the server knows about, including cars added later.
+	AllCars bool `json:"all_cars,omitempty"`
+	// Dest is the destination of the trip being shared; once the car is within
+	// ArrivalRadiusM of it the share is considered finished.
+	Dest           *ShareDest `json:"dest,omitempty"`
+	ArrivalRadiusM float64    `json:"arrival_radius_m,omitempty"`
+	// Scopes restricts the exposed car state, see the Scope constants. Empty means everything.
+	Scopes []string `json:"scopes,omitempty"`
+}
+
+// Cars returns the cars covered by the share, or nil when it covers all cars.
+func (c ShareClaims) Cars() []int64 {
+	switch {
+	case c.AllCars:
+		return nil
+	case len(c.CarIDs) > 0:
+		return c.CarIDs
+	default:
+		return []int64{c.CarID}
+	}
+}
+
+type ShareDest struct {
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
 }
 
 // CreateShareToken builds a signed JWT using provided signer.
-func CreateShareToken(now time.Time, ttl time.Duration, carID int64, sign func(t jwt.Token) ([]byte, error)) (string, time.Time, error) {
+func CreateShareToken(now time.Time, ttl time.Duration, claims ShareClaims, sign func(t jwt.Token) ([]byte, error)) (string, time.Time, error) {
 	t := jwt.New()
 	_ = t.Set(jwt.IssuerKey, IssuerWhereIsMaurus)
 	_ = t.Set(jwt.AudienceKey, []string{AudienceShare})
 	_ = t.Set(jwt.IssuedAtKey, now)
 	exp := now.Add(ttl)
 	_ = t.Set(jwt.ExpirationKey, exp)
-	_ = t.Set(jwt.JwtIDKey, uuid.New().String())
-	_ = t.Set("car_id", carID)
+	jti := claims.ID
+	if jti == "" {
+		jti = uuid.New().String()
+	}
+	_ = t.Set(jwt.JwtIDKey, jti)
+	_ = t.Set("car_id", claims.CarID)
+	if len(claims.CarIDs) > 0 {
+		_ = t.Set("car_ids", claims.CarIDs)
+	}
+	if claims.AllCars {
+		_ = t.Set("all_cars", true)
+	}
+	if claims.Dest != nil {
+		_ = t.Set("dest", claims.Dest)
+		_ = t.Set("arrival_radius_m", claims.ArrivalRadiusM)
+	}
+	if len(claims.Scopes) > 0 {
+		_ = t.Set("scopes", claims.Scopes)
+	}
 	b, err := sign(t)
 	if err != nil {
 		return "", time.Time{}, err
@@ -37,7 +84,8 @@ func CreateShareToken(now time.Time, ttl time.Duration, carID int64, sign func(t
 }
 
 // VerifyShareToken checks claims and signature using provided verify func.
-func VerifyShareToken(raw string, verify func([]byte) (jwt.Token, error)) (jwt.Token, error) {
+// Optional checks are run after the standard validation and can reject otherwise valid tokens.
+func VerifyShareToken(raw string, verify func([]byte) (jwt.Token, error), checks ...func(jwt.Token) error) (jwt.Token, error) {
 	tok, err := verify([]byte(raw))
 	if err != nil {
 		return nil, err
@@ -60,9 +108,27 @@ func VerifyShareToken(raw string, verify func([]byte) (jwt.Token, error)) (jwt.T
 	if err := jwt.Validate(tok); err != nil {
 		return nil, err
 	}
+	for _, check := range checks {
+		if err := check(tok); err != nil {
+			return nil, err
+		}
+	}
 	return tok, nil
 }
 
+// ParseShareClaims extracts the share specific claims from a verified token.
+func ParseShareClaims(tok jwt.Token) (ShareClaims, error) {
+	var c ShareClaims
+	b, err := json.Marshal(tok)
+	if err != nil {
+		return ShareClaims{}, err
+	}
+	if err := json.Unmarshal(b, &c); err != nil {
+		return ShareClaims{}, err
+	}
+	return c, nil
+}
+
 func SetSessionCookie(w http.ResponseWriter, domain string, token string, exp time.Time) {
 	c := &http.Cookie{
 		Name:     CookieName,
@@ -3,6 +3,7 @@ package auth
 import (
 	"errors"
 	"net/http/httptest"
+	"slices"
 	"testing"
 	"time"
 
@@ -29,7 +30,7 @@ func TestCreateAndVerifyShareToken(t *testing.T) {
 		_ = tkn.Set(jwt.ExpirationKey, time.Now().Add(time.Hour))
 		return tkn, nil
 	}
-	raw, exp, err := CreateShareToken(now, time.Hour, 123, sign)
+	raw, exp, err := CreateShareToken(now, time.Hour, ShareClaims{CarID: 123}, sign)
 	if err != nil {
 		t.Fatalf("CreateShareToken error: %v", err)
 	}
@@ -55,3 +56,67 @@ func TestSessionCookie(t *testing.T) {
 		t.Fatalf("unexpected cookie: %+v", c)
 	}
 }
+
+func TestParseShareClaims(t *testing.T) {
+	var signed jwt.Token
+	sign := func(tok jwt.Token) ([]byte, error) {
+		signed = tok
+		return []byte("testtoken"), nil
+	}
+	claims := ShareClaims{ID: "abc", CarID: 7, Dest: &ShareDest{Lat: 51.05, Lon: 3.72}, ArrivalRadiusM: 150, Scopes: []string{ScopeRoute, ScopeBattery}}
+	if _, _, err := CreateShareToken(time.Now(), time.Hour, claims, sign); err != nil {
+		t.Fatalf("CreateShareToken error: %v", err)
+	}
+	got, err := ParseShareClaims(signed)
+	if err != nil {
+		t.Fatalf("ParseShareClaims error: %v", err)
+	}
+	if got.ID != "abc" || got.CarID != 7 || got.Dest == nil || got.Dest.Lat != 51.05 || got.Dest.Lon != 3.72 || got.ArrivalRadiusM != 150 {
+		t.Fatalf("unexpected claims: %+v", got)
+	}
+	if len(got.Scopes) != 2 || got.Scopes[0] != ScopeRoute || got.Scopes[1] != ScopeBattery {
+		t.Fatalf("unexpected scopes: %+v", got.Scopes)
+	}
+}
+
+func TestShareClaims_Cars(t *testing.T) {
+	var signed jwt.Token
+	sign := func(tok jwt.Token) ([]byte, error) {
+		signed = tok
+		return []byte("testtoken"), nil
+	}
+	for _, tc := range []struct {
+		claims ShareClaims
+		want   []int64
+	}{
+		{ShareClaims{CarID: 7}, []int64{7}},
+		{ShareClaims{CarIDs: []int64{1, 2}}, []int64{1, 2}},
+		{ShareClaims{AllCars: true}, nil},
+	} {
+		if _, _, err := CreateShareToken(time.Now(), time.Hour, tc.claims, sign); err != nil {
+			t.Fatalf("CreateShareToken error: %v", err)
+		}
+		got, err := ParseShareClaims(signed)
+		if err != nil {
+			t.Fatalf("ParseShareClaims error: %v", err)
+		}
+		if cars := got.Cars(); !slices.Equal(cars, tc.want) || (cars == nil) != (tc.want == nil) {
+			t.Fatalf("expected cars %v for %+v, got %v", tc.want, tc.claims, cars)
+		}
+	}
+}
+
+func TestVerifyShareToken_Checks(t *testing.T) {
+	verify := func(_ []byte) (jwt.Token, error) {
+		tkn := jwt.New()
+		_ = tkn.Set(jwt.IssuerKey, IssuerWhereIsMaurus)
+		_ = tkn.Set(jwt.AudienceKey, []string{AudienceShare})
+		_ = tkn.Set(jwt.ExpirationKey, time.Now().Add(time.Hour))
+		return tkn, nil
+	}
+	errRejected := errors.New("rejected")
+	_, err := VerifyShareToken("x", verify, func(jwt.Token) error { return errRejected })
+	if !errors.Is(err, errRejected) {
+		t.Fatalf("expected check error, got %v", err)
+	}
+}
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"errors"
 	"strings"
 	"time"
 
@@ -8,19 +9,79 @@ import (
 )
 
 type Config struct {
-	HTTPAddr             string        `env:"HTTP_ADDR" envDefault:":8080"`
-	CORSAllowedOrigins   []string      `env:"CORS_ALLOWED_ORIGINS" envSeparator:","`
-	CookieDomain         string        `env:"COOKIE_DOMAIN"`
-	LogLevel             string        `env:"LOG_LEVEL" envDefault:"info"`
-	TokenDefaultTTL      time.Duration `env:"TOKEN_DEFAULT_TTL" envDefault:"28800s"`
-	KeyRotateInterval    time.Duration `env:"KEY_ROTATE_SECONDS" envDefault:"28800s"`
-	MQTTBrokerURL        string        `env:"MQTT_BROKER_URL"`
-	MQTTUsername         string        `env:"MQTT_USERNAME"`
-	MQTTPassword         string        `env:"MQTT_PASSWORD"`
-	CFJWKSURL            string        `env:"CF_JWKS_URL"`
-	CFIssuer             string        `env:"CF_ISSUER"`
-	CFAudience           string        `env:"CF_AUDIENCE"`
-	SSEHeartbeatInterval time.Duration `env:"SSE_HEARTBEAT_SECONDS" envDefault:"15s"`
+	HTTPAddr             string                   `env:"HTTP_ADDR" envDefault:":8080"`
+	CORSAllowedOrigins   []string                 `env:"CORS_ALLOWED_ORIGINS" envSeparator:","`
+	CookieDomain         string                   `env:"COOKIE_DOMAIN"`
+	LogLevel             string                   `env:"LOG_LEVEL" envDefault:"info"`
+	TokenDefaultTTL      time.Duration            `env:"TOKEN_DEFAULT_TTL" envDefault:"28800s"`
+	KeyRotateInterval    time.Duration            `env:"KEY_ROTATE_SECONDS" envDefault:"28800s"`
+	KeyRetain            int                      `env:"KEY_RETAIN" envDefault:"1"`
+	KeyringDir           string                   `env:"KEYRING_DIR"`
+	KeyringPassphrase    string                   `env:"KEYRING_PASSPHRASE"`
+	MQTTBrokerURL        string                   `env:"MQTT_BROKER_URL"`
+	MQTTUsername         string                   `env:"MQTT_USERNAME"`
+	MQTTPassword         string                   `env:"MQTT_PASSWORD"`
+	MQTTClientID         string                   `env:"MQTT_CLIENT_ID"`
+	MQTTCAFile           string                   `env:"MQTT_CA_FILE"`
+	MQTTCertFile         string                   `env:"MQTT_CERT_FILE"`
+	MQTTKeyFile          string                   `env:"MQTT_KEY_FILE"`
+	MQTTTLSServerName    string                   `env:"MQTT_TLS_SERVER_NAME"`
+	MQTTTLSInsecure      bool                     `env:"MQTT_TLS_INSECURE_SKIP_VERIFY"`
+	MQTTQoS              byte                     `env:"MQTT_QOS" envDefault:"0"`
+	MQTTCleanSession     bool                     `env:"MQTT_CLEAN_SESSION" envDefault:"true"`
+	MQTTTopicPrefix      string                   `env:"MQTT_TOPIC_PREFIX" envDefault:"teslamate"`
+	MQTTConnectionsFile  string                   `env:"MQTT_CONNECTIONS_FILE"`
+	MQTTRecordFile       string                   `env:"MQTT_RECORD_FILE"`
+	SyntheticRouteFile   string                   `env:"SYNTHETIC_ROUTE_FILE"`
+	SyntheticCarID       int64                    `env:"SYNTHETIC_CAR_ID" envDefault:"1"`
+	SyntheticSpeed       string                   `env:"SYNTHETIC_SPEED_PROFILE" envDefault:"50"`
+	IngestKeys           map[int64]string         `env:"INGEST_KEYS" envKeyValSeparator:":"`
+	CFJWKSURL            string                   `env:"CF_JWKS_URL"`
+	CFIssuer             string                   `env:"CF_ISSUER"`
+	CFAudience           string                   `env:"CF_AUDIENCE"`
+	SSEHeartbeatInterval time.Duration            `env:"SSE_HEARTBEAT_SECONDS" envDefault:"15s"`
+	SSESlowPolicy        string                   `env:"SSE_SLOW_POLICY" envDefault:"resync"`
+	ArrivalRadiusM       float64                  `env:"ARRIVAL_RADIUS_M" envDefault:"200"`
+	StaleAfter           time.Duration            `env:"STALE_AFTER" envDefault:"5m"`
+	HistoryWindow        time.Duration            `env:"HISTORY_WINDOW" envDefault:"15m"`
+	HistoryRetention     map[string]time.Duration `env:"HISTORY_RETENTION" envKeyValSeparator:":"`
+	ResampleInterval     time.Duration            `env:"RESAMPLE_INTERVAL" envDefault:"5s"`
+	SharesFile           string                   `env:"SHARES_FILE"`
+	PrivacyZonesFile     string                   `env:"PRIVACY_ZONES_FILE"`
+	HistoryDBPath        string                   `env:"HISTORY_DB_PATH"`
+	MetricsAddr          string                   `env:"METRICS_ADDR"`
+	// Tracing is enabled by pointing the standard OTLP variables at a collector, the exporter
+	// reads the rest of them itself
+	OTLPEndpoint       string `env:"OTEL_EXPORTER_OTLP_ENDPOINT"`
+	OTLPTracesEndpoint string `env:"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"`
+}
+
+// TracingEnabled reports whether an OTLP endpoint to export traces to is configured.
+func (c Config) TracingEnabled() bool {
+	return c.OTLPEndpoint != "" || c.OTLPTracesEndpoint != ""
+}
+
+// redacted replaces a secret that is set.
+const redacted = "[redacted]"
+
+// Redacted returns a copy of the config with its secrets masked, fit for logging.
+func (c Config) Redacted() Config {
+	mask := func(s string) string {
+		if s == "" {
+			return ""
+		}
+		return redacted
+	}
+	c.KeyringPassphrase = mask(c.KeyringPassphrase)
+	c.MQTTPassword = mask(c.MQTTPassword)
+	if c.IngestKeys != nil {
+		keys := make(map[int64]string, len(c.IngestKeys))
+		for carID, key := range c.IngestKeys {
+			keys[carID] = mask(key)
+		}
+		c.IngestKeys = keys
+	}
+	return c
 }
 
 func Load() (Config, error) {
@@ -28,6 +89,11 @@ func Load() (Config, error) {
 	if err := env.Parse(&c); err != nil {
 		return Config{}, err
 	}
+	// Tokens outlive a restart with a persisted keyring, their revocations must as well. Other
+	// instances sharing the keyring accept the same tokens, so they need the same SHARES_FILE.
+	if c.KeyringDir != "" && c.SharesFile == "" {
+		return Config{}, errors.New("KEYRING_DIR requires SHARES_FILE, revoked shares would be accepted again after a restart")
+	}
 	// Normalize allowed origins: trim spaces, drop empties
 	if len(c.CORSAllowedOrigins) == 1 && c.CORSAllowedOrigins[0] == "" {
 		c.CORSAllowedOrigins = nil
@@ -1,8 +1,11 @@
 package config
 
 import (
+	"encoding/json"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestLoad_DefaultsAndNormalization(t *testing.T) {
@@ -37,3 +40,96 @@ func TestLoad_EmptyOriginsBecomeNil(t *testing.T) {
 		t.Fatalf("expected empty origins, got %v", cfg.CORSAllowedOrigins)
 	}
 }
+
+func TestLoad_IngestKeys(t *testing.T) {
+	t.Setenv("INGEST_KEYS", "3:s3cret,4:other")
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("Load() error: %v", err)
+	}
+	expected := map[int64]string{3: "s3cret", 4: "other"}
+	if !reflect.DeepEqual(cfg.IngestKeys, expected) {
+		t.Fatalf("expected ingest keys %v, got %v", expected, cfg.IngestKeys)
+	}
+
+	t.Setenv("INGEST_KEYS", "car3:s3cret")
+	if _, err := Load(); err == nil {
+		t.Fatalf("expected error for a non-numeric car id")
+	}
+}
+
+func TestLoad_MQTT(t *testing.T) {
+	t.Setenv("MQTT_QOS", "1")
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("Load() error: %v", err)
+	}
+	if cfg.MQTTQoS != 1 || !cfg.MQTTCleanSession || cfg.MQTTTopicPrefix != "teslamate" {
+		t.Fatalf("unexpected mqtt config: %+v", cfg)
+	}
+	t.Setenv("MQTT_CLEAN_SESSION", "false")
+	if cfg, _ = Load(); cfg.MQTTCleanSession {
+		t.Fatal("expected a persistent session when asked for")
+	}
+}
+
+func TestLoad_Tracing(t *testing.T) {
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("Load() error: %v", err)
+	}
+	if cfg.TracingEnabled() {
+		t.Fatal("tracing should be disabled by default")
+	}
+	t.Setenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "http://collector:4318/v1/traces")
+	if cfg, _ = Load(); !cfg.TracingEnabled() {
+		t.Fatal("expected tracing enabled with a traces endpoint")
+	}
+}
+
+func TestLoad_History(t *testing.T) {
+	t.Setenv("HISTORY_WINDOW", "30m")
+	t.Setenv("HISTORY_RETENTION", "soc_pct:2h,path:10m")
+	t.Setenv("RESAMPLE_INTERVAL", "0")
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("Load() error: %v", err)
+	}
+	if cfg.HistoryWindow != 30*time.Minute || cfg.ResampleInterval != 0 {
+		t.Fatalf("unexpected history config: %+v", cfg)
+	}
+	if cfg.HistoryRetention["soc_pct"] != 2*time.Hour || cfg.HistoryRetention["path"] != 10*time.Minute {
+		t.Fatalf("unexpected retention: %v", cfg.HistoryRetention)
+	}
+}
+
+func TestLoad_KeyringRequiresSharesFile(t *testing.T) {
+	t.Setenv("KEYRING_DIR", t.TempDir())
+	if _, err := Load(); err == nil {
+		t.Fatal("expected a persisted keyring without SHARES_FILE to be refused")
+	}
+	t.Setenv("SHARES_FILE", "shares.json")
+	if _, err := Load(); err != nil {
+		t.Fatalf("Load() error: %v", err)
+	}
+}
+
+func TestConfig_Redacted(t *testing.T) {
+	t.Setenv("KEYRING_PASSPHRASE", "hunter2")
+	t.Setenv("MQTT_PASSWORD", "mqtt-secret")
+	t.Setenv("INGEST_KEYS", "1:ingest-secret")
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("Load() error: %v", err)
+	}
+	b, _ := json.Marshal(cfg.Redacted())
+	for _, secret := range []string{"hunter2", "mqtt-secret", "ingest-secret"} {
+		if strings.Contains(string(b), secret) {
+			t.Fatalf("expected %s to be redacted: %s", secret, b)
+		}
+	}
+	// the original is left alone
+	if cfg.MQTTPassword != "mqtt-secret" || cfg.IngestKeys[1] != "ingest-secret" {
+		t.Fatalf("redacting modified the config: %+v", cfg)
+	}
+}
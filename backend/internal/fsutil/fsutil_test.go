@@ -0,0 +1,54 @@
+package fsutil
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "data.json")
+	for _, content := range []string{`{"v":1}`, `{"v":2}`} {
+		if err := WriteFileAtomic(path, []byte(content)); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		if b, err := os.ReadFile(path); err != nil || string(b) != content {
+			t.Fatalf("expected %s, got %s (%v)", content, b, err)
+		}
+	}
+	// no temporary files are left behind
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Fatalf("expected a single file, got %d", len(entries))
+	}
+}
+
+func TestLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.json")
+	unlock, err := Lock(path)
+	if err != nil {
+		t.Fatalf("lock: %v", err)
+	}
+	locked := make(chan struct{})
+	go func() {
+		unlock2, err := Lock(path)
+		if err != nil {
+			t.Errorf("lock: %v", err)
+			return
+		}
+		close(locked)
+		unlock2()
+	}()
+	select {
+	case <-locked:
+		t.Fatal("expected the second lock to wait for the first")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("expected the second lock once the first was released")
+	}
+}
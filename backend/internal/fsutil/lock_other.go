@@ -0,0 +1,8 @@
+//go:build !unix
+
+package fsutil
+
+// Lock is a no-op where flock isn't available, instances can't safely share a file there.
+func Lock(path string) (unlock func(), err error) {
+	return func() {}, nil
+}
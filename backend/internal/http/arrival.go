@@ -0,0 +1,70 @@
+package httpx
+
+import (
+	"errors"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v3/jwt"
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/auth"
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/shares"
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/state"
+	"github.com/rs/zerolog/log"
+)
+
+var errArrived = errors.New("share destination reached")
+
+// arrivalCheck returns a func reporting whether the car reached the destination embedded in the
+// share. Once reached the share is remembered, so viewers connecting afterwards are refused even
+// when the car has moved on. Registered shares remember it in the registry, surviving restarts.
+// Returns nil when the share has no destination. exp is the expiry of the share token.
+func (h *PublicHandlers) arrivalCheck(claims auth.ShareClaims, exp time.Time) func() bool {
+	if claims.Dest == nil || claims.ArrivalRadiusM <= 0 {
+		return nil
+	}
+	return func() bool {
+		if _, ok := h.arrived.Load(claims.ID); ok {
+			return true
+		}
+		if h.Shares != nil && h.Shares.HasArrived(claims.ID) {
+			return true
+		}
+		st, _ := h.Store.GetSnapshot(claims.CarID)
+		if st.Location == nil {
+			return false
+		}
+		if state.DistanceMeters(st.Location.Lat, st.Location.Lon, claims.Dest.Lat, claims.Dest.Lon) > claims.ArrivalRadiusM {
+			return false
+		}
+		h.pruneArrived(time.Now())
+		h.arrived.Store(claims.ID, exp)
+		if h.Shares != nil {
+			if err := h.Shares.MarkArrived(claims.ID); err != nil && !errors.Is(err, shares.ErrNotFound) {
+				log.Error().Err(err).Str("jti", claims.ID).Msg("persist share arrival")
+			}
+		}
+		return true
+	}
+}
+
+// checkNotArrived rejects share tokens whose destination has already been reached.
+func (h *PublicHandlers) checkNotArrived(tok jwt.Token) error {
+	claims, err := auth.ParseShareClaims(tok)
+	if err != nil {
+		return err
+	}
+	exp, _ := tok.Expiration()
+	if arrived := h.arrivalCheck(claims, exp); arrived != nil && arrived() {
+		return errArrived
+	}
+	return nil
+}
+
+// pruneArrived forgets arrived shares whose token has expired, those are refused anyway.
+func (h *PublicHandlers) pruneArrived(now time.Time) {
+	h.arrived.Range(func(jti, exp any) bool {
+		if now.After(exp.(time.Time)) {
+			h.arrived.Delete(jti)
+		}
+		return true
+	})
+}
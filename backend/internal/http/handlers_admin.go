@@ -3,25 +3,42 @@ package httpx
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
+	"slices"
 	"strconv"
 	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
 	"github.com/mcuelenaere/where-is-maurus/backend/internal/auth"
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/ingest"
 	"github.com/mcuelenaere/where-is-maurus/backend/internal/keys"
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/metrics"
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/privacy"
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/shares"
 	"github.com/mcuelenaere/where-is-maurus/backend/internal/state"
 	"github.com/mcuelenaere/where-is-maurus/backend/internal/stream"
 	"github.com/rs/zerolog/log"
 )
 
 type AdminHandlers struct {
-	CF        *auth.CFValidator
-	Keys      *keys.Manager
-	Store     *state.Store
-	Hub       *stream.Hub
-	TokenTTL  time.Duration
-	Heartbeat time.Duration
+	CF     *auth.CFValidator
+	Keys   *keys.Manager
+	Shares *shares.Registry
+	Zones  *privacy.Zones
+	Store  *state.Store
+	Hub    *stream.Hub
+	// Dispatcher, when set, reports whether the sources are connected to their upstream
+	Dispatcher *ingest.Dispatcher
+	TokenTTL   time.Duration
+	Heartbeat  time.Duration
+	// ArrivalRadiusM is used for shares that have a destination but no explicit radius.
+	ArrivalRadiusM float64
+	// AllowedOrigins are the cross-origin pages allowed to open a WebSocket
+	AllowedOrigins []string
+	// Metrics, when set, is served at /metrics behind the same CF Access check as the admin routes
+	Metrics http.Handler
 }
 
 func (h *AdminHandlers) middlewareCF(next http.Handler) http.Handler {
@@ -37,19 +54,43 @@ func (h *AdminHandlers) middlewareCF(next http.Handler) http.Handler {
 }
 
 type createShareReq struct {
-	CarID     int64      `json:"car_id"`
-	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	CarID int64 `json:"car_id"`
+	// CarIDs and AllCars let a single share cover several cars
+	CarIDs         []int64         `json:"car_ids,omitempty"`
+	AllCars        bool            `json:"all_cars,omitempty"`
+	ExpiresAt      *time.Time      `json:"expires_at,omitempty"`
+	Dest           *auth.ShareDest `json:"dest,omitempty"`
+	ArrivalRadiusM *float64        `json:"arrival_radius_m,omitempty"`
+	Label          string          `json:"label,omitempty"`
+	Scopes         []string        `json:"scopes,omitempty"`
 }
 
 type createShareResp struct {
-	Token string `json:"token"`
+	Token     string    `json:"token"`
+	JTI       string    `json:"jti"`
+	ExpiresAt time.Time `json:"expires_at"`
 }
 
 func (h *AdminHandlers) Routes(r chi.Router) {
 	r.With(h.middlewareCF).Post("/api/v1/shares", h.handleCreateShare)
 	// SSE stream for admin to observe live updates for a car
 	r.With(h.middlewareCF).Get("/api/v1/admin/cars/{id}/stream", h.handleStream)
+	r.With(h.middlewareCF).Get("/api/v1/admin/cars/{id}/ws", h.handleWebSocket)
 	r.With(h.middlewareCF).Get("/api/v1/admin/cars", h.handleListCars)
+	// every car at once, for fleet overviews
+	r.With(h.middlewareCF).Get("/api/v1/admin/stream", h.handleFleetStream)
+	r.With(h.middlewareCF).Get("/api/v1/admin/ws", h.handleFleetWebSocket)
+	r.With(h.middlewareCF).Get("/api/v1/admin/cars/{id}/charging-sessions", h.handleChargingSessions)
+	r.With(h.middlewareCF).Get("/api/v1/admin/cars/{id}/trips", h.handleTrips)
+	r.With(h.middlewareCF).Get("/api/v1/admin/shares", h.handleListShares)
+	r.With(h.middlewareCF).Delete("/api/v1/admin/shares/{jti}", h.handleRevokeShare)
+	r.With(h.middlewareCF).Get("/api/v1/admin/privacy-zones", h.handleListZones)
+	r.With(h.middlewareCF).Post("/api/v1/admin/privacy-zones", h.handleCreateZone)
+	r.With(h.middlewareCF).Delete("/api/v1/admin/privacy-zones/{id}", h.handleDeleteZone)
+	r.With(h.middlewareCF).Get("/api/v1/admin/stream/stats", h.handleStreamStats)
+	if h.Metrics != nil {
+		r.With(h.middlewareCF).Handle("/metrics", h.Metrics)
+	}
 }
 
 func (h *AdminHandlers) handleCreateShare(w http.ResponseWriter, r *http.Request) {
@@ -69,18 +110,167 @@ func (h *AdminHandlers) handleCreateShare(w http.ResponseWriter, r *http.Request
 	} else {
 		ttl = h.TokenTTL
 	}
-	tok, _, err := auth.CreateShareToken(time.Now(), ttl, req.CarID, h.Keys.SignJWT)
+	if err := auth.ValidateScopes(req.Scopes); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	claims := auth.ShareClaims{ID: uuid.New().String(), Dest: req.Dest, Scopes: req.Scopes}
+	cars := slices.Clone(req.CarIDs)
+	if req.CarID != 0 || (len(cars) == 0 && !req.AllCars) {
+		cars = append(cars, req.CarID)
+	}
+	slices.Sort(cars)
+	cars = slices.Compact(cars)
+	switch {
+	case req.AllCars && len(cars) > 0:
+		writeError(w, http.StatusBadRequest, "bad_request", "all_cars can't be combined with car ids")
+		return
+	case req.AllCars:
+		claims.AllCars = true
+	case len(cars) == 1:
+		claims.CarID = cars[0]
+	default:
+		claims.CarIDs = cars
+	}
+	single := !claims.AllCars && len(claims.CarIDs) == 0
+	if claims.Dest != nil && !single {
+		writeError(w, http.StatusBadRequest, "bad_request", "dest requires a single car")
+		return
+	}
+	if claims.Dest == nil && single {
+		// Fall back to the destination of the route the car is currently navigating to
+		if st, _ := h.Store.GetSnapshot(claims.CarID); st.Route != nil && st.Route.Dest != nil {
+			claims.Dest = &auth.ShareDest{Lat: st.Route.Dest.Lat, Lon: st.Route.Dest.Lon}
+		}
+	}
+	if claims.Dest != nil {
+		claims.ArrivalRadiusM = h.ArrivalRadiusM
+		if req.ArrivalRadiusM != nil {
+			if *req.ArrivalRadiusM <= 0 {
+				writeError(w, http.StatusBadRequest, "bad_request", "arrival_radius_m must be positive")
+				return
+			}
+			claims.ArrivalRadiusM = *req.ArrivalRadiusM
+		}
+	}
+	now := time.Now()
+	tok, exp, err := auth.CreateShareToken(now, ttl, claims, h.Keys.SignJWT)
 	if err != nil {
 		log.Error().Err(err).Msg("sign share token")
 		writeError(w, http.StatusInternalServerError, "internal_error", "failed to sign token")
 		return
 	}
-	writeJSON(w, http.StatusOK, createShareResp{Token: tok})
+	if h.Shares != nil {
+		share := shares.Share{JTI: claims.ID, CarID: claims.CarID, CarIDs: claims.CarIDs, AllCars: claims.AllCars, CreatedAt: now, ExpiresAt: exp, Label: req.Label, Scopes: req.Scopes}
+		if err := h.Shares.Add(share); err != nil {
+			// The share is still usable, it just won't survive a restart
+			log.Error().Err(err).Str("jti", claims.ID).Msg("persist share")
+		}
+	}
+	metrics.SharesIssued.Inc()
+	writeJSON(w, http.StatusOK, createShareResp{Token: tok, JTI: claims.ID, ExpiresAt: exp})
+}
+
+func (h *AdminHandlers) handleListShares(w http.ResponseWriter, r *http.Request) {
+	list := []shares.Share{}
+	if h.Shares != nil {
+		list = h.Shares.List()
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"shares": list})
+}
+
+func (h *AdminHandlers) handleRevokeShare(w http.ResponseWriter, r *http.Request) {
+	jti := chi.URLParam(r, "jti")
+	if h.Shares == nil {
+		writeError(w, http.StatusNotFound, "not_found", "share not found")
+		return
+	}
+	if err := h.Shares.Revoke(jti); errors.Is(err, shares.ErrNotFound) {
+		writeError(w, http.StatusNotFound, "not_found", "share not found")
+		return
+	} else if err != nil {
+		// Revocation is effective in memory even when persisting it failed
+		log.Error().Err(err).Str("jti", jti).Msg("persist share revocation")
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *AdminHandlers) handleListZones(w http.ResponseWriter, r *http.Request) {
+	list := []privacy.Zone{}
+	if h.Zones != nil {
+		list = h.Zones.List()
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"zones": list})
+}
+
+func (h *AdminHandlers) handleCreateZone(w http.ResponseWriter, r *http.Request) {
+	if h.Zones == nil {
+		writeError(w, http.StatusNotImplemented, "not_implemented", "privacy zones disabled")
+		return
+	}
+	var zone privacy.Zone
+	if err := json.NewDecoder(r.Body).Decode(&zone); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", "invalid json")
+		return
+	}
+	if err := zone.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	zone, err := h.Zones.Add(zone)
+	if err != nil {
+		// The zone is applied, it just won't survive a restart
+		log.Error().Err(err).Str("id", zone.ID).Msg("persist privacy zone")
+	}
+	writeJSON(w, http.StatusOK, zone)
+}
+
+func (h *AdminHandlers) handleDeleteZone(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if h.Zones == nil {
+		writeError(w, http.StatusNotFound, "not_found", "privacy zone not found")
+		return
+	}
+	if err := h.Zones.Delete(id); errors.Is(err, privacy.ErrNotFound) {
+		writeError(w, http.StatusNotFound, "not_found", "privacy zone not found")
+		return
+	} else if err != nil {
+		log.Error().Err(err).Str("id", id).Msg("persist privacy zone removal")
+	}
+	w.WriteHeader(http.StatusNoContent)
 }
 
 func (h *AdminHandlers) handleListCars(w http.ResponseWriter, r *http.Request) {
-	cars := h.Store.ListCars()
-	writeJSON(w, http.StatusOK, map[string]any{"cars": cars})
+	resp := map[string]any{"cars": h.Store.ListCars()}
+	if h.Dispatcher != nil {
+		resp["connected"] = h.Dispatcher.Connected()
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleStreamStats reports how stream subscribers keep up, for monitoring.
+func (h *AdminHandlers) handleStreamStats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, h.Hub.Stats())
+}
+
+// handleChargingSessions lists the recent charging sessions of a car, newest first.
+func (h *AdminHandlers) handleChargingSessions(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", "invalid id")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"sessions": h.Store.ChargingSessions(id)})
+}
+
+// handleTrips lists the recent trips of a car, newest first.
+func (h *AdminHandlers) handleTrips(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", "invalid id")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"trips": h.Store.Trips(id)})
 }
 
 // handleStream provides Server-Sent Events for the selected car ID for admin users.
@@ -92,18 +282,61 @@ func (h *AdminHandlers) handleStream(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	flusher, ok := setSSEHeaders(w)
+	sink, ok := newSSESink(w)
 	if !ok {
 		writeError(w, http.StatusInternalServerError, "internal_error", "no flusher")
 		return
 	}
 
-	if ok := sendInitialSnapshot(w, flusher, h.Store, id); !ok {
+	opts := streamOptions{heartbeat: h.Heartbeat}
+	sub, ok := openStream(sink, r.Header.Get("Last-Event-ID"), h.Store, h.Hub, []int64{id}, opts)
+	if !ok {
 		return
 	}
 
 	ctx, cancel := context.WithCancel(r.Context())
 	defer cancel()
 
-	sseLoop(ctx, w, flusher, h.Hub, id, h.Heartbeat)
+	streamLoop(ctx, sink, h.Store, h.Hub, []int64{id}, sub, opts)
+}
+
+// handleWebSocket serves the same stream as handleStream over a WebSocket.
+func (h *AdminHandlers) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", "invalid id")
+		return
+	}
+	serveWebSocket(r.Context(), w, r, h.AllowedOrigins, h.Store, h.Hub, []int64{id}, streamOptions{heartbeat: h.Heartbeat})
+}
+
+// handleFleetStream streams every car at once: a combined snapshot of the fleet, followed by
+// car tagged deltas and a car_added event whenever a new car reports for the first time.
+func (h *AdminHandlers) handleFleetStream(w http.ResponseWriter, r *http.Request) {
+	sink, ok := newSSESink(w)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "internal_error", "no flusher")
+		return
+	}
+	opts := h.fleetStreamOptions()
+	sub, ok := openStream(sink, r.Header.Get("Last-Event-ID"), h.Store, h.Hub, nil, opts)
+	if !ok {
+		return
+	}
+	streamLoop(r.Context(), sink, h.Store, h.Hub, nil, sub, opts)
+}
+
+// handleFleetWebSocket serves the same stream as handleFleetStream over a WebSocket.
+func (h *AdminHandlers) handleFleetWebSocket(w http.ResponseWriter, r *http.Request) {
+	serveWebSocket(r.Context(), w, r, h.AllowedOrigins, h.Store, h.Hub, nil, h.fleetStreamOptions())
+}
+
+func (h *AdminHandlers) fleetStreamOptions() streamOptions {
+	return streamOptions{
+		heartbeat: h.Heartbeat,
+		carAdded:  true,
+		snapshot: func(sink eventSink, id uint64) bool {
+			return sendFleetSnapshot(sink, h.Store, id)
+		},
+	}
 }
@@ -6,12 +6,18 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/auth"
 	"github.com/mcuelenaere/where-is-maurus/backend/internal/keys"
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/privacy"
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/shares"
 	"github.com/mcuelenaere/where-is-maurus/backend/internal/state"
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/stream"
 )
 
 func TestAdminCreateShare_NoCFMiddleware(t *testing.T) {
@@ -39,3 +45,387 @@ func TestAdminCreateShare_NoCFMiddleware(t *testing.T) {
 		t.Fatalf("missing token")
 	}
 }
+
+func TestAdminCreateShare_InfersDestinationFromRoute(t *testing.T) {
+	km, err := keys.NewManager(context.Background(), 0)
+	if err != nil {
+		t.Fatalf("keys: %v", err)
+	}
+	st := state.NewStore()
+	st.UpdateRoute(1, time.Now().UnixMilli(), &state.Dest{Lat: 51.05, Lon: 3.72}, 10, 5)
+	adm := &AdminHandlers{CF: nil, Keys: km, Store: st, TokenTTL: time.Minute, ArrivalRadiusM: 250}
+
+	r := NewRouter(nil)
+	r.Group(func(r chi.Router) { adm.Routes(r) })
+
+	body, _ := json.Marshal(map[string]any{"car_id": 1})
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/shares", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp map[string]string
+	_ = json.Unmarshal(w.Body.Bytes(), &resp)
+	tok, err := auth.VerifyShareToken(resp["token"], km.VerifyJWT)
+	if err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	claims, err := auth.ParseShareClaims(tok)
+	if err != nil {
+		t.Fatalf("claims: %v", err)
+	}
+	if claims.Dest == nil || claims.Dest.Lat != 51.05 || claims.ArrivalRadiusM != 250 {
+		t.Fatalf("expected destination inferred from route, got %+v", claims)
+	}
+}
+
+func TestAdminCreateShare_MultipleCars(t *testing.T) {
+	km, err := keys.NewManager(context.Background(), 0)
+	if err != nil {
+		t.Fatalf("keys: %v", err)
+	}
+	st := state.NewStore()
+	st.UpdateRoute(1, time.Now().UnixMilli(), &state.Dest{Lat: 51.05, Lon: 3.72}, 10, 5)
+	adm := &AdminHandlers{CF: nil, Keys: km, Store: st, TokenTTL: time.Minute, ArrivalRadiusM: 250}
+	r := NewRouter(nil)
+	r.Group(func(r chi.Router) { adm.Routes(r) })
+
+	create := func(req map[string]any) (int, auth.ShareClaims) {
+		body, _ := json.Marshal(req)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/shares", bytes.NewReader(body)))
+		if w.Code != http.StatusOK {
+			return w.Code, auth.ShareClaims{}
+		}
+		var resp map[string]string
+		_ = json.Unmarshal(w.Body.Bytes(), &resp)
+		tok, err := auth.VerifyShareToken(resp["token"], km.VerifyJWT)
+		if err != nil {
+			t.Fatalf("verify: %v", err)
+		}
+		claims, err := auth.ParseShareClaims(tok)
+		if err != nil {
+			t.Fatalf("claims: %v", err)
+		}
+		return w.Code, claims
+	}
+
+	// the route of car 1 isn't used as destination for the whole family
+	code, claims := create(map[string]any{"car_id": 1, "car_ids": []int64{2, 1}})
+	if code != http.StatusOK || len(claims.CarIDs) != 2 || claims.CarIDs[0] != 1 || claims.CarIDs[1] != 2 || claims.Dest != nil {
+		t.Fatalf("unexpected claims: %d %+v", code, claims)
+	}
+	if code, claims = create(map[string]any{"car_ids": []int64{1}}); code != http.StatusOK || claims.CarID != 1 || claims.CarIDs != nil || claims.Dest == nil {
+		t.Fatalf("expected single car share, got %d %+v", code, claims)
+	}
+	if code, claims = create(map[string]any{"all_cars": true}); code != http.StatusOK || !claims.AllCars || claims.Cars() != nil {
+		t.Fatalf("expected all cars share, got %d %+v", code, claims)
+	}
+	for _, req := range []map[string]any{
+		{"all_cars": true, "car_id": 1},
+		{"car_ids": []int64{1, 2}, "dest": map[string]float64{"lat": 1, "lon": 2}},
+	} {
+		if code, _ := create(req); code != http.StatusBadRequest {
+			t.Fatalf("expected 400 for %v, got %d", req, code)
+		}
+	}
+}
+
+func TestAdminRevokeShare(t *testing.T) {
+	km := newTestKeys(t)
+	reg, _ := shares.NewRegistry("")
+	st := state.NewStore()
+	hub := stream.NewHub()
+	adm := &AdminHandlers{CF: nil, Keys: km, Shares: reg, Store: st, Hub: hub, TokenTTL: time.Minute}
+	pub := &PublicHandlers{Keys: km, Shares: reg, Store: st, Hub: hub, CookieDomain: "localhost", Heartbeat: time.Second}
+
+	r := NewRouter(nil)
+	r.Group(func(r chi.Router) { adm.Routes(r) })
+	r.Group(func(r chi.Router) { pub.Routes(r) })
+
+	body, _ := json.Marshal(map[string]any{"car_id": 1, "label": "for mom"})
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/shares", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	var created createShareResp
+	_ = json.Unmarshal(w.Body.Bytes(), &created)
+	if created.JTI == "" {
+		t.Fatalf("expected jti in response: %s", w.Body.String())
+	}
+
+	// share is listed
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/admin/shares", nil))
+	var listed struct {
+		Shares []shares.Share `json:"shares"`
+	}
+	_ = json.Unmarshal(w.Body.Bytes(), &listed)
+	if len(listed.Shares) != 1 || listed.Shares[0].JTI != created.JTI || listed.Shares[0].Label != "for mom" {
+		t.Fatalf("unexpected shares listed: %s", w.Body.String())
+	}
+
+	// open a stream using the share
+	sseReq := httptest.NewRequest(http.MethodGet, "/api/v1/stream", nil)
+	sseReq.AddCookie(&http.Cookie{Name: auth.CookieName, Value: created.Token})
+	sseW := newSyncRecorder()
+	done := make(chan struct{})
+	go func() {
+		r.ServeHTTP(sseW, sseReq)
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/api/v1/admin/shares/"+created.JTI, nil))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d: %s", w.Code, w.Body.String())
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("expected stream to close after revocation")
+	}
+	if !bytes.Contains(sseW.Snapshot(), []byte("event: revoked\n")) {
+		t.Fatalf("expected revoked event; got: %s", sseW.Snapshot())
+	}
+
+	// token is refused afterwards
+	body, _ = json.Marshal(map[string]string{"token": created.Token})
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/session", bytes.NewReader(body)))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for revoked share, got %d", w.Code)
+	}
+
+	// unknown share
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/api/v1/admin/shares/unknown", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", w.Code)
+	}
+}
+
+func TestAdminRevokeShare_SurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	// start brings up a server with the keyring and shares persisted in dir, as after a restart
+	start := func() http.Handler {
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		fs, err := keys.NewFileStore(filepath.Join(dir, "keys"), "secret")
+		if err != nil {
+			t.Fatalf("keyring: %v", err)
+		}
+		km, err := keys.NewManager(ctx, 0, keys.WithStore(fs))
+		if err != nil {
+			t.Fatalf("keys: %v", err)
+		}
+		reg, err := shares.NewRegistry(filepath.Join(dir, "shares.json"))
+		if err != nil {
+			t.Fatalf("shares: %v", err)
+		}
+		st := state.NewStore()
+		hub := stream.NewHub()
+		r := NewRouter(nil)
+		r.Group(func(r chi.Router) {
+			(&AdminHandlers{Keys: km, Shares: reg, Store: st, Hub: hub, TokenTTL: time.Hour}).Routes(r)
+		})
+		r.Group(func(r chi.Router) {
+			(&PublicHandlers{Keys: km, Shares: reg, Store: st, Hub: hub, CookieDomain: "localhost", Heartbeat: time.Second}).Routes(r)
+		})
+		return r
+	}
+	session := func(r http.Handler, token string) int {
+		body, _ := json.Marshal(map[string]string{"token": token})
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/session", bytes.NewReader(body)))
+		return w.Code
+	}
+
+	r := start()
+	var created [2]createShareResp
+	for i := range created {
+		body, _ := json.Marshal(map[string]any{"car_id": 1})
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/shares", bytes.NewReader(body)))
+		_ = json.Unmarshal(w.Body.Bytes(), &created[i])
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/api/v1/admin/shares/"+created[0].JTI, nil))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d: %s", w.Code, w.Body.String())
+	}
+
+	r = start()
+	if code := session(r, created[0].Token); code != http.StatusUnauthorized {
+		t.Fatalf("expected the revoked share to stay revoked after a restart, got %d", code)
+	}
+	if code := session(r, created[1].Token); code != http.StatusOK {
+		t.Fatalf("expected the other share to keep working after a restart, got %d", code)
+	}
+}
+
+func TestAdminChargingSessions(t *testing.T) {
+	st := state.NewStore()
+	st.UpdatePluggedIn(1, 0, true)
+	st.UpdateChargingState(1, 0, "Charging")
+	st.UpdateChargerPower(1, 1000, 11)
+	adm := &AdminHandlers{CF: nil, Keys: newTestKeys(t), Store: st, TokenTTL: time.Minute}
+
+	r := NewRouter(nil)
+	r.Group(func(r chi.Router) { adm.Routes(r) })
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/admin/cars/1/charging-sessions", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Sessions []state.ChargingSession `json:"sessions"`
+	}
+	_ = json.Unmarshal(w.Body.Bytes(), &resp)
+	if len(resp.Sessions) != 1 || resp.Sessions[0].PeakPowerKW != 11 || resp.Sessions[0].EndTS != 0 {
+		t.Fatalf("expected the ongoing session, got %s", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/admin/cars/x/charging-sessions", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for invalid id, got %d", w.Code)
+	}
+}
+
+func TestAdminTrips(t *testing.T) {
+	st := state.NewStore()
+	st.UpdateShiftState(1, 0, "D")
+	st.UpdateShiftState(1, 60_000, "P")
+	adm := &AdminHandlers{CF: nil, Keys: newTestKeys(t), Store: st, TokenTTL: time.Minute}
+
+	r := NewRouter(nil)
+	r.Group(func(r chi.Router) { adm.Routes(r) })
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/admin/cars/1/trips", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Trips []state.Trip `json:"trips"`
+	}
+	_ = json.Unmarshal(w.Body.Bytes(), &resp)
+	if len(resp.Trips) != 1 || resp.Trips[0].EndTS != 60_000 || resp.Trips[0].DurationS != 60 {
+		t.Fatalf("expected the finished trip, got %s", w.Body.String())
+	}
+}
+
+func TestAdminPrivacyZones(t *testing.T) {
+	zones, _ := privacy.NewZones("")
+	adm := &AdminHandlers{CF: nil, Keys: newTestKeys(t), Zones: zones, Store: state.NewStore(), TokenTTL: time.Minute}
+
+	r := NewRouter(nil)
+	r.Group(func(r chi.Router) { adm.Routes(r) })
+
+	body, _ := json.Marshal(map[string]any{"name": "home", "center": map[string]any{"lat": 51.05, "lon": 3.72}, "radius_m": 200})
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/admin/privacy-zones", bytes.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var created privacy.Zone
+	_ = json.Unmarshal(w.Body.Bytes(), &created)
+	if created.ID == "" || created.Mode != privacy.ModeHide {
+		t.Fatalf("unexpected zone: %s", w.Body.String())
+	}
+
+	body, _ = json.Marshal(map[string]any{"radius_m": 200})
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/admin/privacy-zones", bytes.NewReader(body)))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for zone without shape, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/admin/privacy-zones", nil))
+	var listed struct {
+		Zones []privacy.Zone `json:"zones"`
+	}
+	_ = json.Unmarshal(w.Body.Bytes(), &listed)
+	if len(listed.Zones) != 1 || listed.Zones[0].ID != created.ID {
+		t.Fatalf("unexpected zones listed: %s", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/api/v1/admin/privacy-zones/"+created.ID, nil))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/api/v1/admin/privacy-zones/"+created.ID, nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for deleted zone, got %d", w.Code)
+	}
+}
+
+func TestAdminFleetStream(t *testing.T) {
+	st := state.NewStore()
+	hub := stream.NewHub()
+	st.SetNotifier(hub.Broadcast)
+	now := time.Now().UnixMilli()
+	st.UpdateDisplayNameSilently(2, now, "Red")
+	st.UpdateSpeed(1, now, 10)
+	adm := &AdminHandlers{Store: st, Hub: hub, Heartbeat: time.Second}
+	r := NewRouter(nil)
+	r.Group(func(r chi.Router) { adm.Routes(r) })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/admin/stream", nil).WithContext(ctx)
+	w := newSyncRecorder()
+	done := make(chan struct{})
+	go func() {
+		r.ServeHTTP(w, req)
+		close(done)
+	}()
+	time.Sleep(30 * time.Millisecond)
+	hub.Broadcast(3, "delta", st.UpdateSpeed(3, time.Now().UnixMilli(), 30))
+	time.Sleep(30 * time.Millisecond)
+	cancel()
+	<-done
+
+	frames := strings.Split(strings.TrimSpace(string(w.Snapshot())), "\n\n")
+	var snap struct {
+		Cars []struct {
+			CarID       int64  `json:"car_id"`
+			DisplayName string `json:"display_name"`
+		} `json:"cars"`
+	}
+	_, data, _ := strings.Cut(frames[0], "event: snapshot\ndata: ")
+	if err := json.Unmarshal([]byte(data), &snap); err != nil {
+		t.Fatalf("expected combined snapshot first: %v; got: %s", err, frames[0])
+	}
+	if len(snap.Cars) != 2 || snap.Cars[0].CarID != 1 || snap.Cars[0].DisplayName != "Car 1" || snap.Cars[1].DisplayName != "Red" {
+		t.Fatalf("unexpected fleet snapshot: %+v", snap)
+	}
+	if len(frames) < 3 || !strings.Contains(frames[1], "event: car_added\ndata: {\"car_id\":3,") || !strings.Contains(frames[len(frames)-1], "event: delta\ndata: {\"car_id\":3,") {
+		t.Fatalf("expected car_added followed by the delta of the new car; got: %q", frames)
+	}
+}
+
+func TestAdminMetrics(t *testing.T) {
+	metrics := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { _, _ = w.Write([]byte("wim_up 1\n")) })
+	for _, c := range []struct {
+		name string
+		cf   *auth.CFValidator
+		code int
+	}{
+		{"cf disabled", nil, http.StatusOK},
+		{"missing assertion", &auth.CFValidator{}, http.StatusUnauthorized},
+	} {
+		r := NewRouter(nil)
+		r.Group(func(r chi.Router) { (&AdminHandlers{CF: c.cf, Store: state.NewStore(), Metrics: metrics}).Routes(r) })
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		if w.Code != c.code {
+			t.Fatalf("%s: expected %d, got %d", c.name, c.code, w.Code)
+		}
+	}
+}
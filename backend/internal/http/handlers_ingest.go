@@ -0,0 +1,108 @@
+package httpx
+
+import (
+	"crypto/subtle"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/ingest"
+	"github.com/rs/zerolog/hlog"
+)
+
+// maxIngestBody bounds pushed messages; a single location is a few hundred bytes.
+const maxIngestBody = 64 << 10
+
+// IngestHandlers accept locations pushed by trackers other than TeslaMate, using the OwnTracks
+// HTTP or the OsmAnd protocol.
+type IngestHandlers struct {
+	// Keys holds the API key of every car allowed to push, by car id
+	Keys       map[int64]string
+	Dispatcher *ingest.Dispatcher
+}
+
+func (h *IngestHandlers) Routes(r chi.Router) {
+	r.Post("/api/v1/ingest/{id}", h.handleIngest)
+	// OsmAnd's online tracking only makes GET requests
+	r.Get("/api/v1/ingest/{id}", h.handleIngest)
+}
+
+// handleIngest accepts an OwnTracks JSON body or OsmAnd query (or form) parameters.
+func (h *IngestHandlers) handleIngest(w http.ResponseWriter, r *http.Request) {
+	carID, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", "invalid car id")
+		return
+	}
+	if !h.authorize(carID, r) {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "invalid ingest key")
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxIngestBody)
+
+	now := time.Now()
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	ownTracks := r.Method == http.MethodPost && mediaType == "application/json"
+	var events []ingest.Event
+	if ownTracks {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusRequestEntityTooLarge, "too_large", "body too large")
+			return
+		}
+		events, err = ingest.ParseOwnTracks(carID, body, now)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+			return
+		}
+	} else {
+		if err := r.ParseForm(); err != nil {
+			writeError(w, http.StatusBadRequest, "bad_request", "invalid form")
+			return
+		}
+		events, err = ingest.ParseOsmAnd(carID, r.Form, now)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+			return
+		}
+	}
+	dropped := 0
+	for _, ev := range events {
+		if !h.Dispatcher.DispatchInOrder(ev) {
+			dropped++
+		}
+	}
+	hlog.FromRequest(r).Debug().Int64("car_id", carID).Int("events", len(events)).Int("dropped", dropped).Msg("ingest")
+
+	if ownTracks {
+		// OwnTracks expects a (possibly empty) list of messages for the device in return
+		writeJSON(w, http.StatusOK, []any{})
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// authorize checks the key of the car, which is taken from a bearer token, the basic auth
+// password (OwnTracks), the key query parameter (OsmAnd) or the id parameter (Traccar Client,
+// whose device identifier is set to the key).
+func (h *IngestHandlers) authorize(carID int64, r *http.Request) bool {
+	want, ok := h.Keys[carID]
+	if !ok || want == "" {
+		return false
+	}
+	var got string
+	if bearer, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); found {
+		got = bearer
+	} else if _, password, found := r.BasicAuth(); found {
+		got = password
+	} else if key := r.URL.Query().Get("key"); key != "" {
+		got = key
+	} else {
+		got = r.URL.Query().Get("id")
+	}
+	return subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+}
@@ -0,0 +1,124 @@
+package httpx
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/ingest"
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/state"
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/stream"
+)
+
+func TestIngest(t *testing.T) {
+	st := state.NewStore()
+	hub := stream.NewHub()
+	ing := &IngestHandlers{Keys: map[int64]string{3: "s3cret", 4: "other"}, Dispatcher: ingest.NewDispatcher(st, hub)}
+	r := NewRouter(nil)
+	r.Group(func(r chi.Router) { ing.Routes(r) })
+
+	do := func(method, target, body string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// the key must belong to the car
+	for name, c := range map[string]struct {
+		target string
+		header http.Header
+	}{
+		"no key":        {"/api/v1/ingest/3?lat=1&lon=2", nil},
+		"wrong key":     {"/api/v1/ingest/3?lat=1&lon=2&key=nope", nil},
+		"other car key": {"/api/v1/ingest/3?lat=1&lon=2", http.Header{"Authorization": {"Bearer other"}}},
+		"unknown car":   {"/api/v1/ingest/5?lat=1&lon=2&key=s3cret", nil},
+	} {
+		if rr := do(http.MethodPost, c.target, "", c.header); rr.Code != http.StatusUnauthorized {
+			t.Fatalf("%s: expected 401, got %d", name, rr.Code)
+		}
+	}
+
+	// OwnTracks with basic auth
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/ingest/3", strings.NewReader(`{"_type":"location","lat":51.05,"lon":3.72,"vel":54,"batt":64}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth("phone", "s3cret")
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || strings.TrimSpace(rr.Body.String()) != "[]" {
+		t.Fatalf("unexpected OwnTracks response: %d %s", rr.Code, rr.Body.String())
+	}
+	snap, _ := st.GetSnapshot(3)
+	if snap.Location == nil || snap.Location.Lat != 51.05 || snap.Location.SpeedKPH != 54 || snap.Battery == nil || snap.Battery.SOCPct != 64 {
+		t.Fatalf("unexpected state after OwnTracks: %+v %+v", snap.Location, snap.Battery)
+	}
+
+	// OsmAnd GET with the key in the query, Traccar Client with the key as device id
+	if rr := do(http.MethodGet, "/api/v1/ingest/3?key=s3cret&lat=51.06&lon=3.73&speed=10", "", nil); rr.Code != http.StatusOK {
+		t.Fatalf("unexpected OsmAnd response: %d %s", rr.Code, rr.Body.String())
+	}
+	if snap, _ = st.GetSnapshot(3); snap.Location.Lat != 51.06 || snap.Location.SpeedKPH != 18.52 {
+		t.Fatalf("unexpected state after OsmAnd: %+v", snap.Location)
+	}
+	if rr := do(http.MethodPost, "/api/v1/ingest/3?id=s3cret&lat=51.07&lon=3.74", "", nil); rr.Code != http.StatusOK {
+		t.Fatalf("unexpected Traccar response: %d %s", rr.Code, rr.Body.String())
+	}
+
+	// form encoded body with a bearer token
+	form := http.Header{"Authorization": {"Bearer other"}, "Content-Type": {"application/x-www-form-urlencoded"}}
+	if rr := do(http.MethodPost, "/api/v1/ingest/4", "lat=50.85&lon=4.35&bearing=45", form); rr.Code != http.StatusOK {
+		t.Fatalf("unexpected form response: %d %s", rr.Code, rr.Body.String())
+	}
+	if snap, _ = st.GetSnapshot(4); snap.Location == nil || snap.Location.Lat != 50.85 || snap.Location.Heading != 45 {
+		t.Fatalf("unexpected state after form post: %+v", snap.Location)
+	}
+
+	// invalid data
+	if rr := do(http.MethodPost, "/api/v1/ingest/3?key=s3cret&lat=95&lon=2", "", nil); rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for invalid coordinates, got %d", rr.Code)
+	}
+	if rr := do(http.MethodPost, "/api/v1/ingest/3", "{", http.Header{"Authorization": {"Bearer s3cret"}, "Content-Type": {"application/json"}}); rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for invalid json, got %d", rr.Code)
+	}
+}
+
+func TestIngest_DropsBufferedPoints(t *testing.T) {
+	st := state.NewStore()
+	ing := &IngestHandlers{Keys: map[int64]string{3: "s3cret"}, Dispatcher: ingest.NewDispatcher(st, stream.NewHub())}
+	r := NewRouter(nil)
+	r.Group(func(r chi.Router) { ing.Routes(r) })
+	push := func(ts time.Time, lat float64) {
+		target := fmt.Sprintf("/api/v1/ingest/3?key=s3cret&lat=%v&lon=3.72&speed=10&timestamp=%d", lat, ts.Unix())
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, target, nil))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("unexpected response: %d %s", rr.Code, rr.Body.String())
+		}
+	}
+
+	now := time.Now().Truncate(time.Second)
+	push(now, 51.05)
+	// a tracker back online flushes what it buffered while offline
+	push(now.Add(-2*time.Minute), 51.01)
+	push(now.Add(-time.Minute), 51.02)
+
+	snap, hist := st.GetSnapshot(3)
+	if snap.TSMS != now.UnixMilli() || snap.Location.Lat != 51.05 {
+		t.Fatalf("expected buffered points not to move the state back: %d %+v", snap.TSMS, snap.Location)
+	}
+	if len(hist.Path) != 1 || len(hist.SpeedKPH) != 1 {
+		t.Fatalf("expected buffered points to stay out of the history: %+v %+v", hist.Path, hist.SpeedKPH)
+	}
+
+	push(now.Add(time.Second), 51.06)
+	if snap, _ = st.GetSnapshot(3); snap.Location.Lat != 51.06 {
+		t.Fatalf("expected newer points to be applied: %+v", snap.Location)
+	}
+}
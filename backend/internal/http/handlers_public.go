@@ -3,27 +3,44 @@ package httpx
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/lestrrat-go/jwx/v3/jwt"
 	"github.com/mcuelenaere/where-is-maurus/backend/internal/auth"
 	"github.com/mcuelenaere/where-is-maurus/backend/internal/keys"
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/metrics"
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/privacy"
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/shares"
 	"github.com/mcuelenaere/where-is-maurus/backend/internal/state"
 	"github.com/mcuelenaere/where-is-maurus/backend/internal/stream"
+	"github.com/rs/zerolog/log"
 )
 
 type PublicHandlers struct {
 	Keys         *keys.Manager
+	Shares       *shares.Registry
+	Zones        *privacy.Zones
 	Store        *state.Store
 	Hub          *stream.Hub
 	CookieDomain string
 	Heartbeat    time.Duration
+	// AllowedOrigins are the cross-origin pages allowed to open a WebSocket
+	AllowedOrigins []string
+
+	// arrived maps the jti of shares whose destination has been reached to their token expiry
+	arrived sync.Map
 }
 
 func (h *PublicHandlers) Routes(r chi.Router) {
 	r.Post("/api/v1/session", h.handleSession)
 	r.Get("/api/v1/stream", h.handleStream)
+	r.Get("/api/v1/ws", h.handleWebSocket)
+	r.Get("/.well-known/jwks.json", h.handleJWKS)
 	r.Get("/healthz", func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusOK) })
 }
 
@@ -40,9 +57,9 @@ func (h *PublicHandlers) handleSession(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusBadRequest, "bad_request", "invalid json")
 		return
 	}
-	tok, err := auth.VerifyShareToken(req.Token, h.Keys.VerifyJWT)
+	tok, err := h.verifyShare(req.Token)
 	if err != nil {
-		writeError(w, http.StatusUnauthorized, "unauthorized", "invalid token")
+		writeShareError(w, err, "invalid token")
 		return
 	}
 	exp, ok := tok.Expiration()
@@ -51,55 +68,136 @@ func (h *PublicHandlers) handleSession(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	auth.SetSessionCookie(w, h.CookieDomain, req.Token, exp)
+	metrics.SessionsCreated.Inc()
 	writeJSON(w, http.StatusOK, sessionResp{Ok: true})
 }
 
 func (h *PublicHandlers) handleStream(w http.ResponseWriter, r *http.Request) {
+	claims, exp, filter, ok := h.authorizeStream(w, r)
+	if !ok {
+		return
+	}
+	sink, ok := newSSESink(w)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "internal_error", "no flusher")
+		return
+	}
+	opts := h.streamOptions(claims, exp, filter)
+	sub, ok := openStream(sink, r.Header.Get("Last-Event-ID"), h.Store, h.Hub, claims.Cars(), opts)
+	if !ok {
+		return
+	}
+
+	// Stop streaming when the JWT expires by setting a deadline on the context,
+	// otherwise use a cancellable context.
+	ctx, cancel := context.WithDeadline(r.Context(), exp)
+	defer cancel()
+	streamLoop(ctx, sink, h.Store, h.Hub, claims.Cars(), sub, opts)
+}
+
+// handleWebSocket serves the same stream as handleStream over a WebSocket.
+func (h *PublicHandlers) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	claims, exp, filter, ok := h.authorizeStream(w, r)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithDeadline(r.Context(), exp)
+	defer cancel()
+	serveWebSocket(ctx, w, r, h.AllowedOrigins, h.Store, h.Hub, claims.Cars(), h.streamOptions(claims, exp, filter))
+}
+
+// authorizeStream verifies the session cookie and returns the share claims, the session expiry
+// and the filter for what the viewer may see. On failure the error response has been written.
+func (h *PublicHandlers) authorizeStream(w http.ResponseWriter, r *http.Request) (auth.ShareClaims, time.Time, payloadFilter, bool) {
 	raw, err := auth.ReadSessionCookie(r)
 	if err != nil {
 		writeError(w, http.StatusUnauthorized, "unauthorized", "missing session")
-		return
+		return auth.ShareClaims{}, time.Time{}, nil, false
 	}
-	tok, err := auth.VerifyShareToken(raw, h.Keys.VerifyJWT)
+	tok, err := h.verifyShare(raw)
 	if err != nil {
-		writeError(w, http.StatusUnauthorized, "unauthorized", "invalid session")
-		return
+		writeShareError(w, err, "invalid session")
+		return auth.ShareClaims{}, time.Time{}, nil, false
 	}
 	exp, ok := tok.Expiration()
 	if !ok {
 		writeError(w, http.StatusUnauthorized, "unauthorized", "invalid session")
-		return
+		return auth.ShareClaims{}, time.Time{}, nil, false
+	}
+	claims, err := auth.ParseShareClaims(tok)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "invalid session")
+		return auth.ShareClaims{}, time.Time{}, nil, false
 	}
-	var carIDV any
-	_ = tok.Get("car_id", &carIDV)
-	var carID int64
-	switch v := carIDV.(type) {
-	case int64:
-		carID = v
-	case float64:
-		carID = int64(v)
-	case json.Number:
-		if f, err := v.Float64(); err == nil {
-			carID = int64(f)
+
+	// Share viewers only see the granted scopes, and never coordinates inside a privacy zone
+	var redact payloadFilter
+	if h.Zones != nil {
+		redact = func(_ string, payload map[string]any) bool {
+			h.Zones.Redact(payload)
+			return true
 		}
 	}
-	flusher, ok := setSSEHeaders(w)
-	if !ok {
-		writeError(w, http.StatusInternalServerError, "internal_error", "no flusher")
-		return
+	return claims, exp, chainFilters(scopeFilter(claims.Scopes), redact), true
+}
+
+func (h *PublicHandlers) streamOptions(claims auth.ShareClaims, exp time.Time, filter payloadFilter) streamOptions {
+	opts := streamOptions{heartbeat: h.Heartbeat, arrived: h.arrivalCheck(claims, exp), filter: filter}
+	if h.Shares != nil {
+		opts.revoked = h.Shares.Done(claims.ID)
 	}
+	return opts
+}
 
-	if ok := sendInitialSnapshot(w, flusher, h.Store, carID); !ok {
-		return
+// verifyShare validates a share token, rejecting shares that were revoked or whose destination was reached.
+func (h *PublicHandlers) verifyShare(raw string) (jwt.Token, error) {
+	return auth.VerifyShareToken(raw, h.Keys.VerifyJWT, h.checkNotRevoked, h.checkNotArrived)
+}
+
+func (h *PublicHandlers) checkNotRevoked(tok jwt.Token) error {
+	if h.Shares == nil {
+		return nil
 	}
+	if jti, ok := tok.JwtID(); ok && h.Shares.IsRevoked(jti) {
+		return shares.ErrRevoked
+	}
+	return nil
+}
 
-	// Stop streaming when the JWT expires by setting a deadline on the context,
-	// otherwise use a cancellable context.
-	ctx, cancel := context.WithDeadline(r.Context(), exp)
-	defer cancel()
-	sseLoop(ctx, w, flusher, h.Hub, carID, h.Heartbeat)
+// writeShareError maps share verification failures onto an error response.
+func writeShareError(w http.ResponseWriter, err error, msg string) {
+	switch {
+	case errors.Is(err, errArrived):
+		writeError(w, http.StatusGone, "arrived", "destination reached")
+	case errors.Is(err, shares.ErrRevoked):
+		writeError(w, http.StatusUnauthorized, "revoked", "share revoked")
+	default:
+		writeError(w, http.StatusUnauthorized, "unauthorized", msg)
+	}
 }
 
+// handleJWKS publishes the public keys share tokens can be verified with. The response may be
+// cached until the next key rotation; verifiers should refetch when they encounter an unknown kid.
+func (h *PublicHandlers) handleJWKS(w http.ResponseWriter, _ *http.Request) {
+	set, err := h.Keys.PublicKeys()
+	if err != nil {
+		log.Error().Err(err).Msg("public keys")
+		writeError(w, http.StatusInternalServerError, "internal_error", "failed to export keys")
+		return
+	}
+	maxAge := jwksMaxAgeNoRotation
+	if next := h.Keys.NextRotation(); !next.IsZero() {
+		maxAge = max(time.Until(next), 0)
+	}
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(maxAge.Seconds())))
+	w.Header().Set("Content-Type", "application/jwk-set+json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(set)
+}
+
+// jwksMaxAgeNoRotation is the JWKS cache lifetime when keys are never rotated.
+const jwksMaxAgeNoRotation = 24 * time.Hour
+
 func writeJSON(w http.ResponseWriter, status int, v any) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
@@ -7,15 +7,27 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/lestrrat-go/jwx/v3/jwk"
+	"github.com/lestrrat-go/jwx/v3/jwt"
 	"github.com/mcuelenaere/where-is-maurus/backend/internal/auth"
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/ingest"
 	"github.com/mcuelenaere/where-is-maurus/backend/internal/keys"
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/privacy"
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/shares"
 	"github.com/mcuelenaere/where-is-maurus/backend/internal/state"
 	"github.com/mcuelenaere/where-is-maurus/backend/internal/stream"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 // fake key manager for tests: generate once, no rotation
@@ -42,6 +54,41 @@ func TestHealthz(t *testing.T) {
 	}
 }
 
+func TestJWKSPublishesVerificationKeys(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	km, err := keys.NewManager(ctx, time.Hour)
+	if err != nil {
+		t.Fatalf("keys: %v", err)
+	}
+	pub := &PublicHandlers{Keys: km, Store: state.NewStore(), Hub: stream.NewHub(), CookieDomain: "localhost", Heartbeat: time.Second}
+	r := NewRouter(nil)
+	r.Group(func(r chi.Router) { pub.Routes(r) })
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	cc := w.Header().Get("Cache-Control")
+	if !strings.HasPrefix(cc, "public, max-age=") || cc == "public, max-age=0" {
+		t.Fatalf("unexpected Cache-Control %q", cc)
+	}
+	set, err := jwk.Parse(w.Body.Bytes())
+	if err != nil {
+		t.Fatalf("parse jwks: %v", err)
+	}
+
+	// share tokens can be verified using only the published set
+	tokStr, _, err := auth.CreateShareToken(time.Now(), time.Minute, auth.ShareClaims{CarID: 1}, km.SignJWT)
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	if _, err := jwt.Parse([]byte(tokStr), jwt.WithKeySet(set)); err != nil {
+		t.Fatalf("verify with published jwks: %v", err)
+	}
+}
+
 func TestSessionSetsCookie(t *testing.T) {
 	km := newTestKeys(t)
 	pub := &PublicHandlers{Keys: km, Store: state.NewStore(), Hub: stream.NewHub(), CookieDomain: "localhost", Heartbeat: time.Millisecond * 50}
@@ -49,7 +96,7 @@ func TestSessionSetsCookie(t *testing.T) {
 	r.Group(func(r chi.Router) { pub.Routes(r) })
 
 	// issue a share token
-	tokStr, exp, err := auth.CreateShareToken(time.Now(), time.Hour, 1, km.SignJWT)
+	tokStr, exp, err := auth.CreateShareToken(time.Now(), time.Hour, auth.ShareClaims{CarID: 1}, km.SignJWT)
 	if err != nil {
 		t.Fatalf("sign: %v", err)
 	}
@@ -79,7 +126,7 @@ func TestSSEHeartbeatWithoutMQTT(t *testing.T) {
 	r.Group(func(r chi.Router) { pub.Routes(r) })
 
 	// token for car 1
-	tokStr, _, err := auth.CreateShareToken(time.Now(), time.Minute, 1, km.SignJWT)
+	tokStr, _, err := auth.CreateShareToken(time.Now(), time.Minute, auth.ShareClaims{CarID: 1}, km.SignJWT)
 	if err != nil {
 		t.Fatalf("sign: %v", err)
 	}
@@ -122,6 +169,380 @@ func TestSSEHeartbeatWithoutMQTT(t *testing.T) {
 	}
 }
 
+func TestSSEArrivedClosesStream(t *testing.T) {
+	km := newTestKeys(t)
+	st := state.NewStore()
+	hub := stream.NewHub()
+	pub := &PublicHandlers{Keys: km, Store: st, Hub: hub, CookieDomain: "localhost", Heartbeat: time.Second}
+	r := NewRouter(nil)
+	r.Group(func(r chi.Router) { pub.Routes(r) })
+
+	st.UpdateLocation(1, time.Now().UnixMilli(), 51.0, 3.0, -1, -1, -1)
+	claims := auth.ShareClaims{CarID: 1, Dest: &auth.ShareDest{Lat: 51.05, Lon: 3.72}, ArrivalRadiusM: 200}
+	tokStr, _, err := auth.CreateShareToken(time.Now(), time.Minute, claims, km.SignJWT)
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+
+	sseReq := httptest.NewRequest(http.MethodGet, "/api/v1/stream", nil)
+	sseReq.AddCookie(&http.Cookie{Name: auth.CookieName, Value: tokStr})
+	sseW := newSyncRecorder()
+	done := make(chan struct{})
+	go func() {
+		r.ServeHTTP(sseW, sseReq)
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// move the car next to the destination
+	hub.Broadcast(1, "delta", st.UpdateLocation(1, time.Now().UnixMilli(), 51.0501, 3.7201, -1, -1, -1))
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("expected stream to close after arrival")
+	}
+	if !bytes.Contains(sseW.Snapshot(), []byte("event: arrived\n")) {
+		t.Fatalf("expected arrived event in SSE stream; got: %s", sseW.Snapshot())
+	}
+
+	// new viewers are refused
+	body, _ := json.Marshal(map[string]string{"token": tokStr})
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/session", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusGone {
+		t.Fatalf("expected 410 after arrival, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestArrivedSharesExpire(t *testing.T) {
+	pub := &PublicHandlers{}
+	now := time.Now()
+	pub.arrived.Store("expired", now.Add(-time.Minute))
+	pub.arrived.Store("valid", now.Add(time.Minute))
+	pub.pruneArrived(now)
+	if _, ok := pub.arrived.Load("expired"); ok {
+		t.Fatal("expected the expired share to be forgotten")
+	}
+	if _, ok := pub.arrived.Load("valid"); !ok {
+		t.Fatal("expected the share that hasn't expired to be remembered")
+	}
+}
+
+// feedsAll is a source feeding every car, emitting the given events.
+type feedsAll []ingest.Event
+
+func (f feedsAll) Run(ctx context.Context, emit func(ingest.Event)) error {
+	for _, ev := range f {
+		emit(ev)
+	}
+	return nil
+}
+
+func (feedsAll) Feeds(int64) bool { return true }
+
+func TestSSERestoredCarGoesOffline(t *testing.T) {
+	km := newTestKeys(t)
+	st := state.NewStore()
+	hub := stream.NewHub()
+	st.SetNotifier(hub.Broadcast)
+	pub := &PublicHandlers{Keys: km, Store: st, Hub: hub, CookieDomain: "localhost", Heartbeat: time.Second}
+	r := NewRouter(nil)
+	r.Group(func(r chi.Router) { pub.Routes(r) })
+
+	// restored from history, nothing arrived since
+	st.UpdateLocation(1, time.Now().UnixMilli(), 51.0, 3.0, -1, -1, -1)
+	tokStr, _, err := auth.CreateShareToken(time.Now(), time.Minute, auth.ShareClaims{CarID: 1}, km.SignJWT)
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sseReq := httptest.NewRequest(http.MethodGet, "/api/v1/stream", nil).WithContext(ctx)
+	sseReq.AddCookie(&http.Cookie{Name: auth.CookieName, Value: tokStr})
+	sseW := newSyncRecorder()
+	go r.ServeHTTP(sseW, sseReq)
+	time.Sleep(50 * time.Millisecond)
+
+	lost := ingest.ConnectionEvent{Header: ingest.Header{TS: time.Now().UnixMilli()}, Connected: false}
+	if err := ingest.NewDispatcher(st, hub).Run(ctx, feedsAll{lost}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for !bytes.Contains(sseW.Snapshot(), []byte(`"status":"offline"`)) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the viewer to learn the car is offline; got: %s", sseW.Snapshot())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !bytes.Contains(sseW.Snapshot(), []byte("event: status\n")) {
+		t.Fatalf("expected a status event; got: %s", sseW.Snapshot())
+	}
+}
+
+func TestSSELiveCarGoesOfflineWithBroker(t *testing.T) {
+	km := newTestKeys(t)
+	st := state.NewStore()
+	hub := stream.NewHub()
+	st.SetNotifier(hub.Broadcast)
+	pub := &PublicHandlers{Keys: km, Store: st, Hub: hub, CookieDomain: "localhost", Heartbeat: time.Second}
+	r := NewRouter(nil)
+	r.Group(func(r chi.Router) { pub.Routes(r) })
+
+	st.UpdateLocation(1, time.Now().UnixMilli(), 51.0, 3.0, -1, -1, -1)
+	tokStr, _, err := auth.CreateShareToken(time.Now(), time.Minute, auth.ShareClaims{CarID: 1}, km.SignJWT)
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sseReq := httptest.NewRequest(http.MethodGet, "/api/v1/stream", nil).WithContext(ctx)
+	sseReq.AddCookie(&http.Cookie{Name: auth.CookieName, Value: tokStr})
+	sseW := newSyncRecorder()
+	go r.ServeHTTP(sseW, sseReq)
+	time.Sleep(50 * time.Millisecond)
+
+	// the car is live, then the broker drops long before it could go stale
+	now := time.Now().UnixMilli()
+	speed := ingest.MetricEvent{Header: ingest.Header{CarID: 1, TS: now}, Metric: ingest.MetricSpeed, Value: 42}
+	lost := ingest.ConnectionEvent{Header: ingest.Header{TS: now}, Connected: false}
+	if err := ingest.NewDispatcher(st, hub).Run(ctx, feedsAll{speed, lost}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for !bytes.Contains(sseW.Snapshot(), []byte(`"status":"offline"`)) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the viewer to learn the broker dropped; got: %s", sseW.Snapshot())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	body := sseW.Snapshot()
+	if live := bytes.Index(body, []byte(`"status":"live"`)); live < 0 || live > bytes.Index(body, []byte(`"status":"offline"`)) {
+		t.Fatalf("expected the car to be live before going offline; got: %s", body)
+	}
+}
+
+func TestSSERedactsPrivacyZones(t *testing.T) {
+	km := newTestKeys(t)
+	st := state.NewStore()
+	hub := stream.NewHub()
+	zones, _ := privacy.NewZones("")
+	_, _ = zones.Add(privacy.Zone{Center: &privacy.Point{Lat: 51.05, Lon: 3.72}, RadiusM: 200})
+	pub := &PublicHandlers{Keys: km, Zones: zones, Store: st, Hub: hub, CookieDomain: "localhost", Heartbeat: time.Second}
+	r := NewRouter(nil)
+	r.Group(func(r chi.Router) { pub.Routes(r) })
+
+	// parked at home
+	st.UpdateLocation(1, time.Now().UnixMilli(), 51.0501, 3.7201, -1, -1, -1)
+	tokStr, _, err := auth.CreateShareToken(time.Now(), time.Minute, auth.ShareClaims{CarID: 1}, km.SignJWT)
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	sseReq := httptest.NewRequest(http.MethodGet, "/api/v1/stream", nil).WithContext(ctx)
+	sseReq.AddCookie(&http.Cookie{Name: auth.CookieName, Value: tokStr})
+	sseW := newSyncRecorder()
+	done := make(chan struct{})
+	go func() {
+		r.ServeHTTP(sseW, sseReq)
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// drive away from home
+	hub.Broadcast(1, "delta", st.UpdateLocation(1, time.Now().UnixMilli(), 51.10, 3.80, -1, -1, -1))
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	<-done
+
+	out := sseW.Snapshot()
+	if bytes.Contains(out, []byte("51.0501")) {
+		t.Fatalf("expected location inside the zone to be redacted; got: %s", out)
+	}
+	if !bytes.Contains(out, []byte(`"lat":51.1`)) {
+		t.Fatalf("expected location outside the zone to be streamed; got: %s", out)
+	}
+}
+
+func TestSSEResumesFromLastEventID(t *testing.T) {
+	km := newTestKeys(t)
+	st := state.NewStore()
+	hub := stream.NewHub()
+	pub := &PublicHandlers{Keys: km, Store: st, Hub: hub, CookieDomain: "localhost", Heartbeat: time.Second}
+	r := NewRouter(nil)
+	r.Group(func(r chi.Router) { pub.Routes(r) })
+	tokStr, _, err := auth.CreateShareToken(time.Now(), time.Minute, auth.ShareClaims{CarID: 1}, km.SignJWT)
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	connect := func(lastEventID string) []byte {
+		ctx, cancel := context.WithCancel(context.Background())
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/stream", nil).WithContext(ctx)
+		req.AddCookie(&http.Cookie{Name: auth.CookieName, Value: tokStr})
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		w := newSyncRecorder()
+		done := make(chan struct{})
+		go func() {
+			r.ServeHTTP(w, req)
+			close(done)
+		}()
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+		<-done
+		return w.Snapshot()
+	}
+
+	// the snapshot carries the id to resume from
+	out := connect("")
+	idLine, _, _ := bytes.Cut(out, []byte("\n"))
+	if !bytes.HasPrefix(idLine, []byte("id: ")) || !bytes.Contains(out, []byte("event: snapshot\n")) {
+		t.Fatalf("expected snapshot with id; got: %s", out)
+	}
+	lastID := string(bytes.TrimPrefix(idLine, []byte("id: ")))
+
+	// the car moves while the viewer is disconnected
+	hub.Broadcast(1, "delta", st.UpdateSpeed(1, time.Now().UnixMilli(), 42))
+
+	out = connect(lastID)
+	if bytes.Contains(out, []byte("event: snapshot\n")) || !bytes.Contains(out, []byte("event: delta\n")) {
+		t.Fatalf("expected only the missed delta to be replayed; got: %s", out)
+	}
+
+	// unknown ids fall back to a snapshot
+	out = connect("12345")
+	if !bytes.Contains(out, []byte("event: snapshot\n")) || bytes.Contains(out, []byte("event: delta\n")) {
+		t.Fatalf("expected snapshot for unknown Last-Event-ID; got: %s", out)
+	}
+}
+
+func TestSSELoopResyncsAndStopsOnDisconnect(t *testing.T) {
+	st := state.NewStore()
+	st.UpdateSpeed(1, time.Now().UnixMilli(), 42)
+	hub := stream.NewHub(stream.WithSlowPolicy(stream.PolicyDisconnect))
+	sub := hub.Subscribe(1)
+	sub.Resync <- struct{}{}
+
+	w := newSyncRecorder()
+	done := make(chan struct{})
+	go func() {
+		streamLoop(context.Background(), &sseSink{w: w, flusher: w}, st, hub, []int64{1}, sub, streamOptions{heartbeat: time.Minute})
+		close(done)
+	}()
+	// give the loop a chance to resync before overflowing the queue
+	time.Sleep(50 * time.Millisecond)
+	if out := w.Snapshot(); !bytes.Contains(out, []byte("event: snapshot\n")) || !bytes.Contains(out, []byte(`"speed_kph":42`)) {
+		t.Fatalf("expected fresh snapshot after resync; got: %s", out)
+	}
+	// flood the subscriber without it being able to keep up: the hub disconnects it
+	w.mu.Lock()
+	for range 64 {
+		hub.Broadcast(1, "delta", []byte(`{"ts_ms":1}`))
+	}
+	w.mu.Unlock()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("expected stream to end once disconnected")
+	}
+}
+
+func TestSSELoopSkipsFramesOfResyncSnapshot(t *testing.T) {
+	st := state.NewStore()
+	hub := stream.NewHub()
+	sub := hub.Subscribe(1)
+	hub.Broadcast(1, "delta", []byte(`{"speed_kph":10}`))
+	stale := <-sub.Ch
+	sub.Resync <- struct{}{}
+
+	w := newSyncRecorder()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	opts := streamOptions{heartbeat: time.Minute, snapshot: func(sink eventSink, id uint64) bool {
+		// a frame broadcast after the queue was drained, but before the snapshot was taken
+		sub.Ch <- stale
+		return sink.send(id, "snapshot", []byte(`{"speed_kph":10}`)) == nil
+	}}
+	go func() {
+		streamLoop(ctx, &sseSink{w: w, flusher: w}, st, hub, []int64{1}, sub, opts)
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	hub.Broadcast(1, "delta", []byte(`{"speed_kph":20}`))
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	<-done
+
+	out := w.Snapshot()
+	if !bytes.Contains(out, []byte("event: snapshot\n")) || !bytes.Contains(out, []byte(`"speed_kph":20`)) {
+		t.Fatalf("expected the snapshot followed by the newer delta; got: %s", out)
+	}
+	if n := bytes.Count(out, []byte("event: delta\n")); n != 1 {
+		t.Fatalf("expected the delta older than the snapshot to be skipped; got: %s", out)
+	}
+}
+
+func TestSSEMultiplexesSharedCars(t *testing.T) {
+	km := newTestKeys(t)
+	st := state.NewStore()
+	hub := stream.NewHub()
+	now := time.Now().UnixMilli()
+	st.UpdateSpeed(1, now, 10)
+	st.UpdateSpeed(2, now, 20)
+	st.UpdateSpeed(3, now, 30)
+	pub := &PublicHandlers{Keys: km, Store: st, Hub: hub, CookieDomain: "localhost", Heartbeat: time.Second}
+	r := NewRouter(nil)
+	r.Group(func(r chi.Router) { pub.Routes(r) })
+
+	connect := func(claims auth.ShareClaims, broadcast func()) []byte {
+		tokStr, _, err := auth.CreateShareToken(time.Now(), time.Minute, claims, km.SignJWT)
+		if err != nil {
+			t.Fatalf("sign: %v", err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/stream", nil).WithContext(ctx)
+		req.AddCookie(&http.Cookie{Name: auth.CookieName, Value: tokStr})
+		w := newSyncRecorder()
+		done := make(chan struct{})
+		go func() {
+			r.ServeHTTP(w, req)
+			close(done)
+		}()
+		time.Sleep(30 * time.Millisecond)
+		broadcast()
+		time.Sleep(30 * time.Millisecond)
+		cancel()
+		<-done
+		return w.Snapshot()
+	}
+	broadcast := func() {
+		for car := int64(1); car <= 3; car++ {
+			hub.Broadcast(car, "delta", st.UpdateSpeed(car, time.Now().UnixMilli(), float64(car*10+1)))
+		}
+	}
+
+	out := string(connect(auth.ShareClaims{CarIDs: []int64{1, 2}}, broadcast))
+	for _, want := range []string{
+		"event: snapshot\ndata: {\"battery\":null,\"car_id\":1,",
+		"event: snapshot\ndata: {\"battery\":null,\"car_id\":2,",
+		"event: delta\ndata: {\"car_id\":1,",
+		"event: delta\ndata: {\"car_id\":2,",
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("expected %s in stream; got: %s", want, out)
+		}
+	}
+	if strings.Count(out, "event: snapshot\n") != 2 || strings.Contains(out, `"car_id":3`) {
+		t.Fatalf("expected snapshots of cars 1 and 2 only; got: %s", out)
+	}
+
+	out = string(connect(auth.ShareClaims{AllCars: true}, broadcast))
+	if strings.Count(out, "event: snapshot\n") != 3 || strings.Count(out, "event: delta\n") != 3 {
+		t.Fatalf("expected every car in the stream; got: %s", out)
+	}
+}
+
 // syncRecorder is a minimal thread-safe http.ResponseWriter that implements http.Flusher.
 type syncRecorder struct {
 	mu     sync.Mutex
@@ -130,6 +551,44 @@ type syncRecorder struct {
 	code   int
 }
 
+func TestArrivalSurvivesRestart(t *testing.T) {
+	km := newTestKeys(t)
+	path := filepath.Join(t.TempDir(), "shares.json")
+	claims := auth.ShareClaims{ID: "arrived", CarID: 1, Dest: &auth.ShareDest{Lat: 51.05, Lon: 3.72}, ArrivalRadiusM: 200}
+	tokStr, exp, err := auth.CreateShareToken(time.Now(), time.Minute, claims, km.SignJWT)
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	// session brings up a server on the persisted registry with the car at lat, as after a restart
+	session := func(lat float64) int {
+		reg, err := shares.NewRegistry(path)
+		if err != nil {
+			t.Fatalf("shares: %v", err)
+		}
+		if len(reg.List()) == 0 {
+			_ = reg.Add(shares.Share{JTI: claims.ID, CarID: 1, CreatedAt: time.Now(), ExpiresAt: exp})
+		}
+		st := state.NewStore()
+		st.UpdateLocation(1, time.Now().UnixMilli(), lat, 3.72, -1, -1, -1)
+		r := NewRouter(nil)
+		r.Group(func(r chi.Router) {
+			(&PublicHandlers{Keys: km, Shares: reg, Store: st, Hub: stream.NewHub(), CookieDomain: "localhost", Heartbeat: time.Second}).Routes(r)
+		})
+		body, _ := json.Marshal(map[string]string{"token": tokStr})
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/session", bytes.NewReader(body)))
+		return w.Code
+	}
+
+	if code := session(51.0501); code != http.StatusGone {
+		t.Fatalf("expected 410 at the destination, got %d", code)
+	}
+	// the car has moved on, but the share stays used up
+	if code := session(51.0); code != http.StatusGone {
+		t.Fatalf("expected 410 after a restart, got %d", code)
+	}
+}
+
 func newSyncRecorder() *syncRecorder { return &syncRecorder{header: make(http.Header)} }
 
 func (w *syncRecorder) Header() http.Header        { return w.header }
@@ -145,3 +604,39 @@ func (w *syncRecorder) Snapshot() []byte {
 	defer w.mu.Unlock()
 	return append([]byte(nil), w.buf.Bytes()...)
 }
+
+func TestSendFrameContinuesTrace(t *testing.T) {
+	spans := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)))
+	hub := stream.NewHub()
+	sub := hub.Subscribe(1)
+	defer hub.Unsubscribe(sub)
+
+	ctx, parent := otel.Tracer("test").Start(context.Background(), "parent")
+	hub.BroadcastContext(ctx, 1, "delta", []byte(`{"ts_ms":1}`))
+	parent.End()
+	hub.Broadcast(1, "delta", []byte(`{"ts_ms":2}`))
+
+	w := httptest.NewRecorder()
+	sink := &sseSink{w: w, flusher: w}
+	for range 2 {
+		if !(streamOptions{}).sendFrame(sink, hub, <-sub.Ch, 0) {
+			t.Fatal("send failed")
+		}
+	}
+	var writes []sdktrace.ReadOnlySpan
+	for _, s := range spans.Ended() {
+		if s.Name() == "stream.write" {
+			writes = append(writes, s)
+		}
+	}
+	if len(writes) != 1 {
+		t.Fatalf("expected a single stream.write span for the traced frame, got %d", len(writes))
+	}
+	if writes[0].Parent().SpanID() != hub.FrameSpan(sub.LastID+1).SpanID() {
+		t.Fatal("stream.write should continue the broadcast span")
+	}
+	if !slices.Contains(writes[0].Attributes(), attribute.String("transport", "sse")) {
+		t.Fatalf("unexpected attributes %v", writes[0].Attributes())
+	}
+}
@@ -37,7 +37,7 @@ func corsMiddleware(origins []string) func(http.Handler) http.Handler {
 					w.Header().Set("Vary", "Origin")
 					w.Header().Set("Access-Control-Allow-Credentials", "true")
 					w.Header().Set("Access-Control-Allow-Headers", "Content-Type, CF-Access-Jwt-Assertion")
-					w.Header().Set("Access-Control-Allow-Methods", "GET,POST,OPTIONS")
+					w.Header().Set("Access-Control-Allow-Methods", "GET,POST,DELETE,OPTIONS")
 				}
 			}
 			if r.Method == http.MethodOptions {
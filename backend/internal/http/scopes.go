@@ -0,0 +1,127 @@
+package httpx
+
+import "github.com/mcuelenaere/where-is-maurus/backend/internal/auth"
+
+// fieldScopes maps the top-level snapshot and delta fields to the scope exposing them.
+// Fields that are not listed are only sent to shares without scopes, except for the freshness
+// of the data (status, last_seen_ms) which every viewer gets.
+var fieldScopes = map[string]string{
+	"location":         auth.ScopeLocation,
+	"vehicle":          auth.ScopeVehicle,
+	"battery":          auth.ScopeBattery,
+	"charging":         auth.ScopeCharging,
+	"charging_session": auth.ScopeCharging,
+	"climate":          auth.ScopeClimate,
+	"tpms_bar":         auth.ScopeTPMS,
+	"route":            auth.ScopeRoute,
+	"trip":             auth.ScopeTrip,
+}
+
+// historyScopes maps the history_30s series to the scope exposing them.
+var historyScopes = map[string]string{
+	"speed_kph":               auth.ScopeLocation,
+	"heading":                 auth.ScopeLocation,
+	"elevation_m":             auth.ScopeLocation,
+	"soc_pct":                 auth.ScopeBattery,
+	"power_w":                 auth.ScopeBattery,
+	"usable_soc_pct":          auth.ScopeBattery,
+	"est_range_km":            auth.ScopeBattery,
+	"rated_range_km":          auth.ScopeBattery,
+	"charger_power_kw":        auth.ScopeCharging,
+	"charge_energy_added_kwh": auth.ScopeCharging,
+	"inside_c":                auth.ScopeClimate,
+	"outside_c":               auth.ScopeClimate,
+	"tpms_fl":                 auth.ScopeTPMS,
+	"tpms_fr":                 auth.ScopeTPMS,
+	"tpms_rl":                 auth.ScopeTPMS,
+	"tpms_rr":                 auth.ScopeTPMS,
+}
+
+// eventScopes maps derived events to the scope required to receive them.
+var eventScopes = map[string]string{
+	"charging_started":  auth.ScopeCharging,
+	"charging_finished": auth.ScopeCharging,
+	"trip_started":      auth.ScopeTrip,
+	"trip_finished":     auth.ScopeTrip,
+}
+
+// scopeFilter returns a filter removing everything the scopes don't grant, or nil when the
+// share isn't restricted. Deltas left without any granted field are dropped altogether.
+func scopeFilter(scopes []string) payloadFilter {
+	if len(scopes) == 0 {
+		return nil
+	}
+	granted := make(map[string]bool, len(scopes))
+	for _, s := range scopes {
+		granted[s] = true
+	}
+	return func(event string, payload map[string]any) bool {
+		if scope, ok := eventScopes[event]; ok {
+			if !granted[scope] {
+				return false
+			}
+			if !granted[auth.ScopeLocation] {
+				stripTripEndpoints(payload["trip"])
+			}
+			return true
+		}
+		for key, v := range payload {
+			switch key {
+			case "ts_ms", "car_id", "status", "last_seen_ms":
+			case "trip":
+				if !granted[auth.ScopeTrip] {
+					delete(payload, key)
+				} else if !granted[auth.ScopeLocation] {
+					stripTripEndpoints(v)
+				}
+			case "history_30s":
+				hist, ok := v.(map[string]any)
+				if !ok || !granted[auth.ScopeHistory] {
+					delete(payload, key)
+					continue
+				}
+				for name := range hist {
+					if !granted[historyScopes[name]] {
+						delete(hist, name)
+					}
+				}
+				if len(hist) == 0 && event == "delta" {
+					delete(payload, key)
+				}
+			case "path_30s":
+				if !granted[auth.ScopeHistory] || !granted[auth.ScopeLocation] {
+					delete(payload, key)
+				}
+			case "history_window":
+				if !granted[auth.ScopeHistory] {
+					delete(payload, key)
+				}
+			default:
+				if !granted[fieldScopes[key]] {
+					delete(payload, key)
+				}
+			}
+		}
+		if event == "delta" {
+			granted := len(payload)
+			for _, key := range []string{"ts_ms", "car_id"} {
+				if _, ok := payload[key]; ok {
+					granted--
+				}
+			}
+			if granted == 0 {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// stripTripEndpoints removes the start and end coordinates from a trip, the end following the
+// car while the trip is ongoing, so trip statistics don't reveal the location.
+func stripTripEndpoints(v any) {
+	if trip, ok := v.(map[string]any); ok {
+		delete(trip, "start")
+		delete(trip, "end")
+	}
+}
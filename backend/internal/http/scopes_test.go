@@ -0,0 +1,214 @@
+package httpx
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/auth"
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/state"
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/stream"
+)
+
+func TestScopeFilter(t *testing.T) {
+	if scopeFilter(nil) != nil {
+		t.Fatalf("expected no filter for unrestricted shares")
+	}
+	filter := scopeFilter([]string{auth.ScopeRoute, auth.ScopeBattery, auth.ScopeHistory})
+
+	payload := map[string]any{
+		"ts_ms":       1.0,
+		"location":    map[string]any{"lat": 1.0},
+		"battery":     map[string]any{"soc_pct": 50.0},
+		"climate":     map[string]any{"inside_c": 21.0},
+		"tpms_bar":    map[string]any{"fl": 2.9},
+		"route":       map[string]any{"eta_min": 12.0},
+		"history_30s": map[string]any{"soc_pct": []any{}, "inside_c": []any{}, "speed_kph": []any{}},
+		"path_30s":    []any{},
+		"unknown":     true,
+		// describes the history, goes with it
+		"history_window": map[string]any{"version": 1.0, "window_ms": 900000.0},
+	}
+	if !filter("snapshot", payload) {
+		t.Fatalf("expected snapshot to be kept")
+	}
+	for _, key := range []string{"location", "climate", "tpms_bar", "path_30s", "unknown"} {
+		if _, ok := payload[key]; ok {
+			t.Fatalf("expected %s to be removed: %v", key, payload)
+		}
+	}
+	if hist := payload["history_30s"].(map[string]any); len(hist) != 1 || hist["soc_pct"] == nil {
+		t.Fatalf("expected only battery history: %v", hist)
+	}
+	if _, ok := payload["history_window"]; !ok {
+		t.Fatalf("expected history_window with the history scope: %v", payload)
+	}
+	routeOnly := map[string]any{"ts_ms": 1.0, "route": map[string]any{}, "history_window": map[string]any{}}
+	if scopeFilter([]string{auth.ScopeRoute})("snapshot", routeOnly); routeOnly["history_window"] != nil {
+		t.Fatalf("expected history_window to require the history scope: %v", routeOnly)
+	}
+
+	// a delta with nothing granted left is not sent at all
+	if filter("delta", map[string]any{"ts_ms": 1.0, "tpms_bar": map[string]any{"fl": 2.9}, "history_30s": map[string]any{"tpms_fl": []any{}}}) {
+		t.Fatalf("expected delta without granted fields to be dropped")
+	}
+	if filter("charging_started", map[string]any{"ts_ms": 1.0}) {
+		t.Fatalf("expected charging events to require the charging scope")
+	}
+
+	// every viewer learns how fresh the data is
+	status := map[string]any{"ts_ms": 1.0, "status": "stale", "last_seen_ms": 1.0}
+	if !filter("status", status) || len(status) != 3 {
+		t.Fatalf("expected status to be kept as is: %v", status)
+	}
+}
+
+func TestSSEAppliesShareScopes(t *testing.T) {
+	km := newTestKeys(t)
+	st := state.NewStore()
+	hub := stream.NewHub()
+	pub := &PublicHandlers{Keys: km, Store: st, Hub: hub, CookieDomain: "localhost", Heartbeat: time.Second}
+	r := NewRouter(nil)
+	r.Group(func(r chi.Router) { pub.Routes(r) })
+
+	now := time.Now().UnixMilli()
+	st.UpdateRoute(1, now, &state.Dest{Lat: 51.05, Lon: 3.72}, 12, 8)
+	st.UpdateInsideTemp(1, now, 21.5)
+	claims := auth.ShareClaims{CarID: 1, Scopes: []string{auth.ScopeRoute}}
+	tokStr, _, err := auth.CreateShareToken(time.Now(), time.Minute, claims, km.SignJWT)
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sseReq := httptest.NewRequest(http.MethodGet, "/api/v1/stream", nil).WithContext(ctx)
+	sseReq.AddCookie(&http.Cookie{Name: auth.CookieName, Value: tokStr})
+	sseW := newSyncRecorder()
+	done := make(chan struct{})
+	go func() {
+		r.ServeHTTP(sseW, sseReq)
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	hub.Broadcast(1, "delta", st.UpdateTPMS(1, now, "fl", 2.9))
+	hub.Broadcast(1, "delta", st.UpdateRoute(1, now, &state.Dest{Lat: 51.05, Lon: 3.72}, 11, 7))
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	<-done
+
+	out := sseW.Snapshot()
+	if !bytes.Contains(out, []byte(`"eta_min":12`)) || !bytes.Contains(out, []byte(`"eta_min":11`)) {
+		t.Fatalf("expected route in snapshot and delta; got: %s", out)
+	}
+	if bytes.Contains(out, []byte("inside_c")) || bytes.Contains(out, []byte("tpms")) {
+		t.Fatalf("expected climate and tpms to be filtered; got: %s", out)
+	}
+	if n := bytes.Count(out, []byte("event: delta\n")); n != 1 {
+		t.Fatalf("expected the tpms delta to be dropped, got %d deltas: %s", n, out)
+	}
+}
+
+func TestSSETripShareNeverGetsCoordinates(t *testing.T) {
+	km := newTestKeys(t)
+	st := state.NewStore()
+	hub := stream.NewHub()
+	st.SetNotifier(hub.Broadcast)
+	pub := &PublicHandlers{Keys: km, Store: st, Hub: hub, CookieDomain: "localhost", Heartbeat: time.Second}
+	r := NewRouter(nil)
+	r.Group(func(r chi.Router) { pub.Routes(r) })
+
+	now := time.Now().UnixMilli()
+	st.UpdateShiftState(1, now, "D")
+	st.UpdateLocation(1, now, 51.05, 3.72, 50, -1, -1)
+	claims := auth.ShareClaims{CarID: 1, Scopes: []string{auth.ScopeTrip}}
+	tokStr, _, err := auth.CreateShareToken(time.Now(), time.Minute, claims, km.SignJWT)
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sseReq := httptest.NewRequest(http.MethodGet, "/api/v1/stream", nil).WithContext(ctx)
+	sseReq.AddCookie(&http.Cookie{Name: auth.CookieName, Value: tokStr})
+	sseW := newSyncRecorder()
+	done := make(chan struct{})
+	go func() {
+		r.ServeHTTP(sseW, sseReq)
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	hub.Broadcast(1, "delta", st.UpdateLocation(1, now+10_000, 51.06, 3.73, 50, -1, -1))
+	hub.Broadcast(1, "delta", st.UpdateShiftState(1, now+20_000, "P"))
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	<-done
+
+	out := sseW.Snapshot()
+	for _, want := range []string{"event: snapshot\n", "event: delta\n", "event: trip_finished\n", `"distance_km"`} {
+		if !bytes.Contains(out, []byte(want)) {
+			t.Fatalf("expected %q; got: %s", want, out)
+		}
+	}
+	if bytes.Contains(out, []byte(`"lat"`)) || bytes.Contains(out, []byte(`"lon"`)) {
+		t.Fatalf("expected no coordinates without the location scope; got: %s", out)
+	}
+}
+
+func TestSSEAllCarsShareGetsNoCarAdded(t *testing.T) {
+	km := newTestKeys(t)
+	st := state.NewStore()
+	hub := stream.NewHub()
+	st.SetNotifier(hub.Broadcast)
+	pub := &PublicHandlers{Keys: km, Store: st, Hub: hub, CookieDomain: "localhost", Heartbeat: time.Second}
+	r := NewRouter(nil)
+	r.Group(func(r chi.Router) { pub.Routes(r) })
+
+	now := time.Now().UnixMilli()
+	st.UpdateBatteryLevel(1, now, 80)
+	claims := auth.ShareClaims{AllCars: true, Scopes: []string{auth.ScopeBattery}}
+	tokStr, _, err := auth.CreateShareToken(time.Now(), time.Minute, claims, km.SignJWT)
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sseReq := httptest.NewRequest(http.MethodGet, "/api/v1/stream", nil).WithContext(ctx)
+	sseReq.AddCookie(&http.Cookie{Name: auth.CookieName, Value: tokStr})
+	sseW := newSyncRecorder()
+	done := make(chan struct{})
+	go func() {
+		r.ServeHTTP(sseW, sseReq)
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	st.UpdateDisplayNameSilently(2, now, "Secret")
+	hub.Broadcast(2, "delta", st.UpdateBatteryLevel(2, now, 60))
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	<-done
+
+	out := sseW.Snapshot()
+	if !bytes.Contains(out, []byte(`"soc_pct":60`)) {
+		t.Fatalf("expected the battery of the new car; got: %s", out)
+	}
+	if bytes.Contains(out, []byte("car_added")) || bytes.Contains(out, []byte("Secret")) {
+		t.Fatalf("expected no car_added on a share stream; got: %s", out)
+	}
+}
+
+func TestAdminCreateShare_RejectsUnknownScopes(t *testing.T) {
+	adm := &AdminHandlers{CF: nil, Keys: newTestKeys(t), Store: state.NewStore(), TokenTTL: time.Minute}
+	r := NewRouter(nil)
+	r.Group(func(r chi.Router) { adm.Routes(r) })
+
+	body, _ := json.Marshal(map[string]any{"car_id": 1, "scopes": []string{"route", "cabin_camera"}})
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/shares", bytes.NewReader(body)))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d: %s", w.Code, w.Body.String())
+	}
+}
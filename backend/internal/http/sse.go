@@ -1,26 +1,138 @@
 package httpx
 
 import (
+	"cmp"
 	"context"
 	"encoding/json"
 	"net/http"
+	"slices"
+	"strconv"
 	"time"
 
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/metrics"
 	"github.com/mcuelenaere/where-is-maurus/backend/internal/state"
 	"github.com/mcuelenaere/where-is-maurus/backend/internal/stream"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-// setSSEHeaders sets required headers and returns a flusher or error.
-func setSSEHeaders(w http.ResponseWriter) (http.Flusher, bool) {
+var tracer = otel.Tracer("github.com/mcuelenaere/where-is-maurus/backend/internal/http")
+
+// eventSink is the transport a stream is written to (SSE or WebSocket). An id of 0 means the
+// event is not part of the resumable sequence, e.g. heartbeats.
+type eventSink interface {
+	send(id uint64, event string, data []byte) error
+	// transport names the sink in metrics
+	transport() string
+}
+
+// sseSink writes events as Server-Sent Events.
+type sseSink struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+// newSSESink sets required headers and returns a sink, or false when streaming isn't supported.
+func newSSESink(w http.ResponseWriter) (*sseSink, bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, false
+	}
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-store")
 	w.Header().Set("X-Accel-Buffering", "no")
-	flusher, ok := w.(http.Flusher)
-	return flusher, ok
+	return &sseSink{w: w, flusher: flusher}, true
+}
+
+func (s *sseSink) transport() string { return "sse" }
+
+func (s *sseSink) send(id uint64, event string, data []byte) error {
+	var b []byte
+	if id != 0 {
+		b = stream.EncodeFrame(id, event, data)
+	} else {
+		b = []byte("event: " + event + "\n" + "data: " + string(data) + "\n\n")
+	}
+	if _, err := s.w.Write(b); err != nil {
+		return err
+	}
+	s.flusher.Flush()
+	return nil
 }
 
-// sendInitialSnapshot marshals and writes the initial snapshot for the given car.
-func sendInitialSnapshot(w http.ResponseWriter, flusher http.Flusher, st *state.Store, carID int64) bool {
+// openStream subscribes to the cars (nil meaning every car) and brings the client up to date:
+// when the last event id the client reconnects with is still in the replay buffers only the
+// missed frames are sent, otherwise snapshots. The returned subscriber is handed to streamLoop.
+func openStream(sink eventSink, lastEventID string, st *state.Store, hub *stream.Hub, carIDs []int64, opts streamOptions) (*stream.Subscriber, bool) {
+	var sub *stream.Subscriber
+	if lastID, err := strconv.ParseUint(lastEventID, 10, 64); err == nil {
+		var missed [][]byte
+		var ok bool
+		if sub, missed, ok = hub.Resume(carIDs, lastID); ok {
+			for _, b := range missed {
+				if !opts.sendFrame(sink, hub, b, 0) {
+					hub.Unsubscribe(sub)
+					return nil, false
+				}
+			}
+			return sub, true
+		}
+	} else {
+		sub = hub.SubscribeCars(carIDs)
+	}
+	if !opts.sendSnapshot(sink, st, carIDs, sub.LastID) {
+		hub.Unsubscribe(sub)
+		return nil, false
+	}
+	return sub, true
+}
+
+// sendSnapshots sends the snapshot of every car, in id order. A nil carIDs means all cars
+// currently known.
+func sendSnapshots(sink eventSink, st *state.Store, carIDs []int64, id uint64, filter payloadFilter) bool {
+	if carIDs == nil {
+		for _, c := range st.ListCars() {
+			carIDs = append(carIDs, c.ID)
+		}
+		slices.Sort(carIDs)
+	}
+	for _, carID := range carIDs {
+		if !sendInitialSnapshot(sink, st, carID, id, filter) {
+			return false
+		}
+	}
+	return true
+}
+
+// sendInitialSnapshot marshals and writes the initial snapshot for the given car. The snapshot
+// carries the id of the latest frame it includes so a reconnecting client can resume from it.
+// When filter is set it is applied to the snapshot before it is written.
+func sendInitialSnapshot(sink eventSink, st *state.Store, carID int64, id uint64, filter payloadFilter) bool {
+	b, _ := json.Marshal(carSnapshot(st, carID))
+	if filter != nil {
+		b = filterPayload("snapshot", b, filter)
+	}
+	return sink.send(id, "snapshot", b) == nil
+}
+
+// sendFleetSnapshot writes a single snapshot holding every car, with its display name, for
+// overviews of the whole fleet.
+func sendFleetSnapshot(sink eventSink, st *state.Store, id uint64) bool {
+	cars := st.ListCars()
+	slices.SortFunc(cars, func(a, b state.CarInfo) int { return cmp.Compare(a.ID, b.ID) })
+	list := make([]map[string]any, 0, len(cars))
+	for _, c := range cars {
+		snap := carSnapshot(st, c.ID)
+		snap["display_name"] = c.DisplayName
+		list = append(list, snap)
+	}
+	b, _ := json.Marshal(map[string]any{"ts_ms": time.Now().UnixMilli(), "cars": list})
+	return sink.send(id, "snapshot", b) == nil
+}
+
+// carSnapshot returns the snapshot payload of a car.
+func carSnapshot(st *state.Store, carID int64) map[string]any {
 	stateSnap, hist := st.GetSnapshot(carID)
 	historyOnly := map[string]any{
 		"speed_kph":   hist.SpeedKPH,
@@ -34,52 +146,185 @@ func sendInitialSnapshot(w http.ResponseWriter, flusher http.Flusher, st *state.
 		"tpms_fr":     hist.TPMSFR,
 		"tpms_rl":     hist.TPMSRL,
 		"tpms_rr":     hist.TPMSRR,
+
+		"usable_soc_pct":          hist.UsableSOC,
+		"est_range_km":            hist.EstRange,
+		"rated_range_km":          hist.RatedRange,
+		"charger_power_kw":        hist.ChargerKW,
+		"charge_energy_added_kwh": hist.EnergyKWh,
+	}
+	status, lastSeen := st.Status(carID, time.Now().UnixMilli())
+	return map[string]any{
+		"car_id":           carID,
+		"ts_ms":            stateSnap.TSMS,
+		"status":           status,
+		"last_seen_ms":     lastSeen,
+		"location":         stateSnap.Location,
+		"vehicle":          stateSnap.Vehicle,
+		"battery":          stateSnap.Battery,
+		"charging":         stateSnap.Charging,
+		"charging_session": stateSnap.ChargingSession,
+		"trip":             stateSnap.Trip,
+		"climate":          stateSnap.Climate,
+		"tpms_bar":         stateSnap.TPMS,
+		"route":            stateSnap.Route,
+		"history_30s":      historyOnly,
+		"path_30s":         hist.Path,
+		"history_window":   st.HistoryInfo(),
 	}
-	snapshotData := map[string]any{
-		"ts_ms":       stateSnap.TSMS,
-		"location":    stateSnap.Location,
-		"battery":     stateSnap.Battery,
-		"climate":     stateSnap.Climate,
-		"tpms_bar":    stateSnap.TPMS,
-		"route":       stateSnap.Route,
-		"history_30s": historyOnly,
-		"path_30s":    hist.Path,
-	}
-	b, _ := json.Marshal(snapshotData)
-	if _, err := w.Write([]byte("event: snapshot\n" + "data: " + string(b) + "\n\n")); err != nil {
-		return false
-	}
-	flusher.Flush()
-	return true
 }
 
-// sseLoop forwards hub messages and emits heartbeats until the context is canceled.
-func sseLoop(ctx context.Context, w http.ResponseWriter, flusher http.Flusher, hub *stream.Hub, carID int64, heartbeat time.Duration) {
-	sub := hub.Subscribe(carID)
-	defer hub.Unsubscribe(carID, sub)
+// sendFrame forwards a frame produced by stream.Hub, applying the filter to its payload. Frames
+// up to id after, which the client got a snapshot of, and frames that are filtered out count as
+// sent. Writing a traced frame continues the trace of its broadcast.
+func (o streamOptions) sendFrame(sink eventSink, hub *stream.Hub, frame []byte, after uint64) bool {
+	id, event, data, ok := stream.ParseFrame(frame)
+	if !ok || id <= after || event == "car_added" && !o.carAdded {
+		return true
+	}
+	if sc := hub.FrameSpan(id); sc.IsValid() {
+		_, span := tracer.Start(trace.ContextWithSpanContext(context.Background(), sc), "stream.write",
+			trace.WithAttributes(
+				attribute.String("transport", sink.transport()),
+				attribute.String("event", event),
+				attribute.Int64("frame_id", int64(id)), // #nosec G115 -- ids are µs timestamps
+				attribute.Int("payload_size", len(data)),
+			))
+		defer span.End()
+	}
+	if o.filter != nil {
+		if data = filterPayload(event, data, o.filter); data == nil {
+			return true
+		}
+	}
+	return sink.send(id, event, data) == nil
+}
 
-	hb := time.NewTicker(heartbeat)
+// streamOptions controls the per-connection behaviour of streamLoop.
+type streamOptions struct {
+	heartbeat time.Duration
+	// arrived, when set, is consulted after every forwarded message; once it reports
+	// true an arrived event is sent and the stream is closed.
+	arrived func() bool
+	// revoked is closed when the share backing the stream gets revoked.
+	revoked <-chan struct{}
+	// filter, when set, rewrites or drops every forwarded message.
+	filter payloadFilter
+	// carAdded forwards the car_added events, for streams following the whole fleet. Shares
+	// never get them, as they'd announce cars regardless of the scopes.
+	carAdded bool
+	// snapshot, when set, replaces the per-car snapshots sent when the stream starts or resyncs.
+	snapshot func(sink eventSink, id uint64) bool
+}
+
+// sendSnapshot brings the client up to date with the state as of frame id.
+func (o streamOptions) sendSnapshot(sink eventSink, st *state.Store, carIDs []int64, id uint64) bool {
+	if o.snapshot != nil {
+		return o.snapshot(sink, id)
+	}
+	return sendSnapshots(sink, st, carIDs, id, o.filter)
+}
+
+// streamLoop forwards hub messages and emits heartbeats until the context is canceled.
+// It takes ownership of sub and unsubscribes it when done.
+func streamLoop(ctx context.Context, sink eventSink, st *state.Store, hub *stream.Hub, carIDs []int64, sub *stream.Subscriber, opts streamOptions) {
+	defer hub.Unsubscribe(sub)
+	start := time.Now()
+	defer func() { metrics.StreamDuration.WithLabelValues(sink.transport()).Observe(time.Since(start).Seconds()) }()
+
+	hb := time.NewTicker(opts.heartbeat)
 	defer hb.Stop()
 
+	// resynced is the id of the last resync snapshot, frames broadcast while it was taken are
+	// part of it but may still be queued
+	var resynced uint64
 	for {
 		select {
 		case <-ctx.Done():
 			return
-		case b := <-sub.Ch:
-			if len(b) == 0 {
-				continue
+		case <-opts.revoked:
+			sendFinalEvent(sink, "revoked")
+			return
+		case <-sub.Resync:
+			// frames were dropped; discard what's queued and start over from a snapshot
+		drain:
+			for {
+				select {
+				case <-sub.Ch:
+				default:
+					break drain
+				}
+			}
+			resynced = hub.LastID()
+			if !opts.sendSnapshot(sink, st, carIDs, resynced) {
+				return
+			}
+		case b, ok := <-sub.Ch:
+			if !ok {
+				// disconnected by the hub for being too slow, the client resumes from its last event id
+				return
+			}
+			if !opts.sendFrame(sink, hub, b, resynced) {
+				return
 			}
-			if _, err := w.Write(b); err != nil {
+			if opts.arrived != nil && opts.arrived() {
+				sendFinalEvent(sink, "arrived")
 				return
 			}
-			flusher.Flush()
 		case t := <-hb.C:
 			serverTime := map[string]any{"server_time": t.UTC().Format(time.RFC3339Nano)}
 			hbPayload, _ := json.Marshal(serverTime)
-			if _, err := w.Write([]byte("event: heartbeat\n" + "data: " + string(hbPayload) + "\n\n")); err != nil {
+			if err := sink.send(0, "heartbeat", hbPayload); err != nil {
 				return
 			}
-			flusher.Flush()
 		}
 	}
 }
+
+// sendFinalEvent tells the client why the stream is about to be closed.
+func sendFinalEvent(sink eventSink, event string) {
+	payload, _ := json.Marshal(map[string]any{"ts_ms": time.Now().UnixMilli()})
+	_ = sink.send(0, event, payload)
+}
+
+// payloadFilter rewrites the decoded payload of an event in place, returning false when the
+// event must not be sent at all.
+type payloadFilter func(event string, payload map[string]any) bool
+
+// chainFilters combines filters, skipping nil ones. Returns nil when there is nothing to apply.
+func chainFilters(filters ...payloadFilter) payloadFilter {
+	var fs []payloadFilter
+	for _, f := range filters {
+		if f != nil {
+			fs = append(fs, f)
+		}
+	}
+	if len(fs) == 0 {
+		return nil
+	}
+	return func(event string, payload map[string]any) bool {
+		for _, f := range fs {
+			if !f(event, payload) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// filterPayload applies filter to a JSON object. Payloads that cannot be decoded are
+// dropped rather than forwarded unfiltered.
+func filterPayload(event string, data []byte, filter payloadFilter) []byte {
+	var m map[string]any
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil
+	}
+	if !filter(event, m) {
+		return nil
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil
+	}
+	return b
+}
@@ -0,0 +1,147 @@
+package httpx
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/state"
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/stream"
+	"github.com/rs/zerolog/hlog"
+)
+
+// wsWriteTimeout bounds every write so a stuck client can't block the stream forever.
+const wsWriteTimeout = 10 * time.Second
+
+// wsMessage is the envelope of every WebSocket message. Type matches the SSE event name
+// (snapshot, delta, heartbeat, ...) and ID the SSE id, when the event has one.
+type wsMessage struct {
+	Type string          `json:"type"`
+	ID   uint64          `json:"id,omitempty"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+// wsSink writes events as JSON text messages. It serializes writes, as the connection
+// supports only one concurrent writer.
+type wsSink struct {
+	mu   sync.Mutex
+	conn *websocket.Conn
+}
+
+func (s *wsSink) transport() string { return "websocket" }
+
+func (s *wsSink) send(id uint64, event string, data []byte) error {
+	b, err := json.Marshal(wsMessage{Type: event, ID: id, Data: data})
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_ = s.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	return s.conn.WriteMessage(websocket.TextMessage, b)
+}
+
+// serveWebSocket upgrades the request and streams the cars the same way the SSE endpoints do.
+// Clients resume with the last_event_id query parameter (or a Last-Event-ID header) and must
+// show they're alive within three heartbeats: by answering the server's pings, sending pings
+// of their own or sending a {"type":"ping"} message, which is answered with a pong.
+func serveWebSocket(ctx context.Context, w http.ResponseWriter, r *http.Request, allowedOrigins []string, st *state.Store, hub *stream.Hub, carIDs []int64, opts streamOptions) {
+	upgrader := websocket.Upgrader{CheckOrigin: checkOrigin(allowedOrigins)}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader already replied with an error
+		hlog.FromRequest(r).Debug().Err(err).Msg("websocket upgrade")
+		return
+	}
+	defer func() { _ = conn.Close() }()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	sink := &wsSink{conn: conn}
+	go wsReadLoop(conn, sink, 3*opts.heartbeat, cancel)
+	go wsPingLoop(ctx, conn, opts.heartbeat)
+
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+	sub, ok := openStream(sink, lastEventID, st, hub, carIDs, opts)
+	if !ok {
+		return
+	}
+	streamLoop(ctx, sink, st, hub, carIDs, sub, opts)
+	_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(wsWriteTimeout))
+}
+
+// wsReadLoop consumes client messages, extending the liveness deadline on every message, ping
+// or pong. It cancels the stream once the client goes away or stays silent for too long.
+func wsReadLoop(conn *websocket.Conn, sink *wsSink, timeout time.Duration, cancel context.CancelFunc) {
+	defer cancel()
+	alive := func() { _ = conn.SetReadDeadline(time.Now().Add(timeout)) }
+	alive()
+	conn.SetReadLimit(4096)
+	conn.SetPongHandler(func(string) error {
+		alive()
+		return nil
+	})
+	conn.SetPingHandler(func(data string) error {
+		alive()
+		_ = conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(wsWriteTimeout))
+		return nil
+	})
+	for {
+		_, b, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		alive()
+		var msg wsMessage
+		if err := json.Unmarshal(b, &msg); err == nil && msg.Type == "ping" {
+			serverTime := map[string]any{"server_time": time.Now().UTC().Format(time.RFC3339Nano)}
+			payload, _ := json.Marshal(serverTime)
+			if err := sink.send(0, "pong", payload); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// wsPingLoop pings the client every interval; browsers answer with a pong automatically.
+func wsPingLoop(ctx context.Context, conn *websocket.Conn, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// checkOrigin accepts same-origin requests, requests from the allowed CORS origins and
+// clients that don't send an Origin at all (native apps). Browsers always send one, so a
+// third-party page can't ride on the session cookie.
+func checkOrigin(allowed []string) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+		for _, o := range allowed {
+			if o == origin {
+				return true
+			}
+		}
+		u, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(u.Host, r.Host)
+	}
+}
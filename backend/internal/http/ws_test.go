@@ -0,0 +1,130 @@
+package httpx
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/websocket"
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/auth"
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/state"
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/stream"
+)
+
+func readWSMessage(t *testing.T, conn *websocket.Conn) wsMessage {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var msg wsMessage
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	return msg
+}
+
+func TestWebSocketStream(t *testing.T) {
+	km := newTestKeys(t)
+	st := state.NewStore()
+	hub := stream.NewHub()
+	pub := &PublicHandlers{Keys: km, Store: st, Hub: hub, CookieDomain: "localhost", Heartbeat: 100 * time.Millisecond, AllowedOrigins: []string{"https://app.example"}}
+	r := NewRouter(nil)
+	r.Group(func(r chi.Router) { pub.Routes(r) })
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http") + "/api/v1/ws"
+
+	tokStr, _, err := auth.CreateShareToken(time.Now(), time.Minute, auth.ShareClaims{CarID: 1}, km.SignJWT)
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	header := http.Header{}
+	header.Set("Cookie", auth.CookieName+"="+tokStr)
+
+	// the session cookie is required
+	if _, resp, err := websocket.DefaultDialer.Dial(wsURL, nil); err == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without session, got %v", err)
+	}
+	// foreign pages can't use the viewer's cookie
+	evil := header.Clone()
+	evil.Set("Origin", "https://evil.example")
+	if _, resp, err := websocket.DefaultDialer.Dial(wsURL, evil); err == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 for foreign origin, got %v", err)
+	}
+
+	allowed := header.Clone()
+	allowed.Set("Origin", "https://app.example")
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, allowed)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	snap := readWSMessage(t, conn)
+	if snap.Type != "snapshot" || snap.ID == 0 || !json.Valid(snap.Data) {
+		t.Fatalf("expected snapshot first, got %+v", snap)
+	}
+
+	hub.Broadcast(1, "delta", st.UpdateSpeed(1, time.Now().UnixMilli(), 42))
+	delta := readWSMessage(t, conn)
+	if delta.Type != "delta" || delta.ID != snap.ID+1 || !strings.Contains(string(delta.Data), `"speed_kph":42`) {
+		t.Fatalf("unexpected delta: %+v", delta)
+	}
+
+	// application level pings are answered
+	if err := conn.WriteJSON(wsMessage{Type: "ping"}); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	for {
+		msg := readWSMessage(t, conn)
+		if msg.Type == "pong" {
+			break
+		}
+		if msg.Type != "heartbeat" {
+			t.Fatalf("unexpected message: %+v", msg)
+		}
+	}
+
+	// resuming only replays what was missed
+	hub.Broadcast(1, "delta", st.UpdateSpeed(1, time.Now().UnixMilli(), 50))
+	resumed, _, err := websocket.DefaultDialer.Dial(wsURL+"?last_event_id="+strconv.FormatUint(delta.ID, 10), header)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer func() { _ = resumed.Close() }()
+	if msg := readWSMessage(t, resumed); msg.Type != "delta" || msg.ID != delta.ID+1 {
+		t.Fatalf("expected missed delta to be replayed, got %+v", msg)
+	}
+}
+
+func TestWebSocketClosesSilentClients(t *testing.T) {
+	st := state.NewStore()
+	hub := stream.NewHub()
+	adm := &AdminHandlers{Store: st, Hub: hub, Heartbeat: 30 * time.Millisecond}
+	r := NewRouter(nil)
+	r.Group(func(r chi.Router) { adm.Routes(r) })
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/api/v1/admin/cars/1/ws", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+	// don't answer server pings
+	conn.SetPingHandler(func(string) error { return nil })
+
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		var msg wsMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				t.Fatalf("expected normal closure, got %v", err)
+			}
+			return
+		}
+	}
+}
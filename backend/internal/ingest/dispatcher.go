@@ -0,0 +1,269 @@
+package ingest
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/state"
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/stream"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/mcuelenaere/where-is-maurus/backend/internal/ingest")
+
+// Dispatcher applies events to the store and broadcasts the resulting deltas to the viewers
+// of the car.
+type Dispatcher struct {
+	store *state.Store
+	hub   *stream.Hub
+
+	mu sync.Mutex
+	// disconnected counts the running sources that lost their connection
+	disconnected int
+	// fedBy maps the cars onto the run of the source that last fed them, 0 for pushed cars
+	fedBy map[int64]int
+	runs  int
+	// orderMu serializes DispatchInOrder, so no event slips in between its check and update
+	orderMu sync.Mutex
+}
+
+func NewDispatcher(store *state.Store, hub *stream.Hub) *Dispatcher {
+	return &Dispatcher{store: store, hub: hub, fedBy: map[int64]int{}}
+}
+
+// Run feeds the events of src into the store until it stops. While src reports it lost its
+// connection, the cars it fed are offline, as are the cars it maps that nothing fed yet.
+func (d *Dispatcher) Run(ctx context.Context, src Source) error {
+	var (
+		mu        sync.Mutex
+		connected = true
+	)
+	d.mu.Lock()
+	d.runs++
+	run := d.runs
+	d.mu.Unlock()
+	defer func() {
+		if !connected {
+			d.setDisconnected(-1)
+		}
+	}()
+	return src.Run(ctx, func(ev Event) {
+		c, ok := ev.(ConnectionEvent)
+		if !ok {
+			d.feed(ev.Car(), run)
+			d.Dispatch(ev)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if c.Connected == connected {
+			return
+		}
+		connected = c.Connected
+		if connected {
+			d.setDisconnected(-1)
+		} else {
+			d.setDisconnected(1)
+		}
+		for _, id := range d.carsOf(run, src) {
+			d.store.SetOffline(id, !connected, c.TS)
+		}
+	})
+}
+
+// feed records that the run, 0 for a push, fed the car.
+func (d *Dispatcher) feed(carID int64, run int) {
+	d.mu.Lock()
+	d.fedBy[carID] = run
+	d.mu.Unlock()
+}
+
+// carsOf returns the cars the run of src fed last, and the ones it maps that nothing fed yet,
+// such as cars restored from history.
+func (d *Dispatcher) carsOf(run int, src Source) []int64 {
+	mapper, _ := src.(CarMapper)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var ids []int64
+	for _, car := range d.store.ListCars() {
+		owner, fed := d.fedBy[car.ID]
+		if fed && owner == run || !fed && mapper != nil && mapper.Feeds(car.ID) {
+			ids = append(ids, car.ID)
+		}
+	}
+	return ids
+}
+
+func (d *Dispatcher) setDisconnected(delta int) {
+	d.mu.Lock()
+	d.disconnected += delta
+	d.mu.Unlock()
+}
+
+// Connected reports whether all running sources are connected to their upstream.
+func (d *Dispatcher) Connected() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.disconnected == 0
+}
+
+// DispatchInOrder applies the event unless the car already has more recent data, and reports
+// whether it did. Trackers coming back online push the points they buffered with their past
+// timestamps, applying those would move the state and history back in time and feed the trip
+// and charging tracking out of order.
+func (d *Dispatcher) DispatchInOrder(ev Event) bool {
+	d.orderMu.Lock()
+	defer d.orderMu.Unlock()
+	if ev.Time() < d.store.LastUpdate(ev.Car()) {
+		return false
+	}
+	d.feed(ev.Car(), 0)
+	d.Dispatch(ev)
+	return true
+}
+
+// Dispatch applies a single event. Traced events are applied as part of their trace.
+func (d *Dispatcher) Dispatch(ev Event) {
+	ctx := context.Background()
+	if t, ok := ev.(Traced); ok {
+		ctx = trace.ContextWithSpanContext(ctx, t.Span)
+		ev = t.Event
+	}
+	carID, ts := ev.Car(), ev.Time()
+	if trace.SpanContextFromContext(ctx).IsValid() {
+		var span trace.Span
+		ctx, span = tracer.Start(ctx, "store.update", trace.WithAttributes(
+			attribute.Int64("car_id", carID),
+			attribute.String("event", fmt.Sprintf("%T", ev)),
+		))
+		defer span.End()
+	}
+	var delta []byte
+	var seen []string
+	switch e := ev.(type) {
+	case LocationEvent:
+		// the store takes a negative elevation for not reported
+		elev := e.ElevationM
+		if math.IsNaN(elev) || elev < 0 {
+			elev = -1
+		}
+		delta = d.store.UpdateLocation(carID, ts, e.Lat, e.Lon, e.SpeedKPH, e.Heading, elev)
+		seen = append(seen, "location")
+		if e.SpeedKPH >= 0 {
+			seen = append(seen, string(MetricSpeed))
+		}
+		if e.Heading >= 0 {
+			seen = append(seen, string(MetricHeading))
+		}
+		if !math.IsNaN(e.ElevationM) {
+			seen = append(seen, string(MetricElevation))
+			if e.ElevationM < 0 {
+				// below sea level, set on its own
+				d.hub.BroadcastContext(ctx, carID, "delta", delta)
+				delta = d.store.UpdateElevation(carID, ts, e.ElevationM)
+			}
+		}
+	case MetricEvent:
+		delta = d.applyMetric(carID, ts, e.Metric, e.Value)
+		seen = append(seen, metricSeries(e.Metric))
+	case StatusEvent:
+		switch e.Status {
+		case StatusVehicle:
+			delta = d.store.UpdateVehicleState(carID, ts, e.Value)
+		case StatusShift:
+			delta = d.store.UpdateShiftState(carID, ts, e.Value)
+		case StatusCharging:
+			delta = d.store.UpdateChargingState(carID, ts, e.Value)
+		}
+	case PluggedInEvent:
+		delta = d.store.UpdatePluggedIn(carID, ts, e.PluggedIn)
+	case RouteEvent:
+		delta = d.store.UpdateRouteWithMeta(carID, ts, e.Dest, e.ETAMin, e.DistKM, e.DestLabel, e.TrafficDelayMin)
+	case MetaEvent:
+		// Store the data but don't broadcast as delta update
+		switch e.Field {
+		case MetaDisplayName:
+			d.store.UpdateDisplayNameSilently(carID, ts, e.Value)
+		case MetaExteriorColor:
+			d.store.UpdateExteriorColorSilently(carID, ts, e.Value)
+		case MetaModel:
+			d.store.UpdateModelSilently(carID, ts, e.Value)
+		}
+		d.store.MarkSeen(carID, ts)
+		return
+	}
+	if delta == nil {
+		log.Warn().Int64("car_id", carID).Type("event", ev).Msg("unsupported event")
+		return
+	}
+	d.hub.BroadcastContext(ctx, carID, "delta", delta)
+	d.store.MarkSeen(carID, ts, seen...)
+}
+
+// metricSeries returns the name of the history series a metric is kept in.
+func metricSeries(m Metric) string {
+	switch m {
+	case MetricInsideTemp:
+		return "inside_c"
+	case MetricOutsideTemp:
+		return "outside_c"
+	case MetricTPMSFrontLeft:
+		return "tpms_fl"
+	case MetricTPMSFrontRight:
+		return "tpms_fr"
+	case MetricTPMSRearLeft:
+		return "tpms_rl"
+	case MetricTPMSRearRight:
+		return "tpms_rr"
+	}
+	return string(m)
+}
+
+func (d *Dispatcher) applyMetric(carID, ts int64, m Metric, v float64) []byte {
+	switch m {
+	case MetricSpeed:
+		return d.store.UpdateSpeed(carID, ts, v)
+	case MetricHeading:
+		return d.store.UpdateHeading(carID, ts, v)
+	case MetricElevation:
+		return d.store.UpdateElevation(carID, ts, v)
+	case MetricBatteryLevel:
+		return d.store.UpdateBatteryLevel(carID, ts, v)
+	case MetricUsableBatteryLevel:
+		return d.store.UpdateUsableBatteryLevel(carID, ts, v)
+	case MetricPower:
+		return d.store.UpdatePower(carID, ts, v)
+	case MetricEstRange:
+		return d.store.UpdateEstRange(carID, ts, v)
+	case MetricRatedRange:
+		return d.store.UpdateRatedRange(carID, ts, v)
+	case MetricInsideTemp:
+		return d.store.UpdateInsideTemp(carID, ts, v)
+	case MetricOutsideTemp:
+		return d.store.UpdateOutsideTemp(carID, ts, v)
+	case MetricTPMSFrontLeft:
+		return d.store.UpdateTPMS(carID, ts, "fl", v)
+	case MetricTPMSFrontRight:
+		return d.store.UpdateTPMS(carID, ts, "fr", v)
+	case MetricTPMSRearLeft:
+		return d.store.UpdateTPMS(carID, ts, "rl", v)
+	case MetricTPMSRearRight:
+		return d.store.UpdateTPMS(carID, ts, "rr", v)
+	case MetricOdometer:
+		return d.store.UpdateOdometer(carID, ts, v)
+	case MetricChargerPower:
+		return d.store.UpdateChargerPower(carID, ts, v)
+	case MetricChargeEnergyAdded:
+		return d.store.UpdateChargeEnergyAdded(carID, ts, v)
+	case MetricTimeToFullCharge:
+		return d.store.UpdateTimeToFullCharge(carID, ts, v)
+	case MetricChargeLimit:
+		return d.store.UpdateChargeLimit(carID, ts, v)
+	}
+	return nil
+}
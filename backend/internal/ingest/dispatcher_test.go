@@ -0,0 +1,218 @@
+package ingest
+
+import (
+	"context"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/state"
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/stream"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestDispatcher(t *testing.T) {
+	st := state.NewStore()
+	hub := stream.NewHub()
+	sub := hub.Subscribe(3)
+	defer hub.Unsubscribe(sub)
+	d := NewDispatcher(st, hub)
+
+	h := Header{CarID: 3, TS: 1000}
+	events := []Event{
+		MetaEvent{Header: h, Field: MetaDisplayName, Value: "Maurus"},
+		LocationEvent{Header: h, Lat: 51.05, Lon: 3.72, SpeedKPH: -1, Heading: -1, ElevationM: math.NaN()},
+		MetricEvent{Header: h, Metric: MetricSpeed, Value: 42},
+		MetricEvent{Header: h, Metric: MetricTPMSRearLeft, Value: 2.9},
+		StatusEvent{Header: h, Status: StatusShift, Value: "D"},
+		PluggedInEvent{Header: h, PluggedIn: false},
+		RouteEvent{Header: h, Dest: &state.Dest{Lat: 50.85, Lon: 4.35}, ETAMin: 40, DistKM: 55, DestLabel: "Brussels"},
+		// unknown metrics are dropped
+		MetricEvent{Header: h, Metric: "warp_factor", Value: 9},
+	}
+	for _, ev := range events {
+		d.Dispatch(ev)
+	}
+
+	snap, _ := st.GetSnapshot(3)
+	if snap.DisplayName != "Maurus" || snap.Location == nil || snap.Location.Lat != 51.05 || snap.Location.SpeedKPH != 42 {
+		t.Fatalf("unexpected snapshot: %+v", snap)
+	}
+	if snap.TPMS == nil || snap.TPMS.RL != 2.9 || snap.Vehicle == nil || snap.Vehicle.ShiftState != "D" {
+		t.Fatalf("unexpected tpms/vehicle: %+v %+v", snap.TPMS, snap.Vehicle)
+	}
+	if snap.Route == nil || snap.Route.DestLabel != "Brussels" || snap.Route.ETAMin != 40 {
+		t.Fatalf("unexpected route: %+v", snap.Route)
+	}
+
+	// everything but the meta event and the unknown metric is broadcast
+	var deltas []string
+	for len(sub.Ch) > 0 {
+		_, event, data, _ := stream.ParseFrame(<-sub.Ch)
+		if event != "delta" {
+			t.Fatalf("unexpected event %q", event)
+		}
+		deltas = append(deltas, string(data))
+	}
+	if len(deltas) != 6 {
+		t.Fatalf("expected 6 deltas, got %d: %v", len(deltas), deltas)
+	}
+	if !strings.Contains(deltas[1], `"speed_kph":42`) {
+		t.Fatalf("unexpected speed delta: %s", deltas[1])
+	}
+
+	// a route without destination clears it
+	d.Dispatch(RouteEvent{Header: Header{CarID: 3, TS: 2000}})
+	if snap, _ = st.GetSnapshot(3); snap.Route.Dest != nil || snap.Route.DestLabel != "" {
+		t.Fatalf("expected route to be cleared: %+v", snap.Route)
+	}
+}
+
+func TestDispatcher_BelowSeaLevel(t *testing.T) {
+	st := state.NewStore()
+	d := NewDispatcher(st, stream.NewHub())
+	d.Dispatch(LocationEvent{Header: Header{CarID: 1, TS: 1000}, Lat: 31.5, Lon: 35.5, SpeedKPH: -1, Heading: -1, ElevationM: -430})
+	snap, hist := st.GetSnapshot(1)
+	if snap.Location == nil || snap.Location.ElevationM != -430 || len(hist.ElevationM) != 1 {
+		t.Fatalf("expected the elevation below sea level to be kept: %+v %+v", snap.Location, hist.ElevationM)
+	}
+}
+
+// sourceFunc adapts a function to Source.
+type sourceFunc func(ctx context.Context, emit func(Event)) error
+
+func (f sourceFunc) Run(ctx context.Context, emit func(Event)) error { return f(ctx, emit) }
+
+func TestDispatcher_Connection(t *testing.T) {
+	st := state.NewStore()
+	d := NewDispatcher(st, stream.NewHub())
+
+	var statuses []state.Status
+	src := sourceFunc(func(ctx context.Context, emit func(Event)) error {
+		now := time.Now().UnixMilli()
+		check := func() {
+			s, _ := st.Status(1, now)
+			statuses = append(statuses, s)
+		}
+		emit(MetricEvent{Header: Header{CarID: 1, TS: now}, Metric: MetricSpeed, Value: 42})
+		check()
+		emit(ConnectionEvent{Header: Header{TS: now}, Connected: false})
+		check()
+		if d.Connected() {
+			t.Error("expected dispatcher to report a lost connection")
+		}
+		emit(ConnectionEvent{Header: Header{TS: now}, Connected: true})
+		check()
+		emit(ConnectionEvent{Header: Header{TS: now}, Connected: false})
+		return nil
+	})
+	if err := d.Run(context.Background(), src); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []state.Status{state.StatusLive, state.StatusOffline, state.StatusLive}
+	if !slices.Equal(statuses, want) {
+		t.Fatalf("expected %v, got %v", want, statuses)
+	}
+	// the source stopped while disconnected, its car stays offline
+	if s, _ := st.Status(1, time.Now().UnixMilli()); s != state.StatusOffline || st.Fresh(1, "speed_kph", time.Now().UnixMilli()) {
+		t.Fatalf("expected car to stay offline, got %s", s)
+	}
+	if !d.Connected() {
+		t.Fatal("a stopped source no longer counts as disconnected")
+	}
+}
+
+// mappedSource is a source feeding the cars up to maxID.
+type mappedSource struct {
+	sourceFunc
+	maxID int64
+}
+
+func (m mappedSource) Feeds(carID int64) bool { return carID <= m.maxID }
+
+func TestDispatcher_ConnectionRestoredCars(t *testing.T) {
+	st := state.NewStore()
+	d := NewDispatcher(st, stream.NewHub())
+	now := time.Now().UnixMilli()
+	// cars 1 and 2 restored from history, 3 of another source, 2 pushing over HTTP since
+	for _, id := range []int64{1, 2, 3} {
+		st.UpdateLocation(id, now-1000, 51.05, 3.72, -1, -1, -1)
+	}
+	d.DispatchInOrder(MetricEvent{Header: Header{CarID: 2, TS: now}, Metric: MetricSpeed, Value: 42})
+
+	src := mappedSource{maxID: 2, sourceFunc: func(ctx context.Context, emit func(Event)) error {
+		emit(ConnectionEvent{Header: Header{TS: now}, Connected: false})
+		return nil
+	}}
+	if err := d.Run(context.Background(), src); err != nil {
+		t.Fatal(err)
+	}
+	var statuses []state.Status
+	for _, id := range []int64{1, 2, 3} {
+		s, _ := st.Status(id, now)
+		statuses = append(statuses, s)
+	}
+	want := []state.Status{state.StatusOffline, state.StatusLive, state.StatusStale}
+	if !slices.Equal(statuses, want) {
+		t.Fatalf("expected %v, got %v", want, statuses)
+	}
+}
+
+var (
+	spans      = tracetest.NewSpanRecorder()
+	tracerOnce sync.Once
+)
+
+// recordSpans installs a tracer provider recording to spans, once as tracers obtained before
+// only ever delegate to the first provider installed.
+func recordSpans() trace.Tracer {
+	tracerOnce.Do(func() {
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)))
+	})
+	return otel.Tracer("test")
+}
+
+func TestDispatcher_Traced(t *testing.T) {
+	tr := recordSpans()
+	st := state.NewStore()
+	hub := stream.NewHub()
+	d := NewDispatcher(st, hub)
+
+	_, parent := tr.Start(context.Background(), "parent")
+	d.Dispatch(Traced{Event: MetricEvent{Header: Header{CarID: 3, TS: 1000}, Metric: MetricSpeed, Value: 42}, Span: parent.SpanContext()})
+	parent.End()
+
+	if snap, _ := st.GetSnapshot(3); snap.Location == nil || snap.Location.SpeedKPH != 42 {
+		t.Fatalf("traced event not applied: %+v", snap)
+	}
+	byName := map[string]sdktrace.ReadOnlySpan{}
+	for _, s := range spans.Ended() {
+		if s.SpanContext().TraceID() == parent.SpanContext().TraceID() {
+			byName[s.Name()] = s
+		}
+	}
+	update, broadcast := byName["store.update"], byName["hub.broadcast"]
+	if update == nil || broadcast == nil {
+		t.Fatalf("expected store.update and hub.broadcast spans, got %v", byName)
+	}
+	if update.Parent().SpanID() != parent.SpanContext().SpanID() || broadcast.Parent().SpanID() != update.SpanContext().SpanID() {
+		t.Fatal("spans should nest as parent > store.update > hub.broadcast")
+	}
+	if !hub.FrameSpan(hub.LastID()).IsValid() {
+		t.Fatal("broadcast frame should carry its span")
+	}
+
+	// untraced events stay untraced
+	before := len(spans.Ended())
+	d.Dispatch(MetricEvent{Header: Header{CarID: 3, TS: 2000}, Metric: MetricSpeed, Value: 43})
+	if len(spans.Ended()) != before {
+		t.Fatal("untraced event shouldn't start spans")
+	}
+}
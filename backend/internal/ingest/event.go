@@ -0,0 +1,131 @@
+package ingest
+
+import (
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/state"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Event is a single piece of car data produced by a source.
+type Event interface {
+	// Car returns the id of the car the event is about.
+	Car() int64
+	// Time returns when the data was measured or received, in unix milliseconds.
+	Time() int64
+}
+
+// Header carries the fields common to all events.
+type Header struct {
+	CarID int64
+	TS    int64
+}
+
+func (h Header) Car() int64  { return h.CarID }
+func (h Header) Time() int64 { return h.TS }
+
+// LocationEvent moves the car. Negative SpeedKPH and Heading mean not reported, as does a NaN
+// ElevationM: below sea level is a valid elevation.
+type LocationEvent struct {
+	Header
+	Lat        float64
+	Lon        float64
+	SpeedKPH   float64
+	Heading    float64
+	ElevationM float64
+}
+
+// Metric names a numeric value of the car.
+type Metric string
+
+const (
+	MetricSpeed              Metric = "speed_kph"
+	MetricHeading            Metric = "heading"
+	MetricElevation          Metric = "elevation_m"
+	MetricBatteryLevel       Metric = "soc_pct"
+	MetricUsableBatteryLevel Metric = "usable_soc_pct"
+	MetricPower              Metric = "power_w"
+	MetricEstRange           Metric = "est_range_km"
+	MetricRatedRange         Metric = "rated_range_km"
+	MetricInsideTemp         Metric = "inside_temp_c"
+	MetricOutsideTemp        Metric = "outside_temp_c"
+	MetricTPMSFrontLeft      Metric = "tpms_fl_bar"
+	MetricTPMSFrontRight     Metric = "tpms_fr_bar"
+	MetricTPMSRearLeft       Metric = "tpms_rl_bar"
+	MetricTPMSRearRight      Metric = "tpms_rr_bar"
+	MetricOdometer           Metric = "odometer_km"
+	MetricChargerPower       Metric = "charger_power_kw"
+	MetricChargeEnergyAdded  Metric = "charge_energy_added_kwh"
+	MetricTimeToFullCharge   Metric = "time_to_full_charge_h"
+	MetricChargeLimit        Metric = "charge_limit_soc_pct"
+)
+
+// MetricEvent reports a single numeric value.
+type MetricEvent struct {
+	Header
+	Metric Metric
+	Value  float64
+}
+
+// Status names a textual status of the car.
+type Status string
+
+const (
+	// StatusVehicle is one of online, asleep, suspended, offline, driving, charging or updating
+	StatusVehicle Status = "state"
+	// StatusShift is P, D, R or N, empty while parked
+	StatusShift Status = "shift_state"
+	// StatusCharging is the charging state as reported by the car
+	StatusCharging Status = "charging_state"
+)
+
+// StatusEvent reports a textual status.
+type StatusEvent struct {
+	Header
+	Status Status
+	Value  string
+}
+
+// PluggedInEvent reports whether the charge cable is connected.
+type PluggedInEvent struct {
+	Header
+	PluggedIn bool
+}
+
+// RouteEvent reports the active navigation route. A nil Dest clears it.
+type RouteEvent struct {
+	Header
+	Dest            *state.Dest
+	ETAMin          float64
+	DistKM          float64
+	DestLabel       string
+	TrafficDelayMin float64
+}
+
+// MetaField names descriptive car data that isn't streamed to viewers as it changes.
+type MetaField string
+
+const (
+	MetaDisplayName   MetaField = "display_name"
+	MetaExteriorColor MetaField = "exterior_color"
+	MetaModel         MetaField = "model"
+)
+
+// MetaEvent reports descriptive car data.
+type MetaEvent struct {
+	Header
+	Field MetaField
+	Value string
+}
+
+// ConnectionEvent reports that a source lost or regained its upstream connection. It concerns
+// every car the source feeds, CarID is left zero.
+type ConnectionEvent struct {
+	Header
+	Connected bool
+}
+
+// Traced carries the span of the message an event was produced from, so applying the event
+// continues its trace.
+type Traced struct {
+	Event
+	Span trace.SpanContext
+}
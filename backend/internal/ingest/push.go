@@ -0,0 +1,172 @@
+package ingest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// knotsToKPH converts the speed unit of the OsmAnd protocol.
+const knotsToKPH = 1.852
+
+// ParseOwnTracks converts an OwnTracks HTTP message into events for carID. Messages other than
+// locations (transitions, waypoints, ...) carry nothing to store and yield no events.
+// See https://owntracks.org/booklet/tech/json/
+func ParseOwnTracks(carID int64, body []byte, now time.Time) ([]Event, error) {
+	var msg struct {
+		Type string   `json:"_type"`
+		Lat  *float64 `json:"lat"`
+		Lon  *float64 `json:"lon"`
+		Tst  int64    `json:"tst"`
+		Vel  *float64 `json:"vel"`
+		Cog  *float64 `json:"cog"`
+		Alt  *float64 `json:"alt"`
+		Batt *float64 `json:"batt"`
+	}
+	if err := json.Unmarshal(body, &msg); err != nil {
+		return nil, err
+	}
+	if msg.Type != "location" {
+		return nil, nil
+	}
+	if msg.Lat == nil || msg.Lon == nil {
+		return nil, errors.New("missing lat/lon")
+	}
+	var ts int64
+	if msg.Tst > 0 {
+		ts = msg.Tst * 1000
+	}
+	loc := LocationEvent{
+		Header:     Header{CarID: carID, TS: clampTS(ts, now)},
+		Lat:        *msg.Lat,
+		Lon:        *msg.Lon,
+		SpeedKPH:   orUnknown(msg.Vel),
+		Heading:    orUnknown(msg.Cog),
+		ElevationM: elevationOrUnknown(msg.Alt),
+	}
+	return withBattery(loc, msg.Batt)
+}
+
+// ParseOsmAnd converts a location reported with the OsmAnd protocol (as used by OsmAnd's
+// online tracking and Traccar Client) into events for carID. Speed is in knots, timestamp
+// either unix seconds, unix milliseconds or RFC 3339.
+// See https://www.traccar.org/osmand/
+func ParseOsmAnd(carID int64, q url.Values, now time.Time) ([]Event, error) {
+	num := func(names ...string) (*float64, error) {
+		for _, name := range names {
+			if s := q.Get(name); s != "" {
+				v, err := strconv.ParseFloat(s, 64)
+				if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+					return nil, fmt.Errorf("invalid %s %q", name, s)
+				}
+				return &v, nil
+			}
+		}
+		return nil, nil
+	}
+	lat, err := num("lat")
+	if err != nil {
+		return nil, err
+	}
+	lon, err := num("lon")
+	if err != nil {
+		return nil, err
+	}
+	if lat == nil || lon == nil {
+		return nil, errors.New("missing lat/lon")
+	}
+	ts, err := parseTimestamp(q.Get("timestamp"))
+	if err != nil {
+		return nil, err
+	}
+	speed, err := num("speed")
+	if err != nil {
+		return nil, err
+	}
+	if speed != nil {
+		kph := *speed * knotsToKPH
+		speed = &kph
+	}
+	heading, err := num("bearing", "heading")
+	if err != nil {
+		return nil, err
+	}
+	alt, err := num("altitude")
+	if err != nil {
+		return nil, err
+	}
+	batt, err := num("batt")
+	if err != nil {
+		return nil, err
+	}
+	loc := LocationEvent{
+		Header:     Header{CarID: carID, TS: clampTS(ts, now)},
+		Lat:        *lat,
+		Lon:        *lon,
+		SpeedKPH:   orUnknown(speed),
+		Heading:    orUnknown(heading),
+		ElevationM: elevationOrUnknown(alt),
+	}
+	return withBattery(loc, batt)
+}
+
+func parseTimestamp(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		if n > 1e12 {
+			return n, nil
+		}
+		return n * 1000, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timestamp %q", s)
+	}
+	return t.UnixMilli(), nil
+}
+
+// withBattery validates the location and adds the battery level, when reported.
+func withBattery(loc LocationEvent, batt *float64) ([]Event, error) {
+	if loc.Lat < -90 || loc.Lat > 90 || loc.Lon < -180 || loc.Lon > 180 {
+		return nil, fmt.Errorf("coordinate out of range: %v,%v", loc.Lat, loc.Lon)
+	}
+	events := []Event{loc}
+	if batt != nil && *batt >= 0 && *batt <= 100 {
+		events = append(events, MetricEvent{Header: loc.Header, Metric: MetricBatteryLevel, Value: *batt})
+	}
+	return events, nil
+}
+
+// clampTS uses the device time when given, but never one in the future: the store assumes
+// samples don't arrive ahead of the clock. Points from the past are left for
+// Dispatcher.DispatchInOrder to drop when the car has newer data.
+func clampTS(ts int64, now time.Time) int64 {
+	if ts <= 0 || ts > now.UnixMilli() {
+		return now.UnixMilli()
+	}
+	return ts
+}
+
+// orUnknown maps a missing or negative speed or heading onto the "not reported" value of
+// LocationEvent.
+func orUnknown(v *float64) float64 {
+	if v == nil || *v < 0 {
+		return -1
+	}
+	return *v
+}
+
+// elevationOrUnknown maps a missing elevation onto NaN, the "not reported" elevation of
+// LocationEvent.
+func elevationOrUnknown(v *float64) float64 {
+	if v == nil {
+		return math.NaN()
+	}
+	return *v
+}
@@ -0,0 +1,94 @@
+package ingest
+
+import (
+	"math"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestParseOwnTracks(t *testing.T) {
+	now := time.UnixMilli(1_700_000_100_000)
+	body := `{"_type":"location","tid":"mc","lat":51.05,"lon":3.72,"tst":1700000000,"vel":54,"cog":270,"alt":12,"batt":64,"acc":5}`
+	events, err := ParseOwnTracks(4, []byte(body), now)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	h := Header{CarID: 4, TS: 1_700_000_000_000}
+	if len(events) != 2 {
+		t.Fatalf("expected location and battery, got %+v", events)
+	}
+	if want := (LocationEvent{Header: h, Lat: 51.05, Lon: 3.72, SpeedKPH: 54, Heading: 270, ElevationM: 12}); events[0] != want {
+		t.Fatalf("unexpected location: %+v", events[0])
+	}
+	if want := (MetricEvent{Header: h, Metric: MetricBatteryLevel, Value: 64}); events[1] != want {
+		t.Fatalf("unexpected battery: %+v", events[1])
+	}
+
+	// optional fields are not reported and a missing timestamp means now
+	events, err = ParseOwnTracks(4, []byte(`{"_type":"location","lat":1,"lon":2}`), now)
+	if err != nil || len(events) != 1 {
+		t.Fatalf("unexpected result: %+v, %v", events, err)
+	}
+	loc := events[0].(LocationEvent)
+	if !math.IsNaN(loc.ElevationM) {
+		t.Fatalf("expected no elevation, got %v", loc.ElevationM)
+	}
+	loc.ElevationM = 0
+	if want := (LocationEvent{Header: Header{CarID: 4, TS: now.UnixMilli()}, Lat: 1, Lon: 2, SpeedKPH: -1, Heading: -1}); loc != want {
+		t.Fatalf("unexpected location: %+v", events[0])
+	}
+	// below sea level is an elevation like any other
+	events, err = ParseOwnTracks(4, []byte(`{"_type":"location","lat":52.3,"lon":4.7,"alt":-4}`), now)
+	if err != nil || events[0].(LocationEvent).ElevationM != -4 {
+		t.Fatalf("expected the negative altitude to be kept: %+v, %v", events, err)
+	}
+
+	// other message types are ignored
+	if events, err := ParseOwnTracks(4, []byte(`{"_type":"transition","event":"enter"}`), now); err != nil || len(events) != 0 {
+		t.Fatalf("expected no events, got %+v, %v", events, err)
+	}
+	for _, bad := range []string{`nope`, `{"_type":"location","lat":1}`, `{"_type":"location","lat":91,"lon":2}`} {
+		if _, err := ParseOwnTracks(4, []byte(bad), now); err == nil {
+			t.Fatalf("expected error for %s", bad)
+		}
+	}
+}
+
+func TestParseOsmAnd(t *testing.T) {
+	now := time.UnixMilli(1_700_000_100_000)
+	q := url.Values{"id": {"key"}, "lat": {"51.05"}, "lon": {"3.72"}, "timestamp": {"1700000000"}, "speed": {"10"}, "bearing": {"90"}, "altitude": {"12.5"}, "batt": {"64"}}
+	events, err := ParseOsmAnd(4, q, now)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	h := Header{CarID: 4, TS: 1_700_000_000_000}
+	if want := (LocationEvent{Header: h, Lat: 51.05, Lon: 3.72, SpeedKPH: 18.52, Heading: 90, ElevationM: 12.5}); len(events) != 2 || events[0] != want {
+		t.Fatalf("unexpected events: %+v", events)
+	}
+
+	cases := map[string]int64{
+		"1700000000500":        1_700_000_000_500,
+		"2023-11-14T22:13:20Z": 1_700_000_000_000,
+		"":                     now.UnixMilli(),
+		// device clocks running ahead are clamped
+		"1800000000": now.UnixMilli(),
+	}
+	for ts, want := range cases {
+		events, err := ParseOsmAnd(4, url.Values{"lat": {"1"}, "lon": {"2"}, "timestamp": {ts}}, now)
+		if err != nil || len(events) != 1 || events[0].Time() != want {
+			t.Fatalf("timestamp %q: unexpected result %+v, %v", ts, events, err)
+		}
+	}
+
+	for _, bad := range []url.Values{
+		{"lat": {"1"}},
+		{"lat": {"x"}, "lon": {"2"}},
+		{"lat": {"1"}, "lon": {"2"}, "speed": {"NaN"}},
+		{"lat": {"1"}, "lon": {"2"}, "timestamp": {"yesterday"}},
+	} {
+		if _, err := ParseOsmAnd(4, bad, now); err == nil {
+			t.Fatalf("expected error for %v", bad)
+		}
+	}
+}
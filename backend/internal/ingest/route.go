@@ -0,0 +1,234 @@
+package ingest
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Point is a single coordinate of a route. Ele is NaN when the route has no elevation.
+type Point struct {
+	Lat float64
+	Lon float64
+	Ele float64
+}
+
+var errNoLineString = errors.New("no line string found")
+
+// LoadRoute reads a GPX, KML or GeoJSON route, picking the format from the file extension.
+func LoadRoute(path string) ([]Point, error) {
+	f, err := os.Open(path) // #nosec G304 -- path comes from server config
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	var pts []Point
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".gpx":
+		pts, err = ParseGPX(f)
+	case ".kml":
+		pts, err = ParseKML(f)
+	case ".geojson", ".json":
+		pts, err = ParseGeoJSON(f)
+	default:
+		return nil, fmt.Errorf("unsupported route format %q", ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return pts, nil
+}
+
+// ParseGPX returns the points of all tracks in the document, or of its routes when it has no
+// tracks.
+func ParseGPX(r io.Reader) ([]Point, error) {
+	type gpxPoint struct {
+		Lat float64  `xml:"lat,attr"`
+		Lon float64  `xml:"lon,attr"`
+		Ele *float64 `xml:"ele"`
+	}
+	var doc struct {
+		Tracks []struct {
+			Segments []struct {
+				Points []gpxPoint `xml:"trkpt"`
+			} `xml:"trkseg"`
+		} `xml:"trk"`
+		Routes []struct {
+			Points []gpxPoint `xml:"rtept"`
+		} `xml:"rte"`
+	}
+	if err := xml.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, err
+	}
+	var pts []Point
+	add := func(p gpxPoint) {
+		ele := math.NaN()
+		if p.Ele != nil {
+			ele = *p.Ele
+		}
+		pts = append(pts, Point{Lat: p.Lat, Lon: p.Lon, Ele: ele})
+	}
+	for _, trk := range doc.Tracks {
+		for _, seg := range trk.Segments {
+			for _, p := range seg.Points {
+				add(p)
+			}
+		}
+	}
+	if len(pts) == 0 {
+		for _, rte := range doc.Routes {
+			for _, p := range rte.Points {
+				add(p)
+			}
+		}
+	}
+	return checkRoute(pts)
+}
+
+// ParseKML returns the coordinates of all LineStrings in the document, wherever they're nested.
+func ParseKML(r io.Reader) ([]Point, error) {
+	dec := xml.NewDecoder(r)
+	var pts []Point
+	inLineString := false
+	for {
+		tok, err := dec.Token()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "LineString":
+				inLineString = true
+			case "coordinates":
+				if !inLineString {
+					continue
+				}
+				var text string
+				if err := dec.DecodeElement(&text, &t); err != nil {
+					return nil, err
+				}
+				for _, tuple := range strings.Fields(text) {
+					p, err := parseTuple(strings.Split(tuple, ","))
+					if err != nil {
+						return nil, err
+					}
+					pts = append(pts, p)
+				}
+			}
+		case xml.EndElement:
+			if t.Name.Local == "LineString" {
+				inLineString = false
+			}
+		}
+	}
+	return checkRoute(pts)
+}
+
+// ParseGeoJSON accepts a LineString or MultiLineString, either bare, as a Feature or as part of
+// a FeatureCollection. All lines found are joined in document order.
+func ParseGeoJSON(r io.Reader) ([]Point, error) {
+	type geometry struct {
+		Type        string          `json:"type"`
+		Coordinates json.RawMessage `json:"coordinates"`
+	}
+	var doc struct {
+		geometry
+		Geometry *geometry `json:"geometry"`
+		Features []struct {
+			Geometry *geometry `json:"geometry"`
+		} `json:"features"`
+	}
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, err
+	}
+	var pts []Point
+	add := func(g *geometry) error {
+		if g == nil {
+			return nil
+		}
+		var lines [][][]float64
+		switch g.Type {
+		case "LineString":
+			var line [][]float64
+			if err := json.Unmarshal(g.Coordinates, &line); err != nil {
+				return err
+			}
+			lines = [][][]float64{line}
+		case "MultiLineString":
+			if err := json.Unmarshal(g.Coordinates, &lines); err != nil {
+				return err
+			}
+		}
+		for _, line := range lines {
+			for _, c := range line {
+				p, err := parsePosition(c)
+				if err != nil {
+					return err
+				}
+				pts = append(pts, p)
+			}
+		}
+		return nil
+	}
+	if err := add(&doc.geometry); err != nil {
+		return nil, err
+	}
+	if err := add(doc.Geometry); err != nil {
+		return nil, err
+	}
+	for _, f := range doc.Features {
+		if err := add(f.Geometry); err != nil {
+			return nil, err
+		}
+	}
+	return checkRoute(pts)
+}
+
+// parseTuple parses a KML lon,lat[,alt] tuple.
+func parseTuple(fields []string) (Point, error) {
+	pos := make([]float64, 0, len(fields))
+	for _, f := range fields {
+		v, err := strconv.ParseFloat(f, 64)
+		if err != nil {
+			return Point{}, fmt.Errorf("invalid coordinate %q", strings.Join(fields, ","))
+		}
+		pos = append(pos, v)
+	}
+	return parsePosition(pos)
+}
+
+// parsePosition converts a [lon, lat, (ele)] position, the order used by GeoJSON and KML.
+func parsePosition(pos []float64) (Point, error) {
+	if len(pos) < 2 {
+		return Point{}, fmt.Errorf("invalid position %v", pos)
+	}
+	p := Point{Lon: pos[0], Lat: pos[1], Ele: math.NaN()}
+	if len(pos) > 2 {
+		p.Ele = pos[2]
+	}
+	return p, nil
+}
+
+func checkRoute(pts []Point) ([]Point, error) {
+	if len(pts) < 2 {
+		return nil, errNoLineString
+	}
+	for _, p := range pts {
+		if p.Lat < -90 || p.Lat > 90 || p.Lon < -180 || p.Lon > 180 {
+			return nil, fmt.Errorf("coordinate out of range: %v,%v", p.Lat, p.Lon)
+		}
+	}
+	return pts, nil
+}
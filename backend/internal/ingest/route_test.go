@@ -0,0 +1,99 @@
+package ingest
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseGPX(t *testing.T) {
+	doc := `<?xml version="1.0"?>
+<gpx version="1.1" xmlns="http://www.topografix.com/GPX/1/1">
+  <trk><trkseg>
+    <trkpt lat="51.05" lon="3.72"><ele>10.5</ele></trkpt>
+    <trkpt lat="51.06" lon="3.73"><ele>12</ele></trkpt>
+  </trkseg><trkseg>
+    <trkpt lat="51.07" lon="3.74"></trkpt>
+  </trkseg></trk>
+</gpx>`
+	pts, err := ParseGPX(strings.NewReader(doc))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if len(pts) != 3 || pts[0].Lat != 51.05 || pts[0].Lon != 3.72 || pts[0].Ele != 10.5 || pts[2].Lat != 51.07 {
+		t.Fatalf("unexpected points: %+v", pts)
+	}
+	if !math.IsNaN(pts[2].Ele) {
+		t.Fatalf("expected unknown elevation, got %v", pts[2].Ele)
+	}
+
+	// routes are used when there are no tracks
+	doc = `<gpx><rte><rtept lat="1" lon="2"/><rtept lat="3" lon="4"/></rte></gpx>`
+	if pts, err = ParseGPX(strings.NewReader(doc)); err != nil || len(pts) != 2 || pts[1].Lon != 4 {
+		t.Fatalf("unexpected route points: %+v, %v", pts, err)
+	}
+
+	if _, err := ParseGPX(strings.NewReader(`<gpx><wpt lat="1" lon="2"/></gpx>`)); err == nil {
+		t.Fatalf("expected error without a track")
+	}
+}
+
+func TestParseKML(t *testing.T) {
+	doc := `<?xml version="1.0" encoding="UTF-8"?>
+<kml xmlns="http://www.opengis.net/kml/2.2"><Document><Folder>
+  <Placemark><Point><coordinates>9,9</coordinates></Point></Placemark>
+  <Placemark><LineString><coordinates>
+    3.72,51.05,10 3.73,51.06,12
+    3.74,51.07
+  </coordinates></LineString></Placemark>
+</Folder></Document></kml>`
+	pts, err := ParseKML(strings.NewReader(doc))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if len(pts) != 3 || pts[0].Lat != 51.05 || pts[0].Lon != 3.72 || pts[0].Ele != 10 || !math.IsNaN(pts[2].Ele) {
+		t.Fatalf("unexpected points: %+v", pts)
+	}
+
+	bad := `<kml><Placemark><LineString><coordinates>3.72;51.05 1,2</coordinates></LineString></Placemark></kml>`
+	if _, err := ParseKML(strings.NewReader(bad)); err == nil {
+		t.Fatalf("expected error for invalid coordinates")
+	}
+}
+
+func TestParseGeoJSON(t *testing.T) {
+	cases := map[string]string{
+		"geometry":   `{"type":"LineString","coordinates":[[3.72,51.05,10],[3.73,51.06]]}`,
+		"feature":    `{"type":"Feature","properties":{},"geometry":{"type":"LineString","coordinates":[[3.72,51.05,10],[3.73,51.06]]}}`,
+		"collection": `{"type":"FeatureCollection","features":[{"type":"Feature","geometry":{"type":"Point","coordinates":[1,2]}},{"type":"Feature","geometry":{"type":"MultiLineString","coordinates":[[[3.72,51.05,10]],[[3.73,51.06]]]}}]}`,
+	}
+	for name, doc := range cases {
+		pts, err := ParseGeoJSON(strings.NewReader(doc))
+		if err != nil {
+			t.Fatalf("%s: parse: %v", name, err)
+		}
+		if len(pts) != 2 || pts[0].Lat != 51.05 || pts[0].Lon != 3.72 || pts[0].Ele != 10 || pts[1].Lat != 51.06 || !math.IsNaN(pts[1].Ele) {
+			t.Fatalf("%s: unexpected points: %+v", name, pts)
+		}
+	}
+
+	if _, err := ParseGeoJSON(strings.NewReader(`{"type":"LineString","coordinates":[[3.72,151.05],[3.73,51.06]]}`)); err == nil {
+		t.Fatalf("expected error for out of range latitude")
+	}
+}
+
+func TestLoadRoute(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "route.geojson")
+	if err := os.WriteFile(path, []byte(`{"type":"LineString","coordinates":[[3.72,51.05],[3.73,51.06]]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if pts, err := LoadRoute(path); err != nil || len(pts) != 2 {
+		t.Fatalf("unexpected result: %+v, %v", pts, err)
+	}
+	if _, err := LoadRoute(filepath.Join(dir, "route.csv")); err == nil {
+		t.Fatalf("expected error for unsupported format")
+	}
+}
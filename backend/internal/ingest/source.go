@@ -0,0 +1,17 @@
+// Package ingest turns car data from any source (TeslaMate over MQTT, recordings, synthetic
+// cars, ...) into typed events and applies them to the store.
+package ingest
+
+import "context"
+
+// Source produces events, passing each to emit, until ctx is done or the source runs out of
+// data. Events for a car must be emitted in order.
+type Source interface {
+	Run(ctx context.Context, emit func(Event)) error
+}
+
+// CarMapper is implemented by sources that know which cars they feed before these sent anything,
+// so cars restored from history go offline along with their source too.
+type CarMapper interface {
+	Feeds(carID int64) bool
+}
@@ -0,0 +1,238 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/state"
+	"github.com/rs/zerolog/log"
+)
+
+// SpeedStep sets the speed from FromKM into the route until the next step.
+type SpeedStep struct {
+	FromKM float64
+	KPH    float64
+}
+
+// SpeedProfile is a list of speed steps ordered by FromKM.
+type SpeedProfile []SpeedStep
+
+// ParseSpeedProfile parses either a single speed ("50") or comma separated km:kph steps
+// ("0:30,1.5:90,12:50").
+func ParseSpeedProfile(s string) (SpeedProfile, error) {
+	var p SpeedProfile
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		from, kph, found := strings.Cut(part, ":")
+		if !found {
+			from, kph = "0", part
+		}
+		fromKM, err1 := strconv.ParseFloat(strings.TrimSpace(from), 64)
+		speed, err2 := strconv.ParseFloat(strings.TrimSpace(kph), 64)
+		if err1 != nil || err2 != nil || fromKM < 0 || speed <= 0 {
+			return nil, fmt.Errorf("invalid speed step %q", part)
+		}
+		p = append(p, SpeedStep{FromKM: fromKM, KPH: speed})
+	}
+	if len(p) == 0 {
+		return nil, errors.New("empty speed profile")
+	}
+	sort.SliceStable(p, func(i, j int) bool { return p[i].FromKM < p[j].FromKM })
+	if p[0].FromKM > 0 {
+		return nil, fmt.Errorf("speed profile must start at 0km, starts at %vkm", p[0].FromKM)
+	}
+	return p, nil
+}
+
+// SpeedAt returns the speed at the given distance into the route.
+func (p SpeedProfile) SpeedAt(km float64) float64 {
+	i := sort.Search(len(p), func(i int) bool { return p[i].FromKM > km })
+	if i == 0 {
+		return p[0].KPH
+	}
+	return p[i-1].KPH
+}
+
+// Duration returns how long it takes to drive from fromKM to toKM following the profile.
+func (p SpeedProfile) Duration(fromKM, toKM float64) time.Duration {
+	var hours float64
+	for i, step := range p {
+		end := toKM
+		if i+1 < len(p) && p[i+1].FromKM < end {
+			end = p[i+1].FromKM
+		}
+		start := math.Max(fromKM, step.FromKM)
+		if end > start {
+			hours += (end - start) / step.KPH
+		}
+	}
+	return time.Duration(hours * float64(time.Hour))
+}
+
+// Synthetic drives a fake car along a route, for development environments without TeslaMate.
+// It emits the location, speed, heading, elevation, a falling state of charge and an active
+// route with a shrinking ETA.
+type Synthetic struct {
+	CarID       int64
+	DisplayName string
+	Route       []Point
+	Profile     SpeedProfile
+	// Interval between updates, 1s when zero
+	Interval time.Duration
+	// Loop starts over, recharged to StartSOCPct, once the end of the route is reached
+	Loop bool
+
+	// StartSOCPct is the state of charge at the start of the route, 80% when zero
+	StartSOCPct float64
+	// ConsumptionWhKM is the energy used per km, 160Wh/km when zero
+	ConsumptionWhKM float64
+	// CapacityKWh is the usable battery capacity, 75kWh when zero
+	CapacityKWh float64
+
+	out    func(Event)
+	cum    []float64 // cumulative distance in meters up to each route point
+	distM  float64   // distance driven so far
+	socPct float64
+}
+
+// Run drives the route, once or until ctx is done when looping.
+func (s *Synthetic) Run(ctx context.Context, emit func(Event)) error {
+	if err := s.init(emit); err != nil {
+		return err
+	}
+	t := time.NewTicker(s.Interval)
+	defer t.Stop()
+	last := time.Now()
+	s.start(last.UnixMilli())
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case now := <-t.C:
+			if !s.step(now.UnixMilli(), now.Sub(last)) {
+				last = now
+				continue
+			}
+			if !s.Loop {
+				return nil
+			}
+			log.Info().Int64("car_id", s.CarID).Msg("synthetic car reached destination, starting over")
+			s.distM = 0
+			s.socPct = s.StartSOCPct
+			last = time.Now()
+			s.start(last.UnixMilli())
+		}
+	}
+}
+
+func (s *Synthetic) init(emit func(Event)) error {
+	if len(s.Route) < 2 {
+		return errNoLineString
+	}
+	if len(s.Profile) == 0 {
+		return errors.New("empty speed profile")
+	}
+	if s.Interval <= 0 {
+		s.Interval = time.Second
+	}
+	if s.StartSOCPct <= 0 {
+		s.StartSOCPct = 80
+	}
+	if s.ConsumptionWhKM <= 0 {
+		s.ConsumptionWhKM = 160
+	}
+	if s.CapacityKWh <= 0 {
+		s.CapacityKWh = 75
+	}
+	s.out = emit
+	s.cum = make([]float64, len(s.Route))
+	for i := 1; i < len(s.Route); i++ {
+		a, b := s.Route[i-1], s.Route[i]
+		s.cum[i] = s.cum[i-1] + state.DistanceMeters(a.Lat, a.Lon, b.Lat, b.Lon)
+	}
+	s.distM = 0
+	s.socPct = s.StartSOCPct
+	return nil
+}
+
+// start puts the car in drive at the beginning of the route.
+func (s *Synthetic) start(ts int64) {
+	h := Header{CarID: s.CarID, TS: ts}
+	if s.DisplayName != "" {
+		s.out(MetaEvent{Header: h, Field: MetaDisplayName, Value: s.DisplayName})
+	}
+	s.out(StatusEvent{Header: h, Status: StatusVehicle, Value: "driving"})
+	s.out(StatusEvent{Header: h, Status: StatusShift, Value: "D"})
+	s.emit(ts)
+}
+
+// step advances the car by dt and reports whether it reached the end of the route.
+func (s *Synthetic) step(ts int64, dt time.Duration) bool {
+	total := s.cum[len(s.cum)-1]
+	kph := s.Profile.SpeedAt(s.distM / 1000)
+	moved := math.Min(kph/3.6*dt.Seconds(), total-s.distM)
+	s.distM += moved
+	s.socPct = math.Max(0, s.socPct-moved/1000*s.ConsumptionWhKM/(s.CapacityKWh*1000)*100)
+	if s.distM < total {
+		s.emit(ts)
+		return false
+	}
+
+	// parked at the destination
+	h := Header{CarID: s.CarID, TS: ts}
+	end := s.Route[len(s.Route)-1]
+	s.out(LocationEvent{Header: h, Lat: end.Lat, Lon: end.Lon, SpeedKPH: 0, Heading: -1, ElevationM: end.Ele})
+	s.out(MetricEvent{Header: h, Metric: MetricPower, Value: 0})
+	s.out(MetricEvent{Header: h, Metric: MetricBatteryLevel, Value: math.Round(s.socPct)})
+	s.out(RouteEvent{Header: h})
+	s.out(StatusEvent{Header: h, Status: StatusShift, Value: "P"})
+	s.out(StatusEvent{Header: h, Status: StatusVehicle, Value: "online"})
+	return true
+}
+
+// emit sends the state at the current position.
+func (s *Synthetic) emit(ts int64) {
+	total := s.cum[len(s.cum)-1]
+	// segment i runs from point i to point i+1
+	i := sort.SearchFloat64s(s.cum, s.distM)
+	if i > 0 && (i == len(s.cum) || s.cum[i] > s.distM) {
+		i--
+	}
+	if i >= len(s.Route)-1 {
+		i = len(s.Route) - 2
+	}
+	a, b := s.Route[i], s.Route[i+1]
+	frac := 0.0
+	if seg := s.cum[i+1] - s.cum[i]; seg > 0 {
+		frac = (s.distM - s.cum[i]) / seg
+	}
+	lat := a.Lat + (b.Lat-a.Lat)*frac
+	lon := a.Lon + (b.Lon-a.Lon)*frac
+	ele := a.Ele + (b.Ele-a.Ele)*frac
+	kph := s.Profile.SpeedAt(s.distM / 1000)
+	heading := math.Round(state.BearingDegrees(a.Lat, a.Lon, b.Lat, b.Lon))
+
+	h := Header{CarID: s.CarID, TS: ts}
+	s.out(LocationEvent{Header: h, Lat: lat, Lon: lon, SpeedKPH: kph, Heading: heading, ElevationM: ele})
+	// power in kW like TeslaMate reports it, to a tenth
+	s.out(MetricEvent{Header: h, Metric: MetricPower, Value: math.Round(kph*s.ConsumptionWhKM/100) / 10})
+	s.out(MetricEvent{Header: h, Metric: MetricBatteryLevel, Value: math.Round(s.socPct)})
+
+	end := s.Route[len(s.Route)-1]
+	eta := s.Profile.Duration(s.distM/1000, total/1000)
+	s.out(RouteEvent{
+		Header: h,
+		Dest:   &state.Dest{Lat: end.Lat, Lon: end.Lon},
+		ETAMin: math.Ceil(eta.Minutes()),
+		DistKM: math.Round((total-s.distM)/100) / 10,
+	})
+}
@@ -0,0 +1,155 @@
+package ingest
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/state"
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/stream"
+)
+
+func TestParseSpeedProfile(t *testing.T) {
+	p, err := ParseSpeedProfile("50")
+	if err != nil || len(p) != 1 || p[0] != (SpeedStep{FromKM: 0, KPH: 50}) {
+		t.Fatalf("unexpected profile: %+v, %v", p, err)
+	}
+	p, err = ParseSpeedProfile("2:90, 0:30 ,10:50")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	for _, c := range []struct{ km, want float64 }{{0, 30}, {1.9, 30}, {2, 90}, {9, 90}, {25, 50}} {
+		if got := p.SpeedAt(c.km); got != c.want {
+			t.Fatalf("SpeedAt(%v) = %v, want %v", c.km, got, c.want)
+		}
+	}
+	// 1km at 30 plus 8km at 90 plus 2km at 50
+	want := time.Duration((1.0/30 + 8.0/90 + 2.0/50) * float64(time.Hour))
+	if got := p.Duration(1, 12); math.Abs(float64(got-want)) > float64(time.Millisecond) {
+		t.Fatalf("Duration = %v, want %v", got, want)
+	}
+
+	for _, bad := range []string{"", "fast", "1:50", "0:0", "0:-5"} {
+		if _, err := ParseSpeedProfile(bad); err == nil {
+			t.Fatalf("expected error for %q", bad)
+		}
+	}
+}
+
+// straight line north of about 2.2km
+var testRoute = []Point{
+	{Lat: 51.00, Lon: 3.70, Ele: 10},
+	{Lat: 51.01, Lon: 3.70, Ele: 20},
+	{Lat: 51.02, Lon: 3.70, Ele: 10},
+}
+
+func TestSynthetic_Drive(t *testing.T) {
+	st := state.NewStore()
+	hub := stream.NewHub()
+	sub := hub.Subscribe(7)
+	defer hub.Unsubscribe(sub)
+	s := &Synthetic{CarID: 7, DisplayName: "Test", Route: testRoute, Profile: SpeedProfile{{KPH: 36}}}
+	if err := s.init(NewDispatcher(st, hub).Dispatch); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	s.start(1000)
+
+	snap, _ := st.GetSnapshot(7)
+	if snap.DisplayName != "Test" || snap.Vehicle == nil || snap.Vehicle.State != "driving" || snap.Vehicle.ShiftState != "D" {
+		t.Fatalf("unexpected initial state: %+v", snap)
+	}
+	if snap.Route == nil || snap.Route.Dest == nil || snap.Route.Dest.Lat != 51.02 {
+		t.Fatalf("expected active route to the end of the track: %+v", snap.Route)
+	}
+	startETA := snap.Route.ETAMin
+	// 2.2km at 36km/h takes about 4 minutes
+	if startETA < 3 || startETA > 5 {
+		t.Fatalf("unexpected ETA %v", startETA)
+	}
+
+	// 10m/s for 100s ends up halfway the first segment
+	if s.step(101_000, 100*time.Second) {
+		t.Fatalf("didn't expect to arrive yet")
+	}
+	snap, _ = st.GetSnapshot(7)
+	loc := snap.Location
+	if loc == nil || math.Abs(loc.Lat-51.009) > 0.0002 || loc.Lon != 3.70 || loc.SpeedKPH != 36 || loc.Heading != 0 {
+		t.Fatalf("unexpected location: %+v", loc)
+	}
+	if math.Abs(loc.ElevationM-19) > 0.5 {
+		t.Fatalf("expected interpolated elevation, got %v", loc.ElevationM)
+	}
+	if snap.Route.ETAMin >= startETA || snap.Route.DistKM >= 2.2 {
+		t.Fatalf("expected ETA and distance to shrink: %+v", snap.Route)
+	}
+	// 36km/h at 160Wh/km draws 5.76kW
+	if snap.Battery == nil || snap.Battery.SOCPct > 80 || snap.Battery.PowerW != 5.8 {
+		t.Fatalf("unexpected battery: %+v", snap.Battery)
+	}
+
+	// the rest of the way
+	if !s.step(400_000, 300*time.Second) {
+		t.Fatalf("expected to arrive")
+	}
+	snap, _ = st.GetSnapshot(7)
+	if snap.Location.Lat != 51.02 || snap.Location.SpeedKPH != 0 || snap.Vehicle.ShiftState != "P" || snap.Route.Dest != nil {
+		t.Fatalf("unexpected state at destination: %+v %+v %+v", snap.Location, snap.Vehicle, snap.Route)
+	}
+	if snap.Battery.PowerW != 0 {
+		t.Fatalf("expected no power use when parked: %+v", snap.Battery)
+	}
+
+	select {
+	case f := <-sub.Ch:
+		if _, event, _, ok := stream.ParseFrame(f); !ok || event != "delta" {
+			t.Fatalf("unexpected frame %q", f)
+		}
+	default:
+		t.Fatalf("expected deltas to be broadcast")
+	}
+}
+
+func TestSynthetic_SOCFalls(t *testing.T) {
+	st := state.NewStore()
+	// 100km with a 10kWh battery at 200Wh/km would use twice the battery
+	route := []Point{{Lat: 50, Lon: 3, Ele: math.NaN()}, {Lat: 50.9, Lon: 3, Ele: math.NaN()}}
+	s := &Synthetic{CarID: 1, Route: route, Profile: SpeedProfile{{KPH: 100}}, StartSOCPct: 90, ConsumptionWhKM: 200, CapacityKWh: 10}
+	if err := s.init(NewDispatcher(st, stream.NewHub()).Dispatch); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	s.start(0)
+	s.step(1, 3*time.Minute) // 5km, 1kWh
+	snap, _ := st.GetSnapshot(1)
+	if snap.Battery.SOCPct != 80 {
+		t.Fatalf("expected 80%%, got %v", snap.Battery.SOCPct)
+	}
+	if snap.Location.ElevationM != 0 {
+		t.Fatalf("expected no elevation without elevation data, got %v", snap.Location.ElevationM)
+	}
+	s.step(2, time.Hour)
+	if snap, _ = st.GetSnapshot(1); snap.Battery.SOCPct != 0 {
+		t.Fatalf("expected SOC to bottom out at 0, got %v", snap.Battery.SOCPct)
+	}
+}
+
+func TestSynthetic_Run(t *testing.T) {
+	st := state.NewStore()
+	s := &Synthetic{CarID: 1, Route: testRoute, Profile: SpeedProfile{{KPH: 1_000_000}}, Interval: 5 * time.Millisecond}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	// about 8ms at this speed, so it must return on its own
+	if err := NewDispatcher(st, stream.NewHub()).Run(ctx, s); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if ctx.Err() != nil {
+		t.Fatalf("expected the drive to finish before the timeout")
+	}
+	if snap, _ := st.GetSnapshot(1); snap.Vehicle == nil || snap.Vehicle.ShiftState != "P" {
+		t.Fatalf("expected car to be parked: %+v", snap.Vehicle)
+	}
+
+	if err := (&Synthetic{Route: testRoute[:1], Profile: SpeedProfile{{KPH: 1}}}).Run(ctx, func(Event) {}); err == nil {
+		t.Fatalf("expected error for a route without segments")
+	}
+}
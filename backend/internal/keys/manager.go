@@ -6,6 +6,7 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"errors"
+	"sort"
 	"sync"
 	"time"
 
@@ -14,21 +15,58 @@ import (
 	"github.com/lestrrat-go/jwx/v3/jwk"
 	"github.com/lestrrat-go/jwx/v3/jws"
 	"github.com/lestrrat-go/jwx/v3/jwt"
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/metrics"
 	"github.com/rs/zerolog/log"
 )
 
-// Manager holds current and previous EC JWKs and rotates them on a ticker.
+// Manager holds the current EC JWK plus a number of previous ones and rotates them on a ticker.
+// When backed by a Store, keys are loaded on startup and persisted on rotation so that restarts
+// and other instances sharing the store keep accepting each other's tokens.
 type Manager struct {
-	mu       sync.RWMutex
-	current  jwk.Key
-	previous jwk.Key
+	mu sync.RWMutex
+	// keys holds the current key followed by previous keys, newest first
+	keys        []StoredKey
+	store       Store
+	retain      int
+	rotateEvery time.Duration
+	lastReload  time.Time
 }
 
-func NewManager(ctx context.Context, rotateEvery time.Duration) (*Manager, error) {
-	m := &Manager{}
-	if err := m.rotate(); err != nil {
+// Option configures a Manager.
+type Option func(*Manager)
+
+// WithStore persists keys in the given store.
+func WithStore(s Store) Option {
+	return func(m *Manager) { m.store = s }
+}
+
+// WithRetain sets for how many rotations a previous key is kept around for verification
+// (default 1).
+func WithRetain(n int) Option {
+	return func(m *Manager) {
+		if n >= 0 {
+			m.retain = n
+		}
+	}
+}
+
+// reloadThrottle limits how often verification failures trigger a reload from the store.
+const reloadThrottle = 10 * time.Second
+
+func NewManager(ctx context.Context, rotateEvery time.Duration, opts ...Option) (*Manager, error) {
+	m := &Manager{retain: 1, rotateEvery: rotateEvery}
+	for _, opt := range opts {
+		opt(m)
+	}
+	if err := m.reload(); err != nil {
 		return nil, err
 	}
+	// Reuse persisted keys unless the newest one is due for rotation
+	if m.needsRotation(rotateEvery) {
+		if err := m.rotate(); err != nil {
+			return nil, err
+		}
+	}
 	// Start rotation goroutine
 	if rotateEvery > 0 {
 		ticker := time.NewTicker(rotateEvery)
@@ -39,7 +77,7 @@ func NewManager(ctx context.Context, rotateEvery time.Duration) (*Manager, error
 				case <-ctx.Done():
 					return
 				case <-ticker.C:
-					_ = m.rotate() // best-effort
+					_ = m.tick() // best-effort
 				}
 			}
 		}()
@@ -47,47 +85,162 @@ func NewManager(ctx context.Context, rotateEvery time.Duration) (*Manager, error
 	return m, nil
 }
 
-func (m *Manager) rotate() error {
-	log.Info().Msg("rotating JWKs")
+// tick rotates the keys, unless another instance sharing the store rotated recently.
+func (m *Manager) tick() error {
+	if m.store != nil {
+		if err := m.reload(); err != nil {
+			log.Warn().Err(err).Msg("reload JWKs")
+		}
+		if !m.needsRotation(m.rotateEvery / 2) {
+			log.Info().Msg("adopting JWK rotated by another instance")
+			return nil
+		}
+	}
+	return m.rotate()
+}
 
-	// Generate ES256 key (P-256)
-	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+// needsRotation reports whether there is no key yet or the newest key is older than maxAge.
+// A zero maxAge means keys never expire.
+func (m *Manager) needsRotation(maxAge time.Duration) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if len(m.keys) == 0 {
+		return true
+	}
+	return maxAge > 0 && time.Since(m.keys[0].CreatedAt) >= maxAge
+}
+
+// reload replaces the in-memory keys with the ones found in the store.
+func (m *Manager) reload() error {
+	if m.store == nil {
+		return nil
+	}
+	loaded, err := m.store.Load()
 	if err != nil {
 		return err
 	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lastReload = time.Now()
+	if len(loaded) == 0 {
+		return nil
+	}
+	sort.Slice(loaded, func(i, j int) bool { return loaded[i].CreatedAt.After(loaded[j].CreatedAt) })
+	m.keys = loaded
+	m.trimLocked()
+	return nil
+}
+
+// trimLocked drops the keys that stopped being current more than retain rotations ago, also
+// from the store. Keys are judged by their age rather than counted: instances sharing the
+// store may rotate at about the same time, and the key another one just published (and signs
+// with) must survive. The current key is always kept, and keys never expire without rotation.
+func (m *Manager) trimLocked() {
+	if m.rotateEvery <= 0 || len(m.keys) <= 1 {
+		return
+	}
+	cutoff := time.Now().Add(-m.rotateEvery * time.Duration(m.retain+1))
+	kept := m.keys[:1]
+	for _, k := range m.keys[1:] {
+		if k.CreatedAt.After(cutoff) {
+			kept = append(kept, k)
+			continue
+		}
+		if m.store != nil {
+			kid, _ := k.Key.KeyID()
+			if err := m.store.Remove(kid); err != nil {
+				log.Warn().Err(err).Str("kid", kid).Msg("remove expired JWK")
+			}
+		}
+	}
+	m.keys = kept
+}
+
+// newKey generates an ES256 signing key created at the given time.
+func newKey(createdAt time.Time) (StoredKey, error) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return StoredKey{}, err
+	}
 	jwkKey, err := jwk.Import(priv)
 	if err != nil {
-		return err
+		return StoredKey{}, err
 	}
 	_ = jwkKey.Set(jwk.KeyUsageKey, "sig")
 	_ = jwkKey.Set(jwk.AlgorithmKey, jwa.ES256())
-	kid := uuid.New().String()
-	_ = jwkKey.Set(jwk.KeyIDKey, kid)
+	_ = jwkKey.Set(jwk.KeyIDKey, uuid.New().String())
+	return StoredKey{Key: jwkKey, CreatedAt: createdAt}, nil
+}
+
+func (m *Manager) rotate() error {
+	log.Info().Msg("rotating JWKs")
+
+	key, err := newKey(time.Now())
+	if err != nil {
+		return err
+	}
+	if m.store != nil {
+		if err := m.store.Add(key); err != nil {
+			return err
+		}
+	}
 
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	m.previous = m.current
-	m.current = jwkKey
+	m.keys = append([]StoredKey{key}, m.keys...)
+	m.trimLocked()
+	metrics.KeyRotations.Inc()
 	return nil
 }
 
 func (m *Manager) Current() jwk.Key {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
-	return m.current
+	if len(m.keys) == 0 {
+		return nil
+	}
+	return m.keys[0].Key
 }
 
 func (m *Manager) Previous() jwk.Key {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
-	return m.previous
+	if len(m.keys) < 2 {
+		return nil
+	}
+	return m.keys[1].Key
+}
+
+// PublicKeys returns the public halves of all keys currently accepted for verification.
+func (m *Manager) PublicKeys() (jwk.Set, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	set := jwk.NewSet()
+	for _, k := range m.keys {
+		pub, err := k.Key.PublicKey()
+		if err != nil {
+			return nil, err
+		}
+		if err := set.AddKey(pub); err != nil {
+			return nil, err
+		}
+	}
+	return set, nil
+}
+
+// NextRotation returns when the current key is due to be rotated, or the zero time when keys never rotate.
+func (m *Manager) NextRotation() time.Time {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.rotateEvery <= 0 || len(m.keys) == 0 {
+		return time.Time{}
+	}
+	return m.keys[0].CreatedAt.Add(m.rotateEvery)
 }
 
 // SignJWT signs with the current key and sets kid header.
 func (m *Manager) SignJWT(t jwt.Token) ([]byte, error) {
-	m.mu.RLock()
-	cur := m.current
-	m.mu.RUnlock()
+	cur := m.Current()
 	if cur == nil {
 		return nil, ErrNoKey
 	}
@@ -105,29 +258,41 @@ func (m *Manager) SignJWT(t jwt.Token) ([]byte, error) {
 	return jwt.Sign(t, jwt.WithKey(alg, cur, jws.WithProtectedHeaders(hdrs)))
 }
 
-// VerifyJWT verifies against current or previous key.
+// VerifyJWT verifies against the current or any of the retained previous keys.
+// Keys unknown to this instance may have been generated by another instance sharing
+// the store, so on failure the keys are reloaded (throttled) and verification retried.
 func (m *Manager) VerifyJWT(raw []byte) (jwt.Token, error) {
+	if tkn, err := m.verify(raw); err == nil {
+		return tkn, nil
+	}
 	m.mu.RLock()
-	cur := m.current
-	prev := m.previous
+	canReload := m.store != nil && time.Since(m.lastReload) > reloadThrottle
 	m.mu.RUnlock()
-
-	// Try current then previous
-	if cur != nil {
-		var curAlg jwa.SignatureAlgorithm
-		if err := cur.Get(jwk.AlgorithmKey, &curAlg); err != nil {
-			curAlg = jwa.ES256()
-		}
-		if tkn, err := jwt.Parse(raw, jwt.WithKey(curAlg, cur)); err == nil {
+	if canReload {
+		if err := m.reload(); err != nil {
+			log.Warn().Err(err).Msg("reload JWKs")
+		} else if tkn, err := m.verify(raw); err == nil {
 			return tkn, nil
 		}
 	}
-	if prev != nil {
-		var prevAlg jwa.SignatureAlgorithm
-		if err := prev.Get(jwk.AlgorithmKey, &prevAlg); err != nil {
-			prevAlg = jwa.ES256()
+	return nil, ErrVerificationFailed
+}
+
+func (m *Manager) verify(raw []byte) (jwt.Token, error) {
+	m.mu.RLock()
+	keys := make([]jwk.Key, 0, len(m.keys))
+	for _, k := range m.keys {
+		keys = append(keys, k.Key)
+	}
+	m.mu.RUnlock()
+
+	// Try current then previous keys
+	for _, key := range keys {
+		var alg jwa.SignatureAlgorithm
+		if err := key.Get(jwk.AlgorithmKey, &alg); err != nil {
+			alg = jwa.ES256()
 		}
-		if tkn, err := jwt.Parse(raw, jwt.WithKey(prevAlg, prev)); err == nil {
+		if tkn, err := jwt.Parse(raw, jwt.WithKey(alg, key)); err == nil {
 			return tkn, nil
 		}
 	}
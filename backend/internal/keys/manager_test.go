@@ -49,3 +49,163 @@ func TestManagerErrors(t *testing.T) {
 		t.Fatalf("expected verification failure")
 	}
 }
+
+func TestManagerPersistsKeysAcrossRestarts(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fs, err := NewFileStore(t.TempDir(), "")
+	if err != nil {
+		t.Fatalf("NewFileStore error: %v", err)
+	}
+	m1, err := NewManager(ctx, time.Hour, WithStore(fs))
+	if err != nil {
+		t.Fatalf("NewManager error: %v", err)
+	}
+	tok := jwt.New()
+	_ = tok.Set(jwt.ExpirationKey, time.Now().Add(time.Hour))
+	raw, err := m1.SignJWT(tok)
+	if err != nil {
+		t.Fatalf("SignJWT error: %v", err)
+	}
+
+	// a restarted (or second) instance reuses the persisted key instead of generating a new one
+	m2, err := NewManager(ctx, time.Hour, WithStore(fs))
+	if err != nil {
+		t.Fatalf("NewManager error: %v", err)
+	}
+	kid1, _ := m1.Current().KeyID()
+	kid2, _ := m2.Current().KeyID()
+	if kid1 != kid2 {
+		t.Fatalf("expected persisted key to be reused, got %q and %q", kid1, kid2)
+	}
+	if _, err := m2.VerifyJWT(raw); err != nil {
+		t.Fatalf("VerifyJWT on second instance failed: %v", err)
+	}
+}
+
+func TestManagerPicksUpKeysFromOtherInstances(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fs, _ := NewFileStore(t.TempDir(), "pass")
+	m1, _ := NewManager(ctx, time.Hour, WithStore(fs))
+	m2, _ := NewManager(ctx, time.Hour, WithStore(fs))
+
+	// m1 rotates; m2 only learns about the new key through the store
+	if err := m1.rotate(); err != nil {
+		t.Fatalf("rotate error: %v", err)
+	}
+	tok := jwt.New()
+	_ = tok.Set(jwt.ExpirationKey, time.Now().Add(time.Hour))
+	raw, _ := m1.SignJWT(tok)
+	m2.lastReload = time.Time{}
+	if _, err := m2.VerifyJWT(raw); err != nil {
+		t.Fatalf("expected second instance to reload and verify: %v", err)
+	}
+
+	// a tick on m2 shortly after m1 rotated adopts m1's key instead of rotating again
+	if err := m2.tick(); err != nil {
+		t.Fatalf("tick error: %v", err)
+	}
+	kid1, _ := m1.Current().KeyID()
+	kid2, _ := m2.Current().KeyID()
+	if kid1 != kid2 {
+		t.Fatalf("expected second instance to adopt key %q, got %q", kid1, kid2)
+	}
+}
+
+func TestManagerRetainsConfiguredPreviousKeys(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fs, _ := NewFileStore(t.TempDir(), "")
+	// keys rotated hourly, the oldest one stopped being current more than two rotations ago
+	var kids []string
+	for _, age := range []time.Duration{10 * time.Minute, 70 * time.Minute, 130 * time.Minute, 190 * time.Minute} {
+		k, err := newKey(time.Now().Add(-age))
+		if err != nil {
+			t.Fatalf("newKey error: %v", err)
+		}
+		_ = fs.Add(k)
+		kid, _ := k.Key.KeyID()
+		kids = append(kids, kid)
+	}
+	m, err := NewManager(ctx, time.Hour, WithStore(fs), WithRetain(2))
+	if err != nil {
+		t.Fatalf("NewManager error: %v", err)
+	}
+	set, _ := m.PublicKeys()
+	if _, ok := set.LookupKeyID(kids[2]); !ok || set.Len() != 3 {
+		t.Fatalf("expected the keys of the last three rotations, got %d", set.Len())
+	}
+	if _, ok := set.LookupKeyID(kids[3]); ok {
+		t.Fatal("expected the key three rotations old to be dropped")
+	}
+	if loaded, _ := fs.Load(); len(loaded) != 3 {
+		t.Fatalf("expected 3 keys persisted, got %d", len(loaded))
+	}
+}
+
+func TestManagerKeepsKeysOfConcurrentRotations(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fs, _ := NewFileStore(t.TempDir(), "")
+	m1, _ := NewManager(ctx, time.Hour, WithStore(fs), WithRetain(0))
+	m2, _ := NewManager(ctx, time.Hour, WithStore(fs), WithRetain(0))
+
+	// both instances rotate at about the same time, m1 keeps signing with its own key
+	if err := m1.rotate(); err != nil {
+		t.Fatalf("rotate error: %v", err)
+	}
+	if err := m2.rotate(); err != nil {
+		t.Fatalf("rotate error: %v", err)
+	}
+	tok := jwt.New()
+	_ = tok.Set(jwt.ExpirationKey, time.Now().Add(time.Hour))
+	raw, _ := m1.SignJWT(tok)
+
+	if err := m1.reload(); err != nil {
+		t.Fatalf("reload error: %v", err)
+	}
+	m2.lastReload = time.Time{}
+	for _, m := range []*Manager{m1, m2} {
+		if _, err := m.VerifyJWT(raw); err != nil {
+			t.Fatalf("expected the key of the other rotation to survive: %v", err)
+		}
+	}
+	if loaded, _ := fs.Load(); len(loaded) != 3 {
+		t.Fatalf("expected no recent key to be removed from the store, got %d", len(loaded))
+	}
+}
+
+func TestManagerPublicKeys(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m, _ := NewManager(ctx, time.Hour)
+	_ = m.rotate()
+
+	set, err := m.PublicKeys()
+	if err != nil {
+		t.Fatalf("PublicKeys error: %v", err)
+	}
+	if set.Len() != 2 {
+		t.Fatalf("expected current and previous key, got %d", set.Len())
+	}
+	for i := 0; i < set.Len(); i++ {
+		key, _ := set.Key(i)
+		if kid, ok := key.KeyID(); !ok || kid == "" {
+			t.Fatalf("expected kid on public key")
+		}
+		if key.Has("d") {
+			t.Fatalf("public key set must not contain private material")
+		}
+	}
+	// tokens verify against the published keys
+	tok := jwt.New()
+	_ = tok.Set(jwt.ExpirationKey, time.Now().Add(time.Hour))
+	raw, _ := m.SignJWT(tok)
+	if _, err := jwt.Parse(raw, jwt.WithKeySet(set)); err != nil {
+		t.Fatalf("verify against public set failed: %v", err)
+	}
+	if next := m.NextRotation(); time.Until(next) <= 0 || time.Until(next) > time.Hour {
+		t.Fatalf("unexpected next rotation %v", next)
+	}
+}
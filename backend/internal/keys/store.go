@@ -0,0 +1,191 @@
+package keys
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v3/jwk"
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/fsutil"
+	"golang.org/x/crypto/scrypt"
+)
+
+// StoredKey is a signing key together with the moment it was generated.
+type StoredKey struct {
+	Key       jwk.Key
+	CreatedAt time.Time
+}
+
+// Store persists signing keys so they survive restarts and can be shared between instances.
+type Store interface {
+	// Load returns all persisted keys, in no particular order.
+	Load() ([]StoredKey, error)
+	// Add persists a newly generated key.
+	Add(key StoredKey) error
+	// Remove deletes the key with the given kid; removing an unknown key is not an error.
+	Remove(kid string) error
+}
+
+const (
+	keyFileExt       = ".json"
+	encryptedFileExt = ".json.enc"
+)
+
+// FileStore keeps one file per key inside a directory. Keeping keys in separate files
+// allows several instances to share the directory without overwriting each other's keys.
+// When a passphrase is configured keys are encrypted at rest with AES-256-GCM.
+type FileStore struct {
+	dir        string
+	passphrase []byte
+}
+
+// NewFileStore creates the keyring directory when needed.
+func NewFileStore(dir, passphrase string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	fs := &FileStore{dir: dir}
+	if passphrase != "" {
+		fs.passphrase = []byte(passphrase)
+	}
+	return fs, nil
+}
+
+type keyFile struct {
+	CreatedAt time.Time       `json:"created_at"`
+	Key       json.RawMessage `json:"key"`
+}
+
+func (s *FileStore) Load() ([]StoredKey, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	ext := s.ext()
+	var out []StoredKey
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ext) {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(s.dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if s.passphrase != nil {
+			if b, err = decrypt(s.passphrase, b); err != nil {
+				return nil, fmt.Errorf("decrypt %s: %w", e.Name(), err)
+			}
+		}
+		var kf keyFile
+		if err := json.Unmarshal(b, &kf); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", e.Name(), err)
+		}
+		key, err := jwk.ParseKey(kf.Key)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %w", e.Name(), err)
+		}
+		out = append(out, StoredKey{Key: key, CreatedAt: kf.CreatedAt})
+	}
+	return out, nil
+}
+
+func (s *FileStore) Add(key StoredKey) error {
+	kid, ok := key.Key.KeyID()
+	if !ok || kid == "" {
+		return errors.New("key without kid")
+	}
+	raw, err := json.Marshal(key.Key)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(keyFile{CreatedAt: key.CreatedAt, Key: raw})
+	if err != nil {
+		return err
+	}
+	if s.passphrase != nil {
+		if b, err = encrypt(s.passphrase, b); err != nil {
+			return err
+		}
+	}
+	return fsutil.WriteFileAtomic(s.path(kid), b)
+}
+
+func (s *FileStore) Remove(kid string) error {
+	if err := os.Remove(s.path(kid)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (s *FileStore) ext() string {
+	if s.passphrase != nil {
+		return encryptedFileExt
+	}
+	return keyFileExt
+}
+
+func (s *FileStore) path(kid string) string {
+	return filepath.Join(s.dir, filepath.Base(kid)+s.ext())
+}
+
+// encrypted file layout: salt (16 bytes) | nonce (12 bytes) | ciphertext
+const saltSize = 16
+
+func deriveKey(passphrase, salt []byte) ([]byte, error) {
+	return scrypt.Key(passphrase, salt, 1<<15, 8, 1, 32)
+}
+
+func encrypt(passphrase, plaintext []byte) ([]byte, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	key, err := deriveKey(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out := append(salt, nonce...)
+	return gcm.Seal(out, nonce, plaintext, nil), nil
+}
+
+func decrypt(passphrase, data []byte) ([]byte, error) {
+	if len(data) < saltSize {
+		return nil, errors.New("ciphertext too short")
+	}
+	key, err := deriveKey(passphrase, data[:saltSize])
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	data = data[saltSize:]
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	return gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
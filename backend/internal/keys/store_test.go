@@ -0,0 +1,82 @@
+package keys
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileStore_RoundTrip(t *testing.T) {
+	for _, passphrase := range []string{"", "s3cret"} {
+		dir := t.TempDir()
+		fs, err := NewFileStore(dir, passphrase)
+		if err != nil {
+			t.Fatalf("NewFileStore error: %v", err)
+		}
+		m := &Manager{}
+		if err := m.rotate(); err != nil {
+			t.Fatalf("rotate error: %v", err)
+		}
+		key := m.keys[0]
+		if err := fs.Add(key); err != nil {
+			t.Fatalf("Add error: %v", err)
+		}
+
+		loaded, err := fs.Load()
+		if err != nil {
+			t.Fatalf("Load error: %v", err)
+		}
+		if len(loaded) != 1 {
+			t.Fatalf("expected 1 key, got %d", len(loaded))
+		}
+		wantKid, _ := key.Key.KeyID()
+		gotKid, _ := loaded[0].Key.KeyID()
+		if gotKid != wantKid || !loaded[0].CreatedAt.Equal(key.CreatedAt.Round(0)) {
+			t.Fatalf("unexpected key loaded: kid %q created %v", gotKid, loaded[0].CreatedAt)
+		}
+
+		// encrypted keys must not leak the private key material
+		b, _ := os.ReadFile(fs.path(wantKid))
+		if encrypted := !strings.Contains(string(b), `"d"`); encrypted != (passphrase != "") {
+			t.Fatalf("passphrase %q: unexpected file contents %s", passphrase, b)
+		}
+
+		if err := fs.Remove(wantKid); err != nil {
+			t.Fatalf("Remove error: %v", err)
+		}
+		if loaded, _ := fs.Load(); len(loaded) != 0 {
+			t.Fatalf("expected no keys after remove, got %d", len(loaded))
+		}
+		if err := fs.Remove(wantKid); err != nil {
+			t.Fatalf("removing unknown key should not fail: %v", err)
+		}
+	}
+}
+
+func TestFileStore_WrongPassphrase(t *testing.T) {
+	dir := t.TempDir()
+	fs, _ := NewFileStore(dir, "right")
+	m := &Manager{}
+	_ = m.rotate()
+	if err := fs.Add(m.keys[0]); err != nil {
+		t.Fatalf("Add error: %v", err)
+	}
+	other, _ := NewFileStore(dir, "wrong")
+	if _, err := other.Load(); err == nil {
+		t.Fatalf("expected decryption failure with wrong passphrase")
+	}
+}
+
+func TestFileStore_CreatedAtPreserved(t *testing.T) {
+	fs, _ := NewFileStore(t.TempDir(), "")
+	m := &Manager{}
+	_ = m.rotate()
+	key := m.keys[0]
+	key.CreatedAt = time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	_ = fs.Add(key)
+	loaded, _ := fs.Load()
+	if len(loaded) != 1 || !loaded[0].CreatedAt.Equal(key.CreatedAt) {
+		t.Fatalf("unexpected created_at: %+v", loaded)
+	}
+}
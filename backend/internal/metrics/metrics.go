@@ -0,0 +1,133 @@
+// Package metrics exposes the server's Prometheus metrics. Counters of things happening are
+// updated where they happen; the state of the hub and the store is read when scraped.
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/state"
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/stream"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "wim"
+
+// Registry holds all metrics of the server, along with the Go runtime and process metrics.
+var Registry = prometheus.NewRegistry()
+
+func init() {
+	Registry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+}
+
+var factory = promauto.With(Registry)
+
+var (
+	// MQTTMessages counts the messages received from TeslaMate by topic name (speed,
+	// location, ...), regardless of the car.
+	MQTTMessages = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "mqtt_messages_received_total",
+		Help:      "MQTT messages received, by topic name.",
+	}, []string{"topic"})
+	// MQTTParseFailures counts the messages that couldn't be turned into an event.
+	MQTTParseFailures = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "mqtt_parse_failures_total",
+		Help:      "MQTT messages that failed to parse, by topic name.",
+	}, []string{"topic"})
+
+	SharesIssued = factory.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "shares_issued_total",
+		Help:      "Share tokens issued.",
+	})
+	SessionsCreated = factory.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "sessions_created_total",
+		Help:      "Viewer sessions created from a share token.",
+	})
+	KeyRotations = factory.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "key_rotations_total",
+		Help:      "Signing key rotations.",
+	})
+
+	// StorageWritesDropped counts the history db writes dropped because the writer fell behind.
+	StorageWritesDropped = factory.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "storage_writes_dropped_total",
+		Help:      "History database writes dropped because the writer fell behind.",
+	})
+
+	// StreamDuration observes how long viewers stay connected, by transport (sse or websocket).
+	StreamDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "stream_connection_duration_seconds",
+		Help:      "Duration of stream connections, by transport.",
+		Buckets:   []float64{1, 10, 60, 300, 900, 1800, 3600, 4 * 3600, 12 * 3600},
+	}, []string{"transport"})
+)
+
+// Handler serves the metrics of Registry.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
+
+var (
+	subscribersDesc = prometheus.NewDesc(namespace+"_stream_subscribers",
+		"Current stream subscribers per car, car_id=\"all\" for subscribers following every car.", []string{"car_id"}, nil)
+	broadcastsDesc = prometheus.NewDesc(namespace+"_stream_frames_broadcast_total",
+		"Frames broadcast to stream subscribers.", nil, nil)
+	droppedDesc = prometheus.NewDesc(namespace+"_stream_frames_dropped_total",
+		"Frames not delivered to subscribers that fell behind.", nil, nil)
+	slowDesc = prometheus.NewDesc(namespace+"_stream_slow_subscribers_total",
+		"Subscribers that fell behind, by the action taken.", []string{"action"}, nil)
+)
+
+// hubCollector reports the subscribers and counters of a stream.Hub.
+type hubCollector struct{ hub *stream.Hub }
+
+// NewHubCollector returns a collector reporting the subscribers and frames of hub.
+func NewHubCollector(hub *stream.Hub) prometheus.Collector { return hubCollector{hub: hub} }
+
+func (c hubCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- subscribersDesc
+	ch <- broadcastsDesc
+	ch <- droppedDesc
+	ch <- slowDesc
+}
+
+func (c hubCollector) Collect(ch chan<- prometheus.Metric) {
+	for id, n := range c.hub.CarSubscribers() {
+		ch <- prometheus.MustNewConstMetric(subscribersDesc, prometheus.GaugeValue, float64(n), strconv.FormatInt(id, 10))
+	}
+	ch <- prometheus.MustNewConstMetric(subscribersDesc, prometheus.GaugeValue, float64(c.hub.FleetSubscribers()), "all")
+
+	st := c.hub.Stats()
+	ch <- prometheus.MustNewConstMetric(broadcastsDesc, prometheus.CounterValue, float64(st.Broadcasts))
+	ch <- prometheus.MustNewConstMetric(droppedDesc, prometheus.CounterValue, float64(st.DroppedFrames))
+	ch <- prometheus.MustNewConstMetric(slowDesc, prometheus.CounterValue, float64(st.Resyncs), "resync")
+	ch <- prometheus.MustNewConstMetric(slowDesc, prometheus.CounterValue, float64(st.Coalesced), "coalesce")
+	ch <- prometheus.MustNewConstMetric(slowDesc, prometheus.CounterValue, float64(st.Disconnections), "disconnect")
+}
+
+var historyPointsDesc = prometheus.NewDesc(namespace+"_store_history_points",
+	"History samples, breadcrumbs included, kept per car.", []string{"car_id"}, nil)
+
+// storeCollector reports the size of a state.Store.
+type storeCollector struct{ store *state.Store }
+
+// NewStoreCollector returns a collector reporting the history kept per car in store.
+func NewStoreCollector(store *state.Store) prometheus.Collector { return storeCollector{store: store} }
+
+func (c storeCollector) Describe(ch chan<- *prometheus.Desc) { ch <- historyPointsDesc }
+
+func (c storeCollector) Collect(ch chan<- prometheus.Metric) {
+	for id, n := range c.store.HistoryPoints() {
+		ch <- prometheus.MustNewConstMetric(historyPointsDesc, prometheus.GaugeValue, float64(n), strconv.FormatInt(id, 10))
+	}
+}
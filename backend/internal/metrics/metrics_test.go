@@ -0,0 +1,58 @@
+package metrics
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/state"
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/stream"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCollectors(t *testing.T) {
+	st := state.NewStore()
+	st.UpdateSpeed(1, 1000, 50)
+	st.UpdateLocation(1, 2000, 51.05, 3.72, 60, -1, -1)
+	hub := stream.NewHub()
+	sub := hub.Subscribe(1)
+	defer hub.Unsubscribe(sub)
+	fleet := hub.SubscribeCars(nil)
+	defer hub.Unsubscribe(fleet)
+	hub.Broadcast(1, "delta", []byte(`{"ts_ms":1}`))
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(NewHubCollector(hub), NewStoreCollector(st))
+
+	want := `
+# HELP wim_store_history_points History samples, breadcrumbs included, kept per car.
+# TYPE wim_store_history_points gauge
+wim_store_history_points{car_id="1"} 3
+# HELP wim_stream_frames_broadcast_total Frames broadcast to stream subscribers.
+# TYPE wim_stream_frames_broadcast_total counter
+wim_stream_frames_broadcast_total 1
+# HELP wim_stream_subscribers Current stream subscribers per car, car_id="all" for subscribers following every car.
+# TYPE wim_stream_subscribers gauge
+wim_stream_subscribers{car_id="1"} 1
+wim_stream_subscribers{car_id="all"} 1
+`
+	names := []string{"wim_store_history_points", "wim_stream_frames_broadcast_total", "wim_stream_subscribers"}
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(want), names...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	MQTTMessages.WithLabelValues("speed").Inc()
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(rec.Body)
+	for _, name := range []string{`wim_mqtt_messages_received_total{topic="speed"}`, "go_goroutines", "wim_key_rotations_total"} {
+		if !strings.Contains(string(body), name) {
+			t.Fatalf("expected %s in output:\n%s", name, body)
+		}
+	}
+}
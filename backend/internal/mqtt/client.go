@@ -3,37 +3,78 @@ package mqttc
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"strconv"
 	"strings"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/ingest"
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/metrics"
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/recording"
 	"github.com/mcuelenaere/where-is-maurus/backend/internal/state"
-	"github.com/mcuelenaere/where-is-maurus/backend/internal/stream"
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+var tracer = otel.Tracer("github.com/mcuelenaere/where-is-maurus/backend/internal/mqtt")
+
+// Client is the TeslaMate source: it turns the messages TeslaMate publishes into events.
 type Client struct {
-	cli   mqtt.Client
-	store *state.Store
-	hub   *stream.Hub
+	cli          mqtt.Client
+	topics       Topics
+	qos          byte
+	cleanSession bool
+	recorder     *recording.Recorder
+	emit         func(ingest.Event)
 }
 
-func NewClient(brokerURL, username, password string, clientID string, store *state.Store, hub *stream.Hub) *Client {
-	opts := mqtt.NewClientOptions().AddBroker(brokerURL).SetClientID(clientID)
-	if username != "" {
-		opts.SetUsername(username)
-		opts.SetPassword(password)
+func NewClient(o Options) (*Client, error) {
+	if err := o.validate(); err != nil {
+		return nil, err
+	}
+	tlsCfg, err := o.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	opts := mqtt.NewClientOptions().AddBroker(o.BrokerURL).SetClientID(o.ClientID)
+	if o.Username != "" {
+		opts.SetUsername(o.Username)
+		opts.SetPassword(o.Password)
+	}
+	if tlsCfg != nil {
+		opts.SetTLSConfig(tlsCfg)
 	}
 	opts.SetAutoReconnect(true)
-	opts.SetCleanSession(false) // Keep subscriptions across reconnections
-	opts.SetResumeSubs(true)    // Automatically restore subscriptions on reconnect
-	opts.SetConnectionLostHandler(func(_ mqtt.Client, err error) { log.Warn().Err(err).Msg("mqtt lost") })
-	opts.SetOnConnectHandler(func(c mqtt.Client) { log.Info().Msg("mqtt connected") })
-	return &Client{cli: mqtt.NewClient(opts), store: store, hub: hub}
+	opts.SetCleanSession(o.CleanSession) // Keep subscriptions and queued messages across reconnections unless asked not to
+	opts.SetResumeSubs(true)             // Automatically restore subscriptions on reconnect
+	c := &Client{topics: o.Topics, qos: o.QoS, cleanSession: o.CleanSession}
+	opts.SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+		log.Warn().Err(err).Msg("mqtt lost")
+		c.connection(false)
+	})
+	opts.SetOnConnectHandler(func(mqtt.Client) {
+		log.Info().Msg("mqtt connected")
+		c.connection(true)
+	})
+	// A persistent session delivers the messages queued while we were away as soon as we
+	// connect, before the subscriptions (and their handlers) are set up again.
+	opts.SetDefaultPublishHandler(c.handle)
+	c.cli = mqtt.NewClient(opts)
+	return c, nil
 }
 
+// Feeds reports whether the server's car id belongs to a car of this TeslaMate instance.
+func (c *Client) Feeds(carID int64) bool { return c.topics.feeds(carID) }
+
+// SetRecorder makes the client write every message it receives to r. It must be called before
+// Run or SubscribeAllCars.
+func (c *Client) SetRecorder(r *recording.Recorder) { c.recorder = r }
+
 func (c *Client) Connect(ctx context.Context) error {
 	or := c.cli.OptionsReader()
 	if srvs := or.Servers(); len(srvs) > 0 {
@@ -50,8 +91,28 @@ func (c *Client) Connect(ctx context.Context) error {
 	return nil
 }
 
-func (c *Client) SubscribeAllCars(ctx context.Context) error {
-	base := "teslamate/cars/+/" // '+' wildcard for car id
+// Run connects, subscribes to all cars and emits their events until ctx is done.
+func (c *Client) Run(ctx context.Context, emit func(ingest.Event)) error {
+	c.emit = emit
+	if err := c.Connect(ctx); err != nil {
+		return err
+	}
+	if err := c.subscribe(ctx); err != nil {
+		return err
+	}
+	<-ctx.Done()
+	return nil
+}
+
+// SubscribeAllCars subscribes to the TeslaMate topics of all cars, passing the events of the
+// messages received to emit. The client must be connected.
+func (c *Client) SubscribeAllCars(ctx context.Context, emit func(ingest.Event)) error {
+	c.emit = emit
+	return c.subscribe(ctx)
+}
+
+func (c *Client) subscribe(ctx context.Context) error {
+	base := c.topics.prefix() + "/cars/+/" // '+' wildcard for car id
 	topics := []string{
 		base + "display_name",
 		base + "exterior_color",
@@ -69,164 +130,236 @@ func (c *Client) SubscribeAllCars(ctx context.Context) error {
 		base + "tpms_pressure_rl",
 		base + "tpms_pressure_rr",
 		base + "active_route",
+		base + "state",
+		base + "shift_state",
+		base + "odometer",
+		base + "est_battery_range_km",
+		base + "rated_battery_range_km",
+		base + "usable_battery_level",
+		base + "plugged_in",
+		base + "charging_state",
+		base + "charger_power",
+		base + "charge_energy_added",
+		base + "time_to_full_charge",
+		base + "charge_limit_soc",
 	}
-	handler := func(_ mqtt.Client, m mqtt.Message) {
-		topic := m.Topic()
-		payload := string(m.Payload())
-		ts := time.Now().UnixMilli()
-		// Extract car_id from topic: teslamate/cars/{id}/...
-		var carID int64
-		parts := strings.Split(topic, "/")
-		if len(parts) >= 3 {
-			if id, err := strconv.ParseInt(parts[2], 10, 64); err == nil {
-				carID = id
-			}
-		}
-		if carID == 0 {
-			log.Warn().Str("topic", topic).Msg("invalid car_id")
-			return
+	for _, t := range topics {
+		log.Debug().Str("topic", t).Msg("mqtt subscribing")
+		if token := c.cli.Subscribe(t, c.qos, c.handle); token.Wait() && token.Error() != nil {
+			return token.Error()
 		}
-		log.Debug().Int64("car_id", carID).Str("topic", topic).Int("len", len(payload)).Msg("mqtt message")
-		// routing
-		if strings.HasSuffix(topic, "/location") {
-			var loc struct {
-				Latitude  float64 `json:"latitude"`
-				Longitude float64 `json:"longitude"`
-			}
-			if err := json.Unmarshal(m.Payload(), &loc); err == nil {
-				delta := c.store.UpdateLocation(carID, ts, loc.Latitude, loc.Longitude, -1, -1, -1)
-				c.hub.Broadcast(carID, "delta", delta)
-			}
-			return
+	}
+	if !c.cleanSession {
+		// keep the subscriptions so the broker queues messages until we're back
+		return nil
+	}
+	go func() {
+		<-ctx.Done()
+		for _, t := range topics {
+			c.cli.Unsubscribe(t)
 		}
-		if strings.HasSuffix(topic, "/display_name") {
-			displayName := strings.TrimSpace(payload)
-			if displayName != "" {
-				c.store.UpdateDisplayNameSilently(carID, ts, displayName)
-			}
-			return
+	}()
+	return nil
+}
+
+// connection tells the dispatcher the broker connection was lost or (re)established, so the
+// cars of this instance can be flagged offline rather than showing their last state as live.
+func (c *Client) connection(connected bool) {
+	if c.emit == nil {
+		return
+	}
+	c.emit(ingest.ConnectionEvent{Header: ingest.Header{TS: time.Now().UnixMilli()}, Connected: connected})
+}
+
+// handle records a message and emits its event.
+func (c *Client) handle(_ mqtt.Client, m mqtt.Message) {
+	now := time.Now()
+	if c.recorder != nil {
+		if err := c.recorder.Record(m.Topic(), m.Payload(), now); err != nil {
+			log.Warn().Err(err).Msg("record mqtt message")
 		}
-		if strings.HasSuffix(topic, "/exterior_color") {
-			exteriorColor := strings.TrimSpace(payload)
-			if exteriorColor != "" {
-				// Store the data but don't broadcast as delta update
-				c.store.UpdateExteriorColorSilently(carID, ts, exteriorColor)
-			}
-			return
+	}
+	metrics.MQTTMessages.WithLabelValues(topicName(m.Topic())).Inc()
+	if c.emit == nil {
+		return
+	}
+	ctx, span := tracer.Start(context.Background(), "mqtt.message", trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("topic", m.Topic()),
+			attribute.Int("payload_size", len(m.Payload())),
+		))
+	defer span.End()
+	ev := c.topics.ParseMessage(m.Topic(), m.Payload(), now.UnixMilli())
+	if ev == nil {
+		return
+	}
+	span.SetAttributes(attribute.Int64("car_id", ev.Car()))
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		ev = ingest.Traced{Event: ev, Span: sc}
+	}
+	c.emit(ev)
+}
+
+// metricTopics maps the numeric TeslaMate topics onto metrics.
+var metricTopics = map[string]ingest.Metric{
+	"speed":                  ingest.MetricSpeed,
+	"heading":                ingest.MetricHeading,
+	"elevation":              ingest.MetricElevation,
+	"battery_level":          ingest.MetricBatteryLevel,
+	"usable_battery_level":   ingest.MetricUsableBatteryLevel,
+	"power":                  ingest.MetricPower,
+	"inside_temp":            ingest.MetricInsideTemp,
+	"outside_temp":           ingest.MetricOutsideTemp,
+	"tpms_pressure_fl":       ingest.MetricTPMSFrontLeft,
+	"tpms_pressure_fr":       ingest.MetricTPMSFrontRight,
+	"tpms_pressure_rl":       ingest.MetricTPMSRearLeft,
+	"tpms_pressure_rr":       ingest.MetricTPMSRearRight,
+	"odometer":               ingest.MetricOdometer,
+	"est_battery_range_km":   ingest.MetricEstRange,
+	"rated_battery_range_km": ingest.MetricRatedRange,
+	"charger_power":          ingest.MetricChargerPower,
+	"charge_energy_added":    ingest.MetricChargeEnergyAdded,
+	"time_to_full_charge":    ingest.MetricTimeToFullCharge,
+	"charge_limit_soc":       ingest.MetricChargeLimit,
+}
+
+// statusTopics maps the textual TeslaMate topics onto statuses.
+var statusTopics = map[string]ingest.Status{
+	"state":          ingest.StatusVehicle,
+	"shift_state":    ingest.StatusShift,
+	"charging_state": ingest.StatusCharging,
+}
+
+// metaTopics maps the descriptive TeslaMate topics onto meta fields.
+var metaTopics = map[string]ingest.MetaField{
+	"display_name":   ingest.MetaDisplayName,
+	"exterior_color": ingest.MetaExteriorColor,
+	"model":          ingest.MetaModel,
+}
+
+// ParseMessage turns a TeslaMate message received at ts into an event for the mapped car id.
+// It returns nil for messages that can't be parsed, carry nothing to store or are about
+// unmapped cars. It is used for live messages as well as for replaying recordings.
+func (t Topics) ParseMessage(topic string, raw []byte, ts int64) ingest.Event {
+	payload := string(raw)
+	// Extract car_id from topic: {prefix}/cars/{id}/...
+	carID, name, err := t.carID(topic)
+	if errors.Is(err, errUnmappedCar) {
+		log.Debug().Str("topic", topic).Msg("ignoring unmapped car")
+		return nil
+	}
+	if err != nil {
+		metrics.MQTTParseFailures.WithLabelValues(topicName(topic)).Inc()
+		log.Warn().Str("topic", topic).Msg("invalid car_id")
+		return nil
+	}
+	log.Debug().Int64("car_id", carID).Str("topic", topic).Int("len", len(payload)).Msg("mqtt message")
+	h := ingest.Header{CarID: carID, TS: ts}
+	failed := func(err error, msg string) ingest.Event {
+		metrics.MQTTParseFailures.WithLabelValues(name).Inc()
+		log.Warn().Err(err).Str("topic", topic).Msg(msg)
+		return nil
+	}
+
+	// routing
+	switch name {
+	case "location":
+		var loc struct {
+			Latitude  float64 `json:"latitude"`
+			Longitude float64 `json:"longitude"`
 		}
-		if strings.HasSuffix(topic, "/model") {
-			model := strings.TrimSpace(payload)
-			if model != "" {
-				// Store the data but don't broadcast as delta update
-				c.store.UpdateModelSilently(carID, ts, model)
-			}
-			return
+		if err := json.Unmarshal(raw, &loc); err != nil {
+			return failed(err, "failed to parse location")
 		}
-		if strings.HasSuffix(topic, "/active_route") {
-			// Per docs: https://docs.teslamate.org/docs/integrations/mqtt/
-			var ar map[string]any
-			if err := json.Unmarshal(m.Payload(), &ar); err == nil {
-				if e, ok := ar["error"]; ok && e != nil {
-					delta := c.store.UpdateRoute(carID, ts, nil, 0, 0)
-					c.hub.Broadcast(carID, "delta", delta)
-					return
-				}
-				var dest *state.Dest
-				if loc, ok := ar["location"].(map[string]any); ok {
-					lat, _ := toFloat(loc["latitude"])
-					lon, _ := toFloat(loc["longitude"])
-					if lat != 0 || lon != 0 {
-						dest = &state.Dest{Lat: lat, Lon: lon}
-					}
-				}
-				var destLabel string
-				if s, ok := ar["destination"].(string); ok {
-					destLabel = s
-				}
-				trafficDelayMin, _ := toFloat(ar["traffic_minutes_delay"])
-				if trafficDelayMin == 0 {
-					// sometimes delivered as traffic_delay_minutes or traffic_delay_min
-					trafficDelayMin, _ = toFloat(ar["traffic_delay_minutes"])
-					if trafficDelayMin == 0 {
-						trafficDelayMin, _ = toFloat(ar["traffic_delay_min"])
-					}
-				}
-				etaMin, _ := toFloat(ar["minutes_to_arrival"])
-				if etaMin == 0 {
-					etaMin, _ = toFloat(ar["eta_minutes"])
-					if etaMin == 0 {
-						etaMin, _ = toFloat(ar["eta_min"])
-					}
-				}
-				distKM, _ := toFloat(ar["distance_km"])
-				if distKM == 0 {
-					miles, _ := toFloat(ar["miles_to_arrival"])
-					if miles != 0 {
-						distKM = miles * 1.60934
-					} else {
-						distKM, _ = toFloat(ar["dist_km"])
-					}
-				}
-				delta := c.store.UpdateRouteWithMeta(carID, ts, dest, etaMin, distKM, destLabel, trafficDelayMin)
-				c.hub.Broadcast(carID, "delta", delta)
-			}
-			return
+		return ingest.LocationEvent{Header: h, Lat: loc.Latitude, Lon: loc.Longitude, SpeedKPH: -1, Heading: -1, ElevationM: math.NaN()}
+	case "active_route":
+		ev, err := parseActiveRoute(h, raw)
+		if err != nil {
+			return failed(err, "failed to parse active route")
 		}
-		// numeric simple topics
-		val, err := strconv.ParseFloat(payload, 64)
+		return ev
+	case "plugged_in":
+		pluggedIn, err := strconv.ParseBool(strings.TrimSpace(payload))
 		if err != nil {
-			log.Warn().Err(err).Msg("failed to parse float")
-			return
+			return failed(err, "failed to parse bool")
 		}
-		switch {
-		case strings.HasSuffix(topic, "/speed"):
-			delta := c.store.UpdateSpeed(carID, ts, val)
-			c.hub.Broadcast(carID, "delta", delta)
-		case strings.HasSuffix(topic, "/heading"):
-			delta := c.store.UpdateHeading(carID, ts, val)
-			c.hub.Broadcast(carID, "delta", delta)
-		case strings.HasSuffix(topic, "/elevation"):
-			delta := c.store.UpdateElevation(carID, ts, val)
-			c.hub.Broadcast(carID, "delta", delta)
-		case strings.HasSuffix(topic, "/battery_level"):
-			delta := c.store.UpdateBatteryLevel(carID, ts, val)
-			c.hub.Broadcast(carID, "delta", delta)
-		case strings.HasSuffix(topic, "/power"):
-			delta := c.store.UpdatePower(carID, ts, val)
-			c.hub.Broadcast(carID, "delta", delta)
-		case strings.HasSuffix(topic, "/inside_temp"):
-			delta := c.store.UpdateInsideTemp(carID, ts, val)
-			c.hub.Broadcast(carID, "delta", delta)
-		case strings.HasSuffix(topic, "/outside_temp"):
-			delta := c.store.UpdateOutsideTemp(carID, ts, val)
-			c.hub.Broadcast(carID, "delta", delta)
-		case strings.HasSuffix(topic, "/tpms_pressure_fl"):
-			delta := c.store.UpdateTPMS(carID, ts, "fl", val)
-			c.hub.Broadcast(carID, "delta", delta)
-		case strings.HasSuffix(topic, "/tpms_pressure_fr"):
-			delta := c.store.UpdateTPMS(carID, ts, "fr", val)
-			c.hub.Broadcast(carID, "delta", delta)
-		case strings.HasSuffix(topic, "/tpms_pressure_rl"):
-			delta := c.store.UpdateTPMS(carID, ts, "rl", val)
-			c.hub.Broadcast(carID, "delta", delta)
-		case strings.HasSuffix(topic, "/tpms_pressure_rr"):
-			delta := c.store.UpdateTPMS(carID, ts, "rr", val)
-			c.hub.Broadcast(carID, "delta", delta)
+		return ingest.PluggedInEvent{Header: h, PluggedIn: pluggedIn}
+	}
+	if field, ok := metaTopics[name]; ok {
+		value := strings.TrimSpace(payload)
+		if value == "" {
+			return nil
 		}
+		return ingest.MetaEvent{Header: h, Field: field, Value: value}
 	}
-	for _, t := range topics {
-		log.Debug().Str("topic", t).Msg("mqtt subscribing")
-		if token := c.cli.Subscribe(t, 0, handler); token.Wait() && token.Error() != nil {
-			return token.Error()
+	if status, ok := statusTopics[name]; ok {
+		// shift_state is empty while parked
+		return ingest.StatusEvent{Header: h, Status: status, Value: strings.TrimSpace(payload)}
+	}
+	metric, ok := metricTopics[name]
+	if !ok {
+		return nil
+	}
+	val, err := strconv.ParseFloat(payload, 64)
+	if err != nil {
+		return failed(err, "failed to parse float")
+	}
+	return ingest.MetricEvent{Header: h, Metric: metric, Value: val}
+}
+
+// topicName returns the last level of a topic, the name of the value for TeslaMate topics.
+func topicName(topic string) string {
+	return topic[strings.LastIndexByte(topic, '/')+1:]
+}
+
+// parseActiveRoute handles the active_route topic.
+// Per docs: https://docs.teslamate.org/docs/integrations/mqtt/
+func parseActiveRoute(h ingest.Header, raw []byte) (ingest.Event, error) {
+	var ar map[string]any
+	if err := json.Unmarshal(raw, &ar); err != nil {
+		return nil, err
+	}
+	if e, ok := ar["error"]; ok && e != nil {
+		// no active route
+		return ingest.RouteEvent{Header: h}, nil
+	}
+	var dest *state.Dest
+	if loc, ok := ar["location"].(map[string]any); ok {
+		lat, _ := toFloat(loc["latitude"])
+		lon, _ := toFloat(loc["longitude"])
+		if lat != 0 || lon != 0 {
+			dest = &state.Dest{Lat: lat, Lon: lon}
 		}
 	}
-	go func() {
-		<-ctx.Done()
-		for _, t := range topics {
-			c.cli.Unsubscribe(t)
+	var destLabel string
+	if s, ok := ar["destination"].(string); ok {
+		destLabel = s
+	}
+	trafficDelayMin, _ := toFloat(ar["traffic_minutes_delay"])
+	if trafficDelayMin == 0 {
+		// sometimes delivered as traffic_delay_minutes or traffic_delay_min
+		trafficDelayMin, _ = toFloat(ar["traffic_delay_minutes"])
+		if trafficDelayMin == 0 {
+			trafficDelayMin, _ = toFloat(ar["traffic_delay_min"])
 		}
-	}()
-	return nil
+	}
+	etaMin, _ := toFloat(ar["minutes_to_arrival"])
+	if etaMin == 0 {
+		etaMin, _ = toFloat(ar["eta_minutes"])
+		if etaMin == 0 {
+			etaMin, _ = toFloat(ar["eta_min"])
+		}
+	}
+	distKM, _ := toFloat(ar["distance_km"])
+	if distKM == 0 {
+		miles, _ := toFloat(ar["miles_to_arrival"])
+		if miles != 0 {
+			distKM = miles * 1.60934
+		} else {
+			distKM, _ = toFloat(ar["dist_km"])
+		}
+	}
+	return ingest.RouteEvent{Header: h, Dest: dest, ETAMin: etaMin, DistKM: distKM, DestLabel: destLabel, TrafficDelayMin: trafficDelayMin}, nil
 }
 
 func toFloat(v any) (float64, bool) {
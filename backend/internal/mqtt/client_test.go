@@ -2,13 +2,40 @@ package mqttc
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"encoding/pem"
+	"io"
+	"log/slog"
+	"math"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
 	"testing"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/ingest"
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/metrics"
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/recording"
 	"github.com/mcuelenaere/where-is-maurus/backend/internal/state"
 	"github.com/mcuelenaere/where-is-maurus/backend/internal/stream"
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 // We don't hit a real broker; instead, we exercise handler logic indirectly by invoking the subscribed callback.
@@ -68,11 +95,11 @@ func TestSubscribeAllCars_RoutesToStoreAndHub(t *testing.T) {
 	opts := mqtt.NewClientOptions().AddBroker("tcp://example:1883").SetClientID("test")
 	mc := &mockClient{opts: opts}
 
-	c := &Client{cli: mc, store: st, hub: hub}
+	c := &Client{cli: mc}
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	if err := c.SubscribeAllCars(ctx); err != nil {
+	if err := c.SubscribeAllCars(ctx, ingest.NewDispatcher(st, hub).Dispatch); err != nil {
 		t.Fatalf("SubscribeAllCars error: %v", err)
 	}
 
@@ -111,3 +138,450 @@ func TestSubscribeAllCars_RoutesToStoreAndHub(t *testing.T) {
 		t.Fatalf("expected route to be updated: %+v", stSnap.Route)
 	}
 }
+
+func TestSubscribeAllCars_VehicleStatusTopics(t *testing.T) {
+	st := state.NewStore()
+	hub := stream.NewHub()
+	mc := &mockClient{}
+	c := &Client{cli: mc}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := c.SubscribeAllCars(ctx, ingest.NewDispatcher(st, hub).Dispatch); err != nil {
+		t.Fatalf("SubscribeAllCars error: %v", err)
+	}
+	send := func(name, payload string) {
+		handler := mc.subs["teslamate/cars/+/"+name]
+		if handler == nil {
+			t.Fatalf("expected %s handler registered", name)
+		}
+		handler(mc, message{topic: "teslamate/cars/1/" + name, payload: []byte(payload)})
+	}
+	send("state", "charging")
+	send("shift_state", "")
+	send("odometer", "1234.5")
+	send("usable_battery_level", "61")
+	send("battery_level", "62")
+	send("plugged_in", "true")
+	send("charging_state", "Charging")
+	send("charger_power", "7")
+	send("power", "-7000")
+	send("charge_limit_soc", "90")
+
+	stSnap, _ := st.GetSnapshot(1)
+	if stSnap.Vehicle == nil || stSnap.Vehicle.State != "charging" || stSnap.Vehicle.OdometerKM != 1234.5 {
+		t.Fatalf("unexpected vehicle: %+v", stSnap.Vehicle)
+	}
+	// usable_battery_level must not be mistaken for battery_level (and vice versa)
+	if stSnap.Battery == nil || stSnap.Battery.UsableSOCPct != 61 || stSnap.Battery.SOCPct != 62 {
+		t.Fatalf("unexpected battery: %+v", stSnap.Battery)
+	}
+	if stSnap.Battery.PowerW != -7000 {
+		t.Fatalf("expected power to be routed separately from charger_power: %+v", stSnap.Battery)
+	}
+	if stSnap.Charging == nil || !stSnap.Charging.PluggedIn || stSnap.Charging.State != "Charging" || stSnap.Charging.PowerKW != 7 || stSnap.Charging.LimitSOCPct != 90 {
+		t.Fatalf("unexpected charging: %+v", stSnap.Charging)
+	}
+}
+
+func TestSubscribeAllCars_Records(t *testing.T) {
+	st := state.NewStore()
+	hub := stream.NewHub()
+	mc := &mockClient{}
+	c := &Client{cli: mc}
+	path := filepath.Join(t.TempDir(), "drive.jsonl")
+	rec, err := recording.NewRecorder(path)
+	if err != nil {
+		t.Fatalf("new recorder: %v", err)
+	}
+	c.SetRecorder(rec)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := c.SubscribeAllCars(ctx, ingest.NewDispatcher(st, hub).Dispatch); err != nil {
+		t.Fatalf("SubscribeAllCars error: %v", err)
+	}
+	mc.subs["teslamate/cars/+/speed"](mc, message{topic: "teslamate/cars/1/speed", payload: []byte("42")})
+	mc.subs["teslamate/cars/+/heading"](mc, message{topic: "teslamate/cars/1/heading", payload: []byte("90")})
+	_ = rec.Close()
+
+	msgs, err := recording.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if len(msgs) != 2 || msgs[0].Topic != "teslamate/cars/1/speed" || msgs[0].Payload != "42" || msgs[0].TS == 0 {
+		t.Fatalf("unexpected recording: %+v", msgs)
+	}
+
+	// replaying the recording into a fresh store gives the same state
+	replayed := state.NewStore()
+	dispatcher := ingest.NewDispatcher(replayed, stream.NewHub())
+	for _, m := range msgs {
+		dispatcher.Dispatch(Topics{}.ParseMessage(m.Topic, []byte(m.Payload), m.TS))
+	}
+	want, _ := st.GetSnapshot(1)
+	got, _ := replayed.GetSnapshot(1)
+	if got.Location == nil || want.Location == nil || *got.Location != *want.Location || got.Location.SpeedKPH != 42 {
+		t.Fatalf("replayed state differs: %+v vs %+v", got, want)
+	}
+}
+
+func TestParseMessage(t *testing.T) {
+	h := ingest.Header{CarID: 2, TS: 1000}
+	cases := []struct {
+		topic, payload string
+		want           ingest.Event
+	}{
+		{"teslamate/cars/2/location", `{"latitude":1.5,"longitude":2.5}`, ingest.LocationEvent{Header: h, Lat: 1.5, Lon: 2.5, SpeedKPH: -1, Heading: -1, ElevationM: math.NaN()}},
+		{"teslamate/cars/2/speed", "42", ingest.MetricEvent{Header: h, Metric: ingest.MetricSpeed, Value: 42}},
+		{"teslamate/cars/2/usable_battery_level", "61", ingest.MetricEvent{Header: h, Metric: ingest.MetricUsableBatteryLevel, Value: 61}},
+		{"teslamate/cars/2/charger_power", "7", ingest.MetricEvent{Header: h, Metric: ingest.MetricChargerPower, Value: 7}},
+		{"teslamate/cars/2/shift_state", "", ingest.StatusEvent{Header: h, Status: ingest.StatusShift}},
+		{"teslamate/cars/2/plugged_in", "true", ingest.PluggedInEvent{Header: h, PluggedIn: true}},
+		{"teslamate/cars/2/display_name", " Maurus ", ingest.MetaEvent{Header: h, Field: ingest.MetaDisplayName, Value: "Maurus"}},
+		{"teslamate/cars/2/active_route", `{"error":"No active route available"}`, ingest.RouteEvent{Header: h}},
+		{"teslamate/cars/2/active_route", `{"destination":"Home","miles_to_arrival":10,"minutes_to_arrival":12,"traffic_minutes_delay":3}`, ingest.RouteEvent{Header: h, DestLabel: "Home", ETAMin: 12, DistKM: 16.0934, TrafficDelayMin: 3}},
+		// not parseable or nothing to store
+		{"teslamate/cars/x/speed", "42", nil},
+		{"teslamate/cars/2/speed", "fast", nil},
+		{"teslamate/cars/2/plugged_in", "maybe", nil},
+		{"teslamate/cars/2/model", "", nil},
+		{"teslamate/cars/2/unknown", "1", nil},
+	}
+	failures := testutil.ToFloat64(metrics.MQTTParseFailures.WithLabelValues("speed"))
+	for _, c := range cases {
+		if got := (Topics{}).ParseMessage(c.topic, []byte(c.payload), 1000); !sameEvent(got, c.want) {
+			t.Fatalf("ParseMessage(%s, %q) = %+v, want %+v", c.topic, c.payload, got, c.want)
+		}
+	}
+	// the invalid car id and the invalid speed, ignored messages don't count
+	if n := testutil.ToFloat64(metrics.MQTTParseFailures.WithLabelValues("speed")) - failures; n != 2 {
+		t.Fatalf("expected 2 speed parse failures, got %v", n)
+	}
+}
+
+// testPKI holds a CA and the certificates it issued, written to PEM files.
+type testPKI struct {
+	dir    string
+	pool   *x509.CertPool
+	server tls.Certificate
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	t.Helper()
+	p := &testPKI{dir: t.TempDir(), pool: x509.NewCertPool()}
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("ca: %v", err)
+	}
+	ca, _ := x509.ParseCertificate(caDER)
+	p.pool.AddCert(ca)
+	p.write(t, "ca.pem", "CERTIFICATE", caDER)
+
+	issue := func(serial int64, name string, usage x509.ExtKeyUsage) tls.Certificate {
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: name},
+			DNSNames:     []string{name},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatalf("issue %s: %v", name, err)
+		}
+		keyDER, _ := x509.MarshalECPrivateKey(key)
+		p.write(t, name+".pem", "CERTIFICATE", der)
+		p.write(t, name+"-key.pem", "EC PRIVATE KEY", keyDER)
+		cert, err := tls.X509KeyPair(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+		if err != nil {
+			t.Fatalf("key pair %s: %v", name, err)
+		}
+		return cert
+	}
+	// the server certificate only covers broker.test, not the address we dial
+	p.server = issue(2, "broker.test", x509.ExtKeyUsageServerAuth)
+	issue(3, "client", x509.ExtKeyUsageClientAuth)
+	return p
+}
+
+func (p *testPKI) write(t *testing.T, name, typ string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile(p.path(name), pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (p *testPKI) path(name string) string { return filepath.Join(p.dir, name) }
+
+// startTLSBroker runs an in-process broker that requires a client certificate issued by the
+// test CA and returns its ssl:// URL.
+func startTLSBroker(t *testing.T, p *testPKI) (*mochi.Server, string) {
+	t.Helper()
+	// grab a free port
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	_ = l.Close()
+
+	srv := mochi.New(&mochi.Options{InlineClient: true, Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	_ = srv.AddHook(new(auth.AllowHook), nil)
+	tlsCfg := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{p.server},
+		ClientCAs:    p.pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	if err := srv.AddListener(listeners.NewTCP(listeners.Config{ID: "tls", Address: addr, TLSConfig: tlsCfg})); err != nil {
+		t.Fatalf("listener: %v", err)
+	}
+	if err := srv.Serve(); err != nil {
+		t.Fatalf("serve: %v", err)
+	}
+	t.Cleanup(func() { _ = srv.Close() })
+	return srv, "ssl://" + addr
+}
+
+func TestClient_MutualTLS(t *testing.T) {
+	p := newTestPKI(t)
+	broker, url := startTLSBroker(t, p)
+	opts := Options{
+		BrokerURL:  url,
+		ClientID:   "test-mtls",
+		CAFile:     p.path("ca.pem"),
+		CertFile:   p.path("client.pem"),
+		KeyFile:    p.path("client-key.pem"),
+		ServerName: "broker.test",
+		QoS:        1,
+	}
+
+	// every piece of the TLS setup is needed
+	failing := map[string]Options{}
+	noCert := opts
+	noCert.CertFile, noCert.KeyFile = "", ""
+	failing["no client certificate"] = noCert
+	noCA := opts
+	noCA.CAFile = ""
+	failing["system roots"] = noCA
+	noName := opts
+	noName.ServerName = ""
+	failing["server name mismatch"] = noName
+	for name, o := range failing {
+		c, err := NewClient(o)
+		if err != nil {
+			t.Fatalf("%s: new client: %v", name, err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		if err := c.Connect(ctx); err == nil {
+			t.Fatalf("%s: expected connect to fail", name)
+		}
+		cancel()
+	}
+
+	c, err := NewClient(opts)
+	if err != nil {
+		t.Fatalf("new client: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := make(chan ingest.Event, 10)
+	go func() { _ = c.Run(ctx, func(ev ingest.Event) { events <- untraced(ev) }) }()
+
+	// wait for the subscriptions, at the configured QoS
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if cl, ok := broker.Clients.Get("test-mtls"); ok {
+			if sub, ok := cl.State.Subscriptions.GetAll()["teslamate/cars/+/speed"]; ok {
+				if sub.Qos != 1 {
+					t.Fatalf("expected QoS 1 subscription, got %d", sub.Qos)
+				}
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("client didn't subscribe")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// connecting is reported first
+	if ev, ok := (<-events).(ingest.ConnectionEvent); !ok || !ev.Connected {
+		t.Fatalf("expected connection event, got %+v", ev)
+	}
+	if err := broker.Publish("teslamate/cars/1/speed", []byte("42"), false, 1); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	select {
+	case ev := <-events:
+		if m, ok := ev.(ingest.MetricEvent); !ok || m.CarID != 1 || m.Value != 42 {
+			t.Fatalf("unexpected event: %+v", ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no event received")
+	}
+
+	// skipping verification accepts the server certificate despite the name mismatch
+	insecure := noName
+	insecure.CAFile = ""
+	insecure.InsecureSkipVerify = true
+	insecure.ClientID = "test-insecure"
+	ic, err := NewClient(insecure)
+	if err != nil {
+		t.Fatalf("new client: %v", err)
+	}
+	if err := ic.Connect(ctx); err != nil {
+		t.Fatalf("expected insecure connect to succeed: %v", err)
+	}
+}
+
+func TestClient_PersistentSession(t *testing.T) {
+	p := newTestPKI(t)
+	broker, url := startTLSBroker(t, p)
+	opts := Options{
+		BrokerURL:  url,
+		ClientID:   "test-session",
+		CAFile:     p.path("ca.pem"),
+		CertFile:   p.path("client.pem"),
+		KeyFile:    p.path("client-key.pem"),
+		ServerName: "broker.test",
+		QoS:        1,
+	}
+	run := func(ctx context.Context) chan ingest.Event {
+		c, err := NewClient(opts)
+		if err != nil {
+			t.Fatalf("new client: %v", err)
+		}
+		events := make(chan ingest.Event, 10)
+		go func() {
+			_ = c.Run(ctx, func(ev ingest.Event) {
+				if _, ok := ev.(ingest.ConnectionEvent); !ok {
+					events <- untraced(ev)
+				}
+			})
+		}()
+		return events
+	}
+	connected := func(want bool) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			if cl, ok := broker.Clients.Get("test-session"); ok && !cl.Closed() == want {
+				// the last topic subscribed, so the session holds all of them
+				if _, subscribed := cl.State.Subscriptions.Get("teslamate/cars/+/charge_limit_soc"); subscribed {
+					return
+				}
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expected connected=%v", want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	run(ctx)
+	connected(true)
+	cancel()
+	connected(false)
+
+	// published while we're away, delivered when we're back
+	if err := broker.Publish("teslamate/cars/1/speed", []byte("42"), false, 1); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	events := run(ctx)
+	select {
+	case ev := <-events:
+		if m, ok := ev.(ingest.MetricEvent); !ok || m.Value != 42 {
+			t.Fatalf("unexpected event: %+v", ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("queued message not delivered")
+	}
+}
+
+var (
+	spans      = tracetest.NewSpanRecorder()
+	tracerOnce sync.Once
+)
+
+// recordSpans installs a tracer provider recording to spans, once as tracers obtained before
+// only ever delegate to the first provider installed.
+func recordSpans() {
+	tracerOnce.Do(func() {
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)))
+	})
+}
+
+// untraced strips the trace from events, which are traced once a test installed a provider.
+func untraced(ev ingest.Event) ingest.Event {
+	if t, ok := ev.(ingest.Traced); ok {
+		return t.Event
+	}
+	return ev
+}
+
+func TestHandle_Traced(t *testing.T) {
+	recordSpans()
+	st := state.NewStore()
+	hub := stream.NewHub()
+	mc := &mockClient{}
+	c := &Client{cli: mc}
+	c.emit = ingest.NewDispatcher(st, hub).Dispatch
+
+	c.handle(mc, message{topic: "teslamate/cars/7/speed", payload: []byte("42")})
+
+	frame := hub.FrameSpan(hub.LastID())
+	if !frame.IsValid() {
+		t.Fatal("broadcast frame should carry its span")
+	}
+	byName := map[string]sdktrace.ReadOnlySpan{}
+	for _, s := range spans.Ended() {
+		if s.SpanContext().TraceID() == frame.TraceID() {
+			byName[s.Name()] = s
+		}
+	}
+	msg, update, broadcast := byName["mqtt.message"], byName["store.update"], byName["hub.broadcast"]
+	if msg == nil || update == nil || broadcast == nil {
+		t.Fatalf("expected the message, update and broadcast spans in one trace, got %v", byName)
+	}
+	if update.Parent().SpanID() != msg.SpanContext().SpanID() || broadcast.Parent().SpanID() != update.SpanContext().SpanID() {
+		t.Fatal("spans should nest as mqtt.message > store.update > hub.broadcast")
+	}
+	want := []attribute.KeyValue{
+		attribute.String("topic", "teslamate/cars/7/speed"),
+		attribute.Int("payload_size", 2),
+		attribute.Int64("car_id", 7),
+	}
+	for _, kv := range want {
+		if !slices.Contains(msg.Attributes(), kv) {
+			t.Fatalf("expected %v in %v", kv, msg.Attributes())
+		}
+	}
+}
+
+// sameEvent compares events, taking two NaN elevations, for not reported, as equal.
+func sameEvent(a, b ingest.Event) bool {
+	la, okA := a.(ingest.LocationEvent)
+	lb, okB := b.(ingest.LocationEvent)
+	if okA && okB && math.IsNaN(la.ElevationM) && math.IsNaN(lb.ElevationM) {
+		la.ElevationM, lb.ElevationM = 0, 0
+		return la == lb
+	}
+	return a == b
+}
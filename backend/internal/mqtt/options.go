@@ -0,0 +1,280 @@
+package mqttc
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// DefaultTopicPrefix is where TeslaMate publishes without MQTT_NAMESPACE.
+const DefaultTopicPrefix = "teslamate"
+
+// Options configures a connection to the broker of one TeslaMate instance.
+type Options struct {
+	BrokerURL string `json:"broker_url"`
+	Username  string `json:"username,omitempty"`
+	Password  string `json:"password,omitempty"`
+	// ClientID is generated when empty, which requires CleanSession: a generated id changes with
+	// every start, so the broker session it leaves behind could never be resumed.
+	ClientID string `json:"client_id,omitempty"`
+
+	// TLS settings, used with ssl://, tls://, mqtts:// and wss:// brokers. CAFile replaces the
+	// system roots; CertFile and KeyFile hold the client certificate for mutual TLS.
+	CAFile             string `json:"ca_file,omitempty"`
+	CertFile           string `json:"cert_file,omitempty"`
+	KeyFile            string `json:"key_file,omitempty"`
+	ServerName         string `json:"server_name,omitempty"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify,omitempty"`
+
+	// QoS of the subscriptions, 0 (default), 1 or 2
+	QoS byte `json:"qos,omitempty"`
+	// CleanSession discards the broker session on connect, the default. Otherwise the session,
+	// and with it the QoS 1 and 2 messages published while disconnected, is kept.
+	CleanSession bool `json:"clean_session"`
+
+	Topics
+}
+
+// validate checks the settings that can't be checked by connecting.
+func (o Options) validate() error {
+	if o.QoS > 2 {
+		return fmt.Errorf("invalid qos %d", o.QoS)
+	}
+	if (o.CertFile == "") != (o.KeyFile == "") {
+		return errors.New("cert_file and key_file must be set together")
+	}
+	if !o.CleanSession && o.ClientID == "" {
+		return errors.New("a persistent session (clean_session false) requires a client_id")
+	}
+	return nil
+}
+
+// tlsConfig builds the TLS configuration, nil when the defaults will do.
+func (o Options) tlsConfig() (*tls.Config, error) {
+	if o.CAFile == "" && o.CertFile == "" && o.ServerName == "" && !o.InsecureSkipVerify {
+		return nil, nil
+	}
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: o.ServerName,
+		// #nosec G402 -- opt-in for development brokers with self-signed certificates
+		InsecureSkipVerify: o.InsecureSkipVerify,
+	}
+	if o.CAFile != "" {
+		pem, err := os.ReadFile(o.CAFile) // #nosec G304 -- path comes from server config
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found", o.CAFile)
+		}
+	}
+	if o.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// Topics describes where a TeslaMate instance publishes and how its car ids map onto the ids
+// used by the server, so cars of different instances don't collide.
+type Topics struct {
+	// Prefix is the topic prefix, teslamate/<namespace> when TeslaMate runs with MQTT_NAMESPACE
+	Prefix string `json:"topic_prefix,omitempty"`
+	// CarIDs maps TeslaMate car ids onto server car ids. When set, other cars are ignored.
+	CarIDs map[int64]int64 `json:"car_ids,omitempty"`
+	// CarIDOffset is added to the TeslaMate car ids when there's no CarIDs mapping
+	CarIDOffset int64 `json:"car_id_offset,omitempty"`
+
+	// maxCarID bounds the ids of an offset, 0 when unbounded
+	maxCarID int64
+}
+
+func (t Topics) prefix() string {
+	if t.Prefix == "" {
+		return DefaultTopicPrefix
+	}
+	return strings.TrimSuffix(t.Prefix, "/")
+}
+
+var (
+	errInvalidTopic = errors.New("invalid topic")
+	errUnmappedCar  = errors.New("unmapped car")
+)
+
+// carID extracts the TeslaMate car id from {prefix}/cars/{id}/{name} and maps it onto the
+// server's id space. Cars beyond the range of an offset are unmapped, their ids belong to the
+// next connection.
+func (t Topics) carID(topic string) (id int64, name string, err error) {
+	rest, found := strings.CutPrefix(topic, t.prefix()+"/cars/")
+	if !found {
+		return 0, "", errInvalidTopic
+	}
+	idStr, name, found := strings.Cut(rest, "/")
+	if !found || strings.Contains(name, "/") {
+		return 0, "", errInvalidTopic
+	}
+	local, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil || local <= 0 {
+		return 0, "", errInvalidTopic
+	}
+	if t.CarIDs != nil {
+		global, ok := t.CarIDs[local]
+		if !ok {
+			return 0, "", errUnmappedCar
+		}
+		return global, name, nil
+	}
+	global := local + t.CarIDOffset
+	if t.maxCarID != 0 && global > t.maxCarID {
+		return 0, "", errUnmappedCar
+	}
+	return global, name, nil
+}
+
+// feeds reports whether a TeslaMate car maps onto the server's car id.
+func (t Topics) feeds(id int64) bool {
+	if t.CarIDs != nil {
+		for _, global := range t.CarIDs {
+			if global == id {
+				return true
+			}
+		}
+		return false
+	}
+	return id > t.CarIDOffset && (t.maxCarID == 0 || id <= t.maxCarID)
+}
+
+// LoadConnections reads the connections to additional TeslaMate instances from a JSON file
+// holding a list of Options.
+func LoadConnections(path string) ([]Options, error) {
+	b, err := os.ReadFile(path) // #nosec G304 -- path comes from server config
+	if err != nil {
+		return nil, err
+	}
+	var raw []json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	conns := make([]Options, len(raw))
+	for i, r := range raw {
+		conns[i].CleanSession = true
+		if err := json.Unmarshal(r, &conns[i]); err != nil {
+			return nil, fmt.Errorf("%s: connection %d: %w", path, i, err)
+		}
+		if conns[i].BrokerURL == "" {
+			return nil, fmt.Errorf("%s: connection %d: missing broker_url", path, i)
+		}
+	}
+	return conns, nil
+}
+
+// ValidateConnections checks the settings of every connection, and rejects connections whose
+// cars would end up with the same id, as the instances would then overwrite each other's car.
+// Connections with a car_id_offset own every id above their offset up to the next one, the
+// highest offset owning all ids above it, so car_ids can only map below the lowest offset.
+func ValidateConnections(conns []Options) error {
+	mapped := map[int64]int{}
+	offsets := map[int64]int{}
+	for i, c := range conns {
+		if err := c.validate(); err != nil {
+			return fmt.Errorf("connection %d: %w", i, err)
+		}
+		if c.CarIDs == nil {
+			if c.CarIDOffset < 0 {
+				return fmt.Errorf("connection %d: car_id_offset can't be negative", i)
+			}
+			if j, dup := offsets[c.CarIDOffset]; dup {
+				return fmt.Errorf("connections %d and %d have the same car_id_offset, set car_ids or a different offset", j, i)
+			}
+			offsets[c.CarIDOffset] = i
+			continue
+		}
+		for local, global := range c.CarIDs {
+			if local <= 0 || global <= 0 {
+				return fmt.Errorf("connection %d: car ids must be positive", i)
+			}
+			if j, dup := mapped[global]; dup {
+				return fmt.Errorf("connections %d and %d both map a car onto id %d", j, i, global)
+			}
+			mapped[global] = i
+		}
+	}
+	for global, i := range mapped {
+		// the connection with the highest offset below the id owns it
+		owner, found := int64(0), false
+		for offset := range offsets {
+			if offset < global && (!found || offset > owner) {
+				owner, found = offset, true
+			}
+		}
+		if found {
+			return fmt.Errorf("connection %d maps a car onto id %d, in the id range of connection %d with car_id_offset %d", i, global, offsets[owner], owner)
+		}
+	}
+	return nil
+}
+
+// Feeding returns the index of the connection mapping a TeslaMate car onto the server's car
+// id, -1 when none does. The ranges must have been bounded with BoundCarIDRanges.
+func Feeding(conns []Options, id int64) int {
+	for i, c := range conns {
+		if c.feeds(id) {
+			return i
+		}
+	}
+	return -1
+}
+
+// BoundCarIDRanges limits the ids of the connections with a car_id_offset to the next offset,
+// the ones of the highest offset stay unbounded.
+func BoundCarIDRanges(conns []Options) {
+	for i := range conns {
+		if conns[i].CarIDs != nil {
+			continue
+		}
+		for _, c := range conns {
+			if c.CarIDs == nil && c.CarIDOffset > conns[i].CarIDOffset && (conns[i].maxCarID == 0 || c.CarIDOffset < conns[i].maxCarID) {
+				conns[i].maxCarID = c.CarIDOffset
+			}
+		}
+	}
+}
+
+// ValidateIngestCars rejects cars pushing over HTTP whose id a connection maps a TeslaMate car
+// onto, as both would then feed the same car. Connections with a car_id_offset own the ids up
+// to the next offset; the ones of the highest offset are unbounded and left unchecked.
+func ValidateIngestCars(conns []Options, carIDs []int64) error {
+	var offsets []int64
+	for _, c := range conns {
+		if c.CarIDs == nil {
+			offsets = append(offsets, c.CarIDOffset)
+		}
+	}
+	slices.Sort(offsets)
+	for _, id := range carIDs {
+		for i, c := range conns {
+			for _, global := range c.CarIDs {
+				if global == id {
+					return fmt.Errorf("ingest car %d is also mapped by connection %d", id, i)
+				}
+			}
+		}
+		for i := 0; i+1 < len(offsets); i++ {
+			if id > offsets[i] && id <= offsets[i+1] {
+				return fmt.Errorf("ingest car %d is in the id range of the connection with car_id_offset %d", id, offsets[i])
+			}
+		}
+	}
+	return nil
+}
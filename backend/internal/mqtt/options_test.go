@@ -0,0 +1,194 @@
+package mqttc
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/ingest"
+)
+
+func TestTopics_CarID(t *testing.T) {
+	cases := []struct {
+		name   string
+		topics Topics
+		topic  string
+		id     int64
+		err    error
+	}{
+		{"default prefix", Topics{}, "teslamate/cars/1/speed", 1, nil},
+		{"namespace", Topics{Prefix: "teslamate/home/"}, "teslamate/home/cars/2/speed", 2, nil},
+		{"other namespace", Topics{Prefix: "teslamate/home"}, "teslamate/cars/2/speed", 0, errInvalidTopic},
+		{"offset", Topics{CarIDOffset: 100}, "teslamate/cars/2/speed", 102, nil},
+		{"past the next offset", Topics{CarIDOffset: 100, maxCarID: 200}, "teslamate/cars/101/speed", 0, errUnmappedCar},
+		{"mapped", Topics{CarIDs: map[int64]int64{2: 7}, CarIDOffset: 100}, "teslamate/cars/2/speed", 7, nil},
+		{"unmapped", Topics{CarIDs: map[int64]int64{2: 7}}, "teslamate/cars/3/speed", 0, errUnmappedCar},
+		{"not a number", Topics{}, "teslamate/cars/x/speed", 0, errInvalidTopic},
+		{"too deep", Topics{}, "teslamate/cars/1/charging/state", 0, errInvalidTopic},
+	}
+	for _, c := range cases {
+		id, name, err := c.topics.carID(c.topic)
+		if id != c.id || err != c.err || (err == nil && name != "speed") {
+			t.Fatalf("%s: got (%d, %q, %v), want (%d, speed, %v)", c.name, id, name, err, c.id, c.err)
+		}
+	}
+}
+
+func TestLoadConnections(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mqtt.json")
+	doc := `[
+		{"broker_url": "tcp://home:1883", "username": "tm", "password": "pw", "topic_prefix": "teslamate/home"},
+		{"broker_url": "tcp://work:1883", "car_ids": {"1": 101, "2": 102}, "client_id": "wim-work", "clean_session": false}
+	]`
+	if err := os.WriteFile(path, []byte(doc), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	conns, err := LoadConnections(path)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if len(conns) != 2 || conns[0].Username != "tm" || conns[0].Prefix != "teslamate/home" || conns[1].CarIDs[2] != 102 {
+		t.Fatalf("unexpected connections: %+v", conns)
+	}
+	// sessions are clean unless asked otherwise
+	if !conns[0].CleanSession || conns[1].CleanSession {
+		t.Fatalf("unexpected clean_session: %+v", conns)
+	}
+
+	if err := os.WriteFile(path, []byte(`[{"username": "tm"}]`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadConnections(path); err == nil || !strings.Contains(err.Error(), "broker_url") {
+		t.Fatalf("expected missing broker_url error, got %v", err)
+	}
+}
+
+func TestValidateConnections(t *testing.T) {
+	valid := []Options{
+		{BrokerURL: "tcp://a", CleanSession: true, Topics: Topics{CarIDOffset: 100}},
+		{BrokerURL: "tcp://b", CleanSession: true, Topics: Topics{CarIDOffset: 200}},
+		{BrokerURL: "tcp://c", CleanSession: true, Topics: Topics{CarIDs: map[int64]int64{1: 1, 2: 100}}},
+	}
+	if err := ValidateConnections(valid); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	invalid := map[string][]Options{
+		"same offset":     {{BrokerURL: "tcp://a", CleanSession: true}, {BrokerURL: "tcp://b", CleanSession: true, Topics: Topics{Prefix: "teslamate/b"}}},
+		"same mapping":    {{BrokerURL: "tcp://a", CleanSession: true, Topics: Topics{CarIDs: map[int64]int64{1: 5}}}, {BrokerURL: "tcp://b", CleanSession: true, Topics: Topics{CarIDs: map[int64]int64{3: 5}}}},
+		"negative id":     {{BrokerURL: "tcp://a", CleanSession: true, Topics: Topics{CarIDs: map[int64]int64{1: -5}}}},
+		"negative offset": {{BrokerURL: "tcp://a", CleanSession: true, Topics: Topics{CarIDOffset: -1}}},
+		"mapped in range": {{BrokerURL: "tcp://a", CleanSession: true}, {BrokerURL: "tcp://b", CleanSession: true, Topics: Topics{CarIDs: map[int64]int64{1: 1}}}},
+		"mapped in top":   {{BrokerURL: "tcp://a", CleanSession: true, Topics: Topics{CarIDOffset: 100}}, {BrokerURL: "tcp://b", CleanSession: true, Topics: Topics{CarIDs: map[int64]int64{1: 500}}}},
+	}
+	for name, conns := range invalid {
+		if err := ValidateConnections(conns); err == nil {
+			t.Fatalf("%s: expected error", name)
+		}
+	}
+}
+
+func TestBoundCarIDRanges(t *testing.T) {
+	conns := []Options{
+		{BrokerURL: "tcp://a", Topics: Topics{CarIDOffset: 100}},
+		{BrokerURL: "tcp://b"},
+		{BrokerURL: "tcp://c", Topics: Topics{CarIDs: map[int64]int64{1: 201}}},
+		{BrokerURL: "tcp://d", Topics: Topics{CarIDOffset: 50}},
+	}
+	BoundCarIDRanges(conns)
+	feeds := func(i int, ids ...int64) bool {
+		for _, id := range ids {
+			if !conns[i].feeds(id) {
+				return false
+			}
+		}
+		return true
+	}
+	if !feeds(1, 1, 50) || feeds(1, 51) || !feeds(3, 51, 100) || feeds(3, 101) || !feeds(0, 101, 5000) || feeds(0, 100) {
+		t.Fatalf("unexpected offset ranges: %+v", conns)
+	}
+	if !feeds(2, 201) || feeds(2, 1) {
+		t.Fatal("expected only the mapped car")
+	}
+	if Feeding(conns, 75) != 3 || Feeding(conns, 1) != 1 || Feeding(conns, 150) != 0 || Feeding(nil, 1) != -1 {
+		t.Fatal("unexpected connection feeding a car")
+	}
+}
+
+func TestValidateIngestCars(t *testing.T) {
+	conns := []Options{
+		{BrokerURL: "tcp://a"},
+		{BrokerURL: "tcp://b", Topics: Topics{CarIDOffset: 100}},
+		{BrokerURL: "tcp://c", Topics: Topics{CarIDs: map[int64]int64{1: 201}}},
+	}
+	if err := ValidateIngestCars(conns, []int64{202, 500}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, id := range []int64{201, 5, 100} {
+		if err := ValidateIngestCars(conns, []int64{id}); err == nil {
+			t.Fatalf("car %d: expected a collision", id)
+		}
+	}
+	// a single TeslaMate instance leaves the ids above its cars to the trackers
+	if err := ValidateIngestCars(conns[:1], []int64{5}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestSubscribeAllCars_PrefixAndMapping(t *testing.T) {
+	mc := &mockClient{}
+	c := &Client{cli: mc, topics: Topics{Prefix: "teslamate/work", CarIDs: map[int64]int64{1: 101}}}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var got []ingest.Event
+	if err := c.SubscribeAllCars(ctx, func(ev ingest.Event) { got = append(got, ev) }); err != nil {
+		t.Fatalf("SubscribeAllCars error: %v", err)
+	}
+	handler := mc.subs["teslamate/work/cars/+/speed"]
+	if handler == nil {
+		t.Fatalf("expected subscription under the prefix, got %v", mc.subs)
+	}
+	handler(mc, message{topic: "teslamate/work/cars/1/speed", payload: []byte("42")})
+	handler(mc, message{topic: "teslamate/work/cars/2/speed", payload: []byte("50")})
+	if len(got) != 1 || got[0].Car() != 101 {
+		t.Fatalf("expected only the mapped car, got %+v", got)
+	}
+}
+
+func TestOptions_TLS(t *testing.T) {
+	if cfg, err := (Options{BrokerURL: "tcp://a"}).tlsConfig(); err != nil || cfg != nil {
+		t.Fatalf("expected default TLS config, got %+v, %v", cfg, err)
+	}
+	cfg, err := (Options{ServerName: "broker.test", InsecureSkipVerify: true}).tlsConfig()
+	if err != nil || cfg.ServerName != "broker.test" || !cfg.InsecureSkipVerify || cfg.RootCAs != nil {
+		t.Fatalf("unexpected TLS config: %+v, %v", cfg, err)
+	}
+
+	dir := t.TempDir()
+	notPEM := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(notPEM, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	invalid := map[string]Options{
+		"missing ca":     {CAFile: filepath.Join(dir, "missing.pem"), CleanSession: true},
+		"ca without pem": {CAFile: notPEM, CleanSession: true},
+		"bad key pair":   {CertFile: notPEM, KeyFile: notPEM, CleanSession: true},
+	}
+	for name, o := range invalid {
+		if _, err := NewClient(o); err == nil {
+			t.Fatalf("%s: expected error", name)
+		}
+	}
+	for name, o := range map[string]Options{
+		"qos":         {QoS: 3, CleanSession: true},
+		"cert no key": {CertFile: notPEM, CleanSession: true},
+		"key no cert": {KeyFile: notPEM, CleanSession: true},
+		// a generated client id can't resume the session after a restart
+		"persistent session without client id": {},
+	} {
+		if err := o.validate(); err == nil {
+			t.Fatalf("%s: expected validation error", name)
+		}
+	}
+}
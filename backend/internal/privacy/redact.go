@@ -0,0 +1,68 @@
+package privacy
+
+// Redact rewrites a decoded snapshot, delta or event payload in place so it doesn't reveal
+// coordinates inside any zone: the car location is hidden or snapped to the zone centroid,
+// breadcrumbs inside a zone are dropped and trip endpoints and the navigation destination are
+// treated like the location. A destination inside a zone loses its label too.
+func (z *Zones) Redact(payload map[string]any) {
+	if loc, ok := payload["location"].(map[string]any); ok {
+		z.redactPoint(loc)
+	}
+	if path, ok := payload["path_30s"].([]any); ok {
+		kept := make([]any, 0, len(path))
+		for _, p := range path {
+			if m, ok := p.(map[string]any); ok {
+				if lat, lon, ok := coords(m); ok {
+					if _, inside := z.Lookup(lat, lon); inside {
+						continue
+					}
+				}
+			}
+			kept = append(kept, p)
+		}
+		payload["path_30s"] = kept
+	}
+	if trip, ok := payload["trip"].(map[string]any); ok {
+		for _, key := range []string{"start", "end"} {
+			if p, ok := trip[key].(map[string]any); ok && z.redactPoint(p) {
+				if _, ok := p["lat"]; !ok {
+					delete(trip, key)
+				}
+			}
+		}
+	}
+	if route, ok := payload["route"].(map[string]any); ok {
+		if dest, ok := route["dest"].(map[string]any); ok && z.redactPoint(dest) {
+			delete(route, "dest_label")
+			if _, ok := dest["lat"]; !ok {
+				delete(route, "dest")
+			}
+		}
+	}
+}
+
+// redactPoint hides or snaps the lat/lon of m when it lies inside a zone and reports whether it did.
+func (z *Zones) redactPoint(m map[string]any) bool {
+	lat, lon, ok := coords(m)
+	if !ok {
+		return false
+	}
+	zone, inside := z.Lookup(lat, lon)
+	if !inside {
+		return false
+	}
+	if zone.Mode == ModeCentroid {
+		c := zone.Centroid()
+		m["lat"], m["lon"] = c.Lat, c.Lon
+	} else {
+		delete(m, "lat")
+		delete(m, "lon")
+	}
+	return true
+}
+
+func coords(m map[string]any) (lat, lon float64, ok bool) {
+	lat, okLat := m["lat"].(float64)
+	lon, okLon := m["lon"].(float64)
+	return lat, lon, okLat && okLon
+}
@@ -0,0 +1,67 @@
+package privacy
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func decode(t *testing.T, s string) map[string]any {
+	t.Helper()
+	var m map[string]any
+	if err := json.Unmarshal([]byte(s), &m); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	return m
+}
+
+func TestRedact(t *testing.T) {
+	z, _ := NewZones("")
+	_, _ = z.Add(Zone{Center: &Point{Lat: 51.05, Lon: 3.72}, RadiusM: 200})
+	_, _ = z.Add(Zone{Polygon: []Point{{Lat: 0, Lon: 0}, {Lat: 0, Lon: 1}, {Lat: 1, Lon: 1}, {Lat: 1, Lon: 0}}, Mode: ModeCentroid})
+
+	p := decode(t, `{
+		"location": {"lat": 51.0501, "lon": 3.7201, "speed_kph": 0},
+		"path_30s": [{"ts_ms": 1, "lat": 51.0, "lon": 3.0}, {"ts_ms": 2, "lat": 51.0501, "lon": 3.7201}, {"ts_ms": 3, "lat": 0.2, "lon": 0.3}],
+		"trip": {"start": {"lat": 0.2, "lon": 0.3}, "end": {"lat": 51.0501, "lon": 3.7201}, "distance_km": 12},
+		"route": {"dest": {"lat": 51.0501, "lon": 3.7201}, "dest_label": "Home", "eta_min": 12}
+	}`)
+	z.Redact(p)
+
+	loc := p["location"].(map[string]any)
+	if _, ok := loc["lat"]; ok {
+		t.Fatalf("expected coordinates to be hidden: %v", loc)
+	}
+	if loc["speed_kph"] != 0.0 {
+		t.Fatalf("expected other location fields to be kept: %v", loc)
+	}
+	if path := p["path_30s"].([]any); len(path) != 1 || path[0].(map[string]any)["ts_ms"] != 1.0 {
+		t.Fatalf("expected breadcrumbs inside zones to be dropped: %v", path)
+	}
+	trip := p["trip"].(map[string]any)
+	if start := trip["start"].(map[string]any); start["lat"] != 0.5 || start["lon"] != 0.5 {
+		t.Fatalf("expected trip start snapped to centroid: %v", start)
+	}
+	if _, ok := trip["end"]; ok {
+		t.Fatalf("expected trip end inside hide zone to be removed: %v", trip)
+	}
+	route := p["route"].(map[string]any)
+	if _, ok := route["dest"]; ok {
+		t.Fatalf("expected destination inside hide zone to be removed: %v", route)
+	}
+	if _, ok := route["dest_label"]; ok || route["eta_min"] != 12.0 {
+		t.Fatalf("expected only the destination label to be dropped: %v", route)
+	}
+
+	snapped := decode(t, `{"route": {"dest": {"lat": 0.2, "lon": 0.3}, "dest_label": "Work"}}`)
+	z.Redact(snapped)
+	route = snapped["route"].(map[string]any)
+	if dest := route["dest"].(map[string]any); dest["lat"] != 0.5 || dest["lon"] != 0.5 || route["dest_label"] != nil {
+		t.Fatalf("expected destination snapped to centroid without label: %v", route)
+	}
+
+	outside := decode(t, `{"location": {"lat": 48.85, "lon": 2.35}}`)
+	z.Redact(outside)
+	if outside["location"].(map[string]any)["lat"] != 48.85 {
+		t.Fatalf("expected coordinates outside zones to be untouched: %v", outside)
+	}
+}
@@ -0,0 +1,207 @@
+package privacy
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/fsutil"
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/state"
+)
+
+var ErrNotFound = errors.New("privacy zone not found")
+
+const (
+	// ModeHide removes the coordinates of a car inside the zone.
+	ModeHide = "hide"
+	// ModeCentroid replaces the coordinates of a car inside the zone by the zone's centroid.
+	ModeCentroid = "centroid"
+)
+
+type Point struct {
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+}
+
+// Zone is a geofence within which the exact location of a car is not revealed to share viewers.
+// It is either a circle (Center and RadiusM) or a polygon of at least three points.
+type Zone struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name,omitempty"`
+	Center    *Point    `json:"center,omitempty"`
+	RadiusM   float64   `json:"radius_m,omitempty"`
+	Polygon   []Point   `json:"polygon,omitempty"`
+	Mode      string    `json:"mode"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Validate checks the zone shape and fills in the default mode.
+func (z *Zone) Validate() error {
+	switch {
+	case z.Center != nil && len(z.Polygon) > 0:
+		return errors.New("zone must be either a circle or a polygon")
+	case z.Center != nil:
+		if z.RadiusM <= 0 {
+			return errors.New("radius_m must be positive")
+		}
+	case len(z.Polygon) > 0:
+		if len(z.Polygon) < 3 {
+			return errors.New("polygon needs at least 3 points")
+		}
+	default:
+		return errors.New("zone needs a center and radius_m, or a polygon")
+	}
+	switch z.Mode {
+	case "":
+		z.Mode = ModeHide
+	case ModeHide, ModeCentroid:
+	default:
+		return errors.New("mode must be hide or centroid")
+	}
+	return nil
+}
+
+// Contains reports whether the coordinate lies inside the zone.
+func (z *Zone) Contains(lat, lon float64) bool {
+	if z.Center != nil {
+		return state.DistanceMeters(z.Center.Lat, z.Center.Lon, lat, lon) <= z.RadiusM
+	}
+	// ray casting; zones are small enough to treat lat/lon as planar
+	inside := false
+	for i, j := 0, len(z.Polygon)-1; i < len(z.Polygon); j, i = i, i+1 {
+		a, b := z.Polygon[i], z.Polygon[j]
+		if (a.Lat > lat) != (b.Lat > lat) && lon < (b.Lon-a.Lon)*(lat-a.Lat)/(b.Lat-a.Lat)+a.Lon {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// Centroid returns the point reported instead of the real location in ModeCentroid.
+func (z *Zone) Centroid() Point {
+	if z.Center != nil {
+		return *z.Center
+	}
+	var c Point
+	for _, p := range z.Polygon {
+		c.Lat += p.Lat
+		c.Lon += p.Lon
+	}
+	n := float64(len(z.Polygon))
+	return Point{Lat: c.Lat / n, Lon: c.Lon / n}
+}
+
+// Zones holds the configured privacy zones. When a path is configured the zones are persisted
+// as JSON after every change.
+type Zones struct {
+	mu    sync.RWMutex
+	zones map[string]Zone
+	path  string
+}
+
+// NewZones creates the zone set, loading previously persisted zones from path when non-empty.
+func NewZones(path string) (*Zones, error) {
+	z := &Zones{zones: make(map[string]Zone), path: path}
+	if path == "" {
+		return z, nil
+	}
+	b, err := os.ReadFile(path) // #nosec G304 -- path comes from server config
+	if errors.Is(err, os.ErrNotExist) {
+		return z, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var list []Zone
+	if err := json.Unmarshal(b, &list); err != nil {
+		return nil, err
+	}
+	for _, zone := range list {
+		if err := zone.Validate(); err != nil {
+			return nil, err
+		}
+		z.zones[zone.ID] = zone
+	}
+	return z, nil
+}
+
+// Add validates and stores a new zone, assigning it an ID.
+func (z *Zones) Add(zone Zone) (Zone, error) {
+	if err := zone.Validate(); err != nil {
+		return Zone{}, err
+	}
+	zone.ID = uuid.New().String()
+	zone.CreatedAt = time.Now()
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.zones[zone.ID] = zone
+	return zone, z.saveLocked()
+}
+
+// List returns all zones, oldest first.
+func (z *Zones) List() []Zone {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	list := make([]Zone, 0, len(z.zones))
+	for _, zone := range z.zones {
+		list = append(list, zone)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	return list
+}
+
+func (z *Zones) Delete(id string) error {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if _, ok := z.zones[id]; !ok {
+		return ErrNotFound
+	}
+	delete(z.zones, id)
+	return z.saveLocked()
+}
+
+// Lookup returns the zone containing the coordinate, if any. Where zones overlap a hide zone
+// wins over a centroid one, then the oldest zone, so a car is redacted the same way every time.
+func (z *Zones) Lookup(lat, lon float64) (Zone, bool) {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	var (
+		found Zone
+		ok    bool
+	)
+	for _, zone := range z.zones {
+		if zone.Contains(lat, lon) && (!ok || zone.precedes(found)) {
+			found, ok = zone, true
+		}
+	}
+	return found, ok
+}
+
+// precedes reports whether the zone applies rather than o where both contain a coordinate.
+func (zone Zone) precedes(o Zone) bool {
+	if (zone.Mode == ModeHide) != (o.Mode == ModeHide) {
+		return zone.Mode == ModeHide
+	}
+	if !zone.CreatedAt.Equal(o.CreatedAt) {
+		return zone.CreatedAt.Before(o.CreatedAt)
+	}
+	return zone.ID < o.ID
+}
+
+func (z *Zones) saveLocked() error {
+	if z.path == "" {
+		return nil
+	}
+	list := make([]Zone, 0, len(z.zones))
+	for _, zone := range z.zones {
+		list = append(list, zone)
+	}
+	b, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	return fsutil.WriteFileAtomic(z.path, b)
+}
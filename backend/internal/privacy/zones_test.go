@@ -0,0 +1,98 @@
+package privacy
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestZone_Contains(t *testing.T) {
+	circle := Zone{Center: &Point{Lat: 51.05, Lon: 3.72}, RadiusM: 200}
+	if !circle.Contains(51.0505, 3.7205) {
+		t.Fatalf("expected point within 200m to be inside")
+	}
+	if circle.Contains(51.06, 3.72) {
+		t.Fatalf("expected point ~1km away to be outside")
+	}
+
+	square := Zone{Polygon: []Point{{Lat: 0, Lon: 0}, {Lat: 0, Lon: 1}, {Lat: 1, Lon: 1}, {Lat: 1, Lon: 0}}}
+	if !square.Contains(0.5, 0.5) || square.Contains(1.5, 0.5) || square.Contains(0.5, -0.1) {
+		t.Fatalf("unexpected polygon containment")
+	}
+	if c := square.Centroid(); c.Lat != 0.5 || c.Lon != 0.5 {
+		t.Fatalf("unexpected centroid: %+v", c)
+	}
+}
+
+func TestZone_Validate(t *testing.T) {
+	cases := []struct {
+		name string
+		zone Zone
+		ok   bool
+	}{
+		{"circle", Zone{Center: &Point{}, RadiusM: 100}, true},
+		{"polygon", Zone{Polygon: []Point{{}, {Lat: 1}, {Lon: 1}}, Mode: ModeCentroid}, true},
+		{"no radius", Zone{Center: &Point{}}, false},
+		{"too few points", Zone{Polygon: []Point{{}, {Lat: 1}}}, false},
+		{"both shapes", Zone{Center: &Point{}, RadiusM: 1, Polygon: []Point{{}, {Lat: 1}, {Lon: 1}}}, false},
+		{"empty", Zone{}, false},
+		{"bad mode", Zone{Center: &Point{}, RadiusM: 1, Mode: "blur"}, false},
+	}
+	for _, c := range cases {
+		err := c.zone.Validate()
+		if (err == nil) != c.ok {
+			t.Fatalf("%s: unexpected result %v", c.name, err)
+		}
+	}
+	z := Zone{Center: &Point{}, RadiusM: 1}
+	_ = z.Validate()
+	if z.Mode != ModeHide {
+		t.Fatalf("expected default mode hide, got %q", z.Mode)
+	}
+}
+
+func TestZones_Persistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "zones.json")
+	z, err := NewZones(path)
+	if err != nil {
+		t.Fatalf("NewZones error: %v", err)
+	}
+	home, err := z.Add(Zone{Name: "home", Center: &Point{Lat: 51.05, Lon: 3.72}, RadiusM: 200})
+	if err != nil {
+		t.Fatalf("Add error: %v", err)
+	}
+	work, _ := z.Add(Zone{Name: "work", Center: &Point{Lat: 50.85, Lon: 4.35}, RadiusM: 300})
+	if err := z.Delete(work.ID); err != nil {
+		t.Fatalf("Delete error: %v", err)
+	}
+	if err := z.Delete(work.ID); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	reloaded, err := NewZones(path)
+	if err != nil {
+		t.Fatalf("reload error: %v", err)
+	}
+	list := reloaded.List()
+	if len(list) != 1 || list[0].ID != home.ID || list[0].Mode != ModeHide {
+		t.Fatalf("unexpected zones after reload: %+v", list)
+	}
+	if _, ok := reloaded.Lookup(51.0501, 3.7201); !ok {
+		t.Fatalf("expected lookup to find the home zone")
+	}
+}
+
+func TestZones_LookupOverlap(t *testing.T) {
+	z, _ := NewZones("")
+	older, _ := z.Add(Zone{Center: &Point{Lat: 51.05, Lon: 3.72}, RadiusM: 1000, Mode: ModeCentroid})
+	_, _ = z.Add(Zone{Center: &Point{Lat: 51.05, Lon: 3.72}, RadiusM: 1000, Mode: ModeCentroid})
+	hide, _ := z.Add(Zone{Center: &Point{Lat: 51.05, Lon: 3.72}, RadiusM: 100, Mode: ModeHide})
+	// the same zone applies every time, whatever the map order
+	for range 20 {
+		if got, _ := z.Lookup(51.05, 3.72); got.ID != hide.ID {
+			t.Fatalf("expected the hide zone to win, got %+v", got)
+		}
+		if got, _ := z.Lookup(51.055, 3.72); got.ID != older.ID {
+			t.Fatalf("expected the oldest zone to win, got %+v", got)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+// Package recording stores MQTT messages as they are received so a drive can be replayed
+// later, for demos, frontend development and deterministic tests.
+package recording
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Message is a single MQTT message as it was received.
+type Message struct {
+	TS      int64  `json:"ts_ms"`
+	Topic   string `json:"topic"`
+	Payload string `json:"payload"`
+}
+
+// Recorder appends messages to a file, one JSON object per line.
+type Recorder struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// NewRecorder opens path for appending, creating it when needed.
+func NewRecorder(path string) (*Recorder, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600) // #nosec G304 -- path comes from server config
+	if err != nil {
+		return nil, err
+	}
+	return &Recorder{f: f}, nil
+}
+
+// Record writes a message received at the given time.
+func (r *Recorder) Record(topic string, payload []byte, at time.Time) error {
+	b, err := json.Marshal(Message{TS: at.UnixMilli(), Topic: topic, Payload: string(payload)})
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, err = r.f.Write(append(b, '\n'))
+	return err
+}
+
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Close()
+}
+
+// Read decodes a recording, oldest message first.
+func Read(rd io.Reader) ([]Message, error) {
+	var msgs []Message
+	sc := bufio.NewScanner(rd)
+	// location and route payloads are small, but leave room for odd ones
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+		var m Message
+		if err := json.Unmarshal(sc.Bytes(), &m); err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs, sc.Err()
+}
+
+// ReadFile decodes the recording stored at path.
+func ReadFile(path string) ([]Message, error) {
+	f, err := os.Open(path) // #nosec G304 -- path is given by the operator
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	return Read(f)
+}
+
+// Play calls fn for every message, keeping the time between messages as recorded divided by
+// speed: 2 plays twice as fast, 0 or less as fast as possible. It returns ctx.Err() when
+// canceled before the end of the recording.
+func Play(ctx context.Context, msgs []Message, speed float64, fn func(Message)) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+	start := time.Now()
+	first := msgs[0].TS
+	for _, m := range msgs {
+		if speed > 0 {
+			offset := time.Duration(float64(m.TS-first) / speed * float64(time.Millisecond))
+			if wait := time.Until(start.Add(offset)); wait > 0 {
+				t := time.NewTimer(wait)
+				select {
+				case <-ctx.Done():
+					t.Stop()
+					return ctx.Err()
+				case <-t.C:
+				}
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		fn(m)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package recording
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecorder_Roundtrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "drive.jsonl")
+	rec, err := NewRecorder(path)
+	if err != nil {
+		t.Fatalf("new recorder: %v", err)
+	}
+	t0 := time.UnixMilli(1_700_000_000_000)
+	if err := rec.Record("teslamate/cars/1/speed", []byte("42"), t0); err != nil {
+		t.Fatalf("record: %v", err)
+	}
+	if err := rec.Record("teslamate/cars/1/location", []byte(`{"latitude":1.5,"longitude":2.5}`), t0.Add(time.Second)); err != nil {
+		t.Fatalf("record: %v", err)
+	}
+	if err := rec.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	// reopening appends instead of truncating
+	rec, err = NewRecorder(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	_ = rec.Record("teslamate/cars/1/speed", []byte("50"), t0.Add(2*time.Second))
+	_ = rec.Close()
+
+	msgs, err := ReadFile(path)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if len(msgs) != 3 {
+		t.Fatalf("expected 3 messages, got %d", len(msgs))
+	}
+	if msgs[0].TS != t0.UnixMilli() || msgs[0].Topic != "teslamate/cars/1/speed" || msgs[0].Payload != "42" {
+		t.Fatalf("unexpected first message: %+v", msgs[0])
+	}
+	if msgs[1].Payload != `{"latitude":1.5,"longitude":2.5}` || msgs[2].Payload != "50" {
+		t.Fatalf("unexpected messages: %+v", msgs)
+	}
+}
+
+func TestRead_Invalid(t *testing.T) {
+	if _, err := Read(strings.NewReader("{\"ts_ms\":1}\n\nnot json\n")); err == nil {
+		t.Fatalf("expected error for invalid line")
+	}
+}
+
+func TestPlay(t *testing.T) {
+	msgs := []Message{{TS: 1000, Topic: "a"}, {TS: 1100, Topic: "b"}, {TS: 1300, Topic: "c"}}
+
+	var got []string
+	if err := Play(context.Background(), msgs, 0, func(m Message) { got = append(got, m.Topic) }); err != nil {
+		t.Fatalf("play: %v", err)
+	}
+	if strings.Join(got, ",") != "a,b,c" {
+		t.Fatalf("unexpected order: %v", got)
+	}
+
+	// 300ms of recording at 10x takes about 30ms
+	start := time.Now()
+	if err := Play(context.Background(), msgs, 10, func(Message) {}); err != nil {
+		t.Fatalf("play: %v", err)
+	}
+	if d := time.Since(start); d < 25*time.Millisecond || d > time.Second {
+		t.Fatalf("unexpected playback duration %v", d)
+	}
+}
+
+func TestPlay_Canceled(t *testing.T) {
+	msgs := []Message{{TS: 0, Topic: "a"}, {TS: 60_000, Topic: "b"}}
+	ctx, cancel := context.WithCancel(context.Background())
+	var got []string
+	done := make(chan error, 1)
+	go func() {
+		done <- Play(ctx, msgs, 1, func(m Message) { got = append(got, m.Topic) })
+	}()
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected context.Canceled, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("play didn't stop after cancel")
+	}
+	if len(got) != 1 {
+		t.Fatalf("expected only the first message, got %v", got)
+	}
+}
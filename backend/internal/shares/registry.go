@@ -0,0 +1,277 @@
+package shares
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/fsutil"
+)
+
+var (
+	ErrNotFound = errors.New("share not found")
+	ErrRevoked  = errors.New("share revoked")
+)
+
+// Share describes an issued share token.
+type Share struct {
+	JTI       string     `json:"jti"`
+	CarID     int64      `json:"car_id"`
+	CarIDs    []int64    `json:"car_ids,omitempty"`
+	AllCars   bool       `json:"all_cars,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	Label     string     `json:"label,omitempty"`
+	Scopes    []string   `json:"scopes,omitempty"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+	// ArrivedAt is set once the car reached the destination embedded in the share token
+	ArrivedAt *time.Time `json:"arrived_at,omitempty"`
+}
+
+type entry struct {
+	share Share
+	// done is closed once the share gets revoked
+	done chan struct{}
+}
+
+// Registry keeps track of issued shares so they can be listed and revoked before they expire.
+// When a path is configured the registry is persisted as JSON after every change. Instances
+// sharing the file merge each other's shares, revocations and arrivals: before every check,
+// before every save and, for the streams waiting on Done, in Watch. Changes hold a lock on the
+// file from reading to writing it, so concurrent changes of other instances aren't lost.
+type Registry struct {
+	mu     sync.RWMutex
+	shares map[string]*entry
+	path   string
+	// sum is the hash of the file contents merged last, to skip unchanged files
+	sum [sha256.Size]byte
+}
+
+// NewRegistry creates a registry, loading previously persisted shares from path when non-empty.
+func NewRegistry(path string) (*Registry, error) {
+	r := &Registry{shares: make(map[string]*entry), path: path}
+	if err := r.reloadLocked(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Add registers a newly issued share.
+func (r *Registry) Add(s Share) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.updateLocked(func() (bool, error) {
+		r.pruneLocked(time.Now())
+		r.shares[s.JTI] = &entry{share: s, done: make(chan struct{})}
+		return true, nil
+	})
+}
+
+// List returns all shares that have not expired yet, newest first.
+func (r *Registry) List() []Share {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_ = r.reloadLocked()
+	now := time.Now()
+	list := make([]Share, 0, len(r.shares))
+	for _, e := range r.shares {
+		if e.share.ExpiresAt.After(now) {
+			list = append(list, e.share)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+	return list
+}
+
+// Revoke marks the share as revoked and notifies everyone waiting on Done.
+func (r *Registry) Revoke(jti string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.updateLocked(func() (bool, error) {
+		e, ok := r.shares[jti]
+		if !ok {
+			return false, ErrNotFound
+		}
+		if e.share.RevokedAt != nil {
+			return false, nil
+		}
+		now := time.Now()
+		e.share.RevokedAt = &now
+		close(e.done)
+		return true, nil
+	})
+}
+
+// IsRevoked reports whether the share with the given jti has been revoked.
+// Unknown shares are not considered revoked. Revocations by other instances sharing the
+// file are taken into account.
+func (r *Registry) IsRevoked(jti string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// a file that can't be read leaves the shares known so far
+	_ = r.reloadLocked()
+	e, ok := r.shares[jti]
+	return ok && e.share.RevokedAt != nil
+}
+
+// MarkArrived records that the car of the share reached its destination, so the share keeps
+// being refused after a restart.
+func (r *Registry) MarkArrived(jti string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.updateLocked(func() (bool, error) {
+		e, ok := r.shares[jti]
+		if !ok {
+			return false, ErrNotFound
+		}
+		if e.share.ArrivedAt != nil {
+			return false, nil
+		}
+		now := time.Now()
+		e.share.ArrivedAt = &now
+		return true, nil
+	})
+}
+
+// HasArrived reports whether the car of the share with the given jti reached its destination.
+func (r *Registry) HasArrived(jti string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// a file that can't be read leaves the shares known so far
+	_ = r.reloadLocked()
+	e, ok := r.shares[jti]
+	return ok && e.share.ArrivedAt != nil
+}
+
+// Done returns a channel that is closed when the share gets revoked.
+// For unknown shares a nil channel is returned, which blocks forever.
+func (r *Registry) Done(jti string) <-chan struct{} {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if e, ok := r.shares[jti]; ok {
+		return e.done
+	}
+	return nil
+}
+
+// Watch merges the changes of other instances sharing the file every interval until ctx is
+// done, so the streams of shares they revoke end here too.
+func (r *Registry) Watch(ctx context.Context, every time.Duration) {
+	if r.path == "" {
+		return
+	}
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			r.mu.Lock()
+			_ = r.reloadLocked()
+			r.mu.Unlock()
+		}
+	}
+}
+
+// updateLocked merges the file, applies fn and saves the result when fn reports a change. The
+// file stays locked throughout, so no other instance writes in between.
+func (r *Registry) updateLocked(fn func() (bool, error)) error {
+	if r.path != "" {
+		unlock, err := fsutil.Lock(r.path)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	if err := r.reloadLocked(); err != nil {
+		return err
+	}
+	changed, err := fn()
+	if err != nil || !changed {
+		return err
+	}
+	return r.saveLocked()
+}
+
+// reloadLocked merges the shares persisted in the file, when its contents changed since it was
+// last read or written.
+func (r *Registry) reloadLocked() error {
+	if r.path == "" {
+		return nil
+	}
+	b, err := os.ReadFile(r.path) // #nosec G304 -- path comes from server config
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(b)
+	if sum == r.sum {
+		return nil
+	}
+	var list []Share
+	if err := json.Unmarshal(b, &list); err != nil {
+		return err
+	}
+	for _, s := range list {
+		r.mergeLocked(s)
+	}
+	r.sum = sum
+	return nil
+}
+
+// mergeLocked adds a share persisted by any instance, or the revocation and arrival recorded
+// for a known one. Neither is ever undone.
+func (r *Registry) mergeLocked(s Share) {
+	e, ok := r.shares[s.JTI]
+	if !ok {
+		e = &entry{share: s, done: make(chan struct{})}
+		if s.RevokedAt != nil {
+			close(e.done)
+		}
+		r.shares[s.JTI] = e
+		return
+	}
+	if s.RevokedAt != nil && e.share.RevokedAt == nil {
+		e.share.RevokedAt = s.RevokedAt
+		close(e.done)
+	}
+	if s.ArrivedAt != nil && e.share.ArrivedAt == nil {
+		e.share.ArrivedAt = s.ArrivedAt
+	}
+}
+
+// pruneLocked forgets about shares that have expired, they can no longer be used anyway.
+func (r *Registry) pruneLocked(now time.Time) {
+	for jti, e := range r.shares {
+		if !e.share.ExpiresAt.After(now) {
+			delete(r.shares, jti)
+		}
+	}
+}
+
+func (r *Registry) saveLocked() error {
+	if r.path == "" {
+		return nil
+	}
+	list := make([]Share, 0, len(r.shares))
+	for _, e := range r.shares {
+		list = append(list, e.share)
+	}
+	b, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	if err := fsutil.WriteFileAtomic(r.path, b); err != nil {
+		return err
+	}
+	// what was just written holds everything merged so far
+	r.sum = sha256.Sum256(b)
+	return nil
+}
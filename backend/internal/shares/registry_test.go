@@ -0,0 +1,155 @@
+package shares
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRegistry_AddListRevoke(t *testing.T) {
+	r, err := NewRegistry("")
+	if err != nil {
+		t.Fatalf("NewRegistry error: %v", err)
+	}
+	now := time.Now()
+	_ = r.Add(Share{JTI: "a", CarID: 1, CreatedAt: now.Add(-time.Minute), ExpiresAt: now.Add(time.Hour)})
+	_ = r.Add(Share{JTI: "b", CarID: 2, CreatedAt: now, ExpiresAt: now.Add(time.Hour), Label: "mom"})
+	_ = r.Add(Share{JTI: "expired", CarID: 1, CreatedAt: now.Add(-2 * time.Hour), ExpiresAt: now.Add(-time.Hour)})
+
+	list := r.List()
+	if len(list) != 2 || list[0].JTI != "b" || list[1].JTI != "a" {
+		t.Fatalf("unexpected list: %+v", list)
+	}
+
+	done := r.Done("a")
+	if r.IsRevoked("a") {
+		t.Fatalf("expected share not revoked yet")
+	}
+	if err := r.Revoke("a"); err != nil {
+		t.Fatalf("Revoke error: %v", err)
+	}
+	if !r.IsRevoked("a") {
+		t.Fatalf("expected share revoked")
+	}
+	select {
+	case <-done:
+	default:
+		t.Fatalf("expected done channel closed on revoke")
+	}
+	// revoking twice is fine
+	if err := r.Revoke("a"); err != nil {
+		t.Fatalf("second Revoke error: %v", err)
+	}
+	if err := r.Revoke("unknown"); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if r.Done("unknown") != nil {
+		t.Fatalf("expected nil done channel for unknown share")
+	}
+}
+
+func TestRegistry_Persistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shares.json")
+	r, err := NewRegistry(path)
+	if err != nil {
+		t.Fatalf("NewRegistry error: %v", err)
+	}
+	now := time.Now()
+	_ = r.Add(Share{JTI: "a", CarID: 1, CreatedAt: now, ExpiresAt: now.Add(time.Hour)})
+	_ = r.Add(Share{JTI: "b", CarID: 1, CreatedAt: now, ExpiresAt: now.Add(time.Hour)})
+	if err := r.Revoke("b"); err != nil {
+		t.Fatalf("Revoke error: %v", err)
+	}
+	if err := r.MarkArrived("a"); err != nil {
+		t.Fatalf("MarkArrived error: %v", err)
+	}
+	if err := r.MarkArrived("unknown"); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	r2, err := NewRegistry(path)
+	if err != nil {
+		t.Fatalf("reload error: %v", err)
+	}
+	if len(r2.List()) != 2 {
+		t.Fatalf("expected 2 shares after reload, got %d", len(r2.List()))
+	}
+	if r2.IsRevoked("a") || !r2.IsRevoked("b") {
+		t.Fatalf("unexpected revocation state after reload")
+	}
+	if !r2.HasArrived("a") || r2.HasArrived("b") {
+		t.Fatalf("unexpected arrival state after reload")
+	}
+	select {
+	case <-r2.Done("b"):
+	default:
+		t.Fatalf("expected done channel of revoked share to be closed after reload")
+	}
+}
+
+func TestRegistry_SharedFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shares.json")
+	a, _ := NewRegistry(path)
+	b, _ := NewRegistry(path)
+	now := time.Now()
+	if err := a.Add(Share{JTI: "x", CarID: 1, CreatedAt: now, ExpiresAt: now.Add(time.Hour)}); err != nil {
+		t.Fatalf("Add error: %v", err)
+	}
+	if err := b.Add(Share{JTI: "y", CarID: 1, CreatedAt: now, ExpiresAt: now.Add(time.Hour)}); err != nil {
+		t.Fatalf("Add error: %v", err)
+	}
+	done := b.Done("x")
+
+	// revoked on one instance, refused by the other
+	if err := a.Revoke("x"); err != nil {
+		t.Fatalf("Revoke error: %v", err)
+	}
+	if !b.IsRevoked("x") {
+		t.Fatal("expected the revocation of the other instance to be picked up")
+	}
+	select {
+	case <-done:
+	default:
+		t.Fatal("expected done channel closed on a revocation by the other instance")
+	}
+
+	// saving on one instance keeps what the other saved
+	if err := b.Revoke("y"); err != nil {
+		t.Fatalf("Revoke error: %v", err)
+	}
+	if err := a.MarkArrived("y"); err != nil {
+		t.Fatalf("MarkArrived error: %v", err)
+	}
+	c, _ := NewRegistry(path)
+	if !c.IsRevoked("x") || !c.IsRevoked("y") || !c.HasArrived("y") {
+		t.Fatalf("expected the changes of both instances to be persisted: %+v", c.List())
+	}
+}
+
+func TestRegistry_ConcurrentInstances(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shares.json")
+	a, _ := NewRegistry(path)
+	b, _ := NewRegistry(path)
+	now := time.Now()
+	// both instances add shares at the same time, none of them gets lost
+	var wg sync.WaitGroup
+	for i, r := range []*Registry{a, b} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range 20 {
+				s := Share{JTI: fmt.Sprintf("%d-%d", i, j), CarID: 1, CreatedAt: now, ExpiresAt: now.Add(time.Hour)}
+				if err := r.Add(s); err != nil {
+					t.Errorf("Add error: %v", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	c, _ := NewRegistry(path)
+	if n := len(c.List()); n != 40 {
+		t.Fatalf("expected the shares of both instances, got %d", n)
+	}
+}
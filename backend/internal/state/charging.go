@@ -0,0 +1,132 @@
+package state
+
+const (
+	// maxChargingSessions bounds the number of finished sessions kept per car.
+	maxChargingSessions = 20
+	// maxCurvePoints bounds the size of a session's charge curve; when exceeded the
+	// curve is thinned out by dropping every other point.
+	maxCurvePoints = 500
+)
+
+// ChargeCurvePoint is a single charger power reading at a given state of charge.
+type ChargeCurvePoint struct {
+	TS      int64   `json:"ts_ms"`
+	SOCPct  float64 `json:"soc_pct"`
+	PowerKW float64 `json:"power_kw"`
+}
+
+// ChargingSession describes a single charge, from the moment TeslaMate reports the car
+// starting to charge until it stops or gets unplugged. EndTS is zero while it is ongoing.
+type ChargingSession struct {
+	StartTS        int64              `json:"start_ts_ms"`
+	EndTS          int64              `json:"end_ts_ms,omitempty"`
+	StartSOCPct    float64            `json:"start_soc_pct"`
+	EndSOCPct      float64            `json:"end_soc_pct"`
+	EnergyAddedKWh float64            `json:"energy_added_kwh"`
+	PeakPowerKW    float64            `json:"peak_power_kw"`
+	AvgPowerKW     float64            `json:"avg_power_kw"`
+	Curve          []ChargeCurvePoint `json:"curve"`
+}
+
+func (cs *ChargingSession) clone() *ChargingSession {
+	c := *cs
+	c.Curve = append([]ChargeCurvePoint(nil), cs.Curve...)
+	return &c
+}
+
+// isCharging reports whether power is flowing (or about to). TeslaMate may report the car
+// being unplugged before charging_state changes, so both are taken into account.
+func isCharging(ch *Charging) bool {
+	return ch != nil && ch.PluggedIn && (ch.State == "Charging" || ch.State == "Starting")
+}
+
+// trackCharging starts, updates or finishes the charging session of a car after one of
+// the charging related values changed. It must be called with the store lock held.
+func (s *Store) trackCharging(carID int64, ce *carEntry, ts int64, delta map[string]any) {
+	charging := isCharging(ce.state.Charging)
+	cs := ce.state.ChargingSession
+	switch {
+	case cs == nil && charging:
+		cs = &ChargingSession{StartTS: ts}
+		if ce.state.Battery != nil {
+			cs.StartSOCPct = ce.state.Battery.SOCPct
+		}
+		// charge_energy_added still holds the previous charge until TeslaMate reports the new one
+		ce.state.Charging.EnergyAddedKWh = 0
+		ce.state.ChargingSession = cs
+		cs.update(ce.state, ts)
+		s.queueEvent(carID, "charging_started", map[string]any{"ts_ms": ts, "session": cs})
+		delta["charging_session"] = cs
+	case cs != nil && !charging:
+		s.finishCharging(carID, ce, ts, delta)
+	case cs != nil:
+		cs.update(ce.state, ts)
+		delta["charging_session"] = cs
+	}
+}
+
+// finishCharging closes the active charging session.
+func (s *Store) finishCharging(carID int64, ce *carEntry, ts int64, delta map[string]any) {
+	cs := ce.state.ChargingSession
+	cs.update(ce.state, ts)
+	cs.EndTS = ts
+	ce.state.ChargingSession = nil
+	ce.chargingSessions = append(ce.chargingSessions, *cs)
+	if n := len(ce.chargingSessions); n > maxChargingSessions {
+		ce.chargingSessions = ce.chargingSessions[n-maxChargingSessions:]
+	}
+	s.queueEvent(carID, "charging_finished", map[string]any{"ts_ms": ts, "session": cs})
+	delta["charging_session"] = nil
+}
+
+// update folds the latest charging values of st into the session.
+func (cs *ChargingSession) update(st CarState, ts int64) {
+	var soc float64
+	if st.Battery != nil {
+		soc = st.Battery.SOCPct
+	}
+	cs.EndSOCPct = soc
+	if st.Charging == nil {
+		return
+	}
+	ch := st.Charging
+	cs.EnergyAddedKWh = ch.EnergyAddedKWh
+	cs.PeakPowerKW = max(cs.PeakPowerKW, ch.PowerKW)
+	if hours := float64(ts-cs.StartTS) / 3_600_000; hours > 0 && cs.EnergyAddedKWh > 0 {
+		cs.AvgPowerKW = cs.EnergyAddedKWh / hours
+	}
+	if n := len(cs.Curve); n > 0 && cs.Curve[n-1].SOCPct == soc && cs.Curve[n-1].PowerKW == ch.PowerKW {
+		// resampled or otherwise unchanged reading
+		return
+	}
+	cs.Curve = append(cs.Curve, ChargeCurvePoint{TS: ts, SOCPct: soc, PowerKW: ch.PowerKW})
+	if len(cs.Curve) > maxCurvePoints {
+		thinned := cs.Curve[:0]
+		for i, p := range cs.Curve {
+			// keep the latest point so the curve always ends at the current reading
+			if i%2 == 0 || i == len(cs.Curve)-1 {
+				thinned = append(thinned, p)
+			}
+		}
+		cs.Curve = thinned
+	}
+}
+
+// ChargingSessions returns the recent charging sessions of a car, newest first. An ongoing
+// session is included as the first entry.
+func (s *Store) ChargingSessions(carID int64) []ChargingSession {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ce, ok := s.cars[carID]
+	if !ok {
+		return []ChargingSession{}
+	}
+	out := make([]ChargingSession, 0, len(ce.chargingSessions)+1)
+	if ce.state.ChargingSession != nil {
+		out = append(out, *ce.state.ChargingSession.clone())
+	}
+	for i := len(ce.chargingSessions) - 1; i >= 0; i-- {
+		out = append(out, *ce.chargingSessions[i].clone())
+	}
+	return out
+}
@@ -0,0 +1,123 @@
+package state
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+type recordedEvent struct {
+	carID int64
+	event string
+	data  map[string]any
+}
+
+// recordEvents captures the derived events of s, except car_added which is raised by
+// every first update and covered by TestStore_CarAdded.
+func recordEvents(s *Store) *[]recordedEvent {
+	var events []recordedEvent
+	s.SetNotifier(func(carID int64, event string, data []byte) {
+		if event == "car_added" {
+			return
+		}
+		var m map[string]any
+		_ = json.Unmarshal(data, &m)
+		events = append(events, recordedEvent{carID: carID, event: event, data: m})
+	})
+	return &events
+}
+
+func TestChargingSession_Lifecycle(t *testing.T) {
+	s := NewStore()
+	events := recordEvents(s)
+	const hour = int64(3_600_000)
+
+	s.UpdateBatteryLevel(1, 0, 40)
+	// stale value of the previous charge must not leak into the new session
+	s.UpdateChargeEnergyAdded(1, 0, 30)
+	s.UpdateChargingState(1, 0, "Charging")
+	if len(*events) != 0 {
+		t.Fatalf("session must not start before the car is plugged in: %+v", *events)
+	}
+	delta := s.UpdatePluggedIn(1, 0, true)
+	if len(*events) != 1 || (*events)[0].event != "charging_started" || (*events)[0].carID != 1 {
+		t.Fatalf("expected charging_started, got %+v", *events)
+	}
+	var js map[string]any
+	_ = json.Unmarshal(delta, &js)
+	if _, ok := js["charging_session"].(map[string]any); !ok {
+		t.Fatalf("expected charging_session in delta: %s", delta)
+	}
+
+	s.UpdateChargerPower(1, hour/4, 150)
+	s.UpdateChargerPower(1, hour/4, 150) // resampled, must not grow the curve
+	s.UpdateBatteryLevel(1, hour/2, 70)
+	s.UpdateChargerPower(1, hour/2, 90)
+	s.UpdateChargeEnergyAdded(1, hour/2, 50)
+
+	st, _ := s.GetSnapshot(1)
+	cs := st.ChargingSession
+	if cs == nil {
+		t.Fatalf("expected ongoing session in snapshot")
+	}
+	if cs.StartSOCPct != 40 || cs.EndSOCPct != 70 || cs.PeakPowerKW != 150 || cs.EnergyAddedKWh != 50 || cs.AvgPowerKW != 100 {
+		t.Fatalf("unexpected session: %+v", cs)
+	}
+	if len(cs.Curve) != 4 {
+		t.Fatalf("expected 4 curve points, got %+v", cs.Curve)
+	}
+
+	delta = s.UpdateChargingState(1, hour, "Complete")
+	if len(*events) != 2 || (*events)[1].event != "charging_finished" {
+		t.Fatalf("expected charging_finished, got %+v", *events)
+	}
+	js = nil
+	_ = json.Unmarshal(delta, &js)
+	if v, ok := js["charging_session"]; !ok || v != nil {
+		t.Fatalf("expected charging_session to be cleared in delta: %s", delta)
+	}
+	if st, _ := s.GetSnapshot(1); st.ChargingSession != nil {
+		t.Fatalf("expected no ongoing session after finishing")
+	}
+
+	sessions := s.ChargingSessions(1)
+	if len(sessions) != 1 || sessions[0].EndTS != hour || sessions[0].EnergyAddedKWh != 50 {
+		t.Fatalf("unexpected sessions: %+v", sessions)
+	}
+}
+
+func TestChargingSession_EndsOnUnplug(t *testing.T) {
+	s := NewStore()
+	events := recordEvents(s)
+
+	s.UpdatePluggedIn(1, 0, true)
+	s.UpdateChargingState(1, 0, "Starting")
+	s.UpdatePluggedIn(1, 1000, false)
+	// a late charging_state must not start a new session
+	s.UpdateChargerPower(1, 2000, 0)
+	if len(*events) != 2 || (*events)[1].event != "charging_finished" {
+		t.Fatalf("expected session to finish on unplug, got %+v", *events)
+	}
+	if got := s.ChargingSessions(1); len(got) != 1 {
+		t.Fatalf("expected one finished session, got %+v", got)
+	}
+	if got := s.ChargingSessions(2); len(got) != 0 {
+		t.Fatalf("expected no sessions for unknown car, got %+v", got)
+	}
+}
+
+func TestChargingSession_CurveIsBounded(t *testing.T) {
+	s := NewStore()
+	s.UpdatePluggedIn(1, 0, true)
+	s.UpdateChargingState(1, 0, "Charging")
+	for i := range 2 * maxCurvePoints {
+		s.UpdateChargerPower(1, int64(i+1)*1000, float64(i%100))
+	}
+	st, _ := s.GetSnapshot(1)
+	curve := st.ChargingSession.Curve
+	if len(curve) > maxCurvePoints {
+		t.Fatalf("expected curve to be bounded, got %d points", len(curve))
+	}
+	if last := curve[len(curve)-1]; last.TS != 2*maxCurvePoints*1000 {
+		t.Fatalf("expected curve to end at the latest reading, got %+v", last)
+	}
+}
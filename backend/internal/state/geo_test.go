@@ -0,0 +1,42 @@
+package state
+
+import (
+	"math"
+	"testing"
+)
+
+func TestDistanceMeters(t *testing.T) {
+	if d := DistanceMeters(51.05, 3.72, 51.05, 3.72); d != 0 {
+		t.Fatalf("expected 0 for identical points, got %f", d)
+	}
+	// Ghent -> Brussels is roughly 50km as the crow flies
+	d := DistanceMeters(51.0543, 3.7174, 50.8503, 4.3517)
+	if math.Abs(d-49_000) > 2_000 {
+		t.Fatalf("unexpected distance Ghent->Brussels: %f", d)
+	}
+	// one degree of latitude is ~111km
+	d = DistanceMeters(0, 0, 1, 0)
+	if math.Abs(d-111_195) > 100 {
+		t.Fatalf("unexpected distance for 1 degree latitude: %f", d)
+	}
+}
+
+func TestBearingDegrees(t *testing.T) {
+	cases := []struct {
+		name                   string
+		lat1, lon1, lat2, lon2 float64
+		want                   float64
+	}{
+		{"north", 0, 0, 1, 0, 0},
+		{"east", 0, 0, 0, 1, 90},
+		{"south", 1, 0, 0, 0, 180},
+		{"west", 0, 1, 0, 0, 270},
+		// Ghent -> Brussels heads east-south-east
+		{"ghent-brussels", 51.0543, 3.7174, 50.8503, 4.3517, 117},
+	}
+	for _, c := range cases {
+		if got := BearingDegrees(c.lat1, c.lon1, c.lat2, c.lon2); math.Abs(got-c.want) > 1 {
+			t.Fatalf("%s: got %f, want %f", c.name, got, c.want)
+		}
+	}
+}
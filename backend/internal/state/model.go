@@ -25,7 +25,30 @@ type Location struct {
 
 type Battery struct {
 	SOCPct float64 `json:"soc_pct"`
-	PowerW float64 `json:"power_w"`
+	// PowerW is TeslaMate's power reading, in kW despite the name
+	PowerW       float64 `json:"power_w"`
+	UsableSOCPct float64 `json:"usable_soc_pct,omitempty"`
+	EstRangeKM   float64 `json:"est_range_km,omitempty"`
+	RatedRangeKM float64 `json:"rated_range_km,omitempty"`
+}
+
+// Vehicle holds the overall status of the car as reported by TeslaMate.
+type Vehicle struct {
+	// State is one of online, asleep, suspended, offline, driving, charging or updating
+	State string `json:"state,omitempty"`
+	// ShiftState is P, D, R or N, empty when unknown
+	ShiftState string  `json:"shift_state,omitempty"`
+	OdometerKM float64 `json:"odometer_km,omitempty"`
+}
+
+type Charging struct {
+	PluggedIn bool `json:"plugged_in"`
+	// State is TeslaMate's charging_state, e.g. Charging, Complete, Stopped or Disconnected
+	State          string  `json:"state,omitempty"`
+	PowerKW        float64 `json:"power_kw"`
+	EnergyAddedKWh float64 `json:"energy_added_kwh"`
+	TimeToFullH    float64 `json:"time_to_full_h"`
+	LimitSOCPct    float64 `json:"limit_soc_pct,omitempty"`
 }
 
 type Climate struct {
@@ -58,20 +81,78 @@ type CarState struct {
 	DisplayName   string
 	ExteriorColor string
 	Model         string
+	Vehicle       *Vehicle  `json:"vehicle,omitempty"`
 	Location      *Location `json:"location,omitempty"`
 	Battery       *Battery  `json:"battery,omitempty"`
+	Charging      *Charging `json:"charging,omitempty"`
 	Climate       *Climate  `json:"climate,omitempty"`
 	TPMS          *TPMSBar  `json:"tpms_bar,omitempty"`
 	Route         *Route    `json:"route,omitempty"`
+
+	// ChargingSession is the ongoing charging session, nil when the car is not charging
+	ChargingSession *ChargingSession `json:"charging_session,omitempty"`
+	// Trip is the ongoing trip, nil when the car is not being driven
+	Trip *Trip `json:"trip,omitempty"`
+}
+
+// clone returns a copy of the state that does not share any nested structs,
+// so it can be read after the store lock has been released.
+func (s CarState) clone() CarState {
+	c := s
+	if s.Vehicle != nil {
+		v := *s.Vehicle
+		c.Vehicle = &v
+	}
+	if s.Location != nil {
+		loc := *s.Location
+		c.Location = &loc
+	}
+	if s.Battery != nil {
+		b := *s.Battery
+		c.Battery = &b
+	}
+	if s.Charging != nil {
+		ch := *s.Charging
+		c.Charging = &ch
+	}
+	if s.ChargingSession != nil {
+		c.ChargingSession = s.ChargingSession.clone()
+	}
+	if s.Trip != nil {
+		t := *s.Trip
+		c.Trip = &t
+	}
+	if s.Climate != nil {
+		cl := *s.Climate
+		c.Climate = &cl
+	}
+	if s.TPMS != nil {
+		t := *s.TPMS
+		c.TPMS = &t
+	}
+	if s.Route != nil {
+		r := *s.Route
+		if s.Route.Dest != nil {
+			d := *s.Route.Dest
+			r.Dest = &d
+		}
+		c.Route = &r
+	}
+	return c
 }
 
 type HistoryWindow struct {
-	// per metric time series for 30s window
+	// per metric time series within the history window, see HistoryInfo
 	SpeedKPH   []TimestampedFloat `json:"speed_kph"`
 	Heading    []TimestampedFloat `json:"heading"`
 	ElevationM []TimestampedFloat `json:"elevation_m"`
 	SOCPct     []TimestampedFloat `json:"soc_pct"`
 	PowerW     []TimestampedFloat `json:"power_w"`
+	UsableSOC  []TimestampedFloat `json:"usable_soc_pct"`
+	EstRange   []TimestampedFloat `json:"est_range_km"`
+	RatedRange []TimestampedFloat `json:"rated_range_km"`
+	ChargerKW  []TimestampedFloat `json:"charger_power_kw"`
+	EnergyKWh  []TimestampedFloat `json:"charge_energy_added_kwh"`
 	InsideC    []TimestampedFloat `json:"inside_c"`
 	OutsideC   []TimestampedFloat `json:"outside_c"`
 	TPMSFL     []TimestampedFloat `json:"tpms_fl"`
@@ -81,6 +162,28 @@ type HistoryWindow struct {
 	Path       []Breadcrumb       `json:"path_30s"`
 }
 
+// series returns the numeric history series keyed by their JSON name.
+func (h *HistoryWindow) series() map[string]*[]TimestampedFloat {
+	return map[string]*[]TimestampedFloat{
+		"speed_kph":               &h.SpeedKPH,
+		"heading":                 &h.Heading,
+		"elevation_m":             &h.ElevationM,
+		"soc_pct":                 &h.SOCPct,
+		"power_w":                 &h.PowerW,
+		"usable_soc_pct":          &h.UsableSOC,
+		"est_range_km":            &h.EstRange,
+		"rated_range_km":          &h.RatedRange,
+		"charger_power_kw":        &h.ChargerKW,
+		"charge_energy_added_kwh": &h.EnergyKWh,
+		"inside_c":                &h.InsideC,
+		"outside_c":               &h.OutsideC,
+		"tpms_fl":                 &h.TPMSFL,
+		"tpms_fr":                 &h.TPMSFR,
+		"tpms_rl":                 &h.TPMSRL,
+		"tpms_rr":                 &h.TPMSRR,
+	}
+}
+
 type CarInfo struct {
 	ID          int64  `json:"id"`
 	DisplayName string `json:"display_name"`
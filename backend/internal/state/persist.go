@@ -0,0 +1,87 @@
+package state
+
+import "time"
+
+// Persister durably records car state and history samples so the store can be
+// rebuilt after a restart. Implementations must not block for long, they are
+// called while the store lock is held.
+type Persister interface {
+	// SaveState records the latest state of a car.
+	SaveState(carID int64, st CarState)
+	// AppendSamples records history samples appended by an update.
+	AppendSamples(carID int64, samples []Sample)
+	// Load returns every persisted car with its samples not older than since (ms), oldest first.
+	Load(since int64) (map[int64]*PersistedCar, error)
+}
+
+// metricPath is the Sample metric name used for location breadcrumbs.
+const metricPath = "path"
+
+// Sample is a single history point. Metric is the history_30s key of the series it
+// belongs to, or "path" for breadcrumbs in which case Lat/Lon are set instead of V.
+type Sample struct {
+	Metric string  `json:"m"`
+	TS     int64   `json:"ts_ms"`
+	V      float64 `json:"v,omitempty"`
+	Lat    float64 `json:"lat,omitempty"`
+	Lon    float64 `json:"lon,omitempty"`
+}
+
+type PersistedCar struct {
+	State   CarState
+	Samples []Sample
+}
+
+// Restore rebuilds the store from p and writes all further updates through to it.
+func (s *Store) Restore(p Persister) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now().UnixMilli()
+	cars, err := p.Load(now - s.Window().Milliseconds())
+	if err != nil {
+		return err
+	}
+	for carID, pc := range cars {
+		ce := s.ensure(carID)
+		ce.state = pc.State
+		series := ce.history.series()
+		for _, smp := range pc.Samples {
+			if smp.Metric == metricPath {
+				ce.history.Path = append(ce.history.Path, Breadcrumb{TS: smp.TS, Lat: smp.Lat, Lon: smp.Lon})
+			} else if dst, ok := series[smp.Metric]; ok {
+				*dst = append(*dst, TimestampedFloat{TS: smp.TS, V: smp.V})
+			}
+		}
+		s.prune(&ce.history, now)
+	}
+	s.persister = p
+	return nil
+}
+
+// historyMark remembers the length of every history series, so samples appended afterwards can be found.
+type historyMark struct {
+	series map[string]int
+	path   int
+}
+
+func markHistory(h *HistoryWindow) historyMark {
+	m := historyMark{series: make(map[string]int), path: len(h.Path)}
+	for name, ser := range h.series() {
+		m.series[name] = len(*ser)
+	}
+	return m
+}
+
+// samplesSince returns the samples appended to h after mark was taken.
+func samplesSince(h *HistoryWindow, mark historyMark) []Sample {
+	var out []Sample
+	for name, ser := range h.series() {
+		for _, tf := range (*ser)[mark.series[name]:] {
+			out = append(out, Sample{Metric: name, TS: tf.TS, V: tf.V})
+		}
+	}
+	for _, bc := range h.Path[mark.path:] {
+		out = append(out, Sample{Metric: metricPath, TS: bc.TS, Lat: bc.Lat, Lon: bc.Lon})
+	}
+	return out
+}
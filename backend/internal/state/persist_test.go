@@ -0,0 +1,68 @@
+package state
+
+import (
+	"testing"
+	"time"
+)
+
+// memPersister records everything it receives in memory.
+type memPersister struct {
+	states  map[int64]CarState
+	samples map[int64][]Sample
+}
+
+func newMemPersister() *memPersister {
+	return &memPersister{states: map[int64]CarState{}, samples: map[int64][]Sample{}}
+}
+
+func (p *memPersister) SaveState(carID int64, st CarState) { p.states[carID] = st }
+func (p *memPersister) AppendSamples(carID int64, samples []Sample) {
+	p.samples[carID] = append(p.samples[carID], samples...)
+}
+func (p *memPersister) Load(since int64) (map[int64]*PersistedCar, error) {
+	out := map[int64]*PersistedCar{}
+	for id, st := range p.states {
+		pc := &PersistedCar{State: st}
+		for _, smp := range p.samples[id] {
+			if smp.TS >= since {
+				pc.Samples = append(pc.Samples, smp)
+			}
+		}
+		out[id] = pc
+	}
+	return out, nil
+}
+
+func TestStore_WritesThroughToPersister(t *testing.T) {
+	p := newMemPersister()
+	s := NewStore()
+	if err := s.Restore(p); err != nil {
+		t.Fatalf("Restore error: %v", err)
+	}
+	now := time.Now().UnixMilli()
+	s.UpdateLocation(1, now, 1.2, 3.4, 50, -1, -1)
+	s.UpdateTPMS(1, now, "rr", 2.9)
+	s.UpdateModelSilently(1, now, "3")
+
+	if p.states[1].Model != "3" || p.states[1].TPMS == nil || p.states[1].TPMS.RR != 2.9 {
+		t.Fatalf("unexpected persisted state: %+v", p.states[1])
+	}
+	metrics := map[string]int{}
+	for _, smp := range p.samples[1] {
+		metrics[smp.Metric]++
+	}
+	if metrics["speed_kph"] != 1 || metrics["path"] != 1 || metrics["tpms_rr"] != 1 || metrics["heading"] != 0 {
+		t.Fatalf("unexpected persisted samples: %+v", p.samples[1])
+	}
+
+	// a fresh store rebuilds the same view, dropping samples outside the window
+	p.samples[1] = append(p.samples[1], Sample{Metric: "soc_pct", TS: now - time.Hour.Milliseconds(), V: 99})
+	restored := NewStore()
+	if err := restored.Restore(p); err != nil {
+		t.Fatalf("Restore error: %v", err)
+	}
+	st, hist := restored.GetSnapshot(1)
+	if st.Model != "3" || len(hist.SpeedKPH) != 1 || len(hist.Path) != 1 || len(hist.TPMSRR) != 1 || len(hist.SOCPct) != 0 {
+		t.Fatalf("unexpected restored snapshot: %+v %+v", st, hist)
+	}
+}
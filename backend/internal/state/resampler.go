@@ -1,147 +1,92 @@
 package state
 
 import (
-	"encoding/json"
-	"maps"
+	"cmp"
 	"time"
 
 	"github.com/mcuelenaere/where-is-maurus/backend/internal/stream"
 )
 
-// Resampling interval knob (code-configurable only)
-const resampleInterval = 5 * time.Second
-
-// StartResampler periodically appends the latest known values so clients can render flatlines
-// even when the upstream does not emit repeated values.
+// StartResampler periodically appends the latest known values, every ResampleInterval of the
+// store, so clients can render flatlines even when the upstream does not emit repeated values.
+// Only metrics with fresh upstream data are resampled, a car that went quiet must not look live.
+// Every tick also re-evaluates the status of the cars, which keeps happening at the default
+// interval when resampling is disabled.
 func StartResampler(store *Store, hub *stream.Hub) {
-	if resampleInterval <= 0 {
-		return
-	}
-	ticker := time.NewTicker(resampleInterval)
+	interval := store.ResampleInterval()
+	ticker := time.NewTicker(cmp.Or(interval, DefaultResampleInterval))
 	go func() {
 		defer ticker.Stop()
 		for now := range ticker.C {
-			ids := store.ListCarIDs()
 			nowMs := now.UnixMilli()
-			for _, id := range ids {
-				st, hist := store.GetSnapshot(id)
-
-				// Collect all deltas and combine them into one
-				var allDeltas []map[string]any
-
-				// Helper function to add delta if it has content
-				addDelta := func(delta []byte) {
-					if len(delta) > 0 {
-						var deltaMap map[string]any
-						if json.Unmarshal(delta, &deltaMap) == nil {
-							allDeltas = append(allDeltas, deltaMap)
-						}
-					}
-				}
-
-				// location path breadcrumb only (no speed/heading/elev unless independently resampled below)
-				if st.Location != nil {
-					addDelta(store.UpdateLocation(id, nowMs, st.Location.Lat, st.Location.Lon, -1, -1, -1))
-				}
-
-				// speed/heading/elevation
-				if len(hist.SpeedKPH) > 0 && st.Location != nil {
-					addDelta(store.UpdateSpeed(id, nowMs, st.Location.SpeedKPH))
-				}
-				if len(hist.Heading) > 0 && st.Location != nil {
-					addDelta(store.UpdateHeading(id, nowMs, st.Location.Heading))
-				}
-				if len(hist.ElevationM) > 0 && st.Location != nil {
-					addDelta(store.UpdateElevation(id, nowMs, st.Location.ElevationM))
-				}
-
-				// battery
-				if st.Battery != nil {
-					if len(hist.SOCPct) > 0 {
-						addDelta(store.UpdateBatteryLevel(id, nowMs, st.Battery.SOCPct))
-					}
-					if len(hist.PowerW) > 0 {
-						addDelta(store.UpdatePower(id, nowMs, st.Battery.PowerW))
-					}
-				}
-
-				// climate
-				if st.Climate != nil {
-					if len(hist.InsideC) > 0 {
-						addDelta(store.UpdateInsideTemp(id, nowMs, st.Climate.InsideC))
-					}
-					if len(hist.OutsideC) > 0 {
-						addDelta(store.UpdateOutsideTemp(id, nowMs, st.Climate.OutsideC))
-					}
-				}
-
-				// tpms
-				if st.TPMS != nil {
-					if len(hist.TPMSFL) > 0 {
-						addDelta(store.UpdateTPMS(id, nowMs, "fl", st.TPMS.FL))
-					}
-					if len(hist.TPMSFR) > 0 {
-						addDelta(store.UpdateTPMS(id, nowMs, "fr", st.TPMS.FR))
-					}
-					if len(hist.TPMSRL) > 0 {
-						addDelta(store.UpdateTPMS(id, nowMs, "rl", st.TPMS.RL))
+			store.CheckStatus(nowMs)
+			if interval <= 0 {
+				continue
+			}
+			for _, id := range store.ListCarIDs() {
+				var series []string
+				for _, name := range HistorySeries() {
+					// breadcrumbs are fresh while locations keep arriving
+					metric := name
+					if name == metricPath {
+						metric = "location"
 					}
-					if len(hist.TPMSRR) > 0 {
-						addDelta(store.UpdateTPMS(id, nowMs, "rr", st.TPMS.RR))
+					if store.Fresh(id, metric, nowMs) {
+						series = append(series, name)
 					}
 				}
-
-				// Combine all deltas into one big delta
-				if len(allDeltas) > 0 {
-					combinedDelta := mergeDeltas(allDeltas)
-					deltaBytes, _ := json.Marshal(combinedDelta)
-					hub.Broadcast(id, "delta", deltaBytes)
-				}
-
 				// route: we do not resample route; it changes infrequently and not graphed
+				if delta := store.Resample(id, nowMs, series...); delta != nil {
+					hub.Broadcast(id, "delta", delta)
+				}
 			}
 		}
 	}()
 }
 
-// mergeDeltas combines multiple delta maps into one, merging nested structures
-func mergeDeltas(deltas []map[string]any) map[string]any {
-	if len(deltas) == 0 {
+// Resample repeats the last value of the given history series (path for the breadcrumbs) at ts
+// and returns the delta, nil when none of them has a value yet. Only the history changes:
+// repeated values aren't news, so they don't drive the trip and charging tracking nor move the
+// time of the last update.
+func (s *Store) Resample(carID int64, ts int64, series ...string) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ce, ok := s.cars[carID]
+	if !ok {
 		return nil
 	}
-	if len(deltas) == 1 {
-		return deltas[0]
+	var mark historyMark
+	if s.persister != nil {
+		mark = markHistory(&ce.history)
 	}
-
-	// Start with the first delta
-	result := deltas[0]
-
-	// Merge subsequent deltas
-	for _, delta := range deltas[1:] {
-		for key, value := range delta {
-			switch key {
-			case "ts_ms":
-				// Keep the latest timestamp
-				if ts, ok := value.(float64); ok {
-					if resultTs, ok := result[key].(float64); !ok || ts > resultTs {
-						result[key] = value
-					}
-				}
-			case "history_30s":
-				// Merge history objects
-				if resultHistory, ok := result[key].(map[string]any); ok {
-					if newHistory, ok := value.(map[string]any); ok {
-						maps.Copy(resultHistory, newHistory)
-					}
-				} else {
-					result[key] = value
-				}
-			default:
-				// For other keys, just overwrite (latest wins)
-				result[key] = value
+	all := ce.history.series()
+	hist := map[string]any{}
+	delta := map[string]any{"ts_ms": ts}
+	for _, name := range series {
+		if name == metricPath {
+			if n := len(ce.history.Path); n > 0 {
+				last := ce.history.Path[n-1]
+				ce.history.Path = append(ce.history.Path, Breadcrumb{TS: ts, Lat: last.Lat, Lon: last.Lon})
+				delta["path_30s"] = ce.history.Path
 			}
+			continue
+		}
+		if ser, ok := all[name]; ok && len(*ser) > 0 {
+			*ser = append(*ser, TimestampedFloat{TS: ts, V: (*ser)[len(*ser)-1].V})
+			hist[name] = *ser
 		}
 	}
-
-	return result
+	if len(hist) == 0 && delta["path_30s"] == nil {
+		return nil
+	}
+	if len(hist) > 0 {
+		delta["history_30s"] = hist
+	}
+	if s.persister != nil {
+		if samples := samplesSince(&ce.history, mark); len(samples) > 0 {
+			s.persister.AppendSamples(carID, samples)
+		}
+	}
+	s.prune(&ce.history, ts)
+	return marshalDelta(delta)
 }
@@ -5,165 +5,57 @@ import (
 	"testing"
 )
 
-func TestMergeDeltas(t *testing.T) {
-	// Test case 1: Empty deltas
-	result := mergeDeltas([]map[string]any{})
-	if result != nil {
-		t.Error("expected nil for empty deltas")
+func TestStore_Resample(t *testing.T) {
+	s := NewStore()
+	if s.Resample(1, 1000, "speed_kph") != nil {
+		t.Fatal("unknown car yields no delta")
 	}
+	s.UpdateLocation(1, 1000, 51.05, 3.72, 50, -1, -1)
+	s.UpdateBatteryLevel(1, 1000, 80)
 
-	// Test case 2: Single delta
-	singleDelta := map[string]any{
-		"ts_ms": float64(1000),
-		"location": map[string]any{
-			"speed_kph": float64(50),
-		},
+	delta := s.Resample(1, 6000, "speed_kph", "soc_pct", "inside_c", metricPath)
+	var js struct {
+		TS      int64                         `json:"ts_ms"`
+		History map[string][]TimestampedFloat `json:"history_30s"`
+		Path    []Breadcrumb                  `json:"path_30s"`
 	}
-	result = mergeDeltas([]map[string]any{singleDelta})
-	if result == nil {
-		t.Error("expected non-nil result for single delta")
+	if err := json.Unmarshal(delta, &js); err != nil {
+		t.Fatalf("decode delta: %v", err)
 	}
-	if result["ts_ms"] != float64(1000) {
-		t.Error("expected ts_ms to be preserved")
+	if js.TS != 6000 || len(js.History) != 2 || len(js.History["speed_kph"]) != 2 || js.History["soc_pct"][1] != (TimestampedFloat{TS: 6000, V: 80}) {
+		t.Fatalf("expected the known series repeated: %s", delta)
 	}
-
-	// Test case 3: Multiple deltas with different fields
-	delta1 := map[string]any{
-		"ts_ms": float64(1000),
-		"location": map[string]any{
-			"speed_kph": float64(50),
-		},
-		"history_30s": map[string]any{
-			"speed_kph": []any{map[string]any{"ts_ms": float64(1000), "v": float64(50)}},
-		},
-	}
-	delta2 := map[string]any{
-		"ts_ms": float64(2000),
-		"battery": map[string]any{
-			"soc_pct": float64(75),
-		},
-		"history_30s": map[string]any{
-			"soc_pct": []any{map[string]any{"ts_ms": float64(2000), "v": float64(75)}},
-		},
-	}
-	delta3 := map[string]any{
-		"ts_ms": float64(1500),
-		"climate": map[string]any{
-			"inside_c": float64(22),
-		},
-		"history_30s": map[string]any{
-			"inside_c": []any{map[string]any{"ts_ms": float64(1500), "v": float64(22)}},
-		},
-	}
-
-	result = mergeDeltas([]map[string]any{delta1, delta2, delta3})
-
-	// Check that all fields are present
-	if result["location"] == nil {
-		t.Error("expected location to be present")
-	}
-	if result["battery"] == nil {
-		t.Error("expected battery to be present")
-	}
-	if result["climate"] == nil {
-		t.Error("expected climate to be present")
+	if len(js.Path) != 2 || js.Path[1] != (Breadcrumb{TS: 6000, Lat: 51.05, Lon: 3.72}) {
+		t.Fatalf("expected the breadcrumb repeated: %s", delta)
 	}
-
-	// Check that history_30s contains all fields
-	history, ok := result["history_30s"].(map[string]any)
-	if !ok {
-		t.Error("expected history_30s to be present")
-	}
-	if history["speed_kph"] == nil {
-		t.Error("expected speed_kph in history")
-	}
-	if history["soc_pct"] == nil {
-		t.Error("expected soc_pct in history")
-	}
-	if history["inside_c"] == nil {
-		t.Error("expected inside_c in history")
+	if s.Resample(1, 7000, "inside_c") != nil {
+		t.Fatal("series without a value yield no delta")
 	}
-
-	// Check that ts_ms is the latest (2000)
-	if result["ts_ms"] != float64(2000) {
-		t.Errorf("expected latest ts_ms 2000, got %v", result["ts_ms"])
+	// repeated values are not updates
+	if st, _ := s.GetSnapshot(1); st.TSMS != 1000 {
+		t.Fatalf("expected resampling to leave the last update alone, got %d", st.TSMS)
 	}
 }
 
-func TestMergeDeltasWithOverlappingHistory(t *testing.T) {
-	// Test merging when multiple deltas have history_30s
-	delta1 := map[string]any{
-		"ts_ms": float64(1000),
-		"history_30s": map[string]any{
-			"speed_kph": []any{map[string]any{"ts_ms": float64(1000), "v": float64(50)}},
-		},
-	}
-	delta2 := map[string]any{
-		"ts_ms": float64(2000),
-		"history_30s": map[string]any{
-			"soc_pct": []any{map[string]any{"ts_ms": float64(2000), "v": float64(75)}},
-		},
-	}
+func TestStore_ResampleLeavesTripAlone(t *testing.T) {
+	s := NewStore()
+	events := recordEvents(s)
+	const minute = int64(60_000)
 
-	result := mergeDeltas([]map[string]any{delta1, delta2})
+	s.UpdateBatteryLevel(1, 0, 80)
+	s.UpdateShiftState(1, 0, "D")
+	s.UpdateLocation(1, 0, 51.0, 3.7, 100, -1, 10)
+	s.UpdateLocation(1, minute, 51.1, 3.7, 50, -1, 20)
+	st, _ := s.GetSnapshot(1)
+	before, _ := json.Marshal(st.Trip)
 
-	history, ok := result["history_30s"].(map[string]any)
-	if !ok {
-		t.Error("expected history_30s to be present")
-	}
+	s.Resample(1, 2*minute, HistorySeries()...)
 
-	// Both history entries should be present
-	if history["speed_kph"] == nil {
-		t.Error("expected speed_kph in history")
-	}
-	if history["soc_pct"] == nil {
-		t.Error("expected soc_pct in history")
-	}
-
-	// ts_ms should be the latest
-	if result["ts_ms"] != float64(2000) {
-		t.Errorf("expected latest ts_ms 2000, got %v", result["ts_ms"])
-	}
-}
-
-func TestMergeDeltasJSONCompatibility(t *testing.T) {
-	// Test that the merged delta can be marshaled to JSON
-	delta1 := map[string]any{
-		"ts_ms": float64(1000),
-		"location": map[string]any{
-			"speed_kph": float64(50),
-		},
-	}
-	delta2 := map[string]any{
-		"ts_ms": float64(2000),
-		"battery": map[string]any{
-			"soc_pct": float64(75),
-		},
-	}
-
-	result := mergeDeltas([]map[string]any{delta1, delta2})
-
-	// Should be able to marshal to JSON
-	jsonBytes, err := json.Marshal(result)
-	if err != nil {
-		t.Errorf("failed to marshal merged delta: %v", err)
-	}
-
-	// Should be able to unmarshal back
-	var unmarshaled map[string]any
-	err = json.Unmarshal(jsonBytes, &unmarshaled)
-	if err != nil {
-		t.Errorf("failed to unmarshal merged delta: %v", err)
-	}
-
-	// Check that key fields are present
-	if unmarshaled["ts_ms"] == nil {
-		t.Error("expected ts_ms in unmarshaled result")
-	}
-	if unmarshaled["location"] == nil {
-		t.Error("expected location in unmarshaled result")
+	st, _ = s.GetSnapshot(1)
+	if after, _ := json.Marshal(st.Trip); string(after) != string(before) {
+		t.Fatalf("expected the trip untouched by resampling:\nbefore %s\nafter  %s", before, after)
 	}
-	if unmarshaled["battery"] == nil {
-		t.Error("expected battery in unmarshaled result")
+	if len(*events) != 1 {
+		t.Fatalf("expected only trip_started, got %+v", *events)
 	}
 }
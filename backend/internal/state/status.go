@@ -0,0 +1,136 @@
+package state
+
+import "time"
+
+// Status tells viewers whether the data of a car is current.
+type Status string
+
+const (
+	// StatusLive means upstream data arrived recently.
+	StatusLive Status = "live"
+	// StatusStale means nothing arrived from upstream for longer than the stale threshold, the
+	// state is the last one known.
+	StatusStale Status = "stale"
+	// StatusOffline means the source feeding the car lost its connection.
+	StatusOffline Status = "offline"
+)
+
+// DefaultStaleAfter is how long a car goes without upstream data before it counts as stale.
+const DefaultStaleAfter = 5 * time.Minute
+
+// freshness tracks when real upstream data, as opposed to resampled values, last arrived.
+type freshness struct {
+	// seen holds the time of the last upstream sample per metric, keyed by history series name
+	// for the resampled metrics
+	seen     map[string]int64
+	lastSeen int64
+	offline  bool
+	// announced is the status last sent to viewers
+	announced Status
+}
+
+type statusEvent struct {
+	TS         int64  `json:"ts_ms"`
+	Status     Status `json:"status"`
+	LastSeenMS int64  `json:"last_seen_ms,omitempty"`
+}
+
+// SetStaleAfter sets how long a car goes without upstream data before it counts as stale. It
+// must be called before any updates.
+func (s *Store) SetStaleAfter(d time.Duration) {
+	if d > 0 {
+		s.staleAfter = d
+	}
+}
+
+// MarkSeen records that upstream data for the given metrics arrived at ts. Only data from a
+// source is marked, never resampled values, so the status reflects how old the data really is.
+// Data arriving also means the source is connected.
+func (s *Store) MarkSeen(carID int64, ts int64, metrics ...string) {
+	s.mu.Lock()
+	ce, ok := s.cars[carID]
+	if !ok {
+		s.mu.Unlock()
+		return
+	}
+	f := &ce.fresh
+	if f.seen == nil {
+		f.seen = make(map[string]int64)
+	}
+	for _, m := range metrics {
+		if ts > f.seen[m] {
+			f.seen[m] = ts
+		}
+	}
+	f.lastSeen = max(f.lastSeen, ts)
+	f.offline = false
+	s.queueStatus(carID, ce, ts)
+	s.unlockAndNotify()
+}
+
+// SetOffline flags a car whose source lost its connection, or clears the flag once it's back.
+func (s *Store) SetOffline(carID int64, offline bool, now int64) {
+	s.mu.Lock()
+	if ce, ok := s.cars[carID]; ok {
+		ce.fresh.offline = offline
+		s.queueStatus(carID, ce, now)
+	}
+	s.unlockAndNotify()
+}
+
+// CheckStatus re-evaluates the status of every car at now and announces the ones that changed,
+// as cars go stale by time passing alone.
+func (s *Store) CheckStatus(now int64) {
+	s.mu.Lock()
+	for id, ce := range s.cars {
+		s.queueStatus(id, ce, now)
+	}
+	s.unlockAndNotify()
+}
+
+// Status returns the status of the car at now and when upstream data last arrived, zero when
+// nothing arrived since the server started.
+func (s *Store) Status(carID int64, now int64) (Status, int64) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ce, ok := s.cars[carID]
+	if !ok {
+		return StatusStale, 0
+	}
+	return s.statusOf(ce, now), ce.fresh.lastSeen
+}
+
+// Fresh reports whether upstream data for the metric arrived within the stale threshold, so
+// repeating its last value still tells the truth.
+func (s *Store) Fresh(carID int64, metric string, now int64) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ce, ok := s.cars[carID]
+	if !ok || ce.fresh.offline {
+		return false
+	}
+	seen, ok := ce.fresh.seen[metric]
+	return ok && now-seen <= s.staleAfter.Milliseconds()
+}
+
+// statusOf must be called with the lock held.
+func (s *Store) statusOf(ce *carEntry, now int64) Status {
+	switch {
+	case ce.fresh.offline:
+		return StatusOffline
+	case ce.fresh.lastSeen == 0 || now-ce.fresh.lastSeen > s.staleAfter.Milliseconds():
+		return StatusStale
+	}
+	return StatusLive
+}
+
+// queueStatus raises a status event when the status of the car changed. Must be called with
+// the lock held.
+func (s *Store) queueStatus(carID int64, ce *carEntry, now int64) {
+	st := s.statusOf(ce, now)
+	if st == ce.fresh.announced {
+		return
+	}
+	ce.fresh.announced = st
+	s.queueEvent(carID, "status", statusEvent{TS: now, Status: st, LastSeenMS: ce.fresh.lastSeen})
+}
@@ -0,0 +1,72 @@
+package state
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestStore_Status(t *testing.T) {
+	s := NewStore()
+	s.SetStaleAfter(time.Minute)
+	var events []statusEvent
+	s.SetNotifier(func(carID int64, event string, data []byte) {
+		if event != "status" {
+			return
+		}
+		var ev statusEvent
+		if err := json.Unmarshal(data, &ev); err != nil {
+			t.Fatalf("decode status: %v", err)
+		}
+		events = append(events, ev)
+	})
+
+	if st, _ := s.Status(1, 0); st != StatusStale {
+		t.Fatalf("unknown car: expected stale, got %s", st)
+	}
+
+	// values written without being marked, like restored or resampled ones, don't make a car live
+	s.UpdateSpeed(1, 1000, 50)
+	if st, lastSeen := s.Status(1, 1000); st != StatusStale || lastSeen != 0 {
+		t.Fatalf("expected stale without upstream data, got %s %d", st, lastSeen)
+	}
+
+	s.MarkSeen(1, 1000, "speed_kph")
+	if st, lastSeen := s.Status(1, 2000); st != StatusLive || lastSeen != 1000 {
+		t.Fatalf("expected live, got %s %d", st, lastSeen)
+	}
+	if !s.Fresh(1, "speed_kph", 2000) || s.Fresh(1, "soc_pct", 2000) {
+		t.Fatal("only speed should be fresh")
+	}
+
+	// time passing alone makes the car stale
+	s.CheckStatus(30_000)
+	s.CheckStatus(62_000)
+	if s.Fresh(1, "speed_kph", 62_000) {
+		t.Fatal("speed should no longer be fresh")
+	}
+
+	// a lost connection takes precedence over freshness, data arriving brings the car back
+	s.MarkSeen(1, 70_000, "speed_kph")
+	s.SetOffline(1, true, 71_000)
+	if s.Fresh(1, "speed_kph", 71_000) {
+		t.Fatal("offline cars are never fresh")
+	}
+	s.MarkSeen(1, 72_000, "speed_kph")
+
+	want := []statusEvent{
+		{TS: 1000, Status: StatusLive, LastSeenMS: 1000},
+		{TS: 62_000, Status: StatusStale, LastSeenMS: 1000},
+		{TS: 70_000, Status: StatusLive, LastSeenMS: 70_000},
+		{TS: 71_000, Status: StatusOffline, LastSeenMS: 70_000},
+		{TS: 72_000, Status: StatusLive, LastSeenMS: 72_000},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("expected %d status events, got %+v", len(want), events)
+	}
+	for i := range want {
+		if events[i] != want[i] {
+			t.Fatalf("event %d: expected %+v, got %+v", i, want[i], events[i])
+		}
+	}
+}
@@ -2,31 +2,81 @@ package state
 
 import (
 	"encoding/json"
+	"slices"
 	"sync"
 	"time"
 )
 
-// Store keeps per-car state and 30s history.
+// Store keeps per-car state and recent history.
 type Store struct {
 	mu     sync.RWMutex
 	cars   map[int64]*carEntry
 	window time.Duration
+	// retention overrides the window per history series
+	retention map[string]time.Duration
+	resample  time.Duration
+	// staleAfter is how long a car goes without upstream data before it counts as stale
+	staleAfter time.Duration
+	persister  Persister
+	notifier   Notifier
+	// pending holds events raised by an update, they are dispatched once the lock is released
+	pending []pendingEvent
 }
 
 type carEntry struct {
-	state   CarState
-	history HistoryWindow
+	state            CarState
+	history          HistoryWindow
+	chargingSessions []ChargingSession // finished sessions, oldest first
+	trip             tripTracker
+	trips            []Trip // finished trips, oldest first
+	fresh            freshness
+}
+
+// Notifier receives events derived from state changes, such as the start of a
+// charging session. Its signature matches stream.Hub.Broadcast.
+type Notifier func(carID int64, event string, data []byte)
+
+type pendingEvent struct {
+	carID int64
+	event string
+	data  []byte
 }
 
 func NewStore() *Store {
-	return &Store{cars: make(map[int64]*carEntry), window: 15 * time.Minute}
+	return &Store{cars: make(map[int64]*carEntry), window: DefaultWindow, resample: DefaultResampleInterval, staleAfter: DefaultStaleAfter}
+}
+
+// SetNotifier registers the receiver of derived events. It must be called before any updates.
+func (s *Store) SetNotifier(n Notifier) { s.notifier = n }
+
+// queueEvent records an event to dispatch after the current update. Must be called with the lock held.
+func (s *Store) queueEvent(carID int64, event string, payload any) {
+	if s.notifier == nil {
+		return
+	}
+	b, _ := json.Marshal(payload)
+	s.pending = append(s.pending, pendingEvent{carID: carID, event: event, data: b})
 }
 
+// GetSnapshot returns the state and history of the car, empty for cars that never reported.
 func (s *Store) GetSnapshot(carID int64) (CarState, HistoryWindow) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	ce := s.ensure(carID)
-	return ce.state, ce.history
+	ce, ok := s.cars[carID]
+	if !ok {
+		return CarState{}, HistoryWindow{}
+	}
+	return ce.state.clone(), ce.history
+}
+
+// LastUpdate returns the time of the latest update of the car, 0 for cars that never reported.
+func (s *Store) LastUpdate(carID int64) int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if ce, ok := s.cars[carID]; ok {
+		return ce.state.TSMS
+	}
+	return 0
 }
 
 // ListCarIDs returns the IDs of cars seen in the store.
@@ -40,6 +90,21 @@ func (s *Store) ListCarIDs() []int64 {
 	return ids
 }
 
+// HistoryPoints returns how many history samples, breadcrumbs included, are kept per car.
+func (s *Store) HistoryPoints() map[int64]int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	points := make(map[int64]int, len(s.cars))
+	for id, ce := range s.cars {
+		n := len(ce.history.Path)
+		for _, ser := range ce.history.series() {
+			n += len(*ser)
+		}
+		points[id] = n
+	}
+	return points
+}
+
 // ListCars returns car information including IDs and display names.
 func (s *Store) ListCars() []CarInfo {
 	s.mu.RLock()
@@ -65,35 +130,31 @@ func (s *Store) ensure(carID int64) *carEntry {
 	return ce
 }
 
-func prune(history *HistoryWindow, cutoff int64) {
-	pruneTF := func(a []TimestampedFloat) []TimestampedFloat {
-		i := 0
-		for i < len(a) && a[i].TS < cutoff {
-			i++
-		}
-		if i > 0 {
-			a = a[i:]
-		}
-		return a
-	}
-	history.SpeedKPH = pruneTF(history.SpeedKPH)
-	history.Heading = pruneTF(history.Heading)
-	history.ElevationM = pruneTF(history.ElevationM)
-	history.SOCPct = pruneTF(history.SOCPct)
-	history.PowerW = pruneTF(history.PowerW)
-	history.InsideC = pruneTF(history.InsideC)
-	history.OutsideC = pruneTF(history.OutsideC)
-	history.TPMSFL = pruneTF(history.TPMSFL)
-	history.TPMSFR = pruneTF(history.TPMSFR)
-	history.TPMSRL = pruneTF(history.TPMSRL)
-	history.TPMSRR = pruneTF(history.TPMSRR)
-	// Path
-	i := 0
-	for i < len(history.Path) && history.Path[i].TS < cutoff {
-		i++
+// report returns the entry of a car reporting data and reports whether this is the first
+// time the car is seen. Must be called with the lock held.
+func (s *Store) report(carID int64) (*carEntry, bool) {
+	_, known := s.cars[carID]
+	return s.ensure(carID), !known
+}
+
+// queueCarAdded raises the car_added event for a car seen for the first time. It is queued
+// once the update that created the car is applied, so the display name is as good as it gets,
+// but ahead of the events that update raised. Must be called with the lock held.
+func (s *Store) queueCarAdded(carID int64, ce *carEntry) {
+	if s.notifier == nil {
+		return
 	}
-	if i > 0 {
-		history.Path = history.Path[i:]
+	b, _ := json.Marshal(map[string]any{"ts_ms": ce.state.TSMS, "display_name": generateDisplayName(carID, ce.state)})
+	s.pending = slices.Insert(s.pending, 0, pendingEvent{carID: carID, event: "car_added", data: b})
+}
+
+// unlockAndNotify releases the lock and dispatches the events queued during the update.
+func (s *Store) unlockAndNotify() {
+	events := s.pending
+	s.pending = nil
+	s.mu.Unlock()
+	for _, ev := range events {
+		s.notifier(ev.carID, ev.event, ev.data)
 	}
 }
 
@@ -109,18 +170,30 @@ func marshalDelta(delta map[string]any) []byte {
 // updateHelper handles the common update pattern
 func (s *Store) updateHelper(carID, ts int64, updateFn func(*carEntry, map[string]any)) []byte {
 	s.mu.Lock()
-	defer s.mu.Unlock()
 
-	ce := s.ensure(carID)
+	ce, added := s.report(carID)
 	ce.state.TSMS = ts
 
 	delta := map[string]any{"ts_ms": ts}
+	var mark historyMark
+	if s.persister != nil {
+		mark = markHistory(&ce.history)
+	}
 	updateFn(ce, delta)
+	if s.persister != nil {
+		s.persister.SaveState(carID, ce.state.clone())
+		if samples := samplesSince(&ce.history, mark); len(samples) > 0 {
+			s.persister.AppendSamples(carID, samples)
+		}
+	}
 
-	cutoff := ts - ceWindowMs(s.window)
-	prune(&ce.history, cutoff)
-
-	return marshalDelta(delta)
+	s.prune(&ce.history, ts)
+	b := marshalDelta(delta)
+	if added {
+		s.queueCarAdded(carID, ce)
+	}
+	s.unlockAndNotify()
+	return b
 }
 
 // Update helpers. Each returns minimal delta map.
@@ -153,6 +226,7 @@ func (s *Store) UpdateLocation(carID int64, ts int64, lat, lon, speedKPH, headin
 			"elevation_m": ce.history.ElevationM,
 		}
 		delta["path_30s"] = ce.history.Path
+		s.trackTrip(carID, ce, ts, delta)
 	})
 }
 
@@ -166,6 +240,7 @@ func (s *Store) UpdateSpeed(carID int64, ts int64, speedKPH float64) []byte {
 
 		delta["location"] = ce.state.Location
 		delta["history_30s"] = map[string]any{"speed_kph": ce.history.SpeedKPH}
+		s.trackTrip(carID, ce, ts, delta)
 	})
 }
 
@@ -192,6 +267,7 @@ func (s *Store) UpdateElevation(carID int64, ts int64, elevM float64) []byte {
 
 		delta["location"] = ce.state.Location
 		delta["history_30s"] = map[string]any{"elevation_m": ce.history.ElevationM}
+		s.trackTrip(carID, ce, ts, delta)
 	})
 }
 
@@ -205,6 +281,8 @@ func (s *Store) UpdateBatteryLevel(carID int64, ts int64, soc float64) []byte {
 
 		delta["battery"] = ce.state.Battery
 		delta["history_30s"] = map[string]any{"soc_pct": ce.history.SOCPct}
+		s.trackCharging(carID, ce, ts, delta)
+		s.trackTrip(carID, ce, ts, delta)
 	})
 }
 
@@ -218,6 +296,155 @@ func (s *Store) UpdatePower(carID int64, ts int64, powerW float64) []byte {
 
 		delta["battery"] = ce.state.Battery
 		delta["history_30s"] = map[string]any{"power_w": ce.history.PowerW}
+		s.trackTrip(carID, ce, ts, delta)
+	})
+}
+
+func (s *Store) UpdateUsableBatteryLevel(carID int64, ts int64, soc float64) []byte {
+	return s.updateHelper(carID, ts, func(ce *carEntry, delta map[string]any) {
+		if ce.state.Battery == nil {
+			ce.state.Battery = &Battery{}
+		}
+		ce.state.Battery.UsableSOCPct = soc
+		ce.history.UsableSOC = append(ce.history.UsableSOC, TimestampedFloat{TS: ts, V: soc})
+
+		delta["battery"] = ce.state.Battery
+		delta["history_30s"] = map[string]any{"usable_soc_pct": ce.history.UsableSOC}
+	})
+}
+
+func (s *Store) UpdateEstRange(carID int64, ts int64, km float64) []byte {
+	return s.updateHelper(carID, ts, func(ce *carEntry, delta map[string]any) {
+		if ce.state.Battery == nil {
+			ce.state.Battery = &Battery{}
+		}
+		ce.state.Battery.EstRangeKM = km
+		ce.history.EstRange = append(ce.history.EstRange, TimestampedFloat{TS: ts, V: km})
+
+		delta["battery"] = ce.state.Battery
+		delta["history_30s"] = map[string]any{"est_range_km": ce.history.EstRange}
+	})
+}
+
+func (s *Store) UpdateRatedRange(carID int64, ts int64, km float64) []byte {
+	return s.updateHelper(carID, ts, func(ce *carEntry, delta map[string]any) {
+		if ce.state.Battery == nil {
+			ce.state.Battery = &Battery{}
+		}
+		ce.state.Battery.RatedRangeKM = km
+		ce.history.RatedRange = append(ce.history.RatedRange, TimestampedFloat{TS: ts, V: km})
+
+		delta["battery"] = ce.state.Battery
+		delta["history_30s"] = map[string]any{"rated_range_km": ce.history.RatedRange}
+	})
+}
+
+// UpdateVehicleState updates the overall vehicle state (online, asleep, driving, charging, ...).
+func (s *Store) UpdateVehicleState(carID int64, ts int64, vehicleState string) []byte {
+	return s.updateHelper(carID, ts, func(ce *carEntry, delta map[string]any) {
+		if ce.state.Vehicle == nil {
+			ce.state.Vehicle = &Vehicle{}
+		}
+		ce.state.Vehicle.State = vehicleState
+
+		delta["vehicle"] = ce.state.Vehicle
+	})
+}
+
+func (s *Store) UpdateShiftState(carID int64, ts int64, shiftState string) []byte {
+	return s.updateHelper(carID, ts, func(ce *carEntry, delta map[string]any) {
+		if ce.state.Vehicle == nil {
+			ce.state.Vehicle = &Vehicle{}
+		}
+		ce.state.Vehicle.ShiftState = shiftState
+
+		delta["vehicle"] = ce.state.Vehicle
+		s.trackTrip(carID, ce, ts, delta)
+	})
+}
+
+func (s *Store) UpdateOdometer(carID int64, ts int64, km float64) []byte {
+	return s.updateHelper(carID, ts, func(ce *carEntry, delta map[string]any) {
+		if ce.state.Vehicle == nil {
+			ce.state.Vehicle = &Vehicle{}
+		}
+		ce.state.Vehicle.OdometerKM = km
+
+		delta["vehicle"] = ce.state.Vehicle
+	})
+}
+
+func (s *Store) UpdatePluggedIn(carID int64, ts int64, pluggedIn bool) []byte {
+	return s.updateHelper(carID, ts, func(ce *carEntry, delta map[string]any) {
+		if ce.state.Charging == nil {
+			ce.state.Charging = &Charging{}
+		}
+		ce.state.Charging.PluggedIn = pluggedIn
+
+		delta["charging"] = ce.state.Charging
+		s.trackCharging(carID, ce, ts, delta)
+	})
+}
+
+func (s *Store) UpdateChargingState(carID int64, ts int64, chargingState string) []byte {
+	return s.updateHelper(carID, ts, func(ce *carEntry, delta map[string]any) {
+		if ce.state.Charging == nil {
+			ce.state.Charging = &Charging{}
+		}
+		ce.state.Charging.State = chargingState
+
+		delta["charging"] = ce.state.Charging
+		s.trackCharging(carID, ce, ts, delta)
+	})
+}
+
+func (s *Store) UpdateChargerPower(carID int64, ts int64, kw float64) []byte {
+	return s.updateHelper(carID, ts, func(ce *carEntry, delta map[string]any) {
+		if ce.state.Charging == nil {
+			ce.state.Charging = &Charging{}
+		}
+		ce.state.Charging.PowerKW = kw
+		ce.history.ChargerKW = append(ce.history.ChargerKW, TimestampedFloat{TS: ts, V: kw})
+
+		delta["charging"] = ce.state.Charging
+		delta["history_30s"] = map[string]any{"charger_power_kw": ce.history.ChargerKW}
+		s.trackCharging(carID, ce, ts, delta)
+	})
+}
+
+func (s *Store) UpdateChargeEnergyAdded(carID int64, ts int64, kwh float64) []byte {
+	return s.updateHelper(carID, ts, func(ce *carEntry, delta map[string]any) {
+		if ce.state.Charging == nil {
+			ce.state.Charging = &Charging{}
+		}
+		ce.state.Charging.EnergyAddedKWh = kwh
+		ce.history.EnergyKWh = append(ce.history.EnergyKWh, TimestampedFloat{TS: ts, V: kwh})
+
+		delta["charging"] = ce.state.Charging
+		delta["history_30s"] = map[string]any{"charge_energy_added_kwh": ce.history.EnergyKWh}
+		s.trackCharging(carID, ce, ts, delta)
+	})
+}
+
+func (s *Store) UpdateTimeToFullCharge(carID int64, ts int64, hours float64) []byte {
+	return s.updateHelper(carID, ts, func(ce *carEntry, delta map[string]any) {
+		if ce.state.Charging == nil {
+			ce.state.Charging = &Charging{}
+		}
+		ce.state.Charging.TimeToFullH = hours
+
+		delta["charging"] = ce.state.Charging
+	})
+}
+
+func (s *Store) UpdateChargeLimit(carID int64, ts int64, soc float64) []byte {
+	return s.updateHelper(carID, ts, func(ce *carEntry, delta map[string]any) {
+		if ce.state.Charging == nil {
+			ce.state.Charging = &Charging{}
+		}
+		ce.state.Charging.LimitSOCPct = soc
+
+		delta["charging"] = ce.state.Charging
 	})
 }
 
@@ -302,28 +529,44 @@ func (s *Store) UpdateRouteWithMeta(carID int64, ts int64, dest *Dest, etaMin, d
 
 func (s *Store) UpdateDisplayNameSilently(carID int64, ts int64, displayName string) {
 	s.mu.Lock()
-	defer s.mu.Unlock()
-	ce := s.ensure(carID)
+	ce, added := s.report(carID)
 	ce.state.TSMS = ts
 	ce.state.DisplayName = displayName
+	if s.persister != nil {
+		s.persister.SaveState(carID, ce.state.clone())
+	}
+	if added {
+		s.queueCarAdded(carID, ce)
+	}
+	s.unlockAndNotify()
 }
 
 // UpdateExteriorColorSilently updates the exterior color without broadcasting
 func (s *Store) UpdateExteriorColorSilently(carID int64, ts int64, exteriorColor string) {
 	s.mu.Lock()
-	defer s.mu.Unlock()
-	ce := s.ensure(carID)
+	ce, added := s.report(carID)
 	ce.state.TSMS = ts
 	ce.state.ExteriorColor = exteriorColor
+	if s.persister != nil {
+		s.persister.SaveState(carID, ce.state.clone())
+	}
+	if added {
+		s.queueCarAdded(carID, ce)
+	}
+	s.unlockAndNotify()
 }
 
 // UpdateModelSilently updates the model without broadcasting
 func (s *Store) UpdateModelSilently(carID int64, ts int64, model string) {
 	s.mu.Lock()
-	defer s.mu.Unlock()
-	ce := s.ensure(carID)
+	ce, added := s.report(carID)
 	ce.state.TSMS = ts
 	ce.state.Model = model
+	if s.persister != nil {
+		s.persister.SaveState(carID, ce.state.clone())
+	}
+	if added {
+		s.queueCarAdded(carID, ce)
+	}
+	s.unlockAndNotify()
 }
-
-func ceWindowMs(d time.Duration) int64 { return d.Milliseconds() }
@@ -2,6 +2,8 @@ package state
 
 import (
 	"encoding/json"
+	"fmt"
+	"strings"
 	"testing"
 	"time"
 )
@@ -39,6 +41,17 @@ func TestStore_UpdateAndPrune(t *testing.T) {
 	}
 }
 
+func TestStore_SnapshotIsACopy(t *testing.T) {
+	s := NewStore()
+	now := time.Now().UnixMilli()
+	s.UpdateRoute(1, now, &Dest{Lat: 1, Lon: 2}, 3, 4)
+	st, _ := s.GetSnapshot(1)
+	st.Route.Dest.Lat = 10
+	if st, _ = s.GetSnapshot(1); st.Route.Dest.Lat != 1 {
+		t.Fatalf("modifying a snapshot changed the stored destination: %+v", st.Route.Dest)
+	}
+}
+
 func TestListCarIDs(t *testing.T) {
 	s := NewStore()
 	s.UpdateSpeed(1, time.Now().UnixMilli(), 1)
@@ -49,6 +62,30 @@ func TestListCarIDs(t *testing.T) {
 	}
 }
 
+func TestStore_CarAdded(t *testing.T) {
+	s := NewStore()
+	var events []string
+	s.SetNotifier(func(carID int64, event string, data []byte) {
+		events = append(events, fmt.Sprintf("%d %s %s", carID, event, data))
+	})
+	// car_added comes before the events raised by the same update
+	// looking at a car that never reported doesn't create it
+	if st, _ := s.GetSnapshot(1); st.TSMS != 0 || len(s.ListCarIDs()) != 0 {
+		t.Fatalf("expected no car, got %+v", st)
+	}
+	s.UpdateDisplayNameSilently(1, 10, "Blue")
+	s.UpdateSpeed(1, 20, 30)
+	s.UpdateSpeed(2, 30, 40)
+	want := []string{
+		`1 car_added {"display_name":"Blue","ts_ms":10}`,
+		`2 car_added {"display_name":"Car 2","ts_ms":30}`,
+		`2 trip_started`,
+	}
+	if len(events) != 4 || events[0] != want[0] || events[2] != want[1] || !strings.HasPrefix(events[3], want[2]) {
+		t.Fatalf("unexpected events: %q", events)
+	}
+}
+
 // TestUpdateHelper_AllMethods tests that all UpdateXXX methods work correctly with the new updateHelper
 func TestUpdateHelper_AllMethods(t *testing.T) {
 	s := NewStore()
@@ -304,3 +341,44 @@ func checkDelta(t *testing.T, delta []byte, expectedFields ...string) {
 		t.Error("expected delta to contain ts_ms field")
 	}
 }
+
+func TestUpdateHelper_VehicleAndCharging(t *testing.T) {
+	s := NewStore()
+	now := time.Now().UnixMilli()
+
+	s.UpdateVehicleState(1, now, "charging")
+	s.UpdateShiftState(1, now, "P")
+	s.UpdateOdometer(1, now, 12345.6)
+	s.UpdateUsableBatteryLevel(1, now, 78)
+	s.UpdateEstRange(1, now, 310)
+	s.UpdateRatedRange(1, now, 330)
+	s.UpdatePluggedIn(1, now, true)
+	s.UpdateChargingState(1, now, "Charging")
+	s.UpdateChargerPower(1, now, 11)
+	s.UpdateChargeEnergyAdded(1, now, 4.2)
+	s.UpdateTimeToFullCharge(1, now, 1.5)
+	delta := s.UpdateChargeLimit(1, now, 80)
+
+	var js map[string]any
+	if err := json.Unmarshal(delta, &js); err != nil {
+		t.Fatalf("delta should be JSON: %v", err)
+	}
+	if ch, ok := js["charging"].(map[string]any); !ok || ch["limit_soc_pct"] != 80.0 {
+		t.Fatalf("expected charging delta with limit, got %v", js)
+	}
+
+	st, hist := s.GetSnapshot(1)
+	if st.Vehicle == nil || st.Vehicle.State != "charging" || st.Vehicle.ShiftState != "P" || st.Vehicle.OdometerKM != 12345.6 {
+		t.Fatalf("unexpected vehicle: %+v", st.Vehicle)
+	}
+	if st.Battery == nil || st.Battery.UsableSOCPct != 78 || st.Battery.EstRangeKM != 310 || st.Battery.RatedRangeKM != 330 {
+		t.Fatalf("unexpected battery: %+v", st.Battery)
+	}
+	want := Charging{PluggedIn: true, State: "Charging", PowerKW: 11, EnergyAddedKWh: 4.2, TimeToFullH: 1.5, LimitSOCPct: 80}
+	if st.Charging == nil || *st.Charging != want {
+		t.Fatalf("unexpected charging: %+v", st.Charging)
+	}
+	if len(hist.UsableSOC) != 1 || len(hist.EstRange) != 1 || len(hist.RatedRange) != 1 || len(hist.ChargerKW) != 1 || len(hist.EnergyKWh) != 1 {
+		t.Fatalf("expected history samples for graphed values: %+v", hist)
+	}
+}
@@ -0,0 +1,180 @@
+package state
+
+import "time"
+
+const (
+	// maxTrips bounds the number of finished trips kept per car.
+	maxTrips = 50
+	// tripIdleTimeout ends a trip when the car hasn't moved, or hasn't reported at all, for this long.
+	tripIdleTimeout = 5 * time.Minute
+)
+
+// Trip summarizes a single drive. EndTS is zero while it is ongoing.
+type Trip struct {
+	StartTS        int64   `json:"start_ts_ms"`
+	EndTS          int64   `json:"end_ts_ms,omitempty"`
+	Start          *Dest   `json:"start,omitempty"`
+	End            *Dest   `json:"end,omitempty"`
+	DistanceKM     float64 `json:"distance_km"`
+	DurationS      float64 `json:"duration_s"`
+	AvgSpeedKPH    float64 `json:"avg_speed_kph"`
+	MaxSpeedKPH    float64 `json:"max_speed_kph"`
+	ElevationGainM float64 `json:"elevation_gain_m"`
+	ElevationLossM float64 `json:"elevation_loss_m"`
+	StartSOCPct    float64 `json:"start_soc_pct"`
+	EndSOCPct      float64 `json:"end_soc_pct"`
+	SOCUsedPct     float64 `json:"soc_used_pct"`
+	EnergyWh       float64 `json:"energy_wh"`
+	WhPerKM        float64 `json:"wh_per_km"`
+}
+
+// tripTracker holds the bookkeeping needed to update the ongoing trip incrementally.
+// It is not persisted, after a restore it is seeded from the first update.
+type tripTracker struct {
+	seeded       bool
+	lastSeenTS   int64
+	lastMovingTS int64
+	pos          *Dest
+	elev         *float64
+	power        *TimestampedFloat
+}
+
+// isMoving reports whether the car is being driven: in gear, or moving when the shift state is unknown.
+func isMoving(st CarState) bool {
+	if st.Vehicle != nil {
+		switch st.Vehicle.ShiftState {
+		case "D", "R", "N":
+			return true
+		case "P":
+			// the last reported speed may be stale
+			return false
+		}
+	}
+	return st.Location != nil && st.Location.SpeedKPH > 0
+}
+
+func isParked(st CarState) bool {
+	return st.Vehicle != nil && st.Vehicle.ShiftState == "P"
+}
+
+// trackTrip opens, updates or closes the trip of a car after a driving related value changed.
+// It must be called with the store lock held.
+func (s *Store) trackTrip(carID int64, ce *carEntry, ts int64, delta map[string]any) {
+	tt := &ce.trip
+	moving := isMoving(ce.state)
+	if !tt.seeded {
+		*tt = tripTracker{seeded: true, lastSeenTS: ts, lastMovingTS: ts}
+	}
+	if trip := ce.state.Trip; trip != nil {
+		switch {
+		case ts-tt.lastSeenTS > tripIdleTimeout.Milliseconds():
+			// no data for a while (car offline or out of coverage), the trip ended when we lost track
+			s.finishTrip(carID, ce, tt.lastSeenTS, delta)
+		case isParked(ce.state):
+			updateTrip(ce, ts)
+			s.finishTrip(carID, ce, ts, delta)
+		case !moving && ts-tt.lastMovingTS > tripIdleTimeout.Milliseconds():
+			s.finishTrip(carID, ce, tt.lastMovingTS, delta)
+		default:
+			updateTrip(ce, ts)
+			delta["trip"] = trip
+		}
+	}
+	if ce.state.Trip == nil && moving {
+		trip := &Trip{StartTS: ts}
+		if loc := ce.state.Location; loc != nil {
+			trip.Start = &Dest{Lat: loc.Lat, Lon: loc.Lon}
+		}
+		if ce.state.Battery != nil {
+			trip.StartSOCPct = ce.state.Battery.SOCPct
+		}
+		ce.state.Trip = trip
+		*tt = tripTracker{seeded: true}
+		updateTrip(ce, ts)
+		s.queueEvent(carID, "trip_started", map[string]any{"ts_ms": ts, "trip": trip})
+		delta["trip"] = trip
+	}
+	tt.lastSeenTS = ts
+	if moving {
+		tt.lastMovingTS = ts
+	}
+}
+
+// updateTrip folds the latest state into the ongoing trip.
+func updateTrip(ce *carEntry, ts int64) {
+	trip, tt, st := ce.state.Trip, &ce.trip, ce.state
+	if loc := st.Location; loc != nil {
+		if tt.pos != nil {
+			trip.DistanceKM += DistanceMeters(tt.pos.Lat, tt.pos.Lon, loc.Lat, loc.Lon) / 1000
+		}
+		tt.pos = &Dest{Lat: loc.Lat, Lon: loc.Lon}
+		trip.End = &Dest{Lat: loc.Lat, Lon: loc.Lon}
+		trip.MaxSpeedKPH = max(trip.MaxSpeedKPH, loc.SpeedKPH)
+		if len(ce.history.ElevationM) > 0 {
+			if tt.elev != nil {
+				if d := loc.ElevationM - *tt.elev; d > 0 {
+					trip.ElevationGainM += d
+				} else {
+					trip.ElevationLossM -= d
+				}
+			}
+			elev := loc.ElevationM
+			tt.elev = &elev
+		}
+	}
+	if b := st.Battery; b != nil {
+		if trip.StartSOCPct == 0 {
+			// battery level wasn't known yet when the trip started
+			trip.StartSOCPct = b.SOCPct
+		}
+		trip.EndSOCPct = b.SOCPct
+		trip.SOCUsedPct = trip.StartSOCPct - b.SOCPct
+		// integrate the previous power reading (kW) over the time it was valid
+		if tt.power != nil && ts > tt.power.TS {
+			trip.EnergyWh += tt.power.V * 1000 * float64(ts-tt.power.TS) / 3_600_000
+		}
+		tt.power = &TimestampedFloat{TS: ts, V: b.PowerW}
+	}
+	trip.DurationS = float64(ts-trip.StartTS) / 1000
+	if trip.DurationS > 0 {
+		trip.AvgSpeedKPH = trip.DistanceKM / (trip.DurationS / 3600)
+	}
+	if trip.DistanceKM > 0 {
+		trip.WhPerKM = trip.EnergyWh / trip.DistanceKM
+	}
+}
+
+// finishTrip closes the ongoing trip at endTS.
+func (s *Store) finishTrip(carID int64, ce *carEntry, endTS int64, delta map[string]any) {
+	trip := ce.state.Trip
+	trip.EndTS = max(endTS, trip.StartTS)
+	trip.DurationS = float64(trip.EndTS-trip.StartTS) / 1000
+	if trip.DurationS > 0 {
+		trip.AvgSpeedKPH = trip.DistanceKM / (trip.DurationS / 3600)
+	}
+	ce.state.Trip = nil
+	ce.trips = append(ce.trips, *trip)
+	if n := len(ce.trips); n > maxTrips {
+		ce.trips = ce.trips[n-maxTrips:]
+	}
+	s.queueEvent(carID, "trip_finished", map[string]any{"ts_ms": endTS, "trip": trip})
+	delta["trip"] = nil
+}
+
+// Trips returns the recent trips of a car, newest first. An ongoing trip is included as the first entry.
+func (s *Store) Trips(carID int64) []Trip {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ce, ok := s.cars[carID]
+	if !ok {
+		return []Trip{}
+	}
+	out := make([]Trip, 0, len(ce.trips)+1)
+	if ce.state.Trip != nil {
+		out = append(out, *ce.state.Trip)
+	}
+	for i := len(ce.trips) - 1; i >= 0; i-- {
+		out = append(out, ce.trips[i])
+	}
+	return out
+}
@@ -0,0 +1,102 @@
+package state
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+func TestTrip_Lifecycle(t *testing.T) {
+	s := NewStore()
+	events := recordEvents(s)
+	const minute = int64(60_000)
+
+	s.UpdateBatteryLevel(1, 0, 80)
+	s.UpdateLocation(1, 0, 51.0, 3.7, -1, -1, 10)
+	if len(*events) != 0 {
+		t.Fatalf("parked car must not start a trip: %+v", *events)
+	}
+	delta := s.UpdateShiftState(1, 0, "D")
+	if len(*events) != 1 || (*events)[0].event != "trip_started" {
+		t.Fatalf("expected trip_started, got %+v", *events)
+	}
+	var js map[string]any
+	_ = json.Unmarshal(delta, &js)
+	if _, ok := js["trip"].(map[string]any); !ok {
+		t.Fatalf("expected trip in delta: %s", delta)
+	}
+
+	s.UpdatePower(1, 0, 20)
+	s.UpdateSpeed(1, minute, 120)
+	// one degree of latitude north, going uphill then down
+	s.UpdateLocation(1, 3*minute, 52.0, 3.7, -1, -1, 60)
+	s.UpdateLocation(1, 6*minute, 52.0, 3.7, -1, -1, 40)
+	s.UpdateBatteryLevel(1, 6*minute, 70)
+
+	st, _ := s.GetSnapshot(1)
+	trip := st.Trip
+	if trip == nil {
+		t.Fatalf("expected ongoing trip in snapshot")
+	}
+	if math.Abs(trip.DistanceKM-111.2) > 0.5 {
+		t.Fatalf("unexpected distance: %f", trip.DistanceKM)
+	}
+	if trip.MaxSpeedKPH != 120 || trip.ElevationGainM != 50 || trip.ElevationLossM != 20 || trip.SOCUsedPct != 10 {
+		t.Fatalf("unexpected trip: %+v", trip)
+	}
+	// 20kW for 6 minutes
+	if math.Abs(trip.EnergyWh-2000) > 1e-6 {
+		t.Fatalf("unexpected energy: %f", trip.EnergyWh)
+	}
+
+	delta = s.UpdateShiftState(1, 10*minute, "P")
+	if len(*events) != 2 || (*events)[1].event != "trip_finished" {
+		t.Fatalf("expected trip_finished, got %+v", *events)
+	}
+	js = nil
+	_ = json.Unmarshal(delta, &js)
+	if v, ok := js["trip"]; !ok || v != nil {
+		t.Fatalf("expected trip to be cleared in delta: %s", delta)
+	}
+
+	trips := s.Trips(1)
+	if len(trips) != 1 {
+		t.Fatalf("expected one finished trip, got %+v", trips)
+	}
+	got := trips[0]
+	if got.EndTS != 10*minute || got.DurationS != 600 || math.Abs(got.AvgSpeedKPH-got.DistanceKM*6) > 1e-6 {
+		t.Fatalf("unexpected finished trip: %+v", got)
+	}
+	if math.Abs(got.EnergyWh-(2000+20*1000*4.0/60)) > 1e-6 || math.Abs(got.WhPerKM-got.EnergyWh/got.DistanceKM) > 1e-9 {
+		t.Fatalf("unexpected energy figures: %+v", got)
+	}
+}
+
+func TestTrip_EndsAfterIdleOrGap(t *testing.T) {
+	s := NewStore()
+	events := recordEvents(s)
+	const minute = int64(60_000)
+
+	// no shift state known, speed drives detection
+	s.UpdateSpeed(1, 0, 30)
+	s.UpdateSpeed(1, minute, 30)
+	s.UpdateSpeed(1, 2*minute, 0)
+	s.UpdateSpeed(1, 4*minute, 0)
+	if len(*events) != 1 {
+		t.Fatalf("a short stop must not end the trip: %+v", *events)
+	}
+	s.UpdateSpeed(1, 7*minute, 0)
+	if len(*events) != 2 || (*events)[1].event != "trip_finished" || (*events)[1].data["ts_ms"] != float64(minute) {
+		t.Fatalf("expected trip to end at the last movement, got %+v", *events)
+	}
+
+	// data gap: the first trip ends when we lost track, a new one starts
+	s.UpdateSpeed(1, 10*minute, 50)
+	s.UpdateSpeed(1, 30*minute, 50)
+	if len(*events) != 5 || (*events)[3].event != "trip_finished" || (*events)[4].event != "trip_started" {
+		t.Fatalf("expected trip to be split on a data gap, got %+v", *events)
+	}
+	if trips := s.Trips(1); len(trips) != 3 || trips[0].EndTS != 0 || trips[1].EndTS != 10*minute {
+		t.Fatalf("unexpected trips: %+v", trips)
+	}
+}
@@ -0,0 +1,117 @@
+package state
+
+import (
+	"fmt"
+	"slices"
+	"time"
+)
+
+const (
+	// DefaultWindow is how much history is kept per car unless configured otherwise.
+	DefaultWindow = 15 * time.Minute
+	// DefaultResampleInterval is how often the resampler repeats the last known values.
+	DefaultResampleInterval = 5 * time.Second
+)
+
+// HistoryVersion is the version of the history_window wire field. The history_30s and path_30s
+// keys predate a configurable window, clients learn the real one from history_window.
+const HistoryVersion = 1
+
+// HistoryInfo describes the history sent to clients.
+type HistoryInfo struct {
+	Version int `json:"version"`
+	// WindowMS is how far back history goes for series without their own retention
+	WindowMS int64 `json:"window_ms"`
+	// ResampleMS is the interval the last known values are repeated at, 0 when they aren't
+	ResampleMS int64 `json:"resample_ms"`
+	// RetentionMS holds the series, path included, that keep more or less history than the window
+	RetentionMS map[string]int64 `json:"retention_ms,omitempty"`
+}
+
+// SetWindow sets how much history is kept per car. It must be called before any updates.
+func (s *Store) SetWindow(d time.Duration) {
+	if d > 0 {
+		s.window = d
+	}
+}
+
+// SetRetention overrides the window for some history series, keyed by their history_30s name or
+// "path" for the breadcrumbs. It must be called before any updates.
+func (s *Store) SetRetention(retention map[string]time.Duration) error {
+	names := HistorySeries()
+	for name, d := range retention {
+		if !slices.Contains(names, name) {
+			return fmt.Errorf("unknown history series %q", name)
+		}
+		if d <= 0 {
+			return fmt.Errorf("retention of %s must be positive", name)
+		}
+	}
+	s.retention = retention
+	return nil
+}
+
+// SetResampleInterval sets how often the resampler repeats the last known values, 0 disabling
+// resampling. It must be called before StartResampler.
+func (s *Store) SetResampleInterval(d time.Duration) {
+	s.resample = max(d, 0)
+}
+
+// ResampleInterval returns how often the last known values are repeated, 0 when they aren't.
+func (s *Store) ResampleInterval() time.Duration { return s.resample }
+
+// Window returns how much history is kept at most per car, the longest retention included.
+func (s *Store) Window() time.Duration {
+	w := s.window
+	for _, d := range s.retention {
+		w = max(w, d)
+	}
+	return w
+}
+
+// HistoryInfo describes the history kept, for clients to render it.
+func (s *Store) HistoryInfo() HistoryInfo {
+	info := HistoryInfo{Version: HistoryVersion, WindowMS: s.window.Milliseconds(), ResampleMS: s.resample.Milliseconds()}
+	if len(s.retention) > 0 {
+		info.RetentionMS = make(map[string]int64, len(s.retention))
+		for name, d := range s.retention {
+			info.RetentionMS[name] = d.Milliseconds()
+		}
+	}
+	return info
+}
+
+// HistorySeries returns the names of the history series, path included.
+func HistorySeries() []string {
+	var h HistoryWindow
+	names := []string{metricPath}
+	for name := range h.series() {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// retentionOf returns how long the series is kept.
+func (s *Store) retentionOf(name string) time.Duration {
+	if d, ok := s.retention[name]; ok {
+		return d
+	}
+	return s.window
+}
+
+// prune drops the history that's out of retention at now.
+func (s *Store) prune(history *HistoryWindow, now int64) {
+	for name, ser := range history.series() {
+		*ser = pruneBefore(*ser, now-s.retentionOf(name).Milliseconds(), func(v TimestampedFloat) int64 { return v.TS })
+	}
+	history.Path = pruneBefore(history.Path, now-s.retentionOf(metricPath).Milliseconds(), func(b Breadcrumb) int64 { return b.TS })
+}
+
+func pruneBefore[T any](a []T, cutoff int64, ts func(T) int64) []T {
+	i := 0
+	for i < len(a) && ts(a[i]) < cutoff {
+		i++
+	}
+	return a[i:]
+}
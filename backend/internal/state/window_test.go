@@ -0,0 +1,55 @@
+package state
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStore_Retention(t *testing.T) {
+	s := NewStore()
+	s.SetWindow(time.Minute)
+	if err := s.SetRetention(map[string]time.Duration{"warp_factor": time.Hour}); err == nil {
+		t.Fatal("expected unknown series to be rejected")
+	}
+	if err := s.SetRetention(map[string]time.Duration{"soc_pct": time.Hour, "path": 30 * time.Second}); err != nil {
+		t.Fatal(err)
+	}
+	if s.Window() != time.Hour {
+		t.Fatalf("expected the longest retention as window, got %s", s.Window())
+	}
+
+	s.UpdateLocation(1, 0, 51.05, 3.72, 50, -1, -1)
+	s.UpdateBatteryLevel(1, 0, 80)
+	s.UpdateLocation(1, 45_000, 51.06, 3.73, 60, -1, -1)
+	s.UpdateBatteryLevel(1, 90_000, 79)
+
+	_, hist := s.GetSnapshot(1)
+	if len(hist.SOCPct) != 2 {
+		t.Fatalf("expected soc kept for an hour: %+v", hist.SOCPct)
+	}
+	if len(hist.SpeedKPH) != 1 || hist.SpeedKPH[0].TS != 45_000 {
+		t.Fatalf("expected speed kept for the window: %+v", hist.SpeedKPH)
+	}
+	if len(hist.Path) != 0 {
+		t.Fatalf("expected path kept for 30s: %+v", hist.Path)
+	}
+}
+
+func TestStore_HistoryInfo(t *testing.T) {
+	s := NewStore()
+	want := HistoryInfo{Version: HistoryVersion, WindowMS: DefaultWindow.Milliseconds(), ResampleMS: DefaultResampleInterval.Milliseconds()}
+	if got := s.HistoryInfo(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %+v, got %+v", want, got)
+	}
+
+	s.SetWindow(30 * time.Minute)
+	s.SetResampleInterval(0)
+	if err := s.SetRetention(map[string]time.Duration{"soc_pct": time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	want = HistoryInfo{Version: HistoryVersion, WindowMS: 1_800_000, RetentionMS: map[string]int64{"soc_pct": 3_600_000}}
+	if got := s.HistoryInfo(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %+v, got %+v", want, got)
+	}
+}
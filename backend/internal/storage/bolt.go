@@ -0,0 +1,266 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/metrics"
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/state"
+	"github.com/rs/zerolog/log"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	bucketState   = []byte("state")
+	bucketHistory = []byte("history")
+)
+
+const (
+	queueSize     = 1024
+	maxBatch      = 256
+	pruneInterval = time.Minute
+)
+
+// op is a single queued write; exactly one of st or samples is set.
+type op struct {
+	carID   int64
+	st      *state.CarState
+	samples []state.Sample
+}
+
+// Bolt is an embedded, on-disk state.Persister. Writes are queued and committed in
+// batches by a background goroutine so the store never waits on disk I/O, writes that don't
+// fit in the queue are dropped and counted, and samples
+// older than the retention are pruned periodically.
+type Bolt struct {
+	db        *bolt.DB
+	retention time.Duration
+
+	mu     sync.RWMutex
+	closed bool
+	ch     chan op
+	done   chan struct{}
+	// overflowing is set while writes are being dropped, to warn once per episode
+	overflowing atomic.Bool
+}
+
+// OpenBolt opens (or creates) the database at path, keeping history samples for retention.
+func OpenBolt(path string, retention time.Duration) (*Bolt, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(bucketState); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(bucketHistory)
+		return err
+	}); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	b := &Bolt{db: db, retention: retention, ch: make(chan op, queueSize), done: make(chan struct{})}
+	go b.run()
+	return b, nil
+}
+
+func (b *Bolt) SaveState(carID int64, st state.CarState) {
+	b.enqueue(op{carID: carID, st: &st})
+}
+
+func (b *Bolt) AppendSamples(carID int64, samples []state.Sample) {
+	b.enqueue(op{carID: carID, samples: samples})
+}
+
+// enqueue hands o to the writer without waiting: it is called with the store lock held, so
+// when the writer falls behind (slow disk, long prune) the write is dropped instead.
+func (b *Bolt) enqueue(o op) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.closed {
+		return
+	}
+	select {
+	case b.ch <- o:
+		b.overflowing.Store(false)
+	default:
+		metrics.StorageWritesDropped.Inc()
+		if !b.overflowing.Swap(true) {
+			log.Warn().Int64("car_id", o.carID).Msg("history db writer falling behind, dropping writes")
+		}
+	}
+}
+
+func (b *Bolt) Load(since int64) (map[int64]*state.PersistedCar, error) {
+	cars := make(map[int64]*state.PersistedCar)
+	err := b.db.View(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(bucketState).ForEach(func(k, v []byte) error {
+			var st state.CarState
+			if err := json.Unmarshal(v, &st); err != nil {
+				return err
+			}
+			cars[carIDFromKey(k)] = &state.PersistedCar{State: st}
+			return nil
+		}); err != nil {
+			return err
+		}
+		hist := tx.Bucket(bucketHistory)
+		for carID, pc := range cars {
+			bkt := hist.Bucket(carKey(carID))
+			if bkt == nil {
+				continue
+			}
+			c := bkt.Cursor()
+			for k, v := c.Seek(sampleKeyPrefix(since)); k != nil; k, v = c.Next() {
+				var smp state.Sample
+				if err := json.Unmarshal(v, &smp); err != nil {
+					return err
+				}
+				pc.Samples = append(pc.Samples, smp)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cars, nil
+}
+
+// Close flushes queued writes and closes the database.
+func (b *Bolt) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	close(b.ch)
+	b.mu.Unlock()
+	<-b.done
+	return b.db.Close()
+}
+
+func (b *Bolt) run() {
+	defer close(b.done)
+	ticker := time.NewTicker(pruneInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case o, ok := <-b.ch:
+			if !ok {
+				return
+			}
+			batch := []op{o}
+			// Commit whatever else is already queued in the same transaction
+		drain:
+			for len(batch) < maxBatch {
+				select {
+				case o, ok := <-b.ch:
+					if !ok {
+						break drain
+					}
+					batch = append(batch, o)
+				default:
+					break drain
+				}
+			}
+			if err := b.write(batch); err != nil {
+				log.Error().Err(err).Int("ops", len(batch)).Msg("persist history")
+			}
+		case now := <-ticker.C:
+			if err := b.prune(now.Add(-b.retention).UnixMilli()); err != nil {
+				log.Error().Err(err).Msg("prune history")
+			}
+		}
+	}
+}
+
+func (b *Bolt) write(batch []op) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		stBkt := tx.Bucket(bucketState)
+		hist := tx.Bucket(bucketHistory)
+		for _, o := range batch {
+			if o.st != nil {
+				v, err := json.Marshal(o.st)
+				if err != nil {
+					return err
+				}
+				if err := stBkt.Put(carKey(o.carID), v); err != nil {
+					return err
+				}
+				continue
+			}
+			bkt, err := hist.CreateBucketIfNotExists(carKey(o.carID))
+			if err != nil {
+				return err
+			}
+			for _, smp := range o.samples {
+				v, err := json.Marshal(smp)
+				if err != nil {
+					return err
+				}
+				seq, err := bkt.NextSequence()
+				if err != nil {
+					return err
+				}
+				if err := bkt.Put(sampleKey(smp.TS, seq), v); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// prune deletes all samples older than cutoff (ms).
+func (b *Bolt) prune(cutoff int64) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		hist := tx.Bucket(bucketHistory)
+		limit := sampleKeyPrefix(cutoff)
+		return hist.ForEachBucket(func(name []byte) error {
+			bkt := hist.Bucket(name)
+			// Collect first, deleting while iterating a cursor skips entries
+			var expired [][]byte
+			c := bkt.Cursor()
+			for k, _ := c.First(); k != nil && bytes.Compare(k, limit) < 0; k, _ = c.Next() {
+				expired = append(expired, k)
+			}
+			for _, k := range expired {
+				if err := bkt.Delete(k); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+}
+
+func carKey(carID int64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, uint64(carID)) // #nosec G115 -- car ids are positive
+	return k
+}
+
+func carIDFromKey(k []byte) int64 {
+	return int64(binary.BigEndian.Uint64(k)) // #nosec G115 -- round trip of carKey
+}
+
+// sampleKey orders samples by timestamp, the sequence number keeps equal timestamps unique.
+func sampleKey(ts int64, seq uint64) []byte {
+	k := make([]byte, 16)
+	binary.BigEndian.PutUint64(k, uint64(max(ts, 0))) // #nosec G115 -- clamped to non-negative
+	binary.BigEndian.PutUint64(k[8:], seq)
+	return k
+}
+
+func sampleKeyPrefix(ts int64) []byte {
+	return sampleKey(ts, 0)
+}
+
+var _ state.Persister = (*Bolt)(nil)
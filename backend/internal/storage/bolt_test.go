@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/metrics"
+	"github.com/mcuelenaere/where-is-maurus/backend/internal/state"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestBolt_RestoreAfterRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.db")
+	db, err := OpenBolt(path, 15*time.Minute)
+	if err != nil {
+		t.Fatalf("OpenBolt error: %v", err)
+	}
+	st := state.NewStore()
+	if err := st.Restore(db); err != nil {
+		t.Fatalf("Restore error: %v", err)
+	}
+	now := time.Now().UnixMilli()
+	st.UpdateDisplayNameSilently(1, now, "Maurus")
+	st.UpdateLocation(1, now, 51.05, 3.72, 50, 90, 10)
+	st.UpdateBatteryLevel(1, now+1000, 80)
+	st.UpdateRouteWithMeta(1, now+2000, &state.Dest{Lat: 50.85, Lon: 4.35}, 30, 40, "Brussels", 2)
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close error: %v", err)
+	}
+
+	db, err = OpenBolt(path, 15*time.Minute)
+	if err != nil {
+		t.Fatalf("reopen error: %v", err)
+	}
+	defer db.Close()
+	restored := state.NewStore()
+	if err := restored.Restore(db); err != nil {
+		t.Fatalf("Restore error: %v", err)
+	}
+	cs, hist := restored.GetSnapshot(1)
+	if cs.DisplayName != "Maurus" || cs.Location == nil || cs.Location.Lat != 51.05 || cs.Battery == nil || cs.Battery.SOCPct != 80 {
+		t.Fatalf("unexpected restored state: %+v", cs)
+	}
+	if cs.Route == nil || cs.Route.DestLabel != "Brussels" {
+		t.Fatalf("unexpected restored route: %+v", cs.Route)
+	}
+	if len(hist.SpeedKPH) != 1 || len(hist.Heading) != 1 || len(hist.SOCPct) != 1 || len(hist.Path) != 1 {
+		t.Fatalf("unexpected restored history: %+v", hist)
+	}
+	if hist.Path[0].Lat != 51.05 || hist.SOCPct[0].V != 80 {
+		t.Fatalf("unexpected restored samples: %+v", hist)
+	}
+}
+
+func TestBolt_Prune(t *testing.T) {
+	db, err := OpenBolt(filepath.Join(t.TempDir(), "history.db"), time.Minute)
+	if err != nil {
+		t.Fatalf("OpenBolt error: %v", err)
+	}
+	defer db.Close()
+	now := time.Now().UnixMilli()
+	db.SaveState(1, state.CarState{TSMS: now})
+	db.AppendSamples(1, []state.Sample{
+		{Metric: "speed_kph", TS: now - 120_000, V: 1},
+		{Metric: "speed_kph", TS: now - 90_000, V: 2},
+		{Metric: "speed_kph", TS: now, V: 3},
+	})
+	// wait for the background writer
+	deadline := time.Now().Add(time.Second)
+	for {
+		cars, _ := db.Load(0)
+		if cars[1] != nil && len(cars[1].Samples) == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("samples were not written")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := db.prune(now - 60_000); err != nil {
+		t.Fatalf("prune error: %v", err)
+	}
+	cars, err := db.Load(0)
+	if err != nil {
+		t.Fatalf("Load error: %v", err)
+	}
+	if len(cars[1].Samples) != 1 || cars[1].Samples[0].V != 3 {
+		t.Fatalf("expected only the fresh sample to remain, got %+v", cars[1].Samples)
+	}
+}
+
+func TestBolt_EnqueueNeverBlocks(t *testing.T) {
+	// no writer draining the queue, like one stuck on a slow disk
+	b := &Bolt{ch: make(chan op, 1)}
+	before := testutil.ToFloat64(metrics.StorageWritesDropped)
+	done := make(chan struct{})
+	go func() {
+		b.SaveState(1, state.CarState{})
+		b.AppendSamples(1, []state.Sample{{Metric: "soc_pct", TS: 1000, V: 80}})
+		b.SaveState(1, state.CarState{})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("enqueue blocked on a full queue")
+	}
+	if got := testutil.ToFloat64(metrics.StorageWritesDropped) - before; got != 2 {
+		t.Fatalf("expected 2 dropped writes, got %v", got)
+	}
+}
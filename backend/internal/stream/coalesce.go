@@ -0,0 +1,82 @@
+package stream
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+// pendingDelta accumulates the deltas of one car while coalescing.
+type pendingDelta struct {
+	fields  map[string]json.RawMessage
+	history map[string]json.RawMessage
+	lastID  uint64
+}
+
+// coalesceFrames merges the delta frames of each car into a single delta carrying the id of
+// the car's latest one. Deltas hold the full current value of every field they touch, so
+// merging them key by key (and history series by name) yields the same end state as applying
+// them in order. Other events are kept as is; the result is ordered by id so a client resuming
+// from the last id it saw doesn't miss anything.
+func coalesceFrames(frames [][]byte) ([][]byte, bool) {
+	var (
+		out    []frame
+		merged = make(map[string]*pendingDelta)
+	)
+	for _, f := range frames {
+		id, event, data, ok := ParseFrame(f)
+		if !ok {
+			return nil, false
+		}
+		if event != "delta" {
+			out = append(out, frame{id: id, data: f})
+			continue
+		}
+		var delta map[string]json.RawMessage
+		if err := json.Unmarshal(data, &delta); err != nil {
+			return nil, false
+		}
+		car := string(delta["car_id"])
+		p, ok := merged[car]
+		if !ok {
+			p = &pendingDelta{fields: make(map[string]json.RawMessage, len(delta))}
+			merged[car] = p
+		}
+		for k, v := range delta {
+			if k == "history_30s" {
+				var h map[string]json.RawMessage
+				if err := json.Unmarshal(v, &h); err != nil {
+					return nil, false
+				}
+				if p.history == nil {
+					p.history = make(map[string]json.RawMessage, len(h))
+				}
+				for name, series := range h {
+					p.history[name] = series
+				}
+				continue
+			}
+			p.fields[k] = v
+		}
+		p.lastID = max(p.lastID, id)
+	}
+	for _, p := range merged {
+		if p.history != nil {
+			b, err := json.Marshal(p.history)
+			if err != nil {
+				return nil, false
+			}
+			p.fields["history_30s"] = b
+		}
+		data, err := json.Marshal(p.fields)
+		if err != nil {
+			return nil, false
+		}
+		out = append(out, frame{id: p.lastID, data: EncodeFrame(p.lastID, "delta", data)})
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].id < out[j].id })
+	result := make([][]byte, len(out))
+	for i, f := range out {
+		result[i] = f.data
+	}
+	return result, true
+}
@@ -0,0 +1,49 @@
+package stream
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+)
+
+// EncodeFrame builds an SSE frame: id: <id>\n event: <event>\n data: <json>\n\n
+func EncodeFrame(id uint64, event string, data []byte) []byte {
+	b := make([]byte, 0, len(event)+len(data)+40)
+	b = append(b, "id: "...)
+	b = strconv.AppendUint(b, id, 10)
+	b = append(b, "\nevent: "...)
+	b = append(b, event...)
+	b = append(b, "\ndata: "...)
+	b = append(b, data...)
+	return append(b, "\n\n"...)
+}
+
+// ParseFrame splits a frame produced by EncodeFrame into its parts.
+func ParseFrame(frame []byte) (id uint64, event string, data []byte, ok bool) {
+	head, rest, ok := bytes.Cut(frame, []byte("data: "))
+	if !ok {
+		return 0, "", nil, false
+	}
+	for line := range strings.SplitSeq(string(head), "\n") {
+		if v, found := strings.CutPrefix(line, "id: "); found {
+			id, _ = strconv.ParseUint(v, 10, 64)
+		} else if v, found := strings.CutPrefix(line, "event: "); found {
+			event = v
+		}
+	}
+	return id, event, bytes.TrimSuffix(rest, []byte("\n\n")), true
+}
+
+// tagCar adds the car_id to a JSON object payload. Other payloads are returned as is.
+func tagCar(carID int64, data []byte) []byte {
+	if len(data) < 2 || data[0] != '{' {
+		return data
+	}
+	b := make([]byte, 0, len(data)+24)
+	b = append(b, `{"car_id":`...)
+	b = strconv.AppendInt(b, carID, 10)
+	if rest := bytes.TrimSpace(data[1:]); len(rest) > 0 && rest[0] != '}' {
+		b = append(b, ',')
+	}
+	return append(b, data[1:]...)
+}
@@ -0,0 +1,17 @@
+package stream
+
+import "testing"
+
+func TestFrame_RoundTrip(t *testing.T) {
+	f := EncodeFrame(42, "delta", []byte(`{"ts_ms":1}`))
+	if string(f) != "id: 42\nevent: delta\ndata: {\"ts_ms\":1}\n\n" {
+		t.Fatalf("unexpected frame: %q", f)
+	}
+	id, event, data, ok := ParseFrame(f)
+	if !ok || id != 42 || event != "delta" || string(data) != `{"ts_ms":1}` {
+		t.Fatalf("unexpected parse: %v %d %q %q", ok, id, event, data)
+	}
+	if _, _, _, ok := ParseFrame([]byte("event: x\n\n")); ok {
+		t.Fatalf("expected frame without data to be rejected")
+	}
+}
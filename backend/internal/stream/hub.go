@@ -1,65 +1,383 @@
 package stream
 
 import (
+	"context"
+	"fmt"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+var tracer = otel.Tracer("github.com/mcuelenaere/where-is-maurus/backend/internal/stream")
+
+// SlowPolicy decides what happens when a subscriber doesn't keep up and its queue is full.
+type SlowPolicy string
+
+const (
+	// PolicyResync drops the frame and asks the subscriber to start over from a fresh snapshot.
+	PolicyResync SlowPolicy = "resync"
+	// PolicyCoalesce merges the queued deltas into one to make room, resyncing when that isn't enough.
+	PolicyCoalesce SlowPolicy = "coalesce"
+	// PolicyDisconnect closes the subscriber; clients reconnect and resume from Last-Event-ID.
+	PolicyDisconnect SlowPolicy = "disconnect"
+)
+
+// ParseSlowPolicy validates a policy name.
+func ParseSlowPolicy(s string) (SlowPolicy, error) {
+	switch p := SlowPolicy(s); p {
+	case PolicyResync, PolicyCoalesce, PolicyDisconnect:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown slow subscriber policy %q", s)
+}
+
 type Subscriber struct {
+	// Ch delivers frames; it is closed when the subscriber is removed, including by PolicyDisconnect.
 	Ch chan []byte
+	// Resync receives a value when frames were dropped and the client needs a fresh snapshot.
+	Resync chan struct{}
+	// LastID is the id of the latest frame broadcast before the subscriber was added.
+	LastID uint64
+
+	// cars the subscriber follows, nil for every car
+	cars    []int64
+	dropped atomic.Uint64
+}
+
+// Dropped returns how many frames this subscriber missed.
+func (s *Subscriber) Dropped() uint64 { return s.dropped.Load() }
+
+// Stats are cumulative counters describing how subscribers keep up.
+type Stats struct {
+	Subscribers    int    `json:"subscribers"`
+	Broadcasts     uint64 `json:"broadcasts"`
+	DroppedFrames  uint64 `json:"dropped_frames"`
+	Resyncs        uint64 `json:"resyncs"`
+	Coalesced      uint64 `json:"coalesced"`
+	Disconnections uint64 `json:"disconnections"`
 }
 
+// frame is a fully encoded SSE message kept for replay.
+type frame struct {
+	id   uint64
+	data []byte
+	// span is the broadcast span of traced frames
+	span trace.SpanContext
+}
+
+// carStream holds the subscribers and recent frames of a single car.
+type carStream struct {
+	subs map[*Subscriber]struct{}
+	// ring holds the most recent frames, oldest first
+	ring []frame
+	// evicted is the id of the newest frame no longer in ring
+	evicted uint64
+}
+
+// Hub fans frames out to subscribers. Frame ids come from a single sequence shared by all
+// cars, so a subscriber following several cars can resume from one id.
 type Hub struct {
-	mu    sync.RWMutex
-	subs  map[int64]map[*Subscriber]struct{}
-	bufSz int
+	mu   sync.RWMutex
+	cars map[int64]*carStream
+	// all holds the subscribers following every car
+	all     map[*Subscriber]struct{}
+	subs    map[*Subscriber]struct{}
+	seq     uint64
+	seqBase uint64
+	bufSz   int
+	replay  int
+	policy  SlowPolicy
+	stats   Stats
+	// spans holds the broadcast span of the traced frames still in the replay buffers
+	spans map[uint64]trace.SpanContext
+}
+
+// Option configures a Hub.
+type Option func(*Hub)
+
+// WithSlowPolicy sets how subscribers that don't keep up are handled (default PolicyResync).
+func WithSlowPolicy(p SlowPolicy) Option {
+	return func(h *Hub) { h.policy = p }
+}
+
+func NewHub(opts ...Option) *Hub {
+	// Sequences start at the current time in µs so ids keep increasing across restarts
+	// and a stale Last-Event-ID from a previous run never matches the replay buffer.
+	seqBase := uint64(time.Now().UnixMicro()) // #nosec G115 -- current time is positive
+	h := &Hub{
+		cars:    make(map[int64]*carStream),
+		all:     make(map[*Subscriber]struct{}),
+		subs:    make(map[*Subscriber]struct{}),
+		spans:   make(map[uint64]trace.SpanContext),
+		seq:     seqBase,
+		seqBase: seqBase,
+		bufSz:   32,
+		replay:  128,
+		policy:  PolicyResync,
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
+}
+
+// LastID returns the id of the latest frame broadcast.
+func (h *Hub) LastID() uint64 {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.seq
+}
+
+// Stats returns a snapshot of the hub counters.
+func (h *Hub) Stats() Stats {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	st := h.stats
+	st.Subscribers = len(h.subs)
+	return st
 }
 
-func NewHub() *Hub {
-	return &Hub{subs: make(map[int64]map[*Subscriber]struct{}), bufSz: 32}
+// CarSubscribers returns the number of subscribers of every car that has any. Subscribers
+// following every car are not included, they're counted by FleetSubscribers.
+func (h *Hub) CarSubscribers() map[int64]int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	counts := make(map[int64]int, len(h.cars))
+	for id, cs := range h.cars {
+		if len(cs.subs) > 0 {
+			counts[id] = len(cs.subs)
+		}
+	}
+	return counts
 }
 
+// FleetSubscribers returns the number of subscribers following every car.
+func (h *Hub) FleetSubscribers() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.all)
+}
+
+func (h *Hub) car(carID int64) *carStream {
+	cs, ok := h.cars[carID]
+	if !ok {
+		// frames from before the hub existed count as evicted
+		cs = &carStream{subs: make(map[*Subscriber]struct{}), evicted: h.seqBase}
+		h.cars[carID] = cs
+	}
+	return cs
+}
+
+// Subscribe adds a subscriber receiving the frames of one car.
 func (h *Hub) Subscribe(carID int64) *Subscriber {
+	return h.SubscribeCars([]int64{carID})
+}
+
+// SubscribeCars adds a single subscriber receiving the frames of all listed cars. A nil list
+// subscribes to every car, including cars that only show up later.
+func (h *Hub) SubscribeCars(carIDs []int64) *Subscriber {
 	h.mu.Lock()
 	defer h.mu.Unlock()
-	sub := &Subscriber{Ch: make(chan []byte, h.bufSz)}
-	m, ok := h.subs[carID]
-	if !ok {
-		m = make(map[*Subscriber]struct{})
-		h.subs[carID] = m
+	return h.subscribeLocked(carIDs)
+}
+
+// Resume subscribes to the cars (nil meaning every car, as for SubscribeCars) and returns the
+// frames broadcast after lastID. When lastID is no longer (or not yet) covered by the replay
+// buffers ok is false and the caller should send snapshots instead.
+func (h *Hub) Resume(carIDs []int64, lastID uint64) (sub *Subscriber, missed [][]byte, ok bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	sub = h.subscribeLocked(carIDs)
+	if lastID > h.seq {
+		return sub, nil, false
+	}
+	streams := make([]*carStream, 0, len(carIDs))
+	if carIDs == nil {
+		for _, cs := range h.cars {
+			streams = append(streams, cs)
+		}
+	} else {
+		for _, id := range carIDs {
+			streams = append(streams, h.car(id))
+		}
 	}
-	m[sub] = struct{}{}
-	log.Info().Int64("car_id", carID).Msg("added new subscriber")
+	var frames []frame
+	for _, cs := range streams {
+		if lastID < cs.evicted {
+			return sub, nil, false
+		}
+		for _, f := range cs.ring {
+			if f.id > lastID {
+				frames = append(frames, f)
+			}
+		}
+	}
+	sort.Slice(frames, func(i, j int) bool { return frames[i].id < frames[j].id })
+	for _, f := range frames {
+		missed = append(missed, f.data)
+	}
+	return sub, missed, true
+}
+
+func (h *Hub) subscribeLocked(carIDs []int64) *Subscriber {
+	sub := &Subscriber{Ch: make(chan []byte, h.bufSz), Resync: make(chan struct{}, 1), LastID: h.seq, cars: carIDs}
+	h.subs[sub] = struct{}{}
+	if carIDs == nil {
+		h.all[sub] = struct{}{}
+	}
+	for _, id := range carIDs {
+		h.car(id).subs[sub] = struct{}{}
+	}
+	log.Info().Ints64("car_ids", carIDs).Msg("added new subscriber")
 	return sub
 }
 
-func (h *Hub) Unsubscribe(carID int64, sub *Subscriber) {
+// Unsubscribe removes the subscriber and closes its channel. It is a no-op for subscribers
+// that were already removed, e.g. by PolicyDisconnect.
+func (h *Hub) Unsubscribe(sub *Subscriber) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
-	if m, ok := h.subs[carID]; ok {
-		delete(m, sub)
-		close(sub.Ch)
-		if len(m) == 0 {
-			delete(h.subs, carID)
+	if h.removeLocked(sub) {
+		log.Info().Ints64("car_ids", sub.cars).Msg("removed subscriber")
+	}
+}
+
+func (h *Hub) removeLocked(sub *Subscriber) bool {
+	if _, ok := h.subs[sub]; !ok {
+		return false
+	}
+	delete(h.subs, sub)
+	delete(h.all, sub)
+	for _, id := range sub.cars {
+		if cs, ok := h.cars[id]; ok {
+			delete(cs.subs, sub)
 		}
 	}
-	log.Info().Int64("car_id", carID).Msg("removed subscriber")
+	close(sub.Ch)
+	return true
 }
 
+// Broadcast sends an event of the car to its subscribers. JSON object payloads are tagged
+// with the car_id so subscribers following several cars can tell them apart.
 func (h *Hub) Broadcast(carID int64, event string, data []byte) {
+	h.BroadcastContext(context.Background(), carID, event, data)
+}
+
+// BroadcastContext is Broadcast as part of the trace in ctx, if any. The span of the broadcast
+// is kept with the frame, see FrameSpan. Frames outside a trace (resampled values, derived
+// events, ...) aren't traced.
+func (h *Hub) BroadcastContext(ctx context.Context, carID int64, event string, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	var span trace.Span
+	if trace.SpanContextFromContext(ctx).IsValid() {
+		_, span = tracer.Start(ctx, "hub.broadcast", trace.WithAttributes(
+			attribute.Int64("car_id", carID),
+			attribute.String("event", event),
+			attribute.Int("payload_size", len(data)),
+		))
+		defer span.End()
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	cs := h.car(carID)
+	h.seq++
+	h.stats.Broadcasts++
+	payload := EncodeFrame(h.seq, event, tagCar(carID, data))
+	f := frame{id: h.seq, data: payload}
+	if span != nil {
+		f.span = span.SpanContext()
+		h.spans[f.id] = f.span
+		span.SetAttributes(attribute.Int64("frame_id", int64(f.id)), attribute.Int("subscribers", len(cs.subs)+len(h.all))) // #nosec G115 -- ids are µs timestamps
+	}
+	cs.ring = append(cs.ring, f)
+	if n := len(cs.ring) - h.replay; n > 0 {
+		for _, old := range cs.ring[:n] {
+			if old.span.IsValid() {
+				delete(h.spans, old.id)
+			}
+		}
+		cs.evicted = cs.ring[n-1].id
+		// copy instead of reslicing so the backing array doesn't grow forever
+		cs.ring = append(cs.ring[:0:0], cs.ring[n:]...)
+	}
+	for _, subs := range []map[*Subscriber]struct{}{cs.subs, h.all} {
+		for sub := range subs {
+			select {
+			case sub.Ch <- payload:
+			default:
+				h.handleSlow(carID, sub, payload)
+			}
+		}
+	}
+}
+
+// FrameSpan returns the span the frame with the given id was broadcast in, so writing it to a
+// subscriber can join the trace. It is invalid for untraced frames and frames no longer in the
+// replay buffers.
+func (h *Hub) FrameSpan(id uint64) trace.SpanContext {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
-	if len(data) == 0 {
+	return h.spans[id]
+}
+
+// handleSlow applies the slow subscriber policy when sub's queue is full. Must be called with the lock held.
+func (h *Hub) handleSlow(carID int64, sub *Subscriber, payload []byte) {
+	switch h.policy {
+	case PolicyDisconnect:
+		sub.dropped.Add(1)
+		h.stats.DroppedFrames++
+		h.stats.Disconnections++
+		h.removeLocked(sub)
+		log.Warn().Int64("car_id", carID).Msg("disconnected slow subscriber")
 		return
+	case PolicyCoalesce:
+		if h.coalesce(sub, payload) {
+			h.stats.Coalesced++
+			return
+		}
+	}
+	sub.dropped.Add(1)
+	h.stats.DroppedFrames++
+	select {
+	case sub.Resync <- struct{}{}:
+		h.stats.Resyncs++
+		log.Debug().Int64("car_id", carID).Msg("slow subscriber needs resync")
+	default:
+		// resync already pending
+	}
+}
+
+// coalesce drains the queue of sub and requeues its frames with all deltas merged into one.
+// Frames the subscriber reads concurrently are simply not part of the merge.
+func (h *Hub) coalesce(sub *Subscriber, payload []byte) bool {
+	var pending [][]byte
+drain:
+	for {
+		select {
+		case f := <-sub.Ch:
+			pending = append(pending, f)
+		default:
+			break drain
+		}
+	}
+	frames, ok := coalesceFrames(append(pending, payload))
+	if !ok {
+		return false
 	}
-	// SSE framing: event: <event>\n data: <json>\n\n
-	payload := []byte("event: " + event + "\n" + "data: " + string(data) + "\n\n")
-	for sub := range h.subs[carID] {
+	for _, f := range frames {
 		select {
-		case sub.Ch <- payload:
+		case sub.Ch <- f:
 		default:
-			// drop on slow
+			return false
 		}
 	}
+	return true
 }
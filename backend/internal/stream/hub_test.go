@@ -1,7 +1,16 @@
 package stream
 
 import (
+	"context"
+	"fmt"
+	"sync"
 	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func TestHub_SubscribeBroadcastUnsubscribe(t *testing.T) {
@@ -15,16 +24,304 @@ func TestHub_SubscribeBroadcastUnsubscribe(t *testing.T) {
 	h.Broadcast(1, "test", payload)
 	select {
 	case got := <-sub.Ch:
-		expected := "event: test\ndata: x\n\n"
+		expected := fmt.Sprintf("id: %d\nevent: test\ndata: x\n\n", sub.LastID+1)
 		if string(got) != expected {
 			t.Fatalf("unexpected payload: %q, expected %q", got, expected)
 		}
 	default:
 		t.Fatalf("expected message delivered")
 	}
-	h.Unsubscribe(1, sub)
+	h.Unsubscribe(sub)
 	// channel must be closed
 	if _, ok := <-sub.Ch; ok {
 		t.Fatalf("expected channel closed")
 	}
 }
+
+func TestHub_Resume(t *testing.T) {
+	h := NewHub()
+	h.replay = 3
+	first := h.Subscribe(1)
+	start := first.LastID
+	for i := range 5 {
+		h.Broadcast(1, "delta", fmt.Appendf(nil, "%d", i))
+	}
+	h.Unsubscribe(first)
+
+	// last seen frame is still buffered: only the missed frames are replayed
+	sub, missed, ok := h.Resume([]int64{1}, start+3)
+	if !ok || len(missed) != 2 {
+		t.Fatalf("expected 2 missed frames, got ok=%v %q", ok, missed)
+	}
+	if want := fmt.Sprintf("id: %d\nevent: delta\ndata: 3\n\n", start+4); string(missed[0]) != want {
+		t.Fatalf("unexpected replayed frame: %q, expected %q", missed[0], want)
+	}
+	if sub.LastID != start+5 {
+		t.Fatalf("expected LastID %d, got %d", start+5, sub.LastID)
+	}
+	h.Unsubscribe(sub)
+
+	// up to date
+	sub, missed, ok = h.Resume([]int64{1}, start+5)
+	if !ok || len(missed) != 0 {
+		t.Fatalf("expected nothing to replay, got ok=%v %q", ok, missed)
+	}
+	h.Unsubscribe(sub)
+
+	// too old, or from a previous run
+	for _, id := range []uint64{start + 1, start + 6, 42} {
+		sub, _, ok = h.Resume([]int64{1}, id)
+		if ok {
+			t.Fatalf("expected resume from %d to require a snapshot", id)
+		}
+		h.Unsubscribe(sub)
+	}
+}
+
+// fill broadcasts until the subscriber queue is full.
+func fill(h *Hub, sub *Subscriber) {
+	for range cap(sub.Ch) {
+		h.Broadcast(1, "delta", []byte(`{"ts_ms":1}`))
+	}
+}
+
+func TestHub_SlowPolicyResync(t *testing.T) {
+	h := NewHub()
+	sub := h.Subscribe(1)
+	fill(h, sub)
+	h.Broadcast(1, "delta", []byte(`{"ts_ms":2}`))
+	h.Broadcast(1, "delta", []byte(`{"ts_ms":3}`))
+
+	select {
+	case <-sub.Resync:
+	default:
+		t.Fatalf("expected resync signal")
+	}
+	if sub.Dropped() != 2 {
+		t.Fatalf("expected 2 dropped frames, got %d", sub.Dropped())
+	}
+	st := h.Stats()
+	if st.Subscribers != 1 || st.DroppedFrames != 2 || st.Resyncs != 1 {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+}
+
+func TestHub_SlowPolicyDisconnect(t *testing.T) {
+	h := NewHub(WithSlowPolicy(PolicyDisconnect))
+	sub := h.Subscribe(1)
+	fill(h, sub)
+	h.Broadcast(1, "delta", []byte(`{"ts_ms":2}`))
+
+	for range cap(sub.Ch) {
+		<-sub.Ch
+	}
+	if _, ok := <-sub.Ch; ok {
+		t.Fatalf("expected channel closed")
+	}
+	// unsubscribing a disconnected subscriber is a no-op
+	h.Unsubscribe(sub)
+	st := h.Stats()
+	if st.Subscribers != 0 || st.Disconnections != 1 || st.DroppedFrames != 1 {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+}
+
+func TestHub_SlowPolicyCoalesce(t *testing.T) {
+	h := NewHub(WithSlowPolicy(PolicyCoalesce))
+	sub := h.Subscribe(1)
+	h.Broadcast(1, "charging_started", []byte(`{"ts_ms":0}`))
+	for i := 1; i < cap(sub.Ch); i++ {
+		h.Broadcast(1, "delta", fmt.Appendf(nil, `{"ts_ms":%d,"battery":{"soc_pct":%d},"history_30s":{"soc_pct":[[%d,%d]]}}`, i, i, i, i))
+	}
+	h.Broadcast(1, "delta", []byte(`{"ts_ms":99,"location":{"lat":1,"lon":2},"history_30s":{"speed_kph":[[99,10]]}}`))
+
+	if len(sub.Ch) != 2 {
+		t.Fatalf("expected 2 queued frames, got %d", len(sub.Ch))
+	}
+	id, event, _, _ := ParseFrame(<-sub.Ch)
+	if event != "charging_started" || id != sub.LastID+1 {
+		t.Fatalf("expected charging_started to be kept first, got %s %d", event, id)
+	}
+	id, event, data, _ := ParseFrame(<-sub.Ch)
+	want := `{"battery":{"soc_pct":31},"car_id":1,"history_30s":{"soc_pct":[[31,31]],"speed_kph":[[99,10]]},"location":{"lat":1,"lon":2},"ts_ms":99}`
+	if event != "delta" || id != h.LastID() || string(data) != want {
+		t.Fatalf("unexpected merged delta %s %d: %s", event, id, data)
+	}
+	st := h.Stats()
+	if st.Coalesced != 1 || st.DroppedFrames != 0 || sub.Dropped() != 0 {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+}
+
+func TestParseSlowPolicy(t *testing.T) {
+	if p, err := ParseSlowPolicy("coalesce"); err != nil || p != PolicyCoalesce {
+		t.Fatalf("unexpected result: %q %v", p, err)
+	}
+	if _, err := ParseSlowPolicy("drop"); err == nil {
+		t.Fatalf("expected error for unknown policy")
+	}
+}
+
+func TestHub_SubscribeCars(t *testing.T) {
+	h := NewHub()
+	both := h.SubscribeCars([]int64{1, 2})
+	all := h.SubscribeCars(nil)
+	h.Broadcast(1, "delta", []byte(`{"ts_ms":1}`))
+	h.Broadcast(2, "delta", []byte(`{"ts_ms":2}`))
+	h.Broadcast(3, "delta", []byte(`{"ts_ms":3}`))
+
+	if len(both.Ch) != 2 || len(all.Ch) != 3 {
+		t.Fatalf("expected 2 and 3 frames, got %d and %d", len(both.Ch), len(all.Ch))
+	}
+	for i, car := range []int64{1, 2} {
+		id, _, data, _ := ParseFrame(<-both.Ch)
+		want := fmt.Sprintf(`{"car_id":%d,"ts_ms":%d}`, car, car)
+		if id != both.LastID+uint64(i)+1 || string(data) != want {
+			t.Fatalf("unexpected frame %d: %s, expected %s", id, data, want)
+		}
+	}
+	if st := h.Stats(); st.Subscribers != 2 {
+		t.Fatalf("expected 2 subscribers, got %d", st.Subscribers)
+	}
+	h.Unsubscribe(both)
+	h.Unsubscribe(all)
+	if _, ok := <-both.Ch; ok {
+		t.Fatalf("expected channel closed")
+	}
+	if st := h.Stats(); st.Subscribers != 0 {
+		t.Fatalf("expected no subscribers, got %d", st.Subscribers)
+	}
+}
+
+func TestHub_ResumeCars(t *testing.T) {
+	h := NewHub()
+	h.replay = 2
+	start := h.LastID()
+	h.Broadcast(1, "delta", []byte(`{}`))
+	h.Broadcast(2, "delta", []byte(`{}`))
+	h.Broadcast(1, "delta", []byte(`{}`))
+	h.Broadcast(2, "delta", []byte(`{}`))
+
+	// frames of both cars come back in id order
+	sub, missed, ok := h.Resume([]int64{1, 2}, start+1)
+	if !ok || len(missed) != 3 {
+		t.Fatalf("expected 3 missed frames, got ok=%v %q", ok, missed)
+	}
+	for i, f := range missed {
+		if id, _, _, _ := ParseFrame(f); id != start+uint64(i)+2 {
+			t.Fatalf("unexpected frame order: %q", missed)
+		}
+	}
+	h.Unsubscribe(sub)
+
+	// car 1 still has everything after start, car 3 never had frames
+	sub, missed, ok = h.Resume([]int64{1, 3}, start)
+	if !ok || len(missed) != 2 {
+		t.Fatalf("expected 2 missed frames, got ok=%v %q", ok, missed)
+	}
+	h.Unsubscribe(sub)
+
+	// an evicted frame of any followed car requires snapshots
+	h.Broadcast(2, "delta", []byte(`{}`))
+	sub, _, ok = h.Resume(nil, start+1)
+	if ok {
+		t.Fatalf("expected resume to require snapshots")
+	}
+	h.Unsubscribe(sub)
+}
+
+func TestTagCar(t *testing.T) {
+	for in, want := range map[string]string{
+		`{"ts_ms":1}`: `{"car_id":7,"ts_ms":1}`,
+		`{}`:          `{"car_id":7}`,
+		`x`:           `x`,
+	} {
+		if got := string(tagCar(7, []byte(in))); got != want {
+			t.Fatalf("tagCar(%s) = %s, expected %s", in, got, want)
+		}
+	}
+}
+
+func TestCoalesceFrames_PerCar(t *testing.T) {
+	frames, ok := coalesceFrames([][]byte{
+		EncodeFrame(1, "delta", []byte(`{"car_id":1,"speed_kph":10}`)),
+		EncodeFrame(2, "delta", []byte(`{"car_id":2,"speed_kph":20}`)),
+		EncodeFrame(3, "delta", []byte(`{"car_id":1,"speed_kph":11}`)),
+	})
+	if !ok || len(frames) != 2 {
+		t.Fatalf("expected a delta per car, got ok=%v %q", ok, frames)
+	}
+	want := []string{
+		"id: 2\nevent: delta\ndata: {\"car_id\":2,\"speed_kph\":20}\n\n",
+		"id: 3\nevent: delta\ndata: {\"car_id\":1,\"speed_kph\":11}\n\n",
+	}
+	for i, f := range frames {
+		if string(f) != want[i] {
+			t.Fatalf("unexpected frame %d: %q, expected %q", i, f, want[i])
+		}
+	}
+}
+
+var (
+	spans      = tracetest.NewSpanRecorder()
+	tracerOnce sync.Once
+)
+
+// recordSpans installs a tracer provider recording to spans. Tracers obtained before the first
+// provider is installed only ever delegate to that one, hence installing it once.
+func recordSpans() trace.Tracer {
+	tracerOnce.Do(func() {
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)))
+	})
+	return otel.Tracer("test")
+}
+
+func TestHub_BroadcastContext(t *testing.T) {
+	tr := recordSpans()
+	h := NewHub()
+	h.replay = 1
+	sub := h.Subscribe(1)
+	defer h.Unsubscribe(sub)
+
+	// untraced broadcasts don't start spans
+	h.Broadcast(1, "delta", []byte(`{"a":1}`))
+	untraced := h.LastID()
+	if h.FrameSpan(untraced).IsValid() {
+		t.Fatal("untraced frame shouldn't have a span")
+	}
+
+	ctx, parent := tr.Start(context.Background(), "parent")
+	h.BroadcastContext(ctx, 1, "delta", []byte(`{"a":2}`))
+	parent.End()
+	traced := h.LastID()
+	sc := h.FrameSpan(traced)
+	if !sc.IsValid() || sc.TraceID() != parent.SpanContext().TraceID() {
+		t.Fatalf("expected the frame span in the parent trace, got %+v", sc)
+	}
+	var found bool
+	for _, s := range spans.Ended() {
+		if s.SpanContext().SpanID() != sc.SpanID() {
+			continue
+		}
+		found = true
+		if s.Name() != "hub.broadcast" || s.Parent().SpanID() != parent.SpanContext().SpanID() {
+			t.Fatalf("unexpected span %s with parent %s", s.Name(), s.Parent().SpanID())
+		}
+		attrs := map[attribute.Key]attribute.Value{}
+		for _, kv := range s.Attributes() {
+			attrs[kv.Key] = kv.Value
+		}
+		if attrs["car_id"].AsInt64() != 1 || attrs["event"].AsString() != "delta" || attrs["subscribers"].AsInt64() != 1 {
+			t.Fatalf("unexpected attributes %v", s.Attributes())
+		}
+	}
+	if !found {
+		t.Fatal("broadcast span not recorded")
+	}
+
+	// frames evicted from the replay buffer forget their span
+	h.Broadcast(1, "delta", []byte(`{"a":3}`))
+	if h.FrameSpan(traced).IsValid() {
+		t.Fatal("evicted frame should have lost its span")
+	}
+}
@@ -0,0 +1,36 @@
+// Package tracing sets up OpenTelemetry tracing. Spans follow a TeslaMate message from the
+// MQTT handler through the store update and the hub broadcast to the stream writes.
+package tracing
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.40.0"
+)
+
+// ServiceName is reported unless OTEL_SERVICE_NAME says otherwise.
+const ServiceName = "where-is-maurus"
+
+// Setup installs a global tracer provider exporting spans over OTLP/HTTP. The exporter is
+// configured with the standard OTEL_EXPORTER_OTLP_* variables, sampling with OTEL_TRACES_SAMPLER.
+// Until Setup is called tracing is a no-op. The returned function flushes and stops the exporter.
+func Setup(ctx context.Context) (shutdown func(context.Context) error, err error) {
+	exp, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceName(ServiceName)),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exp), sdktrace.WithResource(res))
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
@@ -0,0 +1,25 @@
+package tracing
+
+import (
+	"context"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+)
+
+func TestSetup(t *testing.T) {
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "http://127.0.0.1:4318")
+	t.Setenv("OTEL_SERVICE_NAME", "test")
+	shutdown, err := Setup(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, span := otel.Tracer("test").Start(context.Background(), "span")
+	if !span.SpanContext().IsValid() || !span.IsRecording() {
+		t.Fatal("expected a recording span once set up")
+	}
+	// the span never ends, so there is nothing to flush to the (absent) collector
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -13,8 +13,45 @@ export const PathPointSchema = z.object({
 });
 export type PathPoint = z.infer<typeof PathPointSchema>;
 
+export const ChargingSessionSchema = z.object({
+  start_ts_ms: z.number(),
+  end_ts_ms: z.number().optional(),
+  start_soc_pct: z.number(),
+  end_soc_pct: z.number(),
+  energy_added_kwh: z.number(),
+  peak_power_kw: z.number(),
+  avg_power_kw: z.number(),
+  curve: z.array(z.object({ ts_ms: z.number(), soc_pct: z.number(), power_kw: z.number() })),
+});
+export type ChargingSession = z.infer<typeof ChargingSessionSchema>;
+
+export const TripSchema = z.object({
+  start_ts_ms: z.number(),
+  end_ts_ms: z.number().optional(),
+  start: z.object({ lat: z.number(), lon: z.number() }).optional(),
+  end: z.object({ lat: z.number(), lon: z.number() }).optional(),
+  distance_km: z.number(),
+  duration_s: z.number(),
+  avg_speed_kph: z.number(),
+  max_speed_kph: z.number(),
+  elevation_gain_m: z.number(),
+  elevation_loss_m: z.number(),
+  start_soc_pct: z.number(),
+  end_soc_pct: z.number(),
+  soc_used_pct: z.number(),
+  energy_wh: z.number(),
+  wh_per_km: z.number(),
+});
+export type Trip = z.infer<typeof TripSchema>;
+
+export const CarStatusSchema = z.enum(["live", "stale", "offline"]);
+export type CarStatus = z.infer<typeof CarStatusSchema>;
+
 export const CarStateSchema = z.object({
+  car_id: z.number().optional(),
   ts_ms: z.number(),
+  status: CarStatusSchema.optional(),
+  last_seen_ms: z.number().optional(),
   location: z.object({
     lat: z.number(),
     lon: z.number(),
@@ -25,7 +62,29 @@ export const CarStateSchema = z.object({
   battery: z.object({
     soc_pct: z.number().optional(),
     power_w: z.number().optional(),
+    usable_soc_pct: z.number().optional(),
+    est_range_km: z.number().optional(),
+    rated_range_km: z.number().optional(),
   }),
+  vehicle: z
+    .object({
+      state: z.string().optional(),
+      shift_state: z.string().optional(),
+      odometer_km: z.number().optional(),
+    })
+    .optional(),
+  charging: z
+    .object({
+      plugged_in: z.boolean().optional(),
+      state: z.string().optional(),
+      power_kw: z.number().optional(),
+      energy_added_kwh: z.number().optional(),
+      time_to_full_h: z.number().optional(),
+      limit_soc_pct: z.number().optional(),
+    })
+    .optional(),
+  charging_session: ChargingSessionSchema.nullable().optional(),
+  trip: TripSchema.nullable().optional(),
   climate: z.object({
     inside_c: z.number().optional(),
     outside_c: z.number().optional(),
@@ -60,10 +119,25 @@ export const HistoryWindowSchema = z
     tpms_fr: z.array(HistoryPointSchema).optional(),
     tpms_rl: z.array(HistoryPointSchema).optional(),
     tpms_rr: z.array(HistoryPointSchema).optional(),
+    usable_soc_pct: z.array(HistoryPointSchema).optional(),
+    est_range_km: z.array(HistoryPointSchema).optional(),
+    rated_range_km: z.array(HistoryPointSchema).optional(),
+    charger_power_kw: z.array(HistoryPointSchema).optional(),
+    charge_energy_added_kwh: z.array(HistoryPointSchema).optional(),
   })
   .partial();
 export type HistoryWindow = z.infer<typeof HistoryWindowSchema>;
 
+// Describes history_30s and path_30s, which hold history_window.window_ms of history
+// regardless of their names (retention_ms overrides it per series)
+export const HistoryWindowInfoSchema = z.object({
+  version: z.number(),
+  window_ms: z.number(),
+  resample_ms: z.number(),
+  retention_ms: z.record(z.string(), z.number()).optional(),
+});
+export type HistoryWindowInfo = z.infer<typeof HistoryWindowInfoSchema>;
+
 export const AdminCarsResponseSchema = z.object({
   cars: z.array(
     z.object({
@@ -71,12 +145,16 @@ export const AdminCarsResponseSchema = z.object({
       display_name: z.string(),
     })
   ),
+  connected: z.boolean().optional(),
 });
 export type AdminCarsResponse = z.infer<typeof AdminCarsResponseSchema>;
 
 export const AdminCreateShareRequestSchema = z.object({
-  car_id: z.number(),
+  car_id: z.number().optional(),
+  car_ids: z.array(z.number()).optional(),
+  all_cars: z.boolean().optional(),
   expires_at: z.string().optional(),
+  scopes: z.array(z.string()).optional(),
 });
 export type AdminCreateShareRequest = z.infer<typeof AdminCreateShareRequestSchema>;
 
@@ -87,5 +165,14 @@ export type AdminCreateShareResponse = z.infer<typeof AdminCreateShareResponseSc
 export type SnapshotPayload = CarState & {
   history_30s: HistoryWindow;
   path_30s: PathPoint[];
+  history_window?: HistoryWindowInfo;
 };
 export type DeltaPayload = Partial<SnapshotPayload>;
+
+// Admin fleet stream payloads
+export type FleetSnapshotPayload = {
+  ts_ms: number;
+  cars: (SnapshotPayload & { car_id: number; display_name: string })[];
+};
+export type CarAddedPayload = { car_id: number; display_name: string; ts_ms: number };
+export type StatusPayload = { car_id?: number; ts_ms: number; status: CarStatus; last_seen_ms?: number };